@@ -21,15 +21,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
 	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/fetcher"
-
-	"cloud.google.com/go/storage"
-	"google.golang.org/api/option"
 )
 
 const (
@@ -37,126 +38,532 @@ const (
 )
 
 var (
-	sourceType = flag.String("type", "", "Type of source to fetch; one of Manifest, ZipArchive or TarGzArchive")
+	sourceType = flag.String("type", "", "Type of source to fetch; one of Manifest, Prefix, ZipArchive, TarGzArchive, TarXzArchive, TarZstArchive or TarBz2Archive; Prefix fetches every object whose name starts with the --location object")
 	location   = flag.String("location", "", "Location of source to fetch; in the form gs://bucket/path/to/object#generation")
 
 	destDir     = flag.String("dest_dir", "", "The root where to write the files.")
 	workerCount = flag.Int("workers", 200, "The number of files to fetch in parallel.")
+	autoWorkers = flag.Bool("auto_workers", false, "If true, the number of workers is chosen from the manifest's file count and sizes, ignoring --workers.")
+	minWorkers  = flag.Int("min_workers", 1, "Minimum number of workers when --auto_workers is set.")
+	maxWorkers  = flag.Int("max_workers", 200, "Maximum number of workers when --auto_workers is set.")
+	smallSize   = flag.Int64("small_object_size", 0, "If positive, manifest files of at most this many bytes are fetched by --small_object_workers workers of their own.")
+	smallWork   = flag.Int("small_object_workers", 0, "If positive, the number of workers, besides --workers, fetching files of at most --small_object_size bytes.")
+	retryWork   = flag.Int("retry_workers", 0, "If positive, the number of workers, besides --workers, retrying downloads whose first attempt failed.")
+	schedule    = flag.String("schedule", "", "The order in which a manifest's files are fetched; empty keeps the manifest's order, largest-first finishes soonest, smallest-first makes most files available soonest.")
 	verbose     = flag.Bool("verbose", false, "If true, additional output is logged.")
 	retries     = flag.Int("retries", 3, "Number of times to retry a failed GCS download.")
 	backoff     = flag.Duration("backoff", 100*time.Millisecond, "Time to wait when retrying, will be doubled on each retry.")
+	retryBudget = flag.Duration("retry_budget", 0, "If positive, the total time that may be spent retrying failed downloads across all files.")
+	retryCodes  = flag.String("retry_statuses", "", "If set, a comma-separated list of the HTTP statuses from GCS that are retried, e.g. 408,429,503, instead of 408, 429 and all 5xx statuses.")
+	retryNet    = flag.Bool("retry_network_errors", true, "If true, failures to reach GCS at all, which have no HTTP status, and timed out reads are retried, whether or not --retry_statuses is set.")
 	timeoutGCS  = flag.Bool("timeout_gcs", true, "If true, a timeout will be used to avoid GCS longtails.")
+	gzipObjects = flag.String("gzip_objects", "", "How objects stored with Content-Encoding: gzip are read; empty lets GCS decompress them, compressed writes the stored bytes, decompressed reads the stored bytes and decompresses them locally.")
+	verifyCRC   = flag.Bool("verify_crc32c", false, "If true, each object's CRC32C checksum is fetched from GCS and verified.")
+	verifyMD5   = flag.Bool("verify_md5", false, "If true, each object's MD5 digest is fetched from GCS and verified; composite objects, which have none, are not.")
+	genMatch    = flag.Bool("require_generation_match", false, "If true, the fetch fails instead of reading a newer version of an object overwritten while it is fetched.")
+	archiveSHA  = flag.String("archive_sha256", "", "If set, the expected SHA-256 digest of the archive; nothing is extracted if it does not match.")
+	sidecar     = flag.String("checksum_sidecar", "", "If set, an object in the archive's bucket, in sha256sum format, that each extracted archive entry is verified against.")
+	allListed   = flag.Bool("require_sidecar_entries", false, "If true, archive entries missing from --checksum_sidecar fail extraction instead of being extracted unverified.")
+	resume      = flag.Bool("resume", false, "If true, a retried download continues from the bytes already fetched instead of starting over.")
+	atomic      = flag.Bool("atomic", false, "If true, a manifest's files are only moved into --dest_dir once all of them have been fetched.")
+	syncWrites  = flag.Bool("sync_writes", false, "If true, each file is synced to disk before the fetch reports it, so it survives the machine being preempted.")
+	inPlace     = flag.Bool("in_place_write", false, "If true, a manifest's files are written straight to --dest_dir instead of being staged and renamed; faster on some network file systems, but a failed fetch can leave files partly written.")
+	dedupe      = flag.Bool("dedupe", false, "If true, an object that several manifest entries refer to is fetched once and hard linked to each.")
+	unchanged   = flag.Bool("skip_unchanged", false, "If true, files already in --dest_dir with the expected size and checksum are left as they are instead of being written again.")
+	skipEmpty   = flag.Bool("skip_empty", false, "If true, zero-byte objects, such as folder markers, are not written as empty files.")
+	notNewer    = flag.Bool("skip_if_not_newer", false, "If true, files already in --dest_dir modified no earlier than their objects were last updated are left as they are.")
+	provenance  = flag.Bool("provenance", false, "If true, a .provenance sidecar recording the source object, fetch time and SHA-256 is written next to each fetched file.")
+	provEntries = flag.Bool("provenance_entries", false, "If true, --provenance also writes sidecars for the files extracted from an archive.")
+	provFormat  = flag.String("provenance_format", "text", "The format of --provenance sidecars; one of text or json.")
+	protect     = flag.String("protect", "", "Comma-separated glob patterns, relative to --dest_dir; existing files that match are never overwritten by a fetch or an extraction.")
+	deadline    = flag.Duration("overall_timeout", 0, "If positive, how long a manifest's files may take to fetch in total; the fetch fails when it expires.")
+	cacheDir    = flag.String("cache_dir", "", "If set, fetched objects are kept in this directory and reused by later fetches of the same generation.")
+	cacheMax    = flag.Int64("cache_max_bytes", 0, "If positive, the least recently used entries are evicted from --cache_dir to keep it under this size.")
+	manifestURL = flag.String("manifest_url", "", "If set, an http(s) URL to load the manifest from instead of --location; requires --type=Manifest.")
+	manifestIn  = flag.String("manifest_file", "", "If set, a local file, or - for stdin, to load the manifest from instead of --location; requires --type=Manifest.")
+	streamFiles = flag.Bool("stream_manifest", false, "If true, files are fetched as the manifest is read instead of once all of it has been; skips the free space check and ignores --dedupe and --auto_workers.")
+	preflight   = flag.Bool("preflight", false, "If true, checks that the source can be read before fetching anything, to fail fast on missing objects or permissions.")
+	sampleSize  = flag.Int("preflight_sample", 0, "How many manifest entries --preflight checks the objects of, besides the manifest itself.")
+	verify      = flag.Bool("verify", false, "If true, checks the files in --dest_dir against a manifest instead of fetching them.")
+	dryRun      = flag.Bool("dry_run", false, "If true, reports what would be fetched without writing any files.")
+	billing     = flag.String("billing_project", "", "Project billed for reads from Requester Pays buckets.")
+	maxRate     = flag.Int64("max_bytes_per_sec", 0, "If positive, caps the combined download rate of all workers.")
+	copyBuffer  = flag.Int("copy_buffer_size", 0, "If positive, the size in bytes of the pooled buffer each object is copied through; 0 uses the default.")
+	include     = flag.String("include", "", "Comma-separated glob patterns; if set, only matching files are fetched.")
+	exclude     = flag.String("exclude", "", "Comma-separated glob patterns; matching files are not fetched.")
+	modTime     = flag.Bool("preserve_mtime", true, "If true, files extracted from tar archives keep their recorded modification times.")
+	ownership   = flag.Bool("preserve_ownership", false, "If true and running as root, files extracted from tar archives keep their recorded uid and gid.")
+	strictOwner = flag.Bool("strict_ownership", false, "If true, --preserve_ownership fails extraction when it cannot set an owner, instead of logging a warning.")
+	symlinks    = flag.Bool("allow_symlinks", false, "If true, symlinks in tar archives are recreated; otherwise they are skipped.")
+	flatten     = flag.Bool("flatten", false, "If true, every file extracted from an archive is written directly into --dest_dir, without its directories.")
+	crlfToLF    = flag.Bool("normalize_line_endings", false, "If true, CRLF line endings are converted to LF in text files extracted from archives; files that look binary are left alone.")
+	textExts    = flag.String("text_extensions", "", "Comma-separated extensions, e.g. \".txt,.sh\", of the files --normalize_line_endings converts; empty uses a built-in list of common text formats.")
+	sanitize    = flag.String("sanitize_names", "", "How archive entry names are made safe to extract; empty leaves them as they are, windows replaces characters Windows does not allow with _ and fails on reserved device names such as CON.")
+	collisions  = flag.String("flatten_collisions", "error", "What --flatten does with files of the same name; one of error, overwrite or rename-with-suffix.")
+	permMask    = flag.Uint("perm_mask", 0, "If nonzero, a umask-like mask, e.g. 022, cleared from the modes of files extracted from archives; setuid, setgid and sticky bits are cleared too unless --allow_special_bits is set.")
+	specialBits = flag.Bool("allow_special_bits", false, "If true, --perm_mask keeps setuid, setgid and sticky bits.")
+	forceFile   = flag.Uint("force_file_mode", 0, "If nonzero, the mode, e.g. 0644, given to every regular file extracted from an archive.")
+	forceDir    = flag.Uint("force_dir_mode", 0, "If nonzero, the mode, e.g. 0755, given to every directory extracted from an archive.")
+	defaultDir  = flag.Uint("default_dir_mode", 0, "If nonzero, the mode, e.g. 0755, given to directories a zip archive has no entry for.")
+	streamTar   = flag.Bool("stream_archives", true, "If true, tar archives are extracted as they are downloaded instead of being staged on disk first.")
+	keepArchive = flag.String("keep_archive", "", "If set, the path the downloaded archive is saved to, e.g. for a build to cache it for reuse.")
+	extract     = flag.Bool("extract", true, "If false, an archive saved with --keep_archive is not extracted.")
+	prefetchBuf = flag.Int("prefetch_bytes", 0, "If positive, how many bytes of a streamed archive are downloaded ahead of its extraction, e.g. 4194304 over high-latency links.")
+	maxFiles    = flag.Int("max_files", 0, "If positive, the most files and links an archive may extract; larger archives fail.")
+	maxFileSize = flag.Int64("max_file_bytes", 0, "If positive, the largest a single fetched or extracted file may be; a larger one fails the fetch, or is left out with --skip_large_files.")
+	skipLarge   = flag.Bool("skip_large_files", false, "If true, files over --max_file_bytes are left out instead of failing the fetch.")
+	maxBytes    = flag.Int64("max_total_bytes", 0, "If positive, the most bytes an archive may extract in all; larger archives fail.")
+	maxRatio    = flag.Float64("max_compression_ratio", 200, "If positive, how many times its compressed size an archive entry larger than 1 MiB may expand to; larger ratios fail. Text rarely compresses beyond 20 times.")
+	recurse     = flag.Bool("recurse_archives", false, "If true, archives extracted from an archive are extracted in turn, each into a directory beside it named after it.")
+	maxDepth    = flag.Int("max_archive_depth", 3, "How many levels of nested archives --recurse_archives extracts; deeper ones are left as they are.")
+	zstdWindow  = flag.Uint64("zstd_max_window", 0, "Maximum zstd window size in bytes; 0 uses the decoder default.")
+	zstdThreads = flag.Int("zstd_concurrency", 0, "Number of blocks the zstd decoder works on in parallel; 0 uses the decoder default.")
 	help        = flag.Bool("help", false, "If true, prints help text and exits.")
 
+	logFormat     = flag.String("log_format", "text", "Log output format; one of text or json.")
+	reportFile    = flag.String("report_file", "", "If set, a JSON summary of a manifest fetch is written to this file.")
+	expectFiles   = flag.Int("expected_files", 0, "If positive, the number of files the fetch must write; any other number fails it.")
+	stateFile     = flag.String("state_file", "", "If set, a manifest fetch records the files it has completed in this file, and a fetch started again with it skips those still on disk as written whose objects are unchanged.")
+	lockFile      = flag.String("lockfile", "", "If set, the path, SHA-256 digest, size and generation of every file fetched are written to this file.")
+	endpoint      = flag.String("endpoint", "", "If set, overrides the GCS API endpoint, e.g. to use an emulator.")
+	insecure      = flag.Bool("insecure", false, "If true, disables authentication and TLS verification; for emulators only.")
+	bucketLimits  = flag.String("bucket_concurrency", "", "Per-bucket limits on how many objects are fetched at once, e.g. \"slow-bucket=4,other=16\"; other buckets are only limited by --workers.")
+	timeoutRules  = flag.String("timeout_rules", "", "Per-extension GCS timeouts for each try, overriding the built-in ones when --timeout_gcs is set, e.g. \".bin=30s:1m,=5s\"; an empty extension applies to all other files.")
+	skipSpace     = flag.Bool("skip_space_check", false, "If true, does not check for enough free disk space before writing files.")
 	keepSource    = flag.Bool("keep_source", false, "If true, the source file is preserved in the file system.")
 	stagingFolder = flag.String("staging_folder", ".download/", "Temp folder where to download the source file.")
+	tempPrefix    = flag.String("temp_prefix", "", "If set, starts the name of every temp file in --staging_folder, so that fetchers sharing it can tell their files apart.")
+	staleTempAge  = flag.Duration("stale_temp_age", 0, "If positive, temp files in --staging_folder named with --temp_prefix and older than this are removed before fetching.")
+	fastStaging   = flag.String("fast_staging_folder", "", "If set, files are downloaded to this folder, e.g. a tmpfs, instead of --staging_folder, then moved to --dest_dir.")
 )
 
-func logFatalf(writer io.Writer, format string, a ...interface{}) {
+// logErrorf writes the message to writer and returns the exit status for
+// failing with it.
+func logErrorf(writer io.Writer, format string, a ...interface{}) int {
 	if _, err := fmt.Fprintf(writer, format+"\n", a...); err != nil {
-		log.Fatalf("Failed to write log: %v", err)
+		log.Printf("Failed to write log: %v", err)
+	}
+	return 1
+}
+
+// splitPatterns splits a comma-separated flag value into its non-empty
+// patterns.
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// protectPolicy returns an OverwritePolicy that keeps the existing files in
+// destDir matching any of patterns, or nil if there are none.
+func protectPolicy(destDir string, patterns []string) func(string) bool {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(finalname string) bool {
+		rel, err := filepath.Rel(destDir, finalname)
+		if err != nil {
+			return true
+		}
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, filepath.ToSlash(rel)); ok {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// parseTimeoutRules parses --timeout_rules: comma-separated rules of the form
+// ext=timeout:timeout:..., listing the timeout of each try.
+func parseTimeoutRules(s string) (map[string][]time.Duration, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	rules := map[string][]time.Duration{}
+	for _, rule := range strings.Split(s, ",") {
+		ext, timeouts, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q is not of the form ext=timeout:timeout", rule)
+		}
+		for _, t := range strings.Split(timeouts, ":") {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", rule, err)
+			}
+			rules[ext] = append(rules[ext], d)
+		}
+	}
+	return rules, nil
+}
+
+// parseBucketLimits parses --bucket_concurrency: comma-separated limits of
+// the form bucket=n.
+func parseBucketLimits(s string) (map[string]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	limits := map[string]int{}
+	for _, limit := range strings.Split(s, ",") {
+		bucket, n, ok := strings.Cut(strings.TrimSpace(limit), "=")
+		if !ok || bucket == "" {
+			return nil, fmt.Errorf("limit %q is not of the form bucket=n", limit)
+		}
+		l, err := strconv.Atoi(n)
+		if err != nil || l <= 0 {
+			return nil, fmt.Errorf("limit %q is not a positive number", limit)
+		}
+		limits[bucket] = l
+	}
+	return limits, nil
+}
+
+// parseStatuses parses a comma-separated list of HTTP statuses, such as
+// "408,429,503".
+func parseStatuses(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var statuses []int
+	for _, status := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(status))
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("%q is not an HTTP status", status)
+		}
+		statuses = append(statuses, code)
 	}
-	os.Exit(1)
+	return statuses, nil
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run fetches the source and returns the exit status, so that the deferred
+// closes are done before main exits.
+func run() (status int) {
 	flag.Parse()
 
 	if *help {
 		fmt.Println("Fetches source files from Google Cloud Storage")
 		flag.PrintDefaults()
-		return
+		return 0
 	}
 
 	var stdout, stderr io.Writer = os.Stdout, os.Stderr
 	if outputDir, ok := os.LookupEnv("BUILDER_OUTPUT"); ok {
 		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-			logFatalf(os.Stderr, "Failed to create folder %s: %v", outputDir, err)
+			return logErrorf(os.Stderr, "Failed to create folder %s: %v", outputDir, err)
 		}
 		outfile := filepath.Join(outputDir, "output")
 		f, err := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
-			logFatalf(os.Stderr, "Cannot open output file %s: %v", outfile, err)
+			return logErrorf(os.Stderr, "Cannot open output file %s: %v", outfile, err)
 		}
 		defer func() {
-			if cerr := f.Close(); cerr != nil {
-				log.Fatalf("Failed to close %q: %v", outfile, cerr)
+			if cerr := f.Close(); cerr != nil && status == 0 {
+				status = logErrorf(os.Stderr, "Failed to close %q: %v", outfile, cerr)
 			}
 		}()
 		stderr = io.MultiWriter(stderr, f)
 	}
 
-	if *location == "" || *sourceType == "" {
-		logFatalf(stderr, "Must specify --location and --type")
+	if (*location == "" && *manifestURL == "" && *manifestIn == "") || *sourceType == "" {
+		return logErrorf(stderr, "Must specify --location, --manifest_url or --manifest_file, and --type")
+	}
+	if *manifestURL != "" && *sourceType != "Manifest" {
+		return logErrorf(stderr, "--manifest_url requires --type=Manifest")
+	}
+	if *manifestIn != "" && *sourceType != "Manifest" {
+		return logErrorf(stderr, "--manifest_file requires --type=Manifest")
+	}
+	if *manifestIn != "" && *manifestURL != "" {
+		return logErrorf(stderr, "--manifest_file and --manifest_url cannot both be set")
 	}
 
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithUserAgent(userAgent))
+	client, err := fetcher.NewStorageGCS(ctx, fetcher.ClientOptions{
+		UserAgent: userAgent,
+		Endpoint:  *endpoint,
+		Insecure:  *insecure,
+	})
 	if err != nil {
-		logFatalf(stderr, "Failed to create new GCS client: %v", err)
+		return logErrorf(stderr, "Failed to create new GCS client: %v", err)
+	}
+
+	var bucket, object string
+	var generation int64
+	if *manifestURL == "" && *manifestIn == "" {
+		bucket, object, generation, err = common.ParseBucketObject(*location)
+		if err != nil {
+			return logErrorf(stderr, "Failed to parse --location: %v", err)
+		}
+	}
+
+	var logger *slog.Logger
+	switch *logFormat {
+	case "text":
+	case "json":
+		level := slog.LevelInfo
+		if *verbose {
+			level = slog.LevelDebug
+		}
+		logger = slog.New(slog.NewJSONHandler(stdout, &slog.HandlerOptions{Level: level}))
+	default:
+		return logErrorf(stderr, "Unsupported --log_format %q", *logFormat)
+	}
+
+	var reportWriter io.Writer
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			return logErrorf(stderr, "Cannot create report file %s: %v", *reportFile, err)
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil && status == 0 {
+				status = logErrorf(os.Stderr, "Failed to close %q: %v", *reportFile, cerr)
+			}
+		}()
+		reportWriter = f
 	}
 
-	bucket, object, generation, err := common.ParseBucketObject(*location)
+	var manifestReader io.Reader
+	switch *manifestIn {
+	case "":
+	case "-":
+		manifestReader = os.Stdin
+	default:
+		f, err := os.Open(*manifestIn)
+		if err != nil {
+			return logErrorf(stderr, "Cannot open manifest file %s: %v", *manifestIn, err)
+		}
+		defer f.Close()
+		manifestReader = f
+	}
+
+	var lockfileWriter io.Writer
+	if *lockFile != "" {
+		f, err := os.Create(*lockFile)
+		if err != nil {
+			return logErrorf(stderr, "Cannot create lockfile %s: %v", *lockFile, err)
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil && status == 0 {
+				status = logErrorf(os.Stderr, "Failed to close %q: %v", *lockFile, cerr)
+			}
+		}()
+		lockfileWriter = f
+	}
+
+	sched := fetcher.Schedule(*schedule)
+	switch sched {
+	case fetcher.ManifestOrder, fetcher.LargestFirst, fetcher.SmallestFirst:
+	default:
+		return logErrorf(stderr, "Unsupported --schedule %q", *schedule)
+	}
+
+	policy := fetcher.CollisionPolicy(*collisions)
+	switch policy {
+	case fetcher.CollisionError, fetcher.CollisionOverwrite, fetcher.CollisionRename:
+	default:
+		return logErrorf(stderr, "Unsupported --flatten_collisions %q", *collisions)
+	}
+
+	provenanceFormat := fetcher.ProvenanceFormat(*provFormat)
+	switch provenanceFormat {
+	case fetcher.ProvenanceText, fetcher.ProvenanceJSON:
+	default:
+		return logErrorf(stderr, "Unsupported --provenance_format %q", *provFormat)
+	}
+
+	var sanitizer func(string) (string, error)
+	switch *sanitize {
+	case "":
+	case "windows":
+		sanitizer = fetcher.WindowsNameSanitizer
+	default:
+		return logErrorf(stderr, "Unsupported --sanitize_names %q", *sanitize)
+	}
+
+	gzipMode := fetcher.GzipMode(*gzipObjects)
+	switch gzipMode {
+	case fetcher.GzipTranscoded, fetcher.GzipCompressed, fetcher.GzipDecompressed:
+	default:
+		return logErrorf(stderr, "Unsupported --gzip_objects %q", *gzipObjects)
+	}
+
+	rules, err := parseTimeoutRules(*timeoutRules)
+	if err != nil {
+		return logErrorf(stderr, "Failed to parse --timeout_rules: %v", err)
+	}
+	protected := splitPatterns(*protect)
+	for _, p := range protected {
+		if _, err := path.Match(p, ""); err != nil {
+			return logErrorf(stderr, "Invalid --protect pattern %q: %v", p, err)
+		}
+	}
+
+	bucketConcurrency, err := parseBucketLimits(*bucketLimits)
+	if err != nil {
+		return logErrorf(stderr, "Failed to parse --bucket_concurrency: %v", err)
+	}
+
+	retryStatuses, err := parseStatuses(*retryCodes)
 	if err != nil {
-		logFatalf(stderr, "Failed to parse --location: %v", err)
+		return logErrorf(stderr, "Failed to parse --retry_statuses: %v", err)
 	}
 
 	gcs := &fetcher.Fetcher{
-		GCS:         realGCS{client},
-		OS:          realOS{},
+		GCS:         client,
+		OS:          fetcher.OSFileSystem{},
 		DestDir:     *destDir,
 		StagingDir:  filepath.Join(*destDir, *stagingFolder),
 		CreatedDirs: map[string]bool{},
 		Bucket:      bucket,
 		Object:      object,
 		Generation:  generation,
+		ManifestURL: *manifestURL,
 		TimeoutGCS:  *timeoutGCS,
 		WorkerCount: *workerCount,
 		Retries:     *retries,
-		Backoff:     *backoff,
+		Backoff:     fetcher.ExponentialBackoff{Base: *backoff, Jitter: 0.2},
+		RetryBudget: *retryBudget,
 		SourceType:  *sourceType,
 		KeepSource:  *keepSource,
 		Verbose:     *verbose,
 		Stdout:      stdout,
 		Stderr:      stderr,
-	}
-	if err := gcs.Fetch(ctx); err != nil {
-		logFatalf(stderr, "failed to Fetch: %v", err.Error())
-	}
-}
 
-// realGCS is a wrapper over the GCS client functions.
-type realGCS struct {
-	client *storage.Client
-}
+		RetryableStatuses:    retryStatuses,
+		NoRetryNetworkErrors: !*retryNet,
 
-func (gp realGCS) NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
-	return gp.client.Bucket(bucket).Object(object).NewReader(ctx)
-}
+		TempPrefix:     *tempPrefix,
+		StaleTempAge:   *staleTempAge,
+		FastStagingDir: *fastStaging,
 
-// realOS merely wraps the os package implementations.
-type realOS struct{}
+		RequireGenerationMatch: *genMatch,
 
-func (realOS) Rename(oldpath, newpath string) error {
-	return os.Rename(oldpath, newpath)
-}
+		VerifyCRC32C:   *verifyCRC,
+		VerifyMD5:      *verifyMD5,
+		GzipObjects:    gzipMode,
+		DryRun:         *dryRun,
+		Include:        splitPatterns(*include),
+		Exclude:        splitPatterns(*exclude),
+		BillingProject: *billing,
+		ReportWriter:   reportWriter,
+		LockfileWriter: lockfileWriter,
+		Logger:         logger,
+		MaxBytesPerSec: *maxRate,
+		CopyBufferSize: *copyBuffer,
+		AllowSymlinks:  *symlinks,
 
-func (realOS) Chmod(name string, mode os.FileMode) error {
-	return os.Chmod(name, mode)
-}
+		PreserveModTime: *modTime,
+		ResumeDownloads: *resume,
+		ArchiveSha256:   *archiveSHA,
+		SkipSpaceCheck:  *skipSpace,
+		Atomic:          *atomic,
+		StateFile:       *stateFile,
+		SyncWrites:      *syncWrites,
+		InPlaceWrite:    *inPlace,
+		DedupeIdentical: *dedupe,
+		SkipUnchanged:   *unchanged,
+		SkipEmpty:       *skipEmpty,
+		SkipIfNotNewer:  *notNewer,
+		OverwritePolicy: protectPolicy(*destDir, protected),
+		StreamManifest:  *streamFiles,
+		OverallTimeout:  *deadline,
+		TimeoutRules:    rules,
 
-func (realOS) Create(name string) (*os.File, error) {
-	return os.Create(name)
-}
+		WriteProvenance:   *provenance,
+		ProvenanceEntries: *provEntries,
+		ProvenanceFormat:  provenanceFormat,
 
-func (realOS) MkdirAll(path string, perm os.FileMode) error {
-	return os.MkdirAll(path, perm)
-}
+		CacheDir:      *cacheDir,
+		CacheMaxBytes: *cacheMax,
 
-func (realOS) Open(name string) (*os.File, error) {
-	return os.Open(name)
-}
+		Flatten:           *flatten,
+		FlattenCollisions: policy,
+		StreamArchives:    *streamTar,
+		PrefetchBytes:     *prefetchBuf,
+		NameSanitizer:     sanitizer,
+
+		NormalizeLineEndings: *crlfToLF,
+		TextExtensions:       splitPatterns(*textExts),
+
+		KeepArchive:    *keepArchive != "",
+		ArchivePath:    *keepArchive,
+		ExtractArchive: *extract,
+
+		ChecksumSidecar:       *sidecar,
+		RequireSidecarEntries: *allListed,
+
+		PermMask:         os.FileMode(*permMask),
+		AllowSpecialBits: *specialBits,
+		ForceFileMode:    os.FileMode(*forceFile),
+		ForceDirMode:     os.FileMode(*forceDir),
+		DefaultDirMode:   os.FileMode(*defaultDir),
+
+		PreserveOwnership: *ownership,
+		StrictOwnership:   *strictOwner,
+
+		AutoScaleWorkers: *autoWorkers,
+		MinWorkers:       *minWorkers,
+		MaxWorkers:       *maxWorkers,
+		Schedule:         sched,
+
+		SmallObjectSize:    *smallSize,
+		SmallObjectWorkers: *smallWork,
+		RetryWorkers:       *retryWork,
+
+		PerBucketConcurrency: bucketConcurrency,
 
-func (realOS) RemoveAll(path string) error {
-	return os.RemoveAll(path)
+		MaxFiles:            *maxFiles,
+		ExpectedFileCount:   *expectFiles,
+		MaxTotalBytes:       *maxBytes,
+		MaxFileBytes:        *maxFileSize,
+		SkipLargeFiles:      *skipLarge,
+		MaxCompressionRatio: *maxRatio,
+		RecurseArchives:     *recurse,
+		MaxArchiveDepth:     *maxDepth,
+
+		ZstdMaxWindow:   *zstdWindow,
+		ZstdConcurrency: *zstdThreads,
+
+		ManifestReader:  manifestReader,
+		PreflightSample: *sampleSize,
+	}
+	defer func() {
+		if cerr := gcs.Close(); cerr != nil && status == 0 {
+			status = logErrorf(stderr, "Failed to close fetcher: %v", cerr)
+		}
+	}()
+	if *verify {
+		if *sourceType != "Manifest" {
+			return logErrorf(stderr, "--verify requires --type=Manifest")
+		}
+		mismatches, err := gcs.Verify(ctx)
+		if err != nil {
+			return logErrorf(stderr, "failed to Verify: %v", err)
+		}
+		if len(mismatches) > 0 {
+			return logErrorf(stderr, "%d files do not match the manifest", len(mismatches))
+		}
+		fmt.Fprintln(stdout, "All files match the manifest.")
+		return 0
+	}
+	if *preflight {
+		if err := gcs.Preflight(ctx); err != nil {
+			fmt.Fprintf(stderr, "failed Preflight: %v\n", err)
+			return fetcher.ExitStatus(err)
+		}
+	}
+	if err := gcs.Fetch(ctx); err != nil {
+		fmt.Fprintf(stderr, "failed to Fetch: %v\n", err)
+		return fetcher.ExitStatus(err)
+	}
+	return 0
 }
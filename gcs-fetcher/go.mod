@@ -2,6 +2,9 @@ module github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher
 
 require (
   cloud.google.com/go/storage v1.33.0
+  github.com/klauspost/compress v1.17.11
+  github.com/ulikunitz/xz v0.5.11
+  golang.org/x/time v0.5.0
   google.golang.org/api v0.147.0
 )
 
@@ -30,9 +30,31 @@ type ManifestItem struct {
 	// Sha1Sum is the SHA1 digest of the object.
 	Sha1Sum string `json:"sha1sum"`
 
+	// Sha256Sum is the SHA256 digest of the object. It is optional; when
+	// both Sha1Sum and Sha256Sum are set, both are verified.
+	Sha256Sum string `json:"sha256sum,omitempty"`
+
+	// Algorithm names the checksum algorithm, such as "md5" or "crc32c",
+	// that Digest was computed with. Both are optional, but must be set
+	// together; they are verified in addition to Sha1Sum and Sha256Sum.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Digest is the hex-encoded checksum of the object, computed with
+	// Algorithm.
+	Digest string `json:"digest,omitempty"`
+
 	// FileMode is the mode of the file that should be applied to the
 	// fetched file.
 	FileMode os.FileMode `json:"mode"`
+
+	// Size is the size of the object in bytes. It is optional, and used
+	// as a hint when choosing how many files to fetch in parallel, and to
+	// catch downloads cut short.
+	Size int64 `json:"size,omitempty"`
+
+	// Generation pins the generation of the object to fetch. It is optional,
+	// and takes precedence over a generation given in SourceURL.
+	Generation int64 `json:"generation,omitempty"`
 }
 
 // ParseBucketObject parses a URI into the bucket and object name it points to.
@@ -0,0 +1,228 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// atomicDir returns the directory under StagingDir that holds the tree being
+// fetched in Atomic mode until every file has been fetched.
+func (gf *Fetcher) atomicDir() string {
+	return filepath.Join(gf.StagingDir, "tree")
+}
+
+// commitTree moves every file fetched in Atomic mode from atomicDir into
+// DestDir, merging with whatever DestDir already holds. Each file is first
+// moved beside its destination, so that putting it in place is a rename on
+// the same file system, then renamed into place, with any file it replaces
+// set aside. If any step fails, the files already placed are taken out, the
+// ones they replaced and the directories made are put back as they were, and
+// DestDir is left untouched.
+func (gf *Fetcher) commitTree(reports []jobReport) (err error) {
+	src := gf.atomicDir()
+	var moves []treeMove
+	var dirs []string // The directories made under DestDir, parents first.
+	defer func() {
+		if err != nil {
+			gf.rollbackTree(moves, dirs)
+		}
+	}()
+	for i, report := range reports {
+		if !report.success || report.empty || report.kept {
+			continue
+		}
+		rel, err := filepath.Rel(src, report.finalname)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(gf.DestDir, rel)
+		moves = append(moves, treeMove{src: report.finalname, dst: dst, report: i})
+		if gf.WriteProvenance && !report.unchanged {
+			moves = append(moves, treeMove{src: gf.provenancePath(report.finalname), dst: gf.provenancePath(dst), report: -1})
+		}
+	}
+
+	for i := range moves {
+		m := &moves[i]
+		made, err := gf.mkdirAllNew(filepath.Dir(m.dst))
+		dirs = append(dirs, made...)
+		if err != nil {
+			return err
+		}
+		staged := siblingTemp(m.dst)
+		if err := gf.moveFile(m.src, staged); err != nil {
+			gf.OS.Remove(staged)
+			return fmt.Errorf("moving %q to %q: %v", m.src, m.dst, err)
+		}
+		m.staged = staged
+	}
+
+	for i := range moves {
+		m := &moves[i]
+		if info, err := gf.OS.Stat(m.dst); err == nil && info.IsDir() {
+			return fmt.Errorf("moving %q to %q: destination is a directory", m.src, m.dst)
+		}
+		backup := siblingTemp(m.dst)
+		if err := gf.OS.Rename(m.dst, backup); err == nil {
+			m.backup = backup
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("setting aside %q: %v", m.dst, err)
+		}
+		if err := gf.OS.Rename(m.staged, m.dst); err != nil {
+			return fmt.Errorf("moving %q to %q: %v", m.src, m.dst, err)
+		}
+		m.placed = true
+	}
+
+	synced := map[string]bool{}
+	for _, m := range moves {
+		if m.backup != "" {
+			if err := gf.OS.Remove(m.backup); err != nil {
+				gf.logErr("Failed to remove %q, continuing: %v", m.backup, err)
+			}
+		}
+		if dir := filepath.Dir(m.dst); !synced[dir] {
+			if err := gf.syncDir(dir); err != nil {
+				return err
+			}
+			synced[dir] = true
+		}
+		if m.report >= 0 {
+			reports[m.report].finalname = m.dst
+		}
+	}
+	return nil
+}
+
+// treeMove is one file commitTree moves from src in atomicDir to dst in
+// DestDir, and how far it got.
+type treeMove struct {
+	src, dst string
+	report   int    // Index of the file's jobReport, or -1 for a sidecar.
+	staged   string // Where src was moved to beside dst, if it has been.
+	backup   string // Where the file dst replaces was set aside, if any.
+	placed   bool   // Whether staged has been renamed to dst.
+}
+
+// rollbackTree undoes the moves commitTree made before failing, and removes
+// the directories it made, so DestDir is as it was before. Failures are
+// logged; the first error is what the fetch reports.
+func (gf *Fetcher) rollbackTree(moves []treeMove, dirs []string) {
+	for i := len(moves) - 1; i >= 0; i-- {
+		m := moves[i]
+		if m.placed {
+			if err := gf.OS.Remove(m.dst); err != nil {
+				gf.logErr("Failed to remove %q while rolling back: %v", m.dst, err)
+			}
+		} else if m.staged != "" {
+			if err := gf.OS.Remove(m.staged); err != nil {
+				gf.logErr("Failed to remove %q while rolling back: %v", m.staged, err)
+			}
+		}
+		if m.backup != "" {
+			if err := gf.OS.Rename(m.backup, m.dst); err != nil {
+				gf.logErr("Failed to restore %q from %q while rolling back: %v", m.dst, m.backup, err)
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := gf.OS.Remove(dirs[i]); err != nil {
+			gf.logErr("Failed to remove %q while rolling back: %v", dirs[i], err)
+		}
+	}
+}
+
+// mkdirAllNew is MkdirAll for dir, that also returns the directories it
+// made, parents first.
+func (gf *Fetcher) mkdirAllNew(dir string) ([]string, error) {
+	var missing []string
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		if _, err := gf.OS.Stat(p); !os.IsNotExist(err) || filepath.Dir(p) == p {
+			break
+		}
+		missing = append([]string{p}, missing...)
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	if err := gf.OS.MkdirAll(dir, os.FileMode(0777)|os.ModeDir); err != nil {
+		return missing, err
+	}
+	return missing, nil
+}
+
+// siblingTemp returns an unused-looking hidden name in the same directory as
+// p, for a file to be renamed to or from p.
+func siblingTemp(p string) string {
+	return filepath.Join(filepath.Dir(p), fmt.Sprintf(".%s.%d", filepath.Base(p), rand.Int63()))
+}
+
+// moveFile renames oldpath to newpath. If they are on different file
+// systems, it copies oldpath, including its permissions, beside newpath,
+// renames the copy over newpath and removes oldpath, so newpath is replaced
+// whole, even if it is read-only.
+func (gf *Fetcher) moveFile(oldpath, newpath string) error {
+	err := gf.OS.Rename(oldpath, newpath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	tmp := siblingTemp(newpath)
+	if err := gf.copyLocalFile(oldpath, tmp); err != nil {
+		gf.OS.Remove(tmp)
+		return err
+	}
+	if err := gf.OS.Rename(tmp, newpath); err != nil {
+		gf.OS.Remove(tmp)
+		return err
+	}
+	return gf.OS.Remove(oldpath)
+}
+
+// copyLocalFile copies oldpath, including its permissions, to newpath.
+func (gf *Fetcher) copyLocalFile(oldpath, newpath string) error {
+	src, err := gf.OS.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := gf.OS.Create(newpath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := gf.syncFile(dst, newpath); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return gf.OS.Chmod(newpath, info.Mode())
+}
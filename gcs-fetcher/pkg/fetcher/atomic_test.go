@@ -0,0 +1,248 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// atomicManifest lists three good files and one that always fails to read.
+var atomicManifest = []byte(`{
+	"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+	"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+	"sfile3":       {"sourceUrl": "gs://success-bucket/sfile3"},
+	"c/efile2":     {"sourceUrl": "gs://error-bucket/efile2"}
+}`)
+
+func TestMoveFileAcrossFileSystems(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsEXDEV = 1
+
+	src := filepath.Join(tc.workDir, "src")
+	dst := filepath.Join(tc.workDir, "dst")
+	if err := ioutil.WriteFile(src, sfile1Contents, 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.gf.moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile() = %v", err)
+	}
+
+	got, err := ioutil.ReadFile(dst)
+	if err != nil || string(got) != string(sfile1Contents) {
+		t.Errorf("ReadFile(dst) = (%q, %v), want (%q, nil)", got, err, sfile1Contents)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0555 {
+		t.Errorf("Stat(dst) = (%v, %v), want mode 0555", info, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("Stat(src) = %v, want not exist", err)
+	}
+}
+
+func TestMoveFileOverReadOnlyAcrossFileSystems(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsEXDEV = 1
+	tc.os.honorReadOnly = true
+
+	src := filepath.Join(tc.workDir, "src")
+	dst := filepath.Join(tc.workDir, "dst")
+	if err := ioutil.WriteFile(src, sfile1Contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, []byte("read-only"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.gf.moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile() = %v", err)
+	}
+
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != string(sfile1Contents) {
+		t.Errorf("ReadFile(dst) = (%q, %v), want (%q, nil)", got, err, sfile1Contents)
+	}
+	if want := []string{"dst"}; !reflect.DeepEqual(listFiles(t, tc.workDir), want) {
+		t.Errorf("files = %v, want %v", listFiles(t, tc.workDir), want)
+	}
+}
+
+func TestMoveFileOtherErrors(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsRename = 1
+
+	if err := tc.gf.moveFile("src", "dst"); !errors.Is(err, errRename) {
+		t.Errorf("moveFile() = %v, want %v", err, errRename)
+	}
+}
+
+func TestFetchFromManifestAtomic(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Atomic = true
+	tc.os.errorsEXDEV = 1 // One file is moved into place by copying.
+
+	existing := filepath.Join(tc.workDir, "a", "existing.txt")
+	if err := os.MkdirAll(filepath.Dir(existing), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(existing, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := []byte(`{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "atomic.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "atomic.json"
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() = %v", err)
+	}
+	want := []string{"a/existing.txt", "a/sfile1.js", "b/sfile2.jpg"}
+	if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("files in DestDir got %v, want %v", got, want)
+	}
+}
+
+func TestFetchFromManifestAtomicRollback(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	if err := ioutil.WriteFile(filepath.Join(tc.workDir, "existing.txt"), []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tc.gcs.objects[formatGCSName(successBucket, "atomic.json", generation)] = fakeGCSResponse{content: atomicManifest}
+	tc.gf.Object = "atomic.json"
+	tc.gf.Atomic = true
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err == nil {
+		t.Fatalf("fetchFromManifest() = nil, want error")
+	}
+	want := []string{"existing.txt"}
+	if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("files in DestDir got %v, want %v", got, want)
+	}
+}
+
+func TestFetchFromManifestAtomicCommitFails(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Atomic = true
+	// The last of the files fails to move into DestDir, whichever order they
+	// are moved in.
+	tc.os.failRenameTo = filepath.Join(tc.workDir, "c", "d", "sfile3")
+
+	existing := map[string]string{"a/existing.txt": "keep me", "b/sfile2.jpg": "old sfile2"}
+	for name, content := range existing {
+		path := filepath.Join(tc.workDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := []byte(`{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+		"c/d/sfile3":   {"sourceUrl": "gs://success-bucket/sfile3"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "atomic.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "atomic.json"
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err == nil || !strings.Contains(err.Error(), errRename.Error()) {
+		t.Fatalf("fetchFromManifest() = %v, want %v", err, errRename)
+	}
+	want := []string{"a/existing.txt", "b/sfile2.jpg"}
+	if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("files in DestDir got %v, want %v", got, want)
+	}
+	for name, content := range existing {
+		if got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name)); err != nil || string(got) != content {
+			t.Errorf("ReadFile(%s) = (%q, %v), want (%q, nil)", name, got, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tc.workDir, "c")); !os.IsNotExist(err) {
+		t.Errorf("Stat(c) = %v, want the directory made for the commit removed", err)
+	}
+}
+
+func TestCommitTreeOverReadOnlyAcrossFileSystems(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.honorReadOnly = true
+
+	staged := filepath.Join(tc.gf.atomicDir(), "b", "sfile2.jpg")
+	if err := os.MkdirAll(filepath.Dir(staged), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(staged, sfile2Contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(tc.workDir, "b", "sfile2.jpg")
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, []byte("read-only"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	tc.os.errorsEXDEV = 1 // The staged file is copied beside dst.
+	reports := []jobReport{{success: true, finalname: staged}}
+	if err := tc.gf.commitTree(reports); err != nil {
+		t.Fatalf("commitTree() = %v", err)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || string(got) != string(sfile2Contents) {
+		t.Errorf("ReadFile(dst) = (%q, %v), want (%q, nil)", got, err, sfile2Contents)
+	}
+	if reports[0].finalname != dst {
+		t.Errorf("finalname = %q, want %q", reports[0].finalname, dst)
+	}
+	if files := listFiles(t, filepath.Join(tc.workDir, "b")); !reflect.DeepEqual(files, []string{"sfile2.jpg"}) {
+		t.Errorf("files in b = %v, want only sfile2.jpg", files)
+	}
+}
+
+// listFiles returns the sorted paths, relative to dir, of the files under it.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("walking %q: %v", dir, err)
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// defaultBackoff is used when Fetcher.Backoff is nil.
+var defaultBackoff = ExponentialBackoff{Base: 100 * time.Millisecond, Jitter: 0.2}
+
+// Backoff decides how long to wait before retrying a failed download.
+type Backoff interface {
+	// NextDelay returns the delay before the given retry, where the first
+	// retry is attempt 1.
+	NextDelay(attempt int) time.Duration
+}
+
+// ExponentialBackoff waits Base before the first retry and doubles the delay
+// on each subsequent retry, up to Max if it is set. A random extra delay of
+// up to Jitter times the computed delay is added so that concurrent workers
+// do not retry in lockstep.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+// NextDelay implements Backoff.
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	if attempt < 1 || b.Base <= 0 {
+		return 0
+	}
+	d := float64(b.Base) * math.Pow(2, float64(attempt-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * rand.Float64()
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+func (gf *Fetcher) backoff() Backoff {
+	if gf.Backoff == nil {
+		return defaultBackoff
+	}
+	return gf.Backoff
+}
+
+// retryDelay returns how long to wait before the given retry of the job in
+// report: the delay chosen by Backoff, or longer if the error of its last
+// attempt carried a Retry-After header asking for more.
+func (gf *Fetcher) retryDelay(report *jobReport, retrynum int) time.Duration {
+	d := gf.backoff().NextDelay(retrynum)
+	if n := len(report.attempts); n > 0 {
+		if after := retryAfter(report.attempts[n-1].err, time.Now()); after > d {
+			d = after
+		}
+	}
+	return d
+}
+
+// retryAfter returns the delay asked for, as of now, by the Retry-After
+// header of the googleapi.Error in err's chain, or 0 if there is none. The
+// header holds either a number of seconds or an HTTP date.
+func retryAfter(err error, now time.Time) time.Duration {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return 0
+	}
+	v := strings.TrimSpace(gerr.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// retryBudget tracks the time spent retrying downloads across a fetch.
+type retryBudget struct {
+	mu    sync.Mutex
+	spent time.Duration
+}
+
+// budgetExhaustedError indicates that a download was given up because
+// RetryBudget had been used up. err is the error of its last attempt.
+type budgetExhaustedError struct {
+	budget time.Duration
+	err    error
+}
+
+func (e *budgetExhaustedError) Error() string {
+	return fmt.Sprintf("retry budget of %v exhausted: %v", e.budget, e.err)
+}
+
+func (e *budgetExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// spendRetry charges the attempt, if it was a retry, against RetryBudget.
+func (gf *Fetcher) spendRetry(report *jobReport, attempt jobAttempt) {
+	if gf.RetryBudget <= 0 || len(report.attempts) < 2 {
+		return
+	}
+	gf.retryBudget.mu.Lock()
+	gf.retryBudget.spent += attempt.backoff + attempt.duration
+	gf.retryBudget.mu.Unlock()
+}
+
+// retryAllowed reports whether RetryBudget leaves time for another retry.
+func (gf *Fetcher) retryAllowed() bool {
+	if gf.RetryBudget <= 0 {
+		return true
+	}
+	gf.retryBudget.mu.Lock()
+	defer gf.retryBudget.mu.Unlock()
+	return gf.retryBudget.spent < gf.RetryBudget
+}
+
+// budgetExhausted makes the last failed attempt of report final, as there is
+// no RetryBudget left to retry it.
+func (gf *Fetcher) budgetExhausted(j job, report *jobReport) {
+	last := &report.attempts[len(report.attempts)-1]
+	last.err = &budgetExhaustedError{budget: gf.RetryBudget, err: last.err}
+	last.permanent = true
+	report.err = last.err
+	if gf.Logger != nil {
+		gf.Logger.Error("retry budget exhausted", append(objectAttrs(j), errorAttrs(report.err)...)...)
+	} else {
+		gf.log("Failed to fetch %s, will no longer retry: %v", formatGCSName(j.bucket, j.object, j.generation), report.err)
+	}
+}
+
+// sleep waits for d, returning early with the context's error if ctx is
+// cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
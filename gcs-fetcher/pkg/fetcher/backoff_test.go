@@ -0,0 +1,211 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		backoff ExponentialBackoff
+		attempt int
+		want    time.Duration
+	}{
+		{ExponentialBackoff{Base: 100 * time.Millisecond}, 0, 0},
+		{ExponentialBackoff{Base: 100 * time.Millisecond}, 1, 100 * time.Millisecond},
+		{ExponentialBackoff{Base: 100 * time.Millisecond}, 2, 200 * time.Millisecond},
+		{ExponentialBackoff{Base: 100 * time.Millisecond}, 4, 800 * time.Millisecond},
+		{ExponentialBackoff{Base: 100 * time.Millisecond, Max: 300 * time.Millisecond}, 4, 300 * time.Millisecond},
+		{ExponentialBackoff{}, 3, 0},
+	}
+	for _, test := range tests {
+		if got := test.backoff.NextDelay(test.attempt); got != test.want {
+			t.Errorf("%+v.NextDelay(%d) got %v, want %v", test.backoff, test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	b := ExponentialBackoff{Base: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := b.NextDelay(2); got < 200*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("NextDelay(2) got %v, want in [200ms, 300ms]", got)
+		}
+	}
+}
+
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) NextDelay(int) time.Duration { return time.Duration(b) }
+
+func TestFetchObjectRecordsBackoff(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsCreate = 1
+	tc.gf.Backoff = fixedBackoff(20 * time.Millisecond)
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if !report.success {
+		t.Fatalf("report.success got false, want true")
+	}
+	if len(report.attempts) != 2 {
+		t.Fatalf("len(report.attempts) got %d, want 2", len(report.attempts))
+	}
+	if got := report.attempts[0].backoff; got != 0 {
+		t.Errorf("attempts[0].backoff got %v, want 0", got)
+	}
+	if got := report.attempts[1].backoff; got < 20*time.Millisecond {
+		t.Errorf("attempts[1].backoff got %v, want >= 20ms", got)
+	}
+}
+
+func TestFetchObjectBackoffRespectsCancellation(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsCreate = 1
+	tc.gf.Backoff = fixedBackoff(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	started := time.Now()
+	report := tc.gf.fetchObject(ctx, j)
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("fetchObject() took %v, want it to stop when the context is done", elapsed)
+	}
+	if report.success {
+		t.Errorf("report.success got true, want false")
+	}
+	if report.err != context.DeadlineExceeded {
+		t.Errorf("report.err got %v, want %v", report.err, context.DeadlineExceeded)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	const (
+		files  = 20
+		delay  = 10 * time.Millisecond
+		budget = 50 * time.Millisecond
+	)
+	tc.gf.Retries = 100
+	tc.gf.Backoff = ExponentialBackoff{Base: delay, Max: delay, Jitter: 0.5}
+	tc.gf.RetryBudget = budget
+
+	var jobs []job
+	for i := 0; i < files; i++ {
+		jobs = append(jobs, job{filename: fmt.Sprintf("efile2-%d", i), bucket: errorBucket, object: efile2})
+	}
+	started := time.Now()
+	stats, err := tc.gf.processJobs(context.Background(), jobs)
+	if err == nil {
+		t.Fatalf("processJobs() = nil, want error")
+	}
+
+	// Every retry costs at least delay, and each worker may start one more
+	// retry before it sees that the budget is spent.
+	if max := int(budget/delay) + tc.gf.WorkerCount; stats.retries > max {
+		t.Errorf("stats.retries = %d, want at most %d", stats.retries, max)
+	}
+	if elapsed := time.Since(started); elapsed > 10*budget {
+		t.Errorf("processJobs() took %v, want the budget of %v to cut retries short", elapsed, budget)
+	}
+	for _, report := range stats.reports {
+		var berr *budgetExhaustedError
+		if !errors.As(report.err, &berr) {
+			t.Errorf("%s: err = %v, want budgetExhaustedError", report.job.filename, report.err)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	withHeader := func(v string) error {
+		gerr := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {v}}}
+		return fmt.Errorf("fetching: %w", gerr)
+	}
+	tests := []struct {
+		err  error
+		want time.Duration
+	}{
+		{nil, 0},
+		{errors.New("not a googleapi.Error"), 0},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, 0},
+		{withHeader("3"), 3 * time.Second},
+		{withHeader("-1"), 0},
+		{withHeader(now.Add(90 * time.Second).Format(http.TimeFormat)), 90 * time.Second},
+		{withHeader(now.Add(-time.Minute).Format(http.TimeFormat)), 0},
+		{withHeader("soon"), 0},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.err, now); got != test.want {
+			t.Errorf("retryAfter(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestFetchObjectHonorsRetryAfter(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "throttled", generation)] = fakeGCSResponse{content: sfile1Contents, retryAfter: "1"}
+	tc.gf.Backoff = fixedBackoff(10 * time.Millisecond)
+
+	j := job{bucket: successBucket, object: "throttled", filename: "throttled"}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if !report.success {
+		t.Fatalf("report.success got false, want true: %v", report.err)
+	}
+	if len(report.attempts) != 2 {
+		t.Fatalf("len(report.attempts) got %d, want 2", len(report.attempts))
+	}
+	if got := report.attempts[1].backoff; got < time.Second {
+		t.Errorf("attempts[1].backoff got %v, want at least the 1s of Retry-After", got)
+	}
+}
+
+func TestFetchObjectRetryAfterRespectsCancellation(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "throttled", generation)] = fakeGCSResponse{content: sfile1Contents, retryAfter: "3600"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	j := job{bucket: successBucket, object: "throttled", filename: "throttled"}
+	started := time.Now()
+	report := tc.gf.fetchObject(ctx, j)
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("fetchObject() took %v, want it to stop when the context is done", elapsed)
+	}
+	if report.err != context.DeadlineExceeded {
+		t.Errorf("report.err got %v, want %v", report.err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+// acquireBucket waits until fewer than PerBucketConcurrency allows are being
+// fetched from bucket, and returns the function that lets the next one go.
+// Buckets without a positive limit are not waited for.
+func (gf *Fetcher) acquireBucket(bucket string) (release func()) {
+	limit := gf.PerBucketConcurrency[bucket]
+	if limit <= 0 {
+		return func() {}
+	}
+	gf.mu.Lock()
+	if gf.bucketSlots == nil {
+		gf.bucketSlots = map[string]chan struct{}{}
+	}
+	slots, ok := gf.bucketSlots[bucket]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		gf.bucketSlots[bucket] = slots
+	}
+	gf.mu.Unlock()
+	slots <- struct{}{}
+	return func() { <-slots }
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyGCS records the most reads in flight at once from each bucket.
+type concurrencyGCS struct {
+	GCS
+	mu       sync.Mutex
+	inflight map[string]int
+	max      map[string]int
+}
+
+func (g *concurrencyGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	g.mu.Lock()
+	g.inflight[bucket]++
+	if g.inflight[bucket] > g.max[bucket] {
+		g.max[bucket] = g.inflight[bucket]
+	}
+	g.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	g.mu.Lock()
+	g.inflight[bucket]--
+	g.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader([]byte("content"))), nil
+}
+
+func TestProcessJobsPerBucketConcurrency(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	gcs := &concurrencyGCS{inflight: map[string]int{}, max: map[string]int{}}
+	tc.gf.GCS = gcs
+	tc.gf.WorkerCount = 8
+	tc.gf.PerBucketConcurrency = map[string]int{"one": 1, "two": 2}
+
+	var jobs []job
+	for _, bucket := range []string{"free", "one", "two"} {
+		for i := 0; i < 8; i++ {
+			jobs = append(jobs, job{bucket: bucket, object: "o", filename: fmt.Sprintf("%s/%d", bucket, i)})
+		}
+	}
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("processJobs() = %v, want nil", err)
+	}
+	for bucket, limit := range tc.gf.PerBucketConcurrency {
+		if got := gcs.max[bucket]; got > limit {
+			t.Errorf("%d reads at once from %s, want at most %d", got, bucket, limit)
+		}
+	}
+	if got := gcs.max["free"]; got <= 2 {
+		t.Errorf("at most %d reads at once from the unlimited bucket, want more than 2", got)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"io"
+)
+
+// copyObject copies src to dst like io.Copy. When CopyBufferSize is set, it
+// copies through a buffer of that size taken from a pool shared by the
+// Fetcher's workers, instead of allocating one for every object.
+func (gf *Fetcher) copyObject(dst io.Writer, src io.Reader) (int64, error) {
+	if gf.CopyBufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	buf := gf.copyBuffer()
+	defer gf.copyBuffers.Put(buf)
+	// Hide ReadFrom and WriteTo, which io.CopyBuffer would use instead of
+	// the buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// copyBuffer returns a buffer of CopyBufferSize bytes, reusing a pooled one
+// if it has that size.
+func (gf *Fetcher) copyBuffer() *[]byte {
+	if buf, ok := gf.copyBuffers.Get().(*[]byte); ok && len(*buf) == gf.CopyBufferSize {
+		return buf
+	}
+	buf := make([]byte, gf.CopyBufferSize)
+	return &buf
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchObjectOnceWithTinyCopyBuffer(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	// Smaller than the object, and not a divisor of its length, so the
+	// copy takes several reads and ends on a partial buffer.
+	tc.gf.CopyBufferSize = 4
+	tc.gf.VerifyCRC32C = true
+
+	j := job{bucket: successBucket, object: sfile3, sha256sum: fmt.Sprintf("%x", sha256.Sum256(sfile3Contents))}
+	dest := filepath.Join(tc.workDir, "sfile3.tmp")
+	for i := 0; i < 2; i++ { // The second fetch reuses the pooled buffer.
+		result := tc.gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1))
+		if result.err != nil {
+			t.Fatalf("fetchObjectOnce() err = %v, want nil", result.err)
+		}
+		if int(result.size) != len(sfile3Contents) {
+			t.Errorf("fetchObjectOnce() size = %d, want %d", result.size, len(sfile3Contents))
+		}
+		got, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatalf("ReadFile(%v) = %v", dest, err)
+		}
+		if !bytes.Equal(got, sfile3Contents) {
+			t.Errorf("ReadFile(%v) = %q, want %q", dest, got, sfile3Contents)
+		}
+	}
+}
+
+func TestCopyBufferResizes(t *testing.T) {
+	gf := &Fetcher{CopyBufferSize: 8}
+	gf.copyBuffers.Put(gf.copyBuffer())
+	gf.CopyBufferSize = 16
+	if got := len(*gf.copyBuffer()); got != 16 {
+		t.Errorf("copyBuffer() has %d bytes, want 16", got)
+	}
+}
+
+// contentGCS serves the same content for every object.
+type contentGCS struct {
+	GCS
+	content []byte
+}
+
+func (g contentGCS) NewReader(context.Context, string, string, ReadOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(g.content)), nil
+}
+
+func BenchmarkFetchObjectOnce(b *testing.B) {
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	for _, size := range []int{0, 32 * 1024} {
+		b.Run(fmt.Sprintf("CopyBufferSize=%d", size), func(b *testing.B) {
+			gf := &Fetcher{
+				GCS:            contentGCS{content: content},
+				OS:             OSFileSystem{},
+				CopyBufferSize: size,
+			}
+			j := job{bucket: successBucket, object: sfile1}
+			dest := filepath.Join(b.TempDir(), "staged")
+			b.ReportAllocs()
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if result := gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1)); result.err != nil {
+					b.Fatal(result.err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cacheTmpDir is the directory under CacheDir where entries are written
+// before being renamed into place.
+const cacheTmpDir = ".tmp"
+
+// cacheEntry is a file in the fetch cache.
+type cacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// fetchCache tracks the size and last use of the files in CacheDir, to evict
+// the least recently used ones when CacheMaxBytes is exceeded. It is loaded
+// from CacheDir on first use.
+type fetchCache struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]cacheEntry // Keyed by path.
+	total   int64
+}
+
+// cachePath returns the path of the cache entry for a generation of an
+// object.
+func (gf *Fetcher) cachePath(bucket, object string, generation int64) string {
+	return filepath.Join(gf.CacheDir, bucket, url.PathEscape(object)+"#"+strconv.FormatInt(generation, 10))
+}
+
+// cacheGeneration returns the generation that the content fetched for j is
+// cached under.
+func cacheGeneration(j job, attrs ObjectAttrs) int64 {
+	if j.generation != 0 {
+		return j.generation
+	}
+	return attrs.Generation
+}
+
+// fromCache copies the object described by j and attrs from the cache to
+// dest, and reports whether it could, along with its size and SHA-256
+// digest. An entry whose size or digests do not match is removed.
+func (gf *Fetcher) fromCache(j job, attrs ObjectAttrs, dest string) (sizeBytes, string, bool) {
+	path := gf.cachePath(j.bucket, j.object, cacheGeneration(j, attrs))
+	info, err := gf.OS.Stat(path)
+	if err != nil {
+		return 0, "", false
+	}
+	if info.Size() != attrs.Size {
+		gf.dropFromCache(path, "size mismatch")
+		return 0, "", false
+	}
+	src, err := gf.OS.Open(path)
+	if err != nil {
+		return 0, "", false
+	}
+	defer src.Close()
+	dst, err := gf.OS.Create(dest)
+	if err != nil {
+		return 0, "", false
+	}
+	h1, h256, hcrc, hx := sha1.New(), sha256.New(), crc32.New(crc32cTable), gf.newHash(j)
+	n, err := io.Copy(dst, io.TeeReader(src, io.MultiWriter(hashWriters(hx, h1, h256, hcrc)...)))
+	if err == nil && j.destDirOverride == "" {
+		err = gf.syncFile(dst, dest)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		gf.logErr("Failed to copy %q from cache, fetching instead: %v", path, err)
+		return 0, "", false
+	}
+	if err := verifyDigest(j.filename, "SHA-1", h1, j.sha1sum); err != nil {
+		gf.dropFromCache(path, err.Error())
+		return 0, "", false
+	}
+	if err := verifyDigest(j.filename, "SHA-256", h256, j.sha256sum); err != nil {
+		gf.dropFromCache(path, err.Error())
+		return 0, "", false
+	}
+	if err := verifyJobDigest(j, hx); err != nil {
+		gf.dropFromCache(path, err.Error())
+		return 0, "", false
+	}
+	if hcrc.Sum32() != attrs.CRC32C {
+		gf.dropFromCache(path, "CRC32C mismatch")
+		return 0, "", false
+	}
+
+	now := time.Now()
+	if err := gf.OS.Chtimes(path, now, now); err != nil {
+		gf.logErr("Failed to mark %q as used: %v", path, err)
+	}
+	gf.trackCacheEntry(path, n, now)
+	if gf.Verbose {
+		gf.log("Copied %s from cache", formatGCSName(j.bucket, j.object, cacheGeneration(j, attrs)))
+	}
+	return sizeBytes(n), fmt.Sprintf("%x", h256.Sum(nil)), true
+}
+
+// addToCache copies the verified download at src into the cache. Failures
+// are logged but do not fail the fetch.
+func (gf *Fetcher) addToCache(j job, attrs ObjectAttrs, src string) {
+	path := gf.cachePath(j.bucket, j.object, cacheGeneration(j, attrs))
+	tmpDir := filepath.Join(gf.CacheDir, cacheTmpDir)
+	tmp := filepath.Join(tmpDir, fmt.Sprintf("%d", rand.Int63()))
+	err := gf.OS.MkdirAll(tmpDir, os.FileMode(0777)|os.ModeDir)
+	if err == nil {
+		err = gf.OS.MkdirAll(filepath.Dir(path), os.FileMode(0777)|os.ModeDir)
+	}
+	if err == nil {
+		err = gf.copyLocalFile(src, tmp)
+	}
+	if err == nil {
+		err = gf.OS.Rename(tmp, path)
+	}
+	if err != nil {
+		gf.OS.Remove(tmp)
+		gf.logErr("Failed to add %s to cache: %v", formatGCSName(j.bucket, j.object, cacheGeneration(j, attrs)), err)
+		return
+	}
+	gf.trackCacheEntry(path, attrs.Size, time.Now())
+}
+
+// dropFromCache removes a cache entry that cannot be used.
+func (gf *Fetcher) dropFromCache(path, reason string) {
+	gf.logErr("Discarding cache entry %q: %s", path, reason)
+	if err := gf.OS.Remove(path); err != nil {
+		gf.logErr("Failed to remove cache entry %q: %v", path, err)
+	}
+	gf.cache.mu.Lock()
+	defer gf.cache.mu.Unlock()
+	if e, ok := gf.cache.entries[path]; ok {
+		gf.cache.total -= e.size
+		delete(gf.cache.entries, path)
+	}
+}
+
+// trackCacheEntry records the use of a cache entry and, if the cache has
+// outgrown CacheMaxBytes, evicts the least recently used entries.
+func (gf *Fetcher) trackCacheEntry(path string, size int64, used time.Time) {
+	if gf.CacheMaxBytes <= 0 {
+		return
+	}
+	c := &gf.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded {
+		c.entries = map[string]cacheEntry{}
+		gf.loadCache(gf.CacheDir)
+		c.loaded = true
+	}
+	if e, ok := c.entries[path]; ok {
+		c.total -= e.size
+	}
+	c.entries[path] = cacheEntry{size: size, used: used}
+	c.total += size
+
+	for c.total > gf.CacheMaxBytes && len(c.entries) > 1 {
+		var oldest string
+		for p, e := range c.entries {
+			if p != path && (oldest == "" || e.used.Before(c.entries[oldest].used)) {
+				oldest = p
+			}
+		}
+		if err := gf.OS.Remove(oldest); err != nil && !os.IsNotExist(err) {
+			gf.logErr("Failed to evict cache entry %q: %v", oldest, err)
+		}
+		c.total -= c.entries[oldest].size
+		delete(c.entries, oldest)
+	}
+}
+
+// loadCache adds the entries found under dir to gf.cache, which must be
+// locked.
+func (gf *Fetcher) loadCache(dir string) {
+	entries, err := gf.OS.ReadDir(dir)
+	if err != nil {
+		return // Nothing cached yet.
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			if path != filepath.Join(gf.CacheDir, cacheTmpDir) {
+				gf.loadCache(path)
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		gf.cache.entries[path] = cacheEntry{size: info.Size(), used: info.ModTime()}
+		gf.cache.total += info.Size()
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchCache(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.CacheDir = filepath.Join(tc.workDir, "cache")
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+	}
+
+	fetch := func() {
+		t.Helper()
+		tc.gcs.reads = nil
+		for _, j := range jobs {
+			os.Remove(filepath.Join(tc.workDir, j.filename))
+		}
+		if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+			t.Fatalf("processJobs() = %v", err)
+		}
+		for name, want := range map[string][]byte{"sfile1": sfile1Contents, "sfile2": sfile2Contents} {
+			got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, got, err, want)
+			}
+		}
+	}
+
+	fetch()
+	if got := len(tc.gcs.reads); got != 2 {
+		t.Errorf("first fetch read %d objects, want 2", got)
+	}
+
+	fetch()
+	if len(tc.gcs.reads) != 0 {
+		t.Errorf("second fetch read %v, want nothing", tc.gcs.reads)
+	}
+
+	// A corrupt entry is discarded and fetched again.
+	entry := tc.gf.cachePath(successBucket, sfile1, 0)
+	if err := ioutil.WriteFile(entry, bytes.ToUpper(sfile1Contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fetch()
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)]; got != 1 || len(tc.gcs.reads) != 1 {
+		t.Errorf("fetch with a corrupt entry read %v, want only %s", tc.gcs.reads, sfile1)
+	}
+	if got, err := ioutil.ReadFile(entry); err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("cache entry got (%q, %v), want (%q, nil)", got, err, sfile1Contents)
+	}
+}
+
+func TestFetchCacheEviction(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.CacheDir = filepath.Join(tc.workDir, "cache")
+	tc.gf.CacheMaxBytes = int64(len(sfile2Contents) + len(sfile3Contents))
+
+	for _, object := range []string{sfile1, sfile2, sfile3} {
+		if _, err := tc.gf.processJobs(context.Background(), []job{{bucket: successBucket, object: object, filename: object}}); err != nil {
+			t.Fatalf("processJobs(%s) = %v", object, err)
+		}
+	}
+
+	// sfile1 was the least recently used.
+	for object, want := range map[string]bool{sfile1: false, sfile2: true, sfile3: true} {
+		_, err := os.Stat(tc.gf.cachePath(successBucket, object, 0))
+		if got := err == nil; got != want {
+			t.Errorf("%s cached got %v, want %v", object, got, want)
+		}
+	}
+
+	// A new Fetcher picks up the existing entries.
+	gf := &Fetcher{OS: tc.gf.OS, CacheDir: tc.gf.CacheDir, CacheMaxBytes: int64(len(sfile3Contents))}
+	gf.trackCacheEntry(gf.cachePath(successBucket, sfile3, 0), int64(len(sfile3Contents)), tc.gf.cache.entries[gf.cachePath(successBucket, sfile3, 0)].used)
+	if _, err := os.Stat(gf.cachePath(successBucket, sfile2, 0)); !os.IsNotExist(err) {
+		t.Errorf("%s still cached after shrinking the cache: %v", sfile2, err)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrFetcherClosed is returned by the methods of a Fetcher that has been
+// closed.
+var ErrFetcherClosed = errors.New("fetcher closed")
+
+// Close releases the resources held by gf: it flushes Metrics, if they have
+// a Flush() error method, and closes GCS, if it is an io.Closer, as the one
+// returned by NewStorageGCS is. Fetches in progress should be done first.
+// Afterwards, gf's methods fail with ErrFetcherClosed. Closing gf again
+// does nothing.
+func (gf *Fetcher) Close() error {
+	if !gf.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	var errs []error
+	if m, ok := gf.Metrics.(interface{ Flush() error }); ok {
+		if err := m.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c, ok := gf.GCS.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkOpen returns ErrFetcherClosed if gf has been closed.
+func (gf *Fetcher) checkOpen() error {
+	if gf.closed.Load() {
+		return ErrFetcherClosed
+	}
+	return nil
+}
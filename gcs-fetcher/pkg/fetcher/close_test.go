@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// closingGCS counts the calls to Close.
+type closingGCS struct {
+	GCS
+	closes int
+}
+
+func (g *closingGCS) Close() error {
+	g.closes++
+	return nil
+}
+
+// flushingMetrics counts the calls to Flush.
+type flushingMetrics struct {
+	recordingMetrics
+	flushes int
+}
+
+func (m *flushingMetrics) Flush() error {
+	m.flushes++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	gcs := &closingGCS{GCS: tc.gcs}
+	m := &flushingMetrics{}
+	tc.gf.GCS, tc.gf.Metrics = gcs, m
+
+	var buf bytes.Buffer
+	if _, err := tc.gf.FetchToWriter(context.Background(), successBucket, sfile1, &buf); err != nil {
+		t.Fatalf("FetchToWriter() = %v, want nil", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tc.gf.Close(); err != nil {
+			t.Errorf("Close() #%d = %v, want nil", i+1, err)
+		}
+	}
+	if gcs.closes != 1 || m.flushes != 1 {
+		t.Errorf("GCS closed %d times and metrics flushed %d times, want 1 each", gcs.closes, m.flushes)
+	}
+
+	if _, err := tc.gf.FetchToWriter(context.Background(), successBucket, sfile1, io.Discard); !errors.Is(err, ErrFetcherClosed) {
+		t.Errorf("FetchToWriter() after Close = %v, want %v", err, ErrFetcherClosed)
+	}
+	if err := tc.gf.Fetch(context.Background()); !errors.Is(err, ErrFetcherClosed) {
+		t.Errorf("Fetch() after Close = %v, want %v", err, ErrFetcherClosed)
+	}
+	if _, err := tc.gf.ProcessJobsStreaming(context.Background(), []Job{{Filename: "f", Bucket: successBucket, Object: sfile1}}); !errors.Is(err, ErrFetcherClosed) {
+		t.Errorf("ProcessJobsStreaming() after Close = %v, want %v", err, ErrFetcherClosed)
+	}
+	if _, err := tc.gf.Verify(context.Background()); !errors.Is(err, ErrFetcherClosed) {
+		t.Errorf("Verify() after Close = %v, want %v", err, ErrFetcherClosed)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"mime"
+)
+
+// contentTypeHandler returns the handler in ContentTypeHandlers for
+// contentType, or nil if there is none. An exact match is preferred over
+// one for the media type without its parameters.
+func (gf *Fetcher) contentTypeHandler(contentType string) func(string) error {
+	if contentType == "" {
+		return nil
+	}
+	if h, ok := gf.ContentTypeHandlers[contentType]; ok {
+		return h
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return gf.ContentTypeHandlers[mediaType]
+	}
+	return nil
+}
+
+// handleContentType calls the handler registered for contentType, if any,
+// on finalname.
+func (gf *Fetcher) handleContentType(finalname, contentType string) error {
+	h := gf.contentTypeHandler(contentType)
+	if h == nil {
+		return nil
+	}
+	if err := h(finalname); err != nil {
+		return fmt.Errorf("handling %q of content type %q: %v", finalname, contentType, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchObjectContentTypeHandlers(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	shName := formatGCSName(successBucket, sfile1, generation)
+	tc.gcs.objects[shName] = fakeGCSResponse{content: sfile1Contents, generation: generation, contentType: "application/x-sh; charset=utf-8"}
+
+	var handled []string
+	tc.gf.ContentTypeHandlers = map[string]func(string) error{
+		"application/x-sh": func(finalname string) error {
+			handled = append(handled, finalname)
+			fi, err := os.Stat(finalname)
+			if err != nil {
+				return err
+			}
+			return os.Chmod(finalname, fi.Mode()^0111)
+		},
+	}
+
+	for _, j := range []job{
+		{bucket: successBucket, object: sfile1, generation: generation, filename: "script.sh"},
+		{bucket: successBucket, object: sfile2, filename: "other.txt"},
+	} {
+		if report := tc.gf.fetchObject(context.Background(), j); !report.success {
+			t.Fatalf("fetchObject(%s) failed: %v", j.object, report.err)
+		}
+	}
+
+	script := filepath.Join(tc.workDir, "script.sh")
+	if len(handled) != 1 || handled[0] != script {
+		t.Errorf("handler called on %q, want only %q", handled, script)
+	}
+	if fi, err := os.Stat(script); err != nil || fi.Mode().Perm()&0111 != 0 {
+		t.Errorf("Stat(%q) = %v, %v; want the exec bits toggled off", script, fi, err)
+	}
+	other := filepath.Join(tc.workDir, "other.txt")
+	if fi, err := os.Stat(other); err != nil || fi.Mode().Perm()&0111 == 0 {
+		t.Errorf("Stat(%q) = %v, %v; want the exec bits left alone", other, fi, err)
+	}
+}
+
+func TestFetchObjectContentTypeHandlerFails(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Retries = 0
+	name := formatGCSName(successBucket, sfile1, generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: sfile1Contents, generation: generation, contentType: "application/x-sh"}
+	errHandler := errors.New("handler failed")
+	tc.gf.ContentTypeHandlers = map[string]func(string) error{
+		"application/x-sh": func(string) error { return errHandler },
+	}
+
+	j := job{bucket: successBucket, object: sfile1, generation: generation, filename: "script.sh"}
+	if report := tc.gf.fetchObject(context.Background(), j); report.success {
+		t.Errorf("fetchObject() succeeded, want the handler's error")
+	}
+}
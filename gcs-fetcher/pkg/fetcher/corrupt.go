@@ -0,0 +1,59 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// corruptArchiveError is a failure to read a tarball because it ends early
+// or its compressed stream is damaged. The bytes may have been damaged in
+// transit, so the archive is downloaded again if retries are left.
+type corruptArchiveError struct {
+	archive   string // GCS name of the archive.
+	extracted int    // Files extracted before the damage was found.
+	err       error
+}
+
+func (e *corruptArchiveError) Error() string {
+	return fmt.Sprintf("archive %s is corrupt after %d files were extracted: %v", e.archive, e.extracted, e.err)
+}
+
+func (e *corruptArchiveError) Unwrap() error { return e.err }
+
+// isCorruptStream reports whether err, from decompressing or extracting a
+// tarball, means that its bytes are damaged, rather than, say, that an entry
+// could not be written. A malformed header, which an archive of another
+// format has, is not, as downloading it again would not help.
+func isCorruptStream(err error) bool {
+	var ferr flate.CorruptInputError
+	var berr bzip2.StructuralError
+	if errors.As(err, &berr) {
+		return berr != "bad magic value" && berr != "invalid compression level"
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &ferr)
+}
+
+// corruptArchive returns err, the failure to extract the archive being
+// fetched after st was extracted, as a corruptArchiveError.
+func (gf *Fetcher) corruptArchive(st stats, err error) error {
+	return &corruptArchiveError{archive: formatGCSName(gf.Bucket, gf.Object, gf.Generation), extracted: st.files, err: err}
+}
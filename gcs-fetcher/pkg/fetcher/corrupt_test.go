@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"compress/bzip2"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestIsCorruptStreamBzip2(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  bzip2.StructuralError
+		want bool
+	}{
+		{name: "damaged block", err: "block checksum mismatch", want: true},
+		{name: "damaged stream", err: "file checksum mismatch", want: true},
+		{name: "not bzip2", err: "bad magic value"},
+		{name: "bad header", err: "invalid compression level"},
+	} {
+		if got := isCorruptStream(test.err); got != test.want {
+			t.Errorf("%s: isCorruptStream(%q) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestFetchArchiveCorrupt(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		content := flattenTestArchive(t, "tgz")
+		name := formatGCSName(successBucket, "source.tgz", generation)
+		tc.gcs.objects[name] = fakeGCSResponse{content: content, truncateFirst: len(content) / 2}
+		tc.gf.Object = "source.tgz"
+		tc.gf.SourceType = "TarGzArchive"
+		tc.gf.StreamArchives = stream
+		tc.gf.Retries = 0
+
+		_, err := tc.gf.FetchWithStats(context.Background())
+		var cerr *corruptArchiveError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("FetchWithStats(StreamArchives=%v) = %v, want a corruptArchiveError", stream, err)
+		}
+		if want := formatGCSName(successBucket, "source.tgz", 0); cerr.archive != want || cerr.extracted >= len(flattenTestFiles) {
+			t.Errorf("corruptArchiveError = %+v, want %s with fewer than %d files extracted", cerr, want, len(flattenTestFiles))
+		}
+	}
+}
+
+func TestFetchArchiveRedownloadsCorruptArchive(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		content := flattenTestArchive(t, "tgz")
+		name := formatGCSName(successBucket, "source.tgz", generation)
+		tc.gcs.objects[name] = fakeGCSResponse{content: content, truncateFirst: len(content) / 2}
+		tc.gf.Object = "source.tgz"
+		tc.gf.SourceType = "TarGzArchive"
+		tc.gf.StreamArchives = stream
+
+		st, err := tc.gf.FetchWithStats(context.Background())
+		if err != nil {
+			t.Fatalf("FetchWithStats(StreamArchives=%v) = %v", stream, err)
+		}
+		if st.Files != len(flattenTestFiles) || st.Retries != 1 {
+			t.Errorf("FetchWithStats(StreamArchives=%v) = %+v, want %d files and 1 retry", stream, st, len(flattenTestFiles))
+		}
+		if got := tc.gcs.reads[name]; got != 2 {
+			t.Errorf("%s read %d times with StreamArchives=%v, want 2", name, got, stream)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExpectedFileCount(t *testing.T) {
+	manifest := `{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`
+	for _, test := range []struct {
+		name  string
+		setup func(tc *testContext)
+		files int
+	}{{
+		name: "manifest",
+		setup: func(tc *testContext) {
+			tc.gf.Bucket, tc.gf.Object = "", ""
+			tc.gf.ManifestReader = strings.NewReader(manifest)
+			tc.gf.SourceType = "Manifest"
+		},
+		files: 2,
+	}, {
+		name: "zip",
+		setup: func(tc *testContext) {
+			tc.gcs.objects[formatGCSName(successBucket, "source.zip", generation)] = fakeGCSResponse{content: permTestArchive(t, "zip")}
+			tc.gf.Object = "source.zip"
+			tc.gf.SourceType = "ZipArchive"
+		},
+		files: 3,
+	}} {
+		for _, want := range []int{test.files, test.files + 1} {
+			tc, teardown := buildManifestTestContext(t)
+			test.setup(tc)
+			tc.gf.ExpectedFileCount = want
+			var completed bool
+			tc.gf.OnComplete = func(Stats, []string) { completed = true }
+
+			err := tc.gf.Fetch(context.Background())
+			if want == test.files {
+				if err != nil || !completed {
+					t.Errorf("%s: Fetch() with ExpectedFileCount %d = %v, completed %v; want nil, true", test.name, want, err, completed)
+				}
+			} else {
+				var cerr *countMismatchError
+				if !errors.As(err, &cerr) || cerr.want != want || cerr.got != test.files {
+					t.Errorf("%s: Fetch() with ExpectedFileCount %d = %v, want a countMismatchError for %d files", test.name, want, err, test.files)
+				}
+				if completed {
+					t.Errorf("%s: OnComplete called despite the count mismatch", test.name)
+				}
+			}
+			teardown()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// decrypt returns the plaintext of the object described by j, read from
+// ciphertext, using Decryptor if one is set.
+func (gf *Fetcher) decrypt(ctx context.Context, j job, ciphertext io.Reader) (io.Reader, error) {
+	if gf.Decryptor == nil {
+		return ciphertext, nil
+	}
+	plaintext, err := gf.Decryptor(ctx, j.object, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+	return plaintext, nil
+}
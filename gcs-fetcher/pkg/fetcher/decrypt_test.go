@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// xorReader "decrypts" r by flipping every bit of it.
+type xorReader struct{ r io.Reader }
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0xff
+	}
+	return n, err
+}
+
+func TestDecryptor(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		decrypt func(io.Reader) io.Reader
+	}{
+		{"identity", func(r io.Reader) io.Reader { return r }},
+		{"xor", func(r io.Reader) io.Reader { return xorReader{r} }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			ciphertext, err := ioutil.ReadAll(test.decrypt(strings.NewReader(string(sfile1Contents))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.gcs.objects[formatGCSName(successBucket, sfile1, generation)] = fakeGCSResponse{content: ciphertext}
+			tc.gf.VerifyCRC32C = true
+			var objects []string
+			tc.gf.Decryptor = func(ctx context.Context, object string, r io.Reader) (io.Reader, error) {
+				objects = append(objects, object)
+				return test.decrypt(r), nil
+			}
+
+			// The digest is that of the plaintext.
+			j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt", sha256sum: fmt.Sprintf("%x", sha256.Sum256(sfile1Contents))}
+			report := tc.gf.fetchObject(context.Background(), j)
+			if !report.success {
+				t.Fatalf("fetchObject() failed: %v", report.err)
+			}
+			if len(objects) != 1 || objects[0] != sfile1 {
+				t.Errorf("Decryptor called for %q, want [%q]", objects, sfile1)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "localfile.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(sfile1Contents) {
+				t.Errorf("localfile.txt = %q, want %q", got, sfile1Contents)
+			}
+		})
+	}
+}
+
+func TestDecryptorErrorIsRetried(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	errKMS := errors.New("KMS unavailable")
+	var calls atomic.Int32
+	tc.gf.Decryptor = func(ctx context.Context, object string, r io.Reader) (io.Reader, error) {
+		calls.Add(1)
+		return nil, errKMS
+	}
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if report.success {
+		t.Fatalf("fetchObject() succeeded, want failure")
+	}
+	if !strings.Contains(report.err.Error(), errKMS.Error()) {
+		t.Errorf("report.err = %v, want it to contain %q", report.err, errKMS)
+	}
+	if got := calls.Load(); got != maxretries+1 {
+		t.Errorf("Decryptor called %d times, want %d", got, maxretries+1)
+	}
+	if len(report.attempts) != maxretries+1 {
+		t.Errorf("len(report.attempts) = %d, want %d", len(report.attempts), maxretries+1)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"time"
+)
+
+// dedupeKey identifies the content a job fetches. Jobs expecting different
+// digests get different keys, so each expectation is still verified.
+type dedupeKey struct {
+	bucket, object string
+	generation     int64
+	sha1sum        string
+	sha256sum      string
+	algorithm      string
+	digest         string
+}
+
+func keyOf(j job) dedupeKey {
+	return dedupeKey{bucket: j.bucket, object: j.object, generation: j.generation, sha1sum: j.sha1sum, sha256sum: j.sha256sum, algorithm: j.algorithm, digest: j.digest}
+}
+
+// dedupeJobs returns the first job for each distinct object in jobs, and the
+// remaining jobs for each object, keyed by that object.
+func dedupeJobs(jobs []job) (unique []job, dupes map[dedupeKey][]job) {
+	dupes = map[dedupeKey][]job{}
+	seen := map[dedupeKey]bool{}
+	for _, j := range jobs {
+		k := keyOf(j)
+		if seen[k] {
+			dupes[k] = append(dupes[k], j)
+			continue
+		}
+		seen[k] = true
+		unique = append(unique, j)
+	}
+	return unique, dupes
+}
+
+// linkDuplicates places the file fetched for report at the final name of
+// each job in dupes, as a hard link or, failing that, a copy. It returns a
+// report for each of dupes; if the fetch failed, they fail with its error.
+func (gf *Fetcher) linkDuplicates(report jobReport, dupes []job) []jobReport {
+	var reports []jobReport
+	for _, j := range dupes {
+		started := time.Now()
+		r := jobReport{job: j, started: started, linked: true, empty: report.empty, kept: report.kept}
+		err := report.err
+		if report.success && !report.empty && !report.kept {
+			r.finalname = gf.finalName(j)
+			err = gf.linkFile(report.finalname, r.finalname)
+			if err == nil {
+				err = gf.writeProvenance(j, r.finalname, report.sha256)
+			}
+		}
+		if err == nil {
+			r.success = true
+			r.size = report.size
+			r.sha256 = report.sha256
+			r.metadata = report.metadata
+			if gf.Verbose {
+				gf.log("Linked %q to %q", r.finalname, report.finalname)
+			}
+		}
+		r.err = err
+		r.completed = time.Now()
+		r.attempts = []jobAttempt{{started: started, duration: r.completed.Sub(started), err: err}}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// linkFile makes newpath a hard link to oldpath, or a copy of it if linking
+// fails, for example because the file system does not support hard links.
+func (gf *Fetcher) linkFile(oldpath, newpath string) error {
+	if err := gf.ensureFolders(newpath); err != nil {
+		return fmt.Errorf("creating folders for final file %q: %v", newpath, err)
+	}
+	if err := gf.OS.Link(oldpath, newpath); err == nil {
+		return nil
+	}
+	if err := gf.copyLocalFile(oldpath, newpath); err != nil {
+		return fmt.Errorf("copying %q to %q: %v", oldpath, newpath, err)
+	}
+	return nil
+}
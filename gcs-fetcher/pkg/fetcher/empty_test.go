@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessJobsSkipEmpty(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		tc.gcs.objects[formatGCSName(successBucket, "marker/", generation)] = fakeGCSResponse{content: []byte{}}
+		tc.gf.SkipEmpty = skip
+
+		jobs := []job{
+			{bucket: successBucket, object: "marker/", filename: "marker"},
+			{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		}
+		st, err := tc.gf.processJobs(context.Background(), jobs)
+		if err != nil {
+			t.Fatalf("SkipEmpty=%v: processJobs() = %v, want nil", skip, err)
+		}
+		wantSkipped := 0
+		if skip {
+			wantSkipped = 1
+		}
+		if st.skipped != wantSkipped {
+			t.Errorf("SkipEmpty=%v: skipped = %d, want %d", skip, st.skipped, wantSkipped)
+		}
+
+		info, err := os.Stat(filepath.Join(tc.workDir, "marker"))
+		switch {
+		case skip && !os.IsNotExist(err):
+			t.Errorf("SkipEmpty=true: Stat(marker) = %v, want not exist", err)
+		case !skip && (err != nil || info.Size() != 0):
+			t.Errorf("SkipEmpty=false: Stat(marker) = (%v, %v), want an empty file", info, err)
+		}
+		if _, err := os.Stat(filepath.Join(tc.workDir, "sfile1")); err != nil {
+			t.Errorf("SkipEmpty=%v: Stat(sfile1) = %v, want nil", skip, err)
+		}
+		if got := regularFiles(t, tc.gf.StagingDir); len(got) != 0 {
+			t.Errorf("SkipEmpty=%v: files left in StagingDir: %v", skip, got)
+		}
+		teardown()
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// maxBufferedEntry is the size of the largest archive entry that is read
+// into memory and handed to an extraction worker. Larger entries are written
+// as they are read.
+const maxBufferedEntry = 1024 * 1024
+
+// extractedFile is a regular file read from an archive, waiting to be
+// written.
+type extractedFile struct {
+	name string
+	mode os.FileMode
+	data []byte
+	// setOwner and setTimes apply the owner and times recorded in the
+	// archive, if they are to be preserved.
+	setOwner func() error
+	setTimes func() error
+}
+
+// extractPool writes the files read from an archive using up to WorkerCount
+// goroutines, so that the archive is read and decompressed while earlier
+// files are still being written. The first error cancels the work not yet
+// started.
+type extractPool struct {
+	gf       *Fetcher
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress *progress
+
+	todo      chan extractedFile
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+	pending   sync.WaitGroup // Files submitted but not yet written.
+
+	mu  sync.Mutex
+	err error // The first error.
+
+	// queued holds the names submitted since the last flush. It is only
+	// used by the goroutine reading the archive.
+	queued map[string]bool
+}
+
+// newExtractPool starts the extraction workers. With a WorkerCount of one or
+// less, files are written by submit itself.
+func (gf *Fetcher) newExtractPool(ctx context.Context, progress *progress) *extractPool {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &extractPool{gf: gf, ctx: ctx, cancel: cancel, progress: progress, queued: map[string]bool{}}
+	if gf.WorkerCount <= 1 {
+		return p
+	}
+	p.todo = make(chan extractedFile, gf.WorkerCount)
+	for i := 0; i < gf.WorkerCount; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for f := range p.todo {
+				if p.ctx.Err() == nil {
+					p.fail(p.write(f))
+				}
+				p.pending.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// submit writes f, or hands it to a worker. It returns the first error of
+// any file written so far, after which nothing more should be submitted.
+func (p *extractPool) submit(f extractedFile) error {
+	if p.todo == nil {
+		return p.write(f)
+	}
+	if err := p.await(f.name); err != nil {
+		return err
+	}
+	p.queued[f.name] = true
+	p.pending.Add(1)
+	select {
+	case p.todo <- f:
+	case <-p.ctx.Done():
+		p.pending.Done()
+	}
+	return p.firstErr()
+}
+
+// await waits until an earlier entry for name, if one was submitted, has
+// been written, so that a later entry for the same name replaces it.
+func (p *extractPool) await(name string) error {
+	if p.queued[name] {
+		return p.flush()
+	}
+	return p.firstErr()
+}
+
+// flush waits until every submitted file has been written, so that entries
+// which depend on them, such as hard links, can follow.
+func (p *extractPool) flush() error {
+	p.pending.Wait()
+	p.queued = map[string]bool{}
+	return p.firstErr()
+}
+
+// close stops the workers once every submitted file has been written, and
+// returns the first error.
+func (p *extractPool) close() error {
+	p.closeOnce.Do(func() {
+		if p.todo != nil {
+			close(p.todo)
+			p.workers.Wait()
+		}
+		p.cancel()
+	})
+	return p.firstErr()
+}
+
+func (p *extractPool) write(f extractedFile) error {
+	if err := p.gf.ensureFolders(f.name); err != nil {
+		return err
+	}
+	p.gf.trackPartial(f.name)
+	w, err := p.gf.OS.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.mode)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(f.data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := p.gf.syncFile(w, f.name); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	p.gf.untrackPartial(f.name)
+	// Changing the owner clears setuid and setgid bits, so the mode is set
+	// again afterwards.
+	if f.setOwner != nil {
+		if err := f.setOwner(); err != nil {
+			return err
+		}
+	}
+	if p.gf.setsModes() || f.setOwner != nil {
+		if err := p.gf.OS.Chmod(f.name, f.mode); err != nil {
+			return err
+		}
+	}
+	if f.setTimes != nil {
+		if err := f.setTimes(); err != nil {
+			return err
+		}
+	}
+	p.progress.add(int64(len(f.data)), 1)
+	return nil
+}
+
+func (p *extractPool) fail(err error) {
+	if err == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.cancel()
+	}
+}
+
+func (p *extractPool) firstErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
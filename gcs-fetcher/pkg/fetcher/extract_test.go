@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tarOfSmallFiles returns a tar archive of n small files spread over a few
+// directories.
+func tarOfSmallFiles(t testing.TB, n int) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("dir%d/file%d.txt", i%10, i)
+		content := fmt.Sprintf("content of %s", name)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUntarConcurrently(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		name, linkname, content string
+	}{
+		{name: "a/file.txt", content: "first"},
+		{name: "b/other.txt", content: "other"},
+		{name: "a/file.txt", content: "second"}, // Replaces the first.
+		{name: "hard.txt", linkname: "a/file.txt"},
+		{name: "big.bin", content: strings.Repeat("x", maxBufferedEntry+1)},
+	} {
+		h := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.content))}
+		if e.linkname != "" {
+			h = &tar.Header{Name: e.name, Typeflag: tar.TypeLink, Linkname: e.linkname}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	var files int32
+	gf := &Fetcher{OS: &fakeOS{}, WorkerCount: 4, ProgressFunc: func(_, _ int64, filesDone, _ int) {
+		atomic.StoreInt32(&files, int32(filesDone))
+	}}
+	st, err := gf.untar(context.Background(), &buf, dest)
+	if err != nil {
+		t.Fatalf("untar() = %v", err)
+	}
+	if st.files != 5 || files != 5 {
+		t.Errorf("untar() got %d files with %d reported, want 5", st.files, files)
+	}
+	for name, want := range map[string]string{
+		"a/file.txt":  "second",
+		"b/other.txt": "other",
+		"hard.txt":    "second",
+		"big.bin":     strings.Repeat("x", maxBufferedEntry+1),
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(got) != want {
+			t.Errorf("ReadFile(%s) got %d bytes, %v, want %d bytes", name, len(got), err, len(want))
+		}
+	}
+}
+
+// failingOpenFS fails to open files for writing once a number of them have
+// been opened.
+type failingOpenFS struct {
+	FileSystem
+	opened, limit int32
+}
+
+var errOpenFile = errors.New("instrumented OpenFile error")
+
+func (f *failingOpenFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if atomic.AddInt32(&f.opened, 1) > f.limit {
+		return nil, errOpenFile
+	}
+	return f.FileSystem.OpenFile(name, flag, perm)
+}
+
+func TestUntarConcurrentlyStopsOnError(t *testing.T) {
+	const n, limit = 1000, 10
+	fs := &failingOpenFS{FileSystem: NewMemFileSystem(), limit: limit}
+	gf := &Fetcher{OS: fs, WorkerCount: 4}
+	_, err := gf.untar(context.Background(), bytes.NewReader(tarOfSmallFiles(t, n)), "/dest")
+	if err != errOpenFile {
+		t.Errorf("untar() = %v, want %v", err, errOpenFile)
+	}
+	// Work queued when the error happened may still be attempted, but not
+	// the rest of the archive.
+	if opened := atomic.LoadInt32(&fs.opened); opened > limit+2*int32(gf.WorkerCount)+1 {
+		t.Errorf("untar() opened %d files after the error, want it to stop early", opened-limit)
+	}
+}
+
+func BenchmarkUntarSmallFiles(b *testing.B) {
+	archive := tarOfSmallFiles(b, 2000)
+	for _, workers := range []int{1, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dest, err := ioutil.TempDir("", "untar")
+				if err != nil {
+					b.Fatal(err)
+				}
+				gf := &Fetcher{OS: OSFileSystem{}, WorkerCount: workers}
+				if _, err := gf.untar(context.Background(), bytes.NewReader(archive), dest); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(dest)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -18,25 +18,39 @@ package fetcher
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"math/rand"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/googleapi"
 )
 
@@ -69,6 +83,16 @@ var (
 
 	robotRegex  = regexp.MustCompile(`<Details>(\S+@\S+)\s`)
 	nonHexRegex = regexp.MustCompile(`[^0-9a-f]`)
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Exit statuses used when a fetch cannot continue. A missing object gets its
+// own status so that callers can tell it apart from other failures; 2 is
+// left to the flag package's usage errors.
+const (
+	failureExitStatus  = 1
+	notFoundExitStatus = 3
 )
 
 type sizeBytes int64
@@ -79,7 +103,11 @@ type job struct {
 	bucket, object  string
 	generation      int64
 	sha1sum         string
+	sha256sum       string
+	algorithm       string // Names the hash, in Hashers, that digest is computed with.
+	digest          string
 	destDirOverride string
+	size            int64 // Expected size in bytes, if known.
 }
 
 // jobAttempt is an attempt to download a particular file, may result in
@@ -89,6 +117,9 @@ type jobAttempt struct {
 	duration   time.Duration
 	err        error
 	gcsTimeout time.Duration
+	backoff    time.Duration // Time slept before the attempt started.
+	permanent  bool          // err is not worth retrying; see isRetryable.
+	timedOut   bool          // The read was abandoned after gcsTimeout.
 }
 
 // jobReport stores all the details about the attempts to download a
@@ -101,12 +132,28 @@ type jobReport struct {
 	attempts  []jobAttempt
 	success   bool
 	finalname string
+	sha256    string // Hex-encoded digest of the file written.
 	err       error
+	linked    bool // Linked to another job's download; see DedupeIdentical.
+	unchanged bool // Already up to date; see SkipUnchanged.
+	empty     bool // A zero-length object left unwritten; see SkipEmpty.
+	kept      bool // A local file left as it was; see SkipIfNotNewer, OverwritePolicy and SkipLargeFiles.
+
+	// metadata is the object's custom metadata, for ReportWriter.
+	metadata map[string]string
 }
 
 type fetchOnceResult struct {
-	size sizeBytes
-	err  error
+	size        sizeBytes
+	sha256      string // Hex-encoded digest of the bytes written.
+	contentType string // Set when there are ContentTypeHandlers.
+	empty       bool   // The object is zero-length and dest is not wanted; see SkipEmpty.
+	tooLarge    bool   // The object is over MaxFileBytes and dest is not wanted; see SkipLargeFiles.
+	err         error
+
+	// metadata is set when the object's attrs were looked up, or for
+	// ReportWriter.
+	metadata map[string]string
 }
 
 type stats struct {
@@ -116,49 +163,661 @@ type stats struct {
 	duration    time.Duration
 	retries     int
 	gcsTimeouts int
+	timeouts    int // Attempts abandoned for reading slower than gcsTimeout.
 	success     bool
 	errs        []error
+	skipped     int // Files left out by the Include/Exclude filters, SkipEmpty, SkipIfNotNewer or OverwritePolicy.
+	unchanged   int // Files already up to date; see SkipUnchanged.
+	started     time.Time
+	reports     []jobReport
+	written     []writtenFile // Files extracted from an archive.
+}
+
+// Stats summarizes a fetch, for programs that embed Fetcher.
+type Stats struct {
+	Files     int           // Files fetched from the manifest or extracted from the archive.
+	Skipped   int           // Files left out by the Include/Exclude filters, empty, not newer, or kept, and not written.
+	Unchanged int           // Files, among Files, already up to date and not rewritten.
+	Bytes     int64         // Bytes downloaded from GCS.
+	Retries   int           // Downloads retried after a failed attempt.
+	Elapsed   time.Duration // Time the whole fetch took.
+	Errors    []error       // Why files could not be fetched, if any.
 }
 
-// OS allows us to inject dependencies to facilitate testing.
-type OS interface {
-	Rename(oldpath, newpath string) error
-	Chmod(name string, mode os.FileMode) error
-	Create(name string) (*os.File, error)
-	MkdirAll(path string, perm os.FileMode) error
-	Open(name string) (*os.File, error)
-	RemoveAll(path string) error
+// export returns the public summary of st for a fetch that began at started.
+func (st stats) export(started time.Time) Stats {
+	return Stats{
+		Files:     st.files,
+		Skipped:   st.skipped,
+		Unchanged: st.unchanged,
+		Bytes:     int64(st.size),
+		Retries:   st.retries,
+		Elapsed:   time.Since(started),
+		Errors:    st.errs,
+	}
 }
 
 // GCS allows us to inject dependencies to facilitate testing.
 type GCS interface {
-	NewReader(ctx context.Context, bucket, object string) (io.ReadCloser, error)
+	NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error)
+	// NewRangeReader reads length bytes of the object starting at offset. A
+	// negative length reads to the end of the object. Implementations that
+	// cannot serve ranges return ErrRangeNotSupported.
+	NewRangeReader(ctx context.Context, bucket, object string, offset, length int64, opts ReadOptions) (io.ReadCloser, error)
+	Attrs(ctx context.Context, bucket, object string, opts ReadOptions) (*ObjectAttrs, error)
+	// List returns a page of the objects in bucket whose names start with
+	// prefix, and the token for the next page. An empty pageToken asks for
+	// the first page, and an empty nextPageToken is returned with the last.
+	List(ctx context.Context, bucket, prefix, pageToken string, opts ReadOptions) (objects []ListedObject, nextPageToken string, err error)
+}
+
+// ErrRangeNotSupported is returned by GCS.NewRangeReader when the backend
+// cannot serve partial reads. Fetcher then falls back to a full download.
+var ErrRangeNotSupported = errors.New("range reads not supported")
+
+// ReadOptions are the per-request settings passed to GCS.
+type ReadOptions struct {
+	// UserProject is the project billed for requests to Requester Pays
+	// buckets. If empty, no user project is sent.
+	UserProject string
+
+	// Generation selects a specific generation of the object. If zero, the
+	// live generation is read.
+	Generation int64
+
+	// ReadCompressed asks for the stored bytes of objects with
+	// Content-Encoding: gzip, instead of having GCS decompress them.
+	ReadCompressed bool
+
+	// IfGenerationMatch, if positive, makes the request fail with a 412
+	// Precondition Failed unless the object's live generation is this one.
+	IfGenerationMatch int64
+}
+
+// ObjectAttrs is the subset of a GCS object's metadata used by Fetcher.
+type ObjectAttrs struct {
+	// Size is the length of the object's content in bytes.
+	Size int64
+
+	// CRC32C is the CRC32 checksum of the object's content, computed with
+	// the Castagnoli polynomial.
+	CRC32C uint32
+
+	// Generation identifies the version of the object's content.
+	Generation int64
+
+	// ContentEncoding is the object's Content-Encoding, such as "gzip".
+	ContentEncoding string
+
+	// ContentType is the object's Content-Type, such as "text/plain".
+	ContentType string
+
+	// MD5 is the MD5 digest of the object's content. It is empty for
+	// composite objects, which GCS keeps none for.
+	MD5 []byte
+
+	// Updated is when the object's metadata, or content, last changed.
+	Updated time.Time
+
+	// Metadata is the object's custom metadata, set as x-goog-meta-*
+	// headers, keyed without the prefix.
+	Metadata map[string]string
+}
+
+// ListedObject is an object returned by GCS.List.
+type ListedObject struct {
+	Name       string
+	Size       int64
+	Generation int64
 }
 
 // Fetcher is the main workhorse of this package and does all the heavy lifting.
 type Fetcher struct {
 	GCS GCS
-	OS  OS
+	OS  FileSystem
 
 	DestDir    string
 	KeepSource bool
 	StagingDir string
 
-	// mu guards CreatedDirs
-	mu          sync.Mutex
-	CreatedDirs map[string]bool
+	// FastStagingDir, if set, is where objects are downloaded to before
+	// being moved to their final names, instead of StagingDir. Pointing it
+	// at a fast file system, such as a tmpfs, speeds up downloads to a slow
+	// disk. Where it is on a different file system than the final names,
+	// each file is copied there and then removed, rather than renamed. With
+	// Atomic, each file is copied into the tree under StagingDir as it is
+	// fetched, and the tree is still moved into DestDir all-or-nothing.
+	FastStagingDir string
+
+	// TempPrefix starts the name of every file downloaded under StagingDir,
+	// so that fetchers sharing the directory can tell their files apart.
+	TempPrefix string
+
+	// StaleTempAge, if positive, has the fetch first remove files that
+	// earlier runs left under StagingDir, named with TempPrefix, and not
+	// modified for at least this long.
+	StaleTempAge time.Duration
+
+	// StreamArchives extracts tar archives as they are downloaded, instead of
+	// staging the whole archive under StagingDir first, so that peak disk
+	// use is the extracted files alone. Zip archives, which need random
+	// access, are always staged, as is any archive that KeepSource,
+	// KeepArchive, ArchiveSha256, VerifyCRC32C or CacheDir needs whole.
+	StreamArchives bool
+
+	// KeepArchive saves the downloaded archive to ArchivePath, e.g. for a
+	// build to cache it for reuse. The archive is then only extracted as
+	// well if ExtractArchive is set; without KeepArchive, it always is.
+	KeepArchive    bool
+	ArchivePath    string
+	ExtractArchive bool
+
+	// PrefetchBytes, if positive, is how far a streamed archive is read
+	// ahead of its extraction, so that the download goes on while the data
+	// before is decompressed and written, e.g. over high-latency links.
+	PrefetchBytes int
+
+	// retryPermanent makes fetchObject retry even errors that isRetryable
+	// considers permanent. It is set while fetching the manifest.
+	retryPermanent bool
+
+	// mu guards CreatedDirs, partials and partialFiles
+	mu           sync.Mutex
+	CreatedDirs  map[string]bool
+	partials     map[string]ObjectAttrs // Object each partial staging file belongs to.
+	partialFiles map[string]bool        // Files being written; see removePartials.
+
+	live   liveCounters // Read by Progress.
+	closed atomic.Bool  // Set by Close.
+	tree   string       // See TreeHash. Guarded by mu.
 
 	SourceType     string
 	Bucket, Object string
 	Generation     int64
 
+	// Manifests, if set, lists the manifests of a Manifest source, used
+	// instead of Bucket and Object. They are merged in order: where several
+	// list the same file, the last one wins. StreamManifest only applies to
+	// a single manifest.
+	Manifests []ObjectRef
+
+	// ManifestURL, if set, is an http:// or https:// URL that a Manifest
+	// source is loaded from instead of Bucket and Object. The files it lists
+	// are still fetched from GCS. HTTPClient makes the request, so a client
+	// whose Transport adds credentials can reach authenticated endpoints; if
+	// nil, http.DefaultClient is used.
+	ManifestURL string
+	HTTPClient  *http.Client
+
+	// ManifestReader, if set, supplies the JSON of a Manifest source, such
+	// as one read from stdin or a local file, instead of Bucket and Object.
+	// It is read once. The files it lists are still fetched from GCS.
+	ManifestReader io.Reader
+
+	// PreflightSample is how many of a manifest's entries, the first by
+	// destination path, Preflight looks up the objects of, after reading
+	// the manifest. They are not checked if it is zero, or if the manifest
+	// comes from ManifestReader, which can only be read once.
+	PreflightSample int
+
 	TimeoutGCS  bool
 	WorkerCount int
-	Retries     int
-	Backoff     time.Duration
-	Verbose     bool
-	Stdout      io.Writer
-	Stderr      io.Writer
+	// TimeoutRules overrides the GCS timeouts used when TimeoutGCS is set.
+	// It maps a file extension, such as ".bin", to the timeout of each try:
+	// the first entry for the first try, and so on. Tries beyond the listed
+	// ones wait up to an hour. The "" key applies to extensions without a
+	// rule of their own. Files matched by no rule get the built-in timeouts.
+	TimeoutRules map[string][]time.Duration
+	Retries      int
+	Backoff      Backoff
+	Verbose      bool
+	Stdout       io.Writer
+	Stderr       io.Writer
+
+	// RetryBudget, if positive, bounds the time spent retrying downloads,
+	// summed across every object of the fetch: the waits before retries and
+	// the retried attempts themselves. Once it is used up, failed downloads
+	// are no longer retried and fail with a budgetExhaustedError.
+	RetryBudget time.Duration
+	retryBudget retryBudget
+
+	// RetryableStatuses, if not empty, are the HTTP statuses from GCS that
+	// are retried, instead of 408, 429 and the 5xx statuses. Missing objects
+	// and the errors that need the user to act are never retried.
+	RetryableStatuses []int
+
+	// NoRetryNetworkErrors stops failures to reach GCS at all, which have
+	// no HTTP status, and timed out reads from being retried, whether or
+	// not RetryableStatuses is set. It is the inverse of a
+	// RetryNetworkErrors option so that the zero Fetcher goes on retrying
+	// them, as it always has.
+	NoRetryNetworkErrors bool
+
+	// Hashers maps the checksum algorithms that manifest entries may name in
+	// their Algorithm field to the hash functions computing them. If nil,
+	// DefaultHashers is used. A manifest with an entry naming an algorithm
+	// missing from it fails before anything is fetched.
+	Hashers map[string]func() hash.Hash
+
+	// VerifyCRC32C fetches each object's CRC32C from GCS and compares it
+	// against the downloaded content. This costs an extra metadata request
+	// per object.
+	VerifyCRC32C bool
+
+	// VerifyMD5 fetches each object's MD5 from GCS and compares it against
+	// the downloaded content, like VerifyCRC32C. Composite objects have no
+	// MD5, so they are only checked against their CRC32C, with a note in
+	// the log.
+	VerifyMD5 bool
+
+	// RequireGenerationMatch makes each object's reads fail with a
+	// generationMismatchError, rather than return bytes of another version,
+	// if it is overwritten while it is fetched. Reads are conditioned on the
+	// generation the manifest gives or, where it gives none, the one found
+	// by a metadata request made before reading, which costs an extra
+	// request per object. A pinned generation must also be the live one.
+	RequireGenerationMatch bool
+
+	// GzipObjects decides how objects stored with Content-Encoding: gzip
+	// are read; see GzipMode. Any mode but GzipTranscoded costs an extra
+	// metadata request per object. Manifests and archives are always
+	// decompressed, and archives are not streamed.
+	GzipObjects GzipMode
+
+	// Decryptor, if set, decrypts each object as it is read from GCS, for
+	// objects that are encrypted client-side. It is given every object read,
+	// including manifests and archives, and may return ciphertext unchanged
+	// for objects that are not encrypted. The SHA-1 and SHA-256 digests from
+	// a manifest, and ArchiveSha256, are checked against the plaintext, while
+	// VerifyCRC32C checks the object as stored. Decrypted objects are neither
+	// cached in CacheDir nor resumed by ResumeDownloads. An error returned by
+	// Decryptor, or by reading from its Reader, fails the attempt, which is
+	// retried like a failed download.
+	Decryptor func(ctx context.Context, object string, ciphertext io.Reader) (io.Reader, error)
+
+	// ArchiveSha256 is the expected SHA-256 digest of the archive fetched
+	// for a ZipArchive or Tar*Archive source. If set, the digest is computed
+	// while the archive is downloaded, and nothing is extracted unless it
+	// matches.
+	ArchiveSha256 string
+
+	// ChecksumSidecar names an object in Bucket, in the format written by
+	// sha256sum, that lists the SHA-256 digests of an archive's entries. If
+	// set, each entry is verified against it as it is extracted, and
+	// extraction fails at the first mismatch. Entries it does not list are
+	// extracted unverified, unless RequireSidecarEntries is set.
+	ChecksumSidecar       string
+	RequireSidecarEntries bool
+	entrySums             map[string]string // Loaded from ChecksumSidecar.
+
+	// ResumeDownloads makes a retry continue from the bytes already staged by
+	// a failed attempt, using a range read, instead of starting over. The
+	// object's size and generation are checked on every attempt, so a
+	// changed object is downloaded from scratch. This costs an extra
+	// metadata request per object.
+	ResumeDownloads bool
+
+	// Atomic makes a manifest fetch all-or-nothing: files are fetched into a
+	// tree under StagingDir, and only moved into DestDir once every file has
+	// been fetched. If any file fails, or moving them into DestDir fails
+	// part way, the staging directory is removed and DestDir is left
+	// untouched.
+	Atomic bool
+
+	// StateFile, if set, is where a manifest fetch keeps track of the files
+	// it has completed, rewriting it as it goes, so that a fetch that dies
+	// partway can be resumed: when started again, files the state file
+	// lists that are still on disk as written are not fetched again, as long
+	// as their objects are unchanged. For an entry without a generation,
+	// that takes a metadata request to compare the live object's size and
+	// CRC32C with the file, so files whose content is decrypted or
+	// decompressed are fetched again. An absent or corrupt state file means
+	// every file is fetched. It does not apply to Atomic fetches, which
+	// start afresh, nor to dry runs.
+	StateFile string
+	state     *stateTracker // Loaded from StateFile while processing jobs.
+
+	// SyncWrites makes every file written to DestDir durable before the
+	// fetch reports it: its contents are synced before it is closed and, for
+	// files fetched from a manifest, the directory it is renamed into is
+	// synced afterwards. This guards against losing files when the machine
+	// is preempted, at the cost of slower writes.
+	SyncWrites bool
+
+	// StreamManifest decodes a manifest one entry at a time and starts
+	// fetching its files while the rest is still being read, which saves
+	// time and memory on manifests with hundreds of thousands of entries.
+	// What needs every entry up front is given up: the free space check is
+	// skipped, DedupeIdentical and AutoScaleWorkers are ignored, and progress
+	// totals are unknown. An invalid entry stops further files from being
+	// queued, but the files queued before it are still fetched.
+	StreamManifest bool
+
+	// InPlaceWrite downloads each file of a manifest straight to its final
+	// name, rather than to StagingDir and then renaming it, for file
+	// systems where renames are slow or unsupported. The rename is what
+	// makes a file appear whole or not at all: without it, a file being
+	// fetched is visible while partly written, and a failed or interrupted
+	// fetch can leave it truncated, with its previous content lost.
+	// An attempt made after one that timed out is still staged, as the
+	// abandoned attempt may go on writing to the final name.
+	InPlaceWrite bool
+
+	// DedupeIdentical fetches an object only once when several manifest
+	// entries refer to the same object and generation, then hard links (or,
+	// where that fails, copies) it to each of their destinations.
+	DedupeIdentical bool
+
+	// SkipUnchanged leaves alone files already in DestDir whose content
+	// matches, for incremental fetches into a populated directory. A fetched
+	// file matches if it has the object's size and CRC32C, and any digests
+	// the manifest gives; a file extracted from a zip if it has the entry's
+	// size and CRC32, and from a tarball if it has the entry's content.
+	// Files left alone keep their mode and times. It does not apply to
+	// Atomic fetches, nor with a Decryptor.
+	SkipUnchanged bool
+
+	// SkipEmpty, if true, writes no file for a zero-length object, such as
+	// a folder marker, and counts it among the skipped files. By default an
+	// empty file is created. Staged manifests and archives are unaffected.
+	SkipEmpty bool
+
+	// SkipIfNotNewer leaves alone files already in DestDir modified no
+	// earlier than their objects were last updated in GCS, for incremental
+	// fetches, and counts them among the skipped files. Unlike
+	// SkipUnchanged, the content is not compared. It does not apply to
+	// Atomic fetches.
+	SkipIfNotNewer bool
+
+	// OverwritePolicy, if set, is called with the final name of each file
+	// that a manifest fetch or an archive extraction is about to write,
+	// and that already exists. If it returns false, the existing file is
+	// left as it is, and counted among the skipped files, e.g. to protect
+	// files an earlier build step put there. By default, every file is
+	// overwritten.
+	OverwritePolicy func(finalname string) bool
+
+	// WriteProvenance writes a sidecar next to each file fetched from an
+	// object, recording the object's gs:// URL and generation, when it was
+	// fetched and the file's SHA-256, e.g. for auditing. Files extracted
+	// from an archive get one only if ProvenanceEntries is set too.
+	// ProvenancePath, if set, maps the final name of a file to the path of
+	// its sidecar, by default the name with ".provenance" appended, and
+	// ProvenanceFormat picks the sidecar's format.
+	WriteProvenance   bool
+	ProvenanceEntries bool
+	ProvenancePath    func(finalname string) string
+	ProvenanceFormat  ProvenanceFormat
+
+	// CacheDir, if set, is a directory where fetched objects are kept, keyed
+	// by bucket, object and generation, so that later fetches of the same
+	// generation copy them instead of downloading them again. Entries are
+	// checked against the object's size and CRC32C, and any digests in the
+	// manifest, before use. CacheMaxBytes, if positive, bounds the size of
+	// the cache by evicting the least recently used entries.
+	CacheDir      string
+	CacheMaxBytes int64
+	cache         fetchCache
+
+	// OverallTimeout, if positive, bounds how long fetching the files of a
+	// manifest may take. When it expires, downloads in progress are
+	// abandoned and the fetch fails with a deadlineExceededError; files
+	// already fetched are left in DestDir, unless Atomic is set.
+	OverallTimeout time.Duration
+
+	// SkipSpaceCheck disables the check, made before writing anything, that
+	// the disk has room for everything to be fetched. The check uses the
+	// sizes recorded in the manifest or the zip central directory; tar
+	// archives are not checked, as their size is only known once fully
+	// decompressed.
+	SkipSpaceCheck bool
+
+	// DryRun resolves every object that would be fetched and reports its
+	// destination and size, without writing anything to disk.
+	DryRun bool
+
+	// Include and Exclude filter the files fetched from a manifest or prefix
+	// or extracted from an archive, using path.Match patterns against the
+	// manifest, prefix or archive-relative name. A pattern also matches everything
+	// below a matching directory. A file is fetched if it matches at least
+	// one Include pattern (or Include is empty) and no Exclude pattern.
+	Include []string
+	Exclude []string
+
+	// RewritePath, if set, maps each manifest key that passes the Include
+	// and Exclude filters to the path, relative to DestDir, that its file is
+	// written to. Entries for which it returns false are skipped. It can
+	// strip or add prefixes, flatten a layout, or select files by rules the
+	// patterns cannot express.
+	RewritePath func(manifestKey string) (destRelPath string, keep bool)
+
+	// BillingProject is the project billed for reads from Requester Pays
+	// buckets. If empty, requests are billed to the bucket owner.
+	BillingProject string
+
+	// ReportWriter, if set, receives a JSON summary of a manifest fetch,
+	// including the attempts made for each file and its custom metadata.
+	// Looking up the metadata takes an extra request for each file unless
+	// other options already need the object's attributes; if it fails, the
+	// file is reported without it. The text summary is still written to
+	// Stdout.
+	ReportWriter io.Writer
+
+	// AutoScaleWorkers chooses the number of workers for a manifest from the
+	// number and size of its files, between MinWorkers and MaxWorkers,
+	// instead of using WorkerCount. Zero MinWorkers or MaxWorkers use
+	// defaults of 1 and 200.
+	AutoScaleWorkers bool
+	MinWorkers       int
+	MaxWorkers       int
+
+	// SmallObjectSize and SmallObjectWorkers, if both positive, have the
+	// files of a manifest that it gives as SmallObjectSize bytes or smaller
+	// fetched by a pool of SmallObjectWorkers workers of their own, besides
+	// the workers fetching the other files. Fetching a tiny object takes
+	// about as long as the round trip of its request, so many more of them
+	// can be fetched at once than of large ones; this raises the
+	// concurrency for them without raising WorkerCount for large files too.
+	// It does not make a small object any cheaper to fetch than it would be
+	// for another regular worker: GCS cannot read several objects in one
+	// request, and composing them would write new objects, so each is still
+	// read on its own.
+	SmallObjectSize    int64
+	SmallObjectWorkers int
+
+	// RetryWorkers, if positive, moves the retries of downloads whose first
+	// attempt failed to a pool of that many workers of their own, so that
+	// the other workers go on with fresh files instead of backing off. Each
+	// file is still retried up to Retries times.
+	RetryWorkers int
+
+	// PerBucketConcurrency, if set, limits how many objects are fetched at
+	// once from each bucket it has a positive limit for, such as buckets
+	// with a lower request quota. Workers wait for a fetch from a bucket at
+	// its limit to finish before starting another; the total is still
+	// bounded by the number of workers. Other buckets are not limited.
+	PerBucketConcurrency map[string]int
+	bucketSlots          map[string]chan struct{} // Guarded by mu.
+
+	// Schedule decides the order in which the files of a manifest are
+	// handed to the workers; the zero value is ManifestOrder. Sorting by
+	// size uses the sizes the manifest gives, and looks up the others in
+	// GCS before anything is fetched.
+	Schedule Schedule
+
+	// MaxBytesPerSec caps the combined download rate of all workers. Zero
+	// means no limit.
+	MaxBytesPerSec int64
+	limiterOnce    sync.Once
+	limiter        *rate.Limiter
+
+	// CopyBufferSize, if positive, is the size in bytes of the buffer that
+	// each object is copied through as it is downloaded. Buffers are pooled
+	// and reused across objects, which saves allocations when many workers
+	// fetch at once. Zero uses io.Copy's default.
+	CopyBufferSize int
+	copyBuffers    sync.Pool
+
+	// PreserveModTime sets the modification time of files and directories
+	// extracted from tar archives to the one recorded in the archive. The
+	// gcs-fetcher command enables it by default.
+	PreserveModTime bool
+
+	// PreserveOwnership gives files, directories and symlinks extracted from
+	// tar archives the uid and gid recorded in the archive. It needs root;
+	// without it, or if a change of owner fails, a warning is logged and
+	// extraction goes on, unless StrictOwnership is set, which fails it.
+	PreserveOwnership bool
+	StrictOwnership   bool
+
+	// AllowSymlinks recreates symbolic links found in tar archives. When
+	// false, symlink entries are skipped with a warning.
+	AllowSymlinks bool
+
+	// Flatten writes every regular file extracted from an archive directly
+	// into DestDir, dropping the directories in its name. Directory entries
+	// are ignored, and symlinks are skipped with a warning.
+	// FlattenCollisions decides what happens when two files end up with the
+	// same name; the zero value means CollisionError.
+	Flatten           bool
+	FlattenCollisions CollisionPolicy
+
+	// NameSanitizer, if set, rewrites the name of each entry extracted from
+	// an archive before its path is chosen, e.g. WindowsNameSanitizer for
+	// names Windows cannot store. An entry it returns an error for fails
+	// the extraction. Include, Exclude and ChecksumSidecar still match the
+	// names in the archive.
+	NameSanitizer func(name string) (string, error)
+
+	// PermMask, like a umask, clears permission bits from the modes of the
+	// files and directories extracted from archives. Setuid, setgid and
+	// sticky bits are cleared as well, unless AllowSpecialBits is set.
+	PermMask         os.FileMode
+	AllowSpecialBits bool
+
+	// ForceFileMode and ForceDirMode, if nonzero, replace the modes that
+	// archives record for regular files and directories, respectively.
+	// PermMask is not applied to them.
+	ForceFileMode os.FileMode
+	ForceDirMode  os.FileMode
+
+	// DefaultDirMode, if nonzero, is the mode given to the directories
+	// created for the files extracted from a zip archive that has no entry
+	// for them, or none yet; by default they are created with 0777, less
+	// the umask. A directory entry later in the archive still sets its own
+	// mode. The mode must let the owner write, or no files can be
+	// extracted into the directories.
+	DefaultDirMode os.FileMode
+
+	// ContentTransform, if set, rewrites the content of every file fetched
+	// into DestDir, or extracted from an archive, as it is written, e.g. to
+	// redact secrets or inject build metadata. It is given the file's path
+	// relative to DestDir, or its name in the archive, and a reader of the
+	// original content, and returns a reader of the content to write
+	// instead, which is read as it is written. It may return r to leave a
+	// file alone. Checksums are verified against the original content.
+	// Transformed downloads are neither cached nor resumed, and
+	// FetchToWriter is unaffected.
+	ContentTransform func(relpath string, r io.Reader) (io.Reader, error)
+
+	// NormalizeLineEndings converts CRLF line endings to LF in the files
+	// extracted from an archive whose extension is one of TextExtensions,
+	// or DefaultTextExtensions if it is empty, as they are written, so that
+	// archives made on Windows work with Linux tools. Files whose first
+	// bytes hold a NUL are taken to be binary and left alone. Checksums are
+	// verified against the original content, as for ContentTransform.
+	NormalizeLineEndings bool
+	TextExtensions       []string
+
+	// ContentTypeHandlers maps GCS content types, such as
+	// "application/x-sh", to functions called with the final name of each
+	// object of that type once it is written, e.g. to mark it executable.
+	// A handler registered for the content type without its parameters
+	// also matches, so one for "text/plain" is called for objects of type
+	// "text/plain; charset=utf-8". An error from a handler fails the
+	// attempt. Files extracted from archives are not handled.
+	ContentTypeHandlers map[string]func(finalname string) error
+
+	// Logger, if set, receives structured records of the fetch, its
+	// attempts and its outcome instead of the text written to Stdout and
+	// Stderr.
+	Logger *slog.Logger
+
+	// Metrics, if set, receives counts and timings of the objects fetched.
+	Metrics Metrics
+
+	// ProgressFunc, if set, is called periodically while a manifest is
+	// fetched or an archive extracted, and once more when done. Totals are
+	// -1 while unknown, as when extracting a tar archive. Calls are never
+	// made concurrently, and are made without holding any lock the workers
+	// need, so a slow ProgressFunc does not hold up the fetch: reports that
+	// come due while it runs are skipped, and the next one covers them.
+	ProgressFunc func(bytesDone, bytesTotal int64, filesDone, filesTotal int)
+
+	// OnComplete, if set, is called once after a fetch succeeds, with its
+	// summary and the absolute paths of the files it wrote, sorted. It is
+	// not called when the fetch fails, nor for a dry run.
+	OnComplete func(stats Stats, files []string)
+
+	// LockfileWriter, if set, receives a line of the form
+	// "path sha256 size generation" for each file a successful fetch wrote,
+	// sorted by path. Paths are relative to DestDir, digests are those
+	// computed while fetching, and the generation is 0 for objects not
+	// pinned to one. It is not written to for a dry run.
+	LockfileWriter io.Writer
+
+	// ExpectedFileCount, if positive, is how many files a fetch must write,
+	// as a sanity check against partial archives or overly broad filters.
+	// Files left as they were by SkipUnchanged count, and a file an archive
+	// holds several entries for counts once. If the count differs, the
+	// fetch fails with a countMismatchError, though the files stay in
+	// place, and OnComplete and LockfileWriter are left alone. It is not
+	// checked for a dry run.
+	ExpectedFileCount int
+
+	// MaxFiles and MaxTotalBytes, if positive, limit how many files and
+	// links an archive may extract, and how many bytes they may hold, to
+	// guard against decompression bombs. A zip archive over either limit
+	// fails before anything is extracted; a tarball fails when the entry
+	// over the limit is reached, and what it extracted so far is removed.
+	MaxFiles      int
+	MaxTotalBytes int64
+
+	// MaxFileBytes, if positive, is the largest a single file fetched from
+	// an object or extracted from an archive may be, to keep a worker from
+	// filling its disk with an unexpectedly huge file. A file known to be
+	// larger is not downloaded at all; one that turns out larger as it is
+	// downloaded is stopped there. The fetch then fails with a
+	// fileTooLargeError, unless SkipLargeFiles is set, in which case the
+	// file is left out and counted among the skipped files.
+	MaxFileBytes   int64
+	SkipLargeFiles bool
+
+	// MaxCompressionRatio, if positive, is how many times larger than the
+	// compressed bytes it is read from an archive entry may grow, to catch
+	// a single entry that would fill the disk. Entries of up to 1 MiB are
+	// not checked. A zip entry is checked against its recorded compressed
+	// size before anything is extracted; a tarball's entry as it is
+	// written, and what the tarball extracted so far is then removed.
+	MaxCompressionRatio float64
+
+	// RecurseArchives extracts the archives found among the files extracted
+	// from an archive, each into a directory beside it named after it
+	// without its extension, such as lib/inner for lib/inner.tar.gz. The
+	// archives themselves are kept. MaxArchiveDepth bounds how deep
+	// archives nested in those are extracted; zero means 3. Nested archives
+	// are extracted with the same filters and checks as the outer one, and
+	// MaxFiles and MaxTotalBytes limit what all of them extract together.
+	RecurseArchives bool
+	MaxArchiveDepth int
+	nestedUsage     nestedUsage
+
+	// ZstdMaxWindow caps the window size, in bytes, that the zstd decoder
+	// accepts, bounding its memory use. Zero uses the decoder's default.
+	ZstdMaxWindow uint64
+	// ZstdConcurrency limits how many blocks the zstd decoder works on in
+	// parallel. Zero uses the decoder's default.
+	ZstdConcurrency int
 }
 
 type permissionError struct {
@@ -170,6 +829,143 @@ func (e *permissionError) Error() string {
 	return fmt.Sprintf("Access to bucket %s denied. You must grant Storage Object Viewer permission to %s. If you are using VPC Service Controls, you must also grant it access to your service perimeter.", e.bucket, e.robot)
 }
 
+// notFoundError indicates that an object does not exist, or not at the
+// requested generation.
+type notFoundError struct {
+	object string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("Object %s not found (it may have been deleted or the generation is stale)", e.object)
+}
+
+// generationMismatchError indicates that an object read with
+// RequireGenerationMatch was overwritten since its generation was
+// determined.
+type generationMismatchError struct {
+	object string
+}
+
+func (e *generationMismatchError) Error() string {
+	return fmt.Sprintf("Object %s changed while it was being fetched (its generation no longer matches). The source was overwritten mid-fetch; fetch again once it is no longer being written.", e.object)
+}
+
+// deadlineExceededError indicates that a fetch ran past its OverallTimeout.
+type deadlineExceededError struct {
+	timeout       time.Duration
+	fetched, want int
+}
+
+func (e *deadlineExceededError) Error() string {
+	return fmt.Sprintf("Fetch did not complete within %v (%d of %d files fetched)", e.timeout, e.fetched, e.want)
+}
+
+// countMismatchError indicates that a fetch wrote a different number of
+// files than ExpectedFileCount.
+type countMismatchError struct {
+	want, got int
+}
+
+func (e *countMismatchError) Error() string {
+	return fmt.Sprintf("Fetch wrote %d files, want %d", e.got, e.want)
+}
+
+// fetchErrors lists why the files of a manifest could not be fetched.
+type fetchErrors []error
+
+func (e fetchErrors) Error() string {
+	es := []string{fmt.Sprintf("Errors (%d):", len(e))}
+	for _, err := range e {
+		es = append(es, fmt.Sprintf(" - %s", err))
+	}
+	return strings.Join(es, "\n")
+}
+
+func (e fetchErrors) Unwrap() []error {
+	return e
+}
+
+// manifestValidationError lists the manifest entries whose SourceURL does
+// not name a GCS object, or whose checksum cannot be verified.
+type manifestValidationError struct {
+	invalid map[string]string // Why each bad entry is invalid, by its key.
+}
+
+func (e *manifestValidationError) Error() string {
+	keys := make([]string, 0, len(e.invalid))
+	for key := range e.invalid {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	es := []string{fmt.Sprintf("Invalid manifest entries (%d):", len(keys))}
+	for _, key := range keys {
+		es = append(es, fmt.Sprintf(" - %q: %s", key, e.invalid[key]))
+	}
+	return strings.Join(es, "\n")
+}
+
+// ExitError is returned by Fetch when a fetch fails in a way that the
+// gcs-fetcher command reports with a particular exit status, such as a
+// missing manifest or archive.
+type ExitError struct {
+	Status int
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitStatus returns the status the gcs-fetcher command exits with when Fetch
+// fails with err.
+func ExitStatus(err error) int {
+	var eerr *ExitError
+	if errors.As(err, &eerr) {
+		return eerr.Status
+	}
+	return exitStatus(err)
+}
+
+// exitStatus returns the status the process exits with when a fetch fails
+// with err.
+func exitStatus(err error) int {
+	var nerr *notFoundError
+	if errors.As(err, &nerr) {
+		return notFoundExitStatus
+	}
+	return failureExitStatus
+}
+
+// requesterPaysError indicates that a bucket requires the requester to pay
+// for access, and no usable billing project was given.
+type requesterPaysError struct {
+	bucket  string
+	project string
+}
+
+func (e *requesterPaysError) Error() string {
+	if e.project == "" {
+		return fmt.Sprintf("Bucket %s has Requester Pays enabled, but no billing project was specified. Set --billing_project to a project that may be billed for the download.", e.bucket)
+	}
+	return fmt.Sprintf("Bucket %s has Requester Pays enabled, and billing project %s was not accepted. Make sure the project exists and that your Cloud Build service account has serviceusage.services.use permission on it.", e.bucket, e.project)
+}
+
+// checksumError indicates that downloaded content did not match its
+// expected digest.
+type checksumError struct {
+	name      string
+	algorithm string
+	got, want string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("%s %s mismatch, got %q, want %q", e.name, e.algorithm, e.got, e.want)
+}
+
 func logit(writer io.Writer, format string, a ...interface{}) {
 	if _, err := fmt.Fprintf(writer, format+"\n", a...); err != nil {
 		log.Printf("Failed to write message: "+format, a...)
@@ -177,26 +973,39 @@ func logit(writer io.Writer, format string, a ...interface{}) {
 }
 
 func (gf *Fetcher) log(format string, a ...interface{}) {
+	if gf.Logger != nil {
+		gf.Logger.Info(fmt.Sprintf(format, a...))
+		return
+	}
 	logit(gf.Stdout, format, a...)
 }
 
 func (gf *Fetcher) logErr(format string, a ...interface{}) {
+	if gf.Logger != nil {
+		gf.Logger.Error(fmt.Sprintf(format, a...))
+		return
+	}
 	logit(gf.Stderr, format, a...)
 }
 
-func (gf *Fetcher) recordFailure(j job, started time.Time, gcsTimeout time.Duration, err error, report *jobReport) {
+func (gf *Fetcher) recordFailure(j job, started time.Time, backoff, gcsTimeout time.Duration, err error, report *jobReport) {
 	attempt := jobAttempt{
 		started:    started,
 		duration:   time.Since(started),
 		err:        err,
 		gcsTimeout: gcsTimeout,
+		backoff:    backoff,
+		permanent:  !gf.retryable(err),
 	}
 	report.success = false
 	report.err = err // Hold the latest error.
 	report.attempts = append(report.attempts, attempt)
+	gf.spendRetry(report, attempt)
 
-	isLast := len(report.attempts) == gf.Retries
-	if gf.Verbose || isLast {
+	isLast := len(report.attempts) == gf.Retries || attempt.permanent
+	if gf.Logger != nil {
+		gf.logAttempt(j, report, !isLast)
+	} else if gf.Verbose || isLast {
 		retryMsg := ", will retry"
 		if isLast {
 			retryMsg = ", will no longer retry"
@@ -205,94 +1014,247 @@ func (gf *Fetcher) recordFailure(j job, started time.Time, gcsTimeout time.Durat
 	}
 }
 
-func (gf *Fetcher) recordSuccess(j job, started time.Time, size sizeBytes, finalname string, report *jobReport) {
+func (gf *Fetcher) recordSuccess(j job, started time.Time, backoff time.Duration, size sizeBytes, finalname string, report *jobReport) {
 	attempt := jobAttempt{
 		started:  started,
 		duration: time.Since(started),
+		backoff:  backoff,
 	}
 	report.success = true
 	report.err = nil
 	report.size = size
 	report.attempts = append(report.attempts, attempt)
 	report.finalname = finalname
+	gf.spendRetry(report, attempt)
+	gf.live.files.Add(1)
 
 	mibps := math.MaxFloat64
 	if attempt.duration > 0 {
 		mibps = (float64(report.size) / 1024 / 1024) / attempt.duration.Seconds()
 	}
-	if gf.Verbose {
+	if gf.Logger != nil {
+		gf.logAttempt(j, report, false)
+	} else if gf.Verbose {
 		log.Printf("Fetched %s (%dB in %v, %.2fMiB/s)", formatGCSName(j.bucket, j.object, j.generation), report.size, attempt.duration, mibps)
 	}
 }
 
+// objectFetch is the progress of fetching the object of a job, whose
+// attempts may be made by different workers; see RetryWorkers.
+type objectFetch struct {
+	report   *jobReport
+	settled  bool // Done without downloading, for DryRun, or a file left alone.
+	done     bool // No more attempts are to be made.
+	next     int  // The number of the next attempt; 0 is the first.
+	tmpfile  string
+	resume   bool
+	timedOut bool
+	fuzz     int
+}
+
 // fetchObject is responsible for trying (and retrying) to fetch a single file
 // from GCS. It first downloads the file to a temp file, then renames it to
-// the final location and sets the permissions on the final file.
+// the final location and sets the permissions on the final file. With
+// InPlaceWrite, it downloads straight to the final location instead.
 func (gf *Fetcher) fetchObject(ctx context.Context, j job) *jobReport {
-	report := &jobReport{job: j, started: time.Now()}
-	defer func() {
-		report.completed = time.Now()
-	}()
+	f := gf.startFetch(ctx, j)
+	gf.fetchAttempts(ctx, f, gf.Retries)
+	return gf.finishFetch(f)
+}
 
-	var tmpfile string
-	var backoff time.Duration
+// startFetch starts fetching the object of j. For DryRun, and for files left
+// alone by StateFile, SkipUnchanged, SkipIfNotNewer or OverwritePolicy, the
+// fetch is done straight away.
+func (gf *Fetcher) startFetch(ctx context.Context, j job) *objectFetch {
+	report := &jobReport{job: j, started: time.Now()}
+	gf.live.active.Add(1)
 
 	// Within a manifest, multiple files may have the same SHA. This can lead
 	// to a race condition within the goworkers that are downloading the files
 	// concurrently. To mitigate this issue, we add some randomness to the name
 	// of the temp file being pulled.
-	fuzz := rand.Intn(999999)
+	f := &objectFetch{report: report, fuzz: rand.Intn(999999)}
+
+	if gf.DryRun {
+		gf.dryRunObject(ctx, j, report)
+		f.settled, f.done = true, true
+		return f
+	}
+	sums, ok := gf.completedBefore(ctx, j)
+	if !ok {
+		sums, ok = gf.unchangedObject(ctx, j)
+	}
+	if ok {
+		report.unchanged = true
+		report.sha256 = sums.sha256
+		gf.recordSuccess(j, time.Now(), 0, sizeBytes(sums.size), gf.finalName(j), report)
+		f.settled, f.done = true, true
+	} else if gf.notNewer(ctx, j) || gf.keepsExistingObject(j) || gf.skipsLarge(j) {
+		report.kept = true
+		gf.recordSuccess(j, time.Now(), 0, 0, "", report)
+		f.settled, f.done = true, true
+	}
+	return f
+}
+
+// finishFetch completes the report of f once it is done.
+func (gf *Fetcher) finishFetch(f *objectFetch) *jobReport {
+	report := f.report
+	defer func() {
+		report.completed = time.Now()
+		gf.live.active.Add(-1)
+	}()
+	if f.settled {
+		return report
+	}
+	if gf.ResumeDownloads {
+		gf.mu.Lock()
+		delete(gf.partials, f.tmpfile)
+		gf.mu.Unlock()
+	}
+	j := report.job
+	gf.metrics().ObserveFetch(formatGCSName(j.bucket, j.object, j.generation), int64(report.size), time.Since(report.started), report.err)
+	return report
+}
+
+// fetchAttempts makes the attempts of f up to the one numbered last, or up
+// to Retries if that is lower, stopping once one succeeds or retrying cannot
+// help. It marks f done if no more attempts are to be made.
+func (gf *Fetcher) fetchAttempts(ctx context.Context, f *objectFetch, last int) {
+	if f.done {
+		return
+	}
+	report := f.report
+	j := report.job
+	finalname := gf.finalName(j)
+	tmpfile, resume, timedOut, fuzz := f.tmpfile, f.resume, f.timedOut, f.fuzz
+	defer func() {
+		f.tmpfile, f.resume, f.timedOut = tmpfile, resume, timedOut
+		// The loop only ends early, short of last, when it is done.
+		f.done = f.next <= last || f.next > gf.Retries
+	}()
+	if last > gf.Retries {
+		last = gf.Retries
+	}
+
+	for ; f.next <= last; f.next++ {
+		retrynum := f.next
+		if err := ctx.Err(); err != nil {
+			// The fetch was cancelled or ran past OverallTimeout.
+			if len(report.attempts) == 0 {
+				gf.recordFailure(j, time.Now(), 0, noTimeout, err, report)
+			}
+			break
+		}
+		if n := len(report.attempts); n > 0 && report.attempts[n-1].permanent && !gf.retryPermanent {
+			break // Retrying cannot help.
+		}
+		if retrynum > 0 && !gf.retryAllowed() {
+			gf.budgetExhausted(j, report)
+			break
+		}
 
-	for retrynum := 0; retrynum <= gf.Retries; retrynum++ {
 		// Apply appropriate retry backoff.
+		var backoff time.Duration
 		if retrynum > 0 {
-			if retrynum == 1 {
-				backoff = gf.Backoff
-			} else {
-				backoff *= 2
+			gf.metrics().IncRetry()
+			sleepStarted := time.Now()
+			err := sleep(ctx, gf.retryDelay(report, retrynum))
+			backoff = time.Since(sleepStarted)
+			if err != nil {
+				gf.recordFailure(j, time.Now(), backoff, noTimeout, err, report)
+				break
 			}
-			time.Sleep(backoff)
 		}
 
 		started := time.Now()
 
-		// Download to temp location [DestDir]/[StagingDir]/[Bucket]-[Object]-[fuzz]-[retry]
+		// Download to temp location [StagingDir]/[TempPrefix][Bucket]-[Object]-[fuzz]-[retry],
+		// or under FastStagingDir if set.
 		// If fetchObjectOnceWithTimeout() times out, this file will be orphaned and we can
 		// clean it up later.
-		tmpfile = filepath.Join(gf.StagingDir, fmt.Sprintf("%s-%s-%d-%d", j.bucket, j.object, fuzz, retrynum))
+		//
+		// When resuming, a failed attempt's file is reused instead, unless
+		// that attempt timed out: its goroutine may still be writing to it.
+		// For the same reason, InPlaceWrite stages every attempt after one
+		// that timed out.
+		switch {
+		case resume:
+		case gf.InPlaceWrite && !timedOut:
+			tmpfile = finalname
+		default:
+			tmpfile = gf.tempName(j, fuzz, retrynum)
+		}
+		resume = false
 		if err := gf.ensureFolders(tmpfile); err != nil {
 			e := fmt.Errorf("creating folders for temp file %q: %v", tmpfile, err)
-			gf.recordFailure(j, started, noTimeout, e, report)
+			gf.recordFailure(j, started, backoff, noTimeout, e, report)
 			continue
 		}
 
 		allowedGCSTimeout := gf.timeout(j.filename, retrynum)
-		size, err := gf.fetchObjectOnceWithTimeout(ctx, j, allowedGCSTimeout, tmpfile)
-		if err != nil {
-			// Allow permissionError to bubble up.
+		gf.trackPartial(tmpfile)
+		result := gf.fetchObjectOnceWithTimeout(ctx, j, allowedGCSTimeout, tmpfile)
+		if err := result.err; err != nil {
+			// Bytes that failed verification are not worth resuming from.
+			_, corrupt := err.(*checksumError)
+			if _, ok := err.(*sizeMismatchError); ok {
+				corrupt = true
+			}
+			resume = gf.ResumeDownloads && err != errGCSTimeout && !corrupt
+			timedOut = timedOut || err == errGCSTimeout
+			// Allow permissionError and requesterPaysError to bubble up.
 			e := err
-			if _, ok := err.(*permissionError); !ok {
-				e = fmt.Errorf("fetching %q with timeout %v to temp file %q: %v", formatGCSName(j.bucket, j.object, j.generation), allowedGCSTimeout, tmpfile, err)
+			if !isActionableError(err) {
+				e = fmt.Errorf("fetching %q with timeout %v to temp file %q: %w", formatGCSName(j.bucket, j.object, j.generation), allowedGCSTimeout, tmpfile, err)
+			}
+			gf.recordFailure(j, started, backoff, allowedGCSTimeout, e, report)
+			if err == errGCSTimeout && ctx.Err() == nil {
+				report.attempts[len(report.attempts)-1].timedOut = true
 			}
-			gf.recordFailure(j, started, allowedGCSTimeout, e, report)
 			continue
 		}
+		if result.empty {
+			if err := gf.OS.Remove(tmpfile); err != nil {
+				e := fmt.Errorf("removing empty file %q: %v", tmpfile, err)
+				gf.recordFailure(j, started, backoff, noTimeout, e, report)
+				continue
+			}
+			gf.untrackPartial(tmpfile)
+			report.empty = true
+			gf.recordSuccess(j, started, backoff, 0, "", report)
+			break
+		}
+		if result.tooLarge {
+			if err := gf.OS.Remove(tmpfile); err != nil && !os.IsNotExist(err) {
+				e := fmt.Errorf("removing oversized file %q: %v", tmpfile, err)
+				gf.recordFailure(j, started, backoff, noTimeout, e, report)
+				continue
+			}
+			gf.untrackPartial(tmpfile)
+			report.kept = true
+			gf.recordSuccess(j, started, backoff, 0, "", report)
+			break
+		}
 
 		// Rename the temp file to the final filename
-		dest := gf.DestDir
-		if j.destDirOverride != "" {
-			dest = j.destDirOverride
-		}
-		finalname := filepath.Join(dest, j.filename)
-		if err := gf.ensureFolders(finalname); err != nil {
-			e := fmt.Errorf("creating folders for final file %q: %v", finalname, err)
-			gf.recordFailure(j, started, noTimeout, e, report)
-			continue
+		if tmpfile != finalname {
+			if err := gf.ensureFolders(finalname); err != nil {
+				e := fmt.Errorf("creating folders for final file %q: %v", finalname, err)
+				gf.recordFailure(j, started, backoff, noTimeout, e, report)
+				continue
+			}
+			if err := gf.moveFile(tmpfile, finalname); err != nil {
+				e := fmt.Errorf("renaming %q to %q: %v", tmpfile, finalname, err)
+				gf.recordFailure(j, started, backoff, noTimeout, e, report)
+				continue
+			}
 		}
-		if err := gf.OS.Rename(tmpfile, finalname); err != nil {
-			e := fmt.Errorf("renaming %q to %q: %v", tmpfile, finalname, err)
-			gf.recordFailure(j, started, noTimeout, e, report)
-			continue
+		if j.destDirOverride == "" {
+			if err := gf.syncDir(filepath.Dir(finalname)); err != nil {
+				gf.recordFailure(j, started, backoff, noTimeout, err, report)
+				continue
+			}
 		}
 
 		// TODO(jasonco): make the posix attributes match the source
@@ -302,24 +1264,65 @@ func (gf *Fetcher) fetchObject(ctx context.Context, j job) *jobReport {
 		mode := os.FileMode(0555)
 		if err := gf.OS.Chmod(finalname, mode); err != nil {
 			e := fmt.Errorf("chmod %q to %v: %v", finalname, mode, err)
-			gf.recordFailure(j, started, noTimeout, e, report)
+			gf.recordFailure(j, started, backoff, noTimeout, e, report)
+			continue
+		}
+		if err := gf.handleContentType(finalname, result.contentType); err != nil {
+			gf.recordFailure(j, started, backoff, noTimeout, err, report)
+			continue
+		}
+		if err := gf.writeProvenance(j, finalname, result.sha256); err != nil {
+			gf.recordFailure(j, started, backoff, noTimeout, err, report)
 			continue
 		}
 
-		gf.recordSuccess(j, started, size, finalname, report)
+		gf.untrackPartial(tmpfile)
+		report.sha256 = result.sha256
+		report.metadata = result.metadata
+		gf.recordSuccess(j, started, backoff, result.size, finalname, report)
 		break // Success! No more retries needed.
 	}
+}
 
-	return report
+// finalName returns the path that the object described by j is written to.
+func (gf *Fetcher) finalName(j job) string {
+	dest := gf.DestDir
+	if gf.Atomic && !gf.DryRun {
+		dest = gf.atomicDir()
+	}
+	if j.destDirOverride != "" {
+		dest = j.destDirOverride
+	}
+	return filepath.Join(dest, j.filename)
+}
+
+// dryRunObject looks up the size of the object described by j and reports
+// where it would be written, without downloading it.
+func (gf *Fetcher) dryRunObject(ctx context.Context, j job, report *jobReport) {
+	started := time.Now()
+	attrs, err := gf.GCS.Attrs(ctx, j.bucket, j.object, gf.readOptions(j))
+	if err != nil {
+		gf.recordFailure(j, started, 0, noTimeout, gf.gcsError(err, j, "fetching attributes of"), report)
+		return
+	}
+	finalname := gf.finalName(j)
+	gf.log("Would fetch %s to %q (%d bytes).", formatGCSName(j.bucket, j.object, j.generation), finalname, attrs.Size)
+	gf.recordSuccess(j, started, 0, sizeBytes(attrs.Size), finalname, report)
 }
 
 // fetchObjectOnceWithTimeout is merely mechanics to call fetchObjectOnce(),
 // using a circuit breaker pattern to timeout the call if it takes too long.
 // GCS has long tail latencies, so we retry with low timeouts on the first
 // couple of attempts. On subsequent attempts, we simply wait for a long time.
-func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeout time.Duration, dest string) (sizeBytes, error) {
+//
+// A slow read often means a degraded connection, so an abandoned attempt has
+// its context cancelled, which tears down its request. The retry then reads
+// the object from the start with a new reader.
+func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeout time.Duration, dest string) fetchOnceResult {
 	result := make(chan fetchOnceResult, 1)
 	breakerSig := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// Start the function that we want to timeout if it takes too long.
 	go func() {
@@ -329,16 +1332,16 @@ func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeou
 	// Wait to see who finshes first: function or timeout
 	select {
 	case r := <-result:
-		return r.size, r.err
+		return r
 	case <-ctx.Done():
 		close(breakerSig) // Signal fetchObjectOnce() to cancel
 		if ctx.Err() == context.DeadlineExceeded {
-			return 0, errGCSTimeout
+			return fetchOnceResult{err: errGCSTimeout}
 		}
-		return 0, ctx.Err()
+		return fetchOnceResult{err: ctx.Err()}
 	case <-time.After(timeout):
 		close(breakerSig) // Signal fetchObjectOnce() to cancel
-		return 0, errGCSTimeout
+		return fetchOnceResult{err: errGCSTimeout}
 	}
 }
 
@@ -348,21 +1351,81 @@ func (gf *Fetcher) fetchObjectOnceWithTimeout(ctx context.Context, j job, timeou
 // that no one is listening for a response anymore.
 func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, breakerSig <-chan struct{}) fetchOnceResult {
 	var result fetchOnceResult
+	if gf.limitsSize(j) && gf.tooLarge(j.size) {
+		return gf.tooLargeResult(&fileTooLargeError{name: formatGCSName(j.bucket, j.object, j.generation), size: j.size, limit: gf.MaxFileBytes})
+	}
 
-	r, err := gf.GCS.NewReader(ctx, j.bucket, j.object)
-	if err != nil {
-		// Check for AccessDenied failure here and return a useful error message on Stderr and exit immediately.
-		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusForbidden {
-			// Try to parse out the robot name.
-			match := robotRegex.FindStringSubmatch(err.Error())
-			robot := "your Cloud Build service account"
-			if len(match) == 2 {
-				robot = match[1]
-			}
-			result.err = &permissionError{bucket: j.bucket, robot: robot}
+	// Decrypted, decompressed or transformed content cannot be checked
+	// against the object's size and CRC32C, so it is neither cached nor
+	// resumed.
+	rewritten := gf.ContentTransform != nil && j.destDirOverride == ""
+	transformed := gf.Decryptor != nil || gf.gunzips(j) || rewritten
+	useCache := gf.CacheDir != "" && !transformed
+	resume := gf.ResumeDownloads && !transformed
+
+	// Look up the expected CRC32C, the object's encoding or content type,
+	// or the object a partial download or a cache entry must belong to,
+	// before reading.
+	var attrs *ObjectAttrs
+	opts := gf.readOptions(j)
+	if gf.VerifyCRC32C || gf.VerifyMD5 || resume || useCache || gf.GzipObjects != GzipTranscoded || len(gf.ContentTypeHandlers) > 0 ||
+		(gf.RequireGenerationMatch && j.generation == 0) {
+		var err error
+		attrs, err = gf.GCS.Attrs(ctx, j.bucket, j.object, opts)
+		if err != nil {
+			result.err = gf.gcsError(err, j, "fetching attributes of")
+			return result
+		}
+		result.contentType = attrs.ContentType
+		result.metadata = attrs.Metadata
+		if gf.limitsSize(j) && !transformed && gf.tooLarge(attrs.Size) {
+			return gf.tooLargeResult(&fileTooLargeError{name: formatGCSName(j.bucket, j.object, j.generation), size: attrs.Size, limit: gf.MaxFileBytes})
+		}
+		if gf.RequireGenerationMatch && j.generation == 0 {
+			// Read the version just looked up, and nothing written since.
+			opts.IfGenerationMatch = attrs.Generation
+		}
+	}
+	if attrs == nil && gf.ReportWriter != nil && j.destDirOverride == "" {
+		// Only for the report: the checks below are left as they are, and
+		// a failed lookup leaves the metadata out rather than failing the
+		// download.
+		if meta, err := gf.GCS.Attrs(ctx, j.bucket, j.object, opts); err != nil {
+			gf.logErr("WARNING: leaving the metadata of %s out of the report: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+		} else {
+			result.metadata = meta.Metadata
+		}
+	}
+	if useCache {
+		if size, digest, ok := gf.fromCache(j, *attrs, dest); ok {
+			result.size, result.sha256 = size, digest
+			result.empty = gf.skipsEmpty(j, size)
 			return result
 		}
-		result.err = fmt.Errorf("creating GCS reader for %q: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+
+	var offset int64
+	if resume {
+		offset = gf.resumeOffset(dest, *attrs)
+	}
+
+	var r io.ReadCloser
+	var err error
+	switch {
+	case offset > 0 && offset == attrs.Size:
+		// A previous attempt downloaded everything but failed afterwards.
+		r = io.NopCloser(strings.NewReader(""))
+	case offset > 0:
+		r, err = gf.GCS.NewRangeReader(ctx, j.bucket, j.object, offset, -1, opts)
+		if err == ErrRangeNotSupported {
+			offset = 0
+			r, err = gf.GCS.NewReader(ctx, j.bucket, j.object, opts)
+		}
+	default:
+		r, err = gf.GCS.NewReader(ctx, j.bucket, j.object, opts)
+	}
+	if err != nil {
+		result.err = gf.gcsError(err, j, "creating GCS reader for")
 		return result
 	}
 	defer func() {
@@ -380,19 +1443,79 @@ func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, brea
 		// Fallthrough
 	}
 
-	f, err := gf.OS.Create(dest)
+	var f File
+	if offset > 0 {
+		f, err = gf.OS.OpenFile(dest, os.O_RDWR, 0)
+	} else {
+		f, err = gf.OS.Create(dest)
+	}
 	if err != nil {
 		result.err = fmt.Errorf("creating destination file %q: %v", dest, err)
 		return result
 	}
+	defer func() {
+		// An attempt abandoned when the fetch was cancelled, or when it
+		// timed out, may finish after removePartials has run, so it removes
+		// its file itself. A file written in place is left to
+		// removePartials, as a later attempt may have replaced it.
+		if result.err != nil && ctx.Err() != nil && dest != gf.finalName(j) {
+			gf.OS.Remove(dest)
+		}
+	}()
 	defer func() {
 		if cerr := f.Close(); cerr != nil {
 			result.err = fmt.Errorf("Failed to close file %q: %v", dest, cerr)
 		}
 	}()
 
-	h := sha1.New()
-	n, err := io.Copy(f, io.TeeReader(r, h))
+	h1, h256, hcrc, hx := sha1.New(), sha256.New(), crc32.New(crc32cTable), gf.newHash(j)
+	plain := hashWriters(hx, h1, h256)
+	storedHashes := []io.Writer{hcrc}
+	var hmd5 hash.Hash
+	if gf.VerifyMD5 {
+		hmd5 = md5.New()
+		storedHashes = append(storedHashes, hmd5)
+	}
+	hashes := io.MultiWriter(append(plain, storedHashes...)...)
+	if offset > 0 {
+		// Hash the bytes already staged; this also leaves f positioned at
+		// the end, ready to append the rest.
+		if _, err := io.Copy(hashes, f); err != nil {
+			result.err = fmt.Errorf("reading partial download %q: %v", dest, err)
+			return result
+		}
+		if gf.Verbose {
+			log.Printf("Resuming %s at byte %d", formatGCSName(j.bucket, j.object, j.generation), offset)
+		}
+	}
+	// The size and CRC32C are those of the object as stored in GCS, while
+	// the digests from the manifest are those of the plaintext.
+	stored := &readTracker{r: gf.counted(gf.throttle(ctx, r))}
+	content, decompressed, err := gf.decompress(j, attrs, io.TeeReader(stored, io.MultiWriter(storedHashes...)))
+	if err != nil {
+		result.err = err
+		return result
+	}
+	plaintext, err := gf.decrypt(ctx, j, content)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	body := io.TeeReader(plaintext, io.MultiWriter(plain...))
+	if rewritten {
+		// Staged manifests and archives are left as they are.
+		if body, err = gf.transformContent(j.filename, body); err != nil {
+			result.err = fmt.Errorf("transforming %q: %v", j.filename, err)
+			return result
+		}
+	}
+	if gf.limitsSize(j) {
+		body = &maxFileReader{r: body, name: formatGCSName(j.bucket, j.object, j.generation), n: offset, limit: gf.MaxFileBytes}
+	}
+	n, err := gf.copyObject(f, body)
+	if terr, ok := err.(*fileTooLargeError); ok {
+		return gf.tooLargeResult(terr)
+	}
 	if err != nil {
 		result.err = fmt.Errorf("copying bytes from %q to %q: %v", formatGCSName(j.bucket, j.object, j.generation), dest, err)
 		return result
@@ -407,91 +1530,311 @@ func (gf *Fetcher) fetchObjectOnce(ctx context.Context, j job, dest string, brea
 		// Fallthrough
 	}
 
-	result.size = sizeBytes(n)
+	result.size = sizeBytes(offset + n)
+	result.sha256 = fmt.Sprintf("%x", h256.Sum(nil))
+
+	// Check that the whole object arrived: a stream can end early without
+	// error. Without attrs, the size from the manifest or listing is only
+	// a hint, so on a mismatch the object itself decides; it may have been
+	// overwritten since, or decompressed by GCS as it was served.
+	if attrs == nil && j.size > 0 && stored.n != j.size {
+		actual, err := gf.GCS.Attrs(ctx, j.bucket, j.object, opts)
+		if err != nil {
+			result.err = gf.gcsError(err, j, "fetching attributes of")
+			return result
+		}
+		if stored.n != actual.Size && actual.ContentEncoding != "gzip" {
+			result.err = sizeError(j.filename, stored.n, actual)
+			return result
+		}
+	}
+	if attrs != nil && !decompressed {
+		if got := offset + stored.n; got != attrs.Size {
+			result.err = sizeError(j.filename, got, attrs)
+			return result
+		}
+	}
 
-	// Verify the sha1sum before declaring success.
-	if j.sha1sum != "" {
-		got := strings.ToLower(fmt.Sprintf("%x", h.Sum(nil)))
-		want := strings.ToLower(nonHexRegex.ReplaceAllString(j.sha1sum, ""))
-		if got != want {
-			result.err = fmt.Errorf("%s SHA mismatch, got %q, want %q", j.filename, got, want)
+	// Verify the digests before declaring success.
+	if err := verifyDigest(j.filename, "SHA-1", h1, j.sha1sum); err != nil {
+		result.err = err
+		return result
+	}
+	if err := verifyDigest(j.filename, "SHA-256", h256, j.sha256sum); err != nil {
+		result.err = err
+		return result
+	}
+	if err := verifyJobDigest(j, hx); err != nil {
+		result.err = err
+		return result
+	}
+	if attrs != nil {
+		if got := hcrc.Sum32(); got != attrs.CRC32C {
+			result.err = &checksumError{
+				name:      j.filename,
+				algorithm: "CRC32C",
+				got:       fmt.Sprintf("%08x", got),
+				want:      fmt.Sprintf("%08x", attrs.CRC32C),
+			}
+			return result
+		}
+	}
+	if hmd5 != nil {
+		if err := gf.verifyMD5(j, attrs.MD5, hmd5); err != nil {
+			result.err = err
+			return result
+		}
+	}
+	if gf.skipsEmpty(j, result.size) {
+		// fetchObject removes dest, so there is nothing to sync or cache.
+		result.empty = true
+		return result
+	}
+	// Staged manifests and archives are removed once used, so only files
+	// bound for DestDir are worth syncing.
+	if j.destDirOverride == "" {
+		if err := gf.syncFile(f, dest); err != nil {
+			result.err = err
 			return result
 		}
 	}
+	if useCache {
+		gf.addToCache(j, *attrs, dest)
+	}
 	return result
 }
 
-// ensureFolders takes a full path to a filename and makes sure that
-// all the folders leading to the filename exist.
-func (gf *Fetcher) ensureFolders(filename string) error {
-	filedir := filepath.Dir(filename)
+// verifyMD5 compares the MD5 accumulated in h with want, the one GCS keeps
+// for the object of j. Composite objects have none, and are let through.
+func (gf *Fetcher) verifyMD5(j job, want []byte, h hash.Hash) error {
+	if len(want) == 0 {
+		gf.log("%s is a composite object, which has no MD5; only its CRC32C is verified.", formatGCSName(j.bucket, j.object, j.generation))
+		return nil
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return &checksumError{name: j.filename, algorithm: "MD5", got: fmt.Sprintf("%x", got), want: fmt.Sprintf("%x", want)}
+	}
+	return nil
+}
+
+// skipsEmpty reports whether SkipEmpty leaves the file for j, of the given
+// size, unwritten.
+func (gf *Fetcher) skipsEmpty(j job, size sizeBytes) bool {
+	return gf.SkipEmpty && size == 0 && j.destDirOverride == ""
+}
+
+// resumeOffset returns how many bytes of the object described by attrs are
+// already staged in dest, or 0 if dest must be downloaded from scratch. It
+// records attrs as the object dest belongs to.
+func (gf *Fetcher) resumeOffset(dest string, attrs ObjectAttrs) int64 {
 	gf.mu.Lock()
 	defer gf.mu.Unlock()
-	if _, ok := gf.CreatedDirs[filedir]; !ok {
-		if err := gf.OS.MkdirAll(filedir, os.FileMode(0777)|os.ModeDir); err != nil {
-			return fmt.Errorf("ensuring folders for %q: %v", filedir, err)
-		}
-		gf.CreatedDirs[filedir] = true
+	if gf.partials == nil {
+		gf.partials = map[string]ObjectAttrs{}
 	}
-	return nil
+	prev, ok := gf.partials[dest]
+	gf.partials[dest] = attrs
+	if !ok || prev.Generation != attrs.Generation || prev.Size != attrs.Size {
+		return 0
+	}
+	info, err := gf.OS.Stat(dest)
+	if err != nil || info.Size() > attrs.Size {
+		return 0
+	}
+	return info.Size()
 }
 
-// doWork is the worker routine. It listens for jobs, fetches the file,
-// and emits a job report. This continues until channel job is closed.
-func (gf *Fetcher) doWork(ctx context.Context, todo <-chan job, results chan<- jobReport) {
-	for j := range todo {
-		report := gf.fetchObject(ctx, j)
-		if gf.Verbose {
-			gf.log("Report: %#v", report)
+// gcsError converts an error returned by GCS into a more useful error. In
+// particular, AccessDenied failures become a permissionError and Requester
+// Pays refusals a requesterPaysError, both with actionable messages.
+func (gf *Fetcher) gcsError(err error, j job, action string) error {
+	if isRequesterPaysError(err) {
+		return &requesterPaysError{bucket: j.bucket, project: gf.BillingProject}
+	}
+	if gerr, ok := err.(*googleapi.Error); (ok && gerr.Code == http.StatusNotFound) || err == storage.ErrObjectNotExist {
+		return &notFoundError{object: formatGCSName(j.bucket, j.object, j.generation)}
+	}
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+		return &generationMismatchError{object: formatGCSName(j.bucket, j.object, j.generation)}
+	}
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusForbidden {
+		// Try to parse out the robot name.
+		match := robotRegex.FindStringSubmatch(err.Error())
+		robot := "your Cloud Build service account"
+		if len(match) == 2 {
+			robot = match[1]
 		}
-		results <- *report
+		return &permissionError{bucket: j.bucket, robot: robot}
 	}
+	return fmt.Errorf("%s %q: %w", action, formatGCSName(j.bucket, j.object, j.generation), err)
 }
 
-// processJobs is the primary concurrency mechanics for Fetcher.
-// This method spins up a set of worker goroutines, creates a
-// goroutine to send all the jobs to the workers, then waits for
-// all the jobs to complete. It also compiles and returns final
-// statistics for the jobs.
-func (gf *Fetcher) processJobs(ctx context.Context, jobs []job) stats {
-	workerCount := gf.WorkerCount
-	if len(jobs) < workerCount {
-		workerCount = len(jobs)
+// isActionableError reports whether err needs the user to change their
+// configuration or source, rather than being a transient failure.
+func isActionableError(err error) bool {
+	switch err.(type) {
+	case *permissionError, *requesterPaysError, *notFoundError, *generationMismatchError:
+		return true
 	}
-	todo := make(chan job, workerCount)
-	results := make(chan jobReport, workerCount)
-	stats := stats{workers: workerCount, files: len(jobs), success: true}
+	return false
+}
 
-	// Spin up our workers.
-	var wg sync.WaitGroup
-	for i := 0; i < workerCount; i++ {
-		wg.Add(1)
-		go func() {
-			gf.doWork(ctx, todo, results)
-			wg.Done()
-		}()
+// isRetryable reports whether another attempt might succeed where err
+// failed. GCS rate limiting and server errors are transient; bad requests,
+// missing objects and the errors that need the user to act are not. Anything
+// else, such as a network timeout or a file that couldn't be created, is
+// retried.
+func isRetryable(err error) bool {
+	if neverRetried(err) {
+		return false
 	}
-
-	// Queue the jobs.
-	started := time.Now()
-	var qwg sync.WaitGroup
-	qwg.Add(1)
-	go func() {
-		for _, j := range jobs {
-			todo <- j
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
 		}
-		qwg.Done()
-	}()
+		return gerr.Code >= http.StatusInternalServerError
+	}
+	return true
+}
 
-	// Consume the reports.
-	failed := false
-	for n := 0; n < len(jobs); n++ {
-		report := <-results
-		if !report.success {
-			failed = true
-		}
-		stats.size += report.size
-		lastIndex := len(report.attempts) - 1
+// neverRetried reports whether err is one that no retry policy retries:
+// the errors that need the user to act, missing objects, cancellation and
+// archives that cannot be extracted.
+func neverRetried(err error) bool {
+	if err == nil || isActionableError(err) {
+		return true
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var xerr *extractError
+	var terr *fileTooLargeError
+	return errors.As(err, &xerr) || errors.As(err, &terr)
+}
+
+// isRequesterPaysError reports whether err is GCS refusing a request because
+// the bucket has Requester Pays enabled and no user project was given.
+func isRequesterPaysError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok || gerr.Code != http.StatusBadRequest {
+		return false
+	}
+	for _, e := range gerr.Errors {
+		if e.Reason == "userProjectMissing" {
+			return true
+		}
+	}
+	msg := strings.ToLower(gerr.Message + gerr.Body)
+	return strings.Contains(msg, "requester pays") || strings.Contains(msg, "userprojectmissing")
+}
+
+// readOptions returns the ReadOptions for requests made by gf for j.
+func (gf *Fetcher) readOptions(j job) ReadOptions {
+	opts := ReadOptions{UserProject: gf.BillingProject, Generation: j.generation, ReadCompressed: gf.GzipObjects != GzipTranscoded}
+	if gf.RequireGenerationMatch {
+		opts.IfGenerationMatch = j.generation
+	}
+	return opts
+}
+
+// verifyDigest compares the digest accumulated in h against the hex-encoded
+// want. An empty want means no digest was supplied and always verifies.
+func verifyDigest(filename, algorithm string, h hash.Hash, want string) error {
+	if want == "" {
+		return nil
+	}
+	got := strings.ToLower(fmt.Sprintf("%x", h.Sum(nil)))
+	want = nonHexRegex.ReplaceAllString(strings.ToLower(want), "")
+	if got != want {
+		return &checksumError{name: filename, algorithm: algorithm, got: got, want: want}
+	}
+	return nil
+}
+
+// ensureFolders takes a full path to a filename and makes sure that
+// all the folders leading to the filename exist.
+func (gf *Fetcher) ensureFolders(filename string) error {
+	filedir := filepath.Dir(filename)
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	if gf.CreatedDirs == nil {
+		gf.CreatedDirs = map[string]bool{}
+	}
+	if _, ok := gf.CreatedDirs[filedir]; !ok {
+		if err := gf.OS.MkdirAll(filedir, os.FileMode(0777)|os.ModeDir); err != nil {
+			return fmt.Errorf("ensuring folders for %q: %v", filedir, err)
+		}
+		gf.CreatedDirs[filedir] = true
+	}
+	return nil
+}
+
+// doWork is the worker routine. It listens for jobs, fetches the file,
+// and emits a job report. This continues until channel job is closed. If
+// retries is not nil, it makes only the first attempt at each file, and
+// hands those that must be retried over to retries.
+func (gf *Fetcher) doWork(ctx context.Context, todo <-chan job, results chan<- jobReport, retries *retryPool) {
+	for j := range todo {
+		release := gf.acquireBucket(j.bucket)
+		f := gf.startFetch(ctx, j)
+		if retries == nil {
+			gf.fetchAttempts(ctx, f, gf.Retries)
+		} else if gf.fetchAttempts(ctx, f, 0); !f.done {
+			release()
+			retries.add(f)
+			continue
+		}
+		release()
+		report := gf.finishFetch(f)
+		if gf.Verbose {
+			gf.log("Report: %#v", report)
+		}
+		results <- *report
+	}
+}
+
+// processJobs is the primary concurrency mechanics for Fetcher.
+// This method starts the jobs with startJobs, then waits for
+// all the jobs to complete. It also compiles and returns final
+// statistics for the jobs. If any job fails, the error is a fetchErrors
+// listing why; if OverallTimeout expires first, the statistics cover the jobs
+// completed so far and the error is a deadlineExceededError.
+func (gf *Fetcher) processJobs(ctx context.Context, jobs []job) (stats, error) {
+	parent := ctx
+	if gf.OverallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gf.OverallTimeout)
+		defer cancel()
+	}
+
+	gf.state = gf.loadState()
+	reports, jobs, skipped, workerCount := gf.startJobs(ctx, jobs)
+	stats := stats{workers: workerCount, files: len(jobs), skipped: skipped, success: true, started: time.Now()}
+	failed := gf.consumeReports(reports, gf.newProgress(manifestSize(jobs), len(jobs)), &stats)
+	return gf.finishJobs(ctx, parent, stats, failed)
+}
+
+// consumeReports adds the reports received until the channel is closed to
+// stats, and to the StateFile, and reports whether any of them failed.
+func (gf *Fetcher) consumeReports(reports <-chan jobReport, progress *progress, stats *stats) (failed bool) {
+	for report := range reports {
+		if !report.success {
+			failed = true
+		}
+		progress.add(reportedSize(report), 1)
+		stats.reports = append(stats.reports, report)
+		gf.recordState(report)
+		if report.empty || report.kept {
+			stats.skipped++
+		}
+		if report.unchanged {
+			stats.unchanged++
+		} else if !report.linked {
+			stats.size += report.size
+		}
+		lastIndex := len(report.attempts) - 1
 		stats.retries += lastIndex // First attempt is not considered a "retry".
 		finalAttempt := report.attempts[lastIndex]
 		stats.duration += finalAttempt.duration
@@ -502,21 +1845,256 @@ func (gf *Fetcher) processJobs(ctx context.Context, jobs []job) stats {
 			if attempt.gcsTimeout > noTimeout {
 				stats.gcsTimeouts++
 			}
+			if attempt.timedOut {
+				stats.timeouts++
+			}
+		}
+	}
+	gf.saveState()
+	progress.done()
+	return failed
+}
+
+// reportedSize returns the bytes that report accounts for towards the
+// progress total: the size the manifest gives its object, which is counted
+// in the total, even if fewer bytes were written because the file was
+// skipped, kept, linked or found unchanged.
+func reportedSize(report jobReport) int64 {
+	if size := int64(report.size); size > report.job.size {
+		return size
+	}
+	return report.job.size
+}
+
+// finishJobs completes the statistics of jobs fetched with ctx, derived
+// from parent by OverallTimeout, writes the report, and returns the error
+// for processJobs to return. If ctx was cancelled, it first removes the
+// files that the jobs left partly written.
+func (gf *Fetcher) finishJobs(ctx, parent context.Context, stats stats, failed bool) (_ stats, err error) {
+	gf.removePartials(ctx)
+	stats.duration = time.Since(stats.started)
+	stats.success = !failed
+	var deadlineErr error
+	if failed && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		fetched := 0
+		for _, report := range stats.reports {
+			if report.success {
+				fetched++
+			}
 		}
+		deadlineErr = &deadlineExceededError{timeout: gf.OverallTimeout, fetched: fetched, want: stats.files}
+		stats.errs = append(stats.errs, deadlineErr)
+	}
+	if err := gf.writeReport(stats); err != nil {
+		gf.logErr("Failed to write report: %v", err)
 	}
-	qwg.Wait()
-	close(results)
-	close(todo)
-	wg.Wait()
 
 	if failed {
-		stats.success = false
 		gf.logErr("Failed to download at least one file. Cannot continue.")
-		os.Exit(1)
+		if gf.Atomic {
+			// Roll back: nothing has been moved into DestDir yet.
+			if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
+				gf.logErr("Failed to remove staging dir %q: %v", gf.StagingDir, err)
+			}
+		}
+		if deadlineErr != nil {
+			return stats, deadlineErr
+		}
+		return stats, fetchErrors(stats.errs)
+	}
+	return stats, nil
+}
+
+// startJobs applies the Include/Exclude filters, RewritePath and
+// DedupeIdentical to jobs, then spins up a set of worker goroutines to fetch
+// them. It returns a channel that receives the report of each job, including
+// the duplicates linked to a fetched job, as it completes, and is closed once
+// all are done; the caller must drain it. It also returns the jobs that
+// passed the filters, how many did not, and the number of workers.
+func (gf *Fetcher) startJobs(ctx context.Context, jobs []job) (reports <-chan jobReport, included []job, skipped, workerCount int) {
+	included, skipped = gf.filterJobs(jobs)
+	queued := included
+	var dupes map[dedupeKey][]job
+	if gf.DedupeIdentical && !gf.DryRun {
+		queued, dupes = dedupeJobs(included)
+	}
+	queued = gf.scheduleJobs(ctx, queued)
+
+	queued, small := gf.splitSmallJobs(queued)
+	workerCount = gf.WorkerCount
+	if gf.AutoScaleWorkers {
+		workerCount = gf.autoScaleWorkers(queued)
+	}
+	if len(queued) < workerCount {
+		workerCount = len(queued)
+	}
+	queues := []jobQueue{queueJobs(queued, workerCount)}
+	if len(small) > 0 {
+		smallWorkers := gf.SmallObjectWorkers
+		if len(small) < smallWorkers {
+			smallWorkers = len(small)
+		}
+		queues = append(queues, queueJobs(small, smallWorkers))
+		workerCount += smallWorkers
+	}
+	if gf.RetryWorkers > 0 && gf.Retries > 0 {
+		workerCount += gf.RetryWorkers
+	}
+	return gf.runJobs(ctx, queues, dupes), included, skipped, workerCount
+}
+
+// jobQueue is a channel of jobs to fetch, and how many workers fetch them.
+type jobQueue struct {
+	todo    <-chan job
+	workers int
+}
+
+// queueJobs returns a jobQueue of workers that jobs are sent to, in order.
+func queueJobs(jobs []job, workers int) jobQueue {
+	todo := make(chan job, workers)
+	go func() {
+		for _, j := range jobs {
+			todo <- j
+		}
+		close(todo)
+	}()
+	return jobQueue{todo: todo, workers: workers}
+}
+
+// runJobs spins up the workers of each of queues to fetch the jobs received
+// from it. It returns a channel that receives the report of each job,
+// followed by those of its duplicates in dupes once they are linked to it,
+// and is closed once every queue is closed and every job is done.
+func (gf *Fetcher) runJobs(ctx context.Context, queues []jobQueue, dupes map[dedupeKey][]job) <-chan jobReport {
+	workerCount := gf.RetryWorkers
+	for _, q := range queues {
+		workerCount += q.workers
+	}
+	results := make(chan jobReport, workerCount)
+	out := make(chan jobReport, workerCount)
+
+	// Spin up our workers.
+	var retries *retryPool
+	if gf.RetryWorkers > 0 && gf.Retries > 0 {
+		retries = gf.newRetryPool(ctx, results)
+	}
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		for i := 0; i < q.workers; i++ {
+			wg.Add(1)
+			go func(todo <-chan job) {
+				gf.doWork(ctx, todo, results, retries)
+				wg.Done()
+			}(q.todo)
+		}
+	}
+	go func() {
+		wg.Wait()
+		if retries != nil {
+			retries.close()
+		}
+		close(results)
+	}()
+
+	// Pass on the reports, linking duplicates as their original completes.
+	go func() {
+		for report := range results {
+			out <- report
+			for _, r := range gf.linkDuplicates(report, dupes[keyOf(report.job)]) {
+				out <- r
+			}
+		}
+		close(out)
+	}()
+	return out
+}
+
+// manifestJobs creates a job for each file listed in a manifest. If any
+// entry's SourceURL does not name a GCS object, or its checksum algorithm is
+// unknown, it returns a manifestValidationError listing every such entry, so
+// that nothing is fetched from a bad manifest.
+func (gf *Fetcher) manifestJobs(files map[string]common.ManifestItem) ([]job, error) {
+	var jobs []job
+	invalid := map[string]string{}
+	for filename, info := range files {
+		j, problem := gf.manifestJob(filename, info)
+		if problem != "" {
+			invalid[filename] = problem
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if len(invalid) > 0 {
+		return nil, &manifestValidationError{invalid: invalid}
+	}
+	return jobs, nil
+}
+
+// manifestJob creates the job for a file listed in a manifest, or describes
+// why its entry is invalid.
+func (gf *Fetcher) manifestJob(filename string, info common.ManifestItem) (j job, problem string) {
+	if info.SourceURL == "" {
+		return j, "no sourceUrl"
+	}
+	bucket, object, generation, err := common.ParseBucketObject(info.SourceURL)
+	if err != nil || bucket == "" || object == "" {
+		return j, fmt.Sprintf("sourceUrl %q is not a gs://bucket/object URL", info.SourceURL)
+	}
+	if info.Generation != 0 {
+		generation = info.Generation
+	}
+	if problem := gf.checksumProblem(info.Algorithm, info.Digest); problem != "" {
+		return j, problem
+	}
+	return job{
+		filename:   filename,
+		bucket:     bucket,
+		object:     object,
+		generation: generation,
+		sha1sum:    info.Sha1Sum,
+		sha256sum:  info.Sha256Sum,
+		algorithm:  info.Algorithm,
+		digest:     info.Digest,
+		size:       info.Size,
+	}, ""
+}
+
+// filterJobs returns the jobs that pass the Include and Exclude filters and
+// are kept by RewritePath, with their filenames rewritten, and how many did
+// not.
+func (gf *Fetcher) filterJobs(jobs []job) (included []job, skipped int) {
+	if len(gf.Include) == 0 && len(gf.Exclude) == 0 && gf.RewritePath == nil {
+		return jobs, 0
+	}
+	for _, j := range jobs {
+		if !gf.included(j.filename) {
+			skipped++
+			continue
+		}
+		if gf.RewritePath != nil {
+			name, keep := gf.RewritePath(j.filename)
+			if !keep {
+				skipped++
+				continue
+			}
+			j.filename = name
+		}
+		included = append(included, j)
 	}
+	return included, skipped
+}
 
-	stats.duration = time.Since(started)
-	return stats
+// manifestSize returns the total size of jobs as recorded in the manifest,
+// or -1 if any size is missing.
+func manifestSize(jobs []job) int64 {
+	var total int64
+	for _, j := range jobs {
+		if j.size <= 0 {
+			return -1
+		}
+		total += j.size
+	}
+	return total
 }
 
 // getTimeout returns the GCS timeout that should be used for a given
@@ -528,6 +2106,17 @@ func (gf *Fetcher) timeout(filename string, retrynum int) time.Duration {
 		return defaultTimeout
 	}
 
+	rule, ok := gf.TimeoutRules[filepath.Ext(filename)]
+	if !ok {
+		rule, ok = gf.TimeoutRules[""]
+	}
+	if ok {
+		if retrynum < len(rule) {
+			return rule[retrynum]
+		}
+		return defaultTimeout
+	}
+
 	// Use short timeouts for source code, longer for non-source
 	if sourceExt[filepath.Ext(filename)] {
 		if timeout, ok := sourceTimeout[retrynum]; ok {
@@ -541,79 +2130,189 @@ func (gf *Fetcher) timeout(filename string, retrynum int) time.Duration {
 	return defaultTimeout
 }
 
-// fetchFromManifest is used when downloading source based on a manifest file.
-// It is responsible for fetching the manifest file, decoding the JSON, and
-// assembling the list of jobs to process (i.e., files to download).
-func (gf *Fetcher) fetchFromManifest(ctx context.Context) (err error) {
-	started := time.Now()
-	gf.log("Fetching manifest %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
-
+// downloadManifest fetches the manifest file ref into the staging directory
+// and decodes it, calling each for every entry. It also returns how long the
+// successful download took.
+func (gf *Fetcher) downloadManifest(ctx context.Context, ref ObjectRef, each func(string, common.ManifestItem)) (duration time.Duration, err error) {
 	// Download the manifest file from GCS.
 	manifestDir := gf.StagingDir
 	j := job{
-		filename:        gf.Object,
-		bucket:          gf.Bucket,
-		object:          gf.Object,
-		generation:      gf.Generation,
+		filename:        ref.Object,
+		bucket:          ref.Bucket,
+		object:          ref.Object,
+		generation:      ref.Generation,
 		destDirOverride: manifestDir,
 	}
 	// Override the retry/backoff to span an up-to-11 second eventual consistency
 	// issue on new project creation. We'll only do this for the first file
 	// (the manifest), and then drop back to the original retry/backoff.
+	// The new project may also not see the manifest, or have access to it,
+	// straight away, so errors that are otherwise permanent are retried too.
 	oretries, obackoff := gf.Retries, gf.Backoff
-	gf.Retries, gf.Backoff = 6, 1*time.Second // Yields 1s, 2s, 4s, 8s, 16s
+	gf.Retries, gf.Backoff = 6, ExponentialBackoff{Base: 1 * time.Second} // Yields 1s, 2s, 4s, 8s, 16s
+	gf.retryPermanent = true
 	report := gf.fetchObject(ctx, j)
 	gf.Retries, gf.Backoff = oretries, obackoff
+	gf.retryPermanent = false
 	if !report.success {
-		if err, ok := report.err.(*permissionError); ok {
-			gf.logErr(err.Error())
-			os.Exit(1)
+		if isActionableError(report.err) {
+			if gf.Logger != nil {
+				gf.Logger.Error("cannot fetch manifest", append(objectAttrs(j), errorAttrs(report.err)...)...)
+			} else {
+				gf.logErr(report.err.Error())
+			}
+			return 0, &ExitError{Status: exitStatus(report.err), Err: report.err}
 		}
-		return fmt.Errorf("failed to download manifest %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
+		return 0, fmt.Errorf("failed to download manifest %s: %v", formatGCSName(ref.Bucket, ref.Object, ref.Generation), report.err)
 	}
+	duration = report.attempts[len(report.attempts)-1].duration
 
 	// Decode the JSON manifest
 	manifestFile := filepath.Join(manifestDir, j.filename)
 	r, err := gf.OS.Open(manifestFile)
 	if err != nil {
-		return fmt.Errorf("opening manifest file %q: %v", manifestFile, err)
+		return 0, fmt.Errorf("opening manifest file %q: %v", manifestFile, err)
 	}
 	defer func() {
 		if cerr := r.Close(); cerr != nil {
 			err = fmt.Errorf("Failed to close file %q: %v", manifestFile, cerr)
 		}
 	}()
-	var files map[string]common.ManifestItem
-	if err := json.NewDecoder(r).Decode(&files); err != nil {
-		return fmt.Errorf("decoding JSON from manifest file %q: %v", manifestFile, err)
+	if err := decodeManifest(r, each); err != nil {
+		return 0, fmt.Errorf("decoding JSON from manifest file %q: %v", manifestFile, err)
 	}
+	return duration, nil
+}
 
-	// Create the jobs
-	var jobs []job
-	for filename, info := range files {
-		bucket, object, generation, err := common.ParseBucketObject(info.SourceURL)
+// readManifest decodes the manifest ref directly from GCS, or the one from
+// ManifestReader or at ManifestURL if set, without staging it on disk and
+// without retries, calling each for every entry.
+func (gf *Fetcher) readManifest(ctx context.Context, ref ObjectRef, each func(string, common.ManifestItem)) (err error) {
+	if gf.ManifestReader != nil {
+		if err := decodeManifest(gf.ManifestReader, each); err != nil {
+			return fmt.Errorf("decoding JSON from manifest file: %v", err)
+		}
+		return nil
+	}
+	if gf.ManifestURL != "" {
+		return gf.readManifestURL(ctx, each)
+	}
+	j := job{bucket: ref.Bucket, object: ref.Object, generation: ref.Generation}
+	opts := gf.readOptions(j)
+	opts.ReadCompressed = false // Let GCS decompress it.
+	r, err := gf.GCS.NewReader(ctx, j.bucket, j.object, opts)
+	if err != nil {
+		return gf.gcsError(err, j, "creating GCS reader for")
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil {
+			err = fmt.Errorf("Failed to close GCS reader: %v", cerr)
+		}
+	}()
+	if err := decodeManifest(r, each); err != nil {
+		return fmt.Errorf("decoding JSON from manifest %s: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+	return nil
+}
+
+// loadManifest reads the manifest ref, calling each for every entry, and
+// returns how long it took to fetch.
+func (gf *Fetcher) loadManifest(ctx context.Context, ref ObjectRef, each func(string, common.ManifestItem)) (time.Duration, error) {
+	if gf.DryRun || gf.ManifestURL != "" || gf.ManifestReader != nil {
+		// Read the manifest straight into memory so that nothing, not even
+		// the staging directory, is written to disk for it.
+		started := time.Now()
+		err := gf.readManifest(ctx, ref, each)
+		return time.Since(started), err
+	}
+	return gf.downloadManifest(ctx, ref, each)
+}
+
+// decodeManifest decodes the JSON manifest read from r one entry at a time,
+// calling each for every entry in the order they appear, so that the whole
+// manifest is never held in memory at once.
+func decodeManifest(r io.Reader, each func(string, common.ManifestItem)) error {
+	d := json.NewDecoder(r)
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil // A null manifest lists no files.
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("manifest starts with %v, want a JSON object", tok)
+	}
+	for d.More() {
+		tok, err := d.Token()
 		if err != nil {
-			return fmt.Errorf("parsing bucket/object from %q: %v", info.SourceURL, err)
+			return err
 		}
-		j := job{
-			filename:   filename,
-			bucket:     bucket,
-			object:     object,
-			generation: generation,
-			sha1sum:    info.Sha1Sum,
+		var item common.ManifestItem
+		if err := d.Decode(&item); err != nil {
+			return err
 		}
-		jobs = append(jobs, j)
+		each(tok.(string), item)
+	}
+	_, err = d.Token() // The closing brace.
+	return err
+}
+
+// fetchFromManifest is used when downloading source based on a manifest file.
+// It is responsible for fetching the manifest file, decoding the JSON, and
+// assembling the list of jobs to process (i.e., files to download).
+func (gf *Fetcher) fetchFromManifest(ctx context.Context) (_ Stats, err error) {
+	started := time.Now()
+	gf.logFetchStart("manifest")
+
+	var stats stats
+	var manifestDuration time.Duration
+	if gf.StreamManifest && len(gf.manifests()) == 1 {
+		gf.log("Processing files as the manifest is read.")
+		stats, manifestDuration, err = gf.processManifestStream(ctx)
+		if stats.started.IsZero() {
+			return Stats{}, err
+		}
+	} else {
+		var files map[string]common.ManifestItem
+		files, manifestDuration, err = gf.loadManifests(ctx, gf.loadManifest)
+		if err != nil {
+			return Stats{}, err
+		}
+
+		var jobs []job
+		if jobs, err = gf.manifestJobs(files); err != nil {
+			return Stats{}, err
+		}
+
+		included, _ := gf.filterJobs(jobs)
+		if err := gf.checkSpace(gf.StagingDir, knownSize(included)); err != nil {
+			return Stats{}, err
+		}
+
+		gf.log("Processing %v files.", len(jobs))
+		stats, err = gf.processJobs(ctx, jobs)
 	}
+	return gf.summarizeFetch(started, stats, manifestDuration, err)
+}
 
-	gf.log("Processing %v files.", len(jobs))
-	stats := gf.processJobs(ctx, jobs)
+// summarizeFetch moves the files fetched for a manifest or prefix into place,
+// cleans up and logs the summary. manifestDuration is how long it took to
+// find the files to fetch, and err any error from fetching them.
+func (gf *Fetcher) summarizeFetch(started time.Time, stats stats, manifestDuration time.Duration, err error) (Stats, error) {
+	if err == nil && gf.Atomic && !gf.DryRun {
+		if err := gf.commitTree(stats.reports); err != nil {
+			gf.removeStagingDirs()
+			return stats.export(started), fmt.Errorf("moving fetched files into %q: %v", gf.DestDir, err)
+		}
+	}
 
 	// Final cleanup of failed downloads. We won't miss any files; these vestiges
 	// are from go routines that have timed out and would otherwise check their
 	// circuit breaker and die. However, we won't wait for these remaining
 	// go routines to finish because out goal is to get done as fast as possible!
-	if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
-		gf.log("Failed to remove staging dir %v, continuing: %v", gf.StagingDir, err)
+	if !gf.DryRun {
+		gf.removeStagingDirs()
 	}
 
 	// Emit final stats.
@@ -622,36 +2321,98 @@ func (gf *Fetcher) fetchFromManifest(ctx context.Context) (err error) {
 	if stats.duration > 0 {
 		mibps = mib / stats.duration.Seconds()
 	}
-	manifestDuration := report.attempts[len(report.attempts)-1].duration
 	status := "SUCCESS"
 	if !stats.success {
 		status = "FAILURE"
 	}
-	gf.log("******************************************************")
-	gf.log("Status:                      %s", status)
-	gf.log("Started:                     %s", started.Format(time.RFC3339))
-	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
-	gf.log("Requested workers: %6d", gf.WorkerCount)
-	gf.log("Actual workers:    %6d", stats.workers)
-	gf.log("Total files:       %6d", stats.files)
-	gf.log("Total retries:     %6d", stats.retries)
-	if gf.TimeoutGCS {
-		gf.log("GCS timeouts:      %6d", stats.gcsTimeouts)
+	if gf.Logger != nil {
+		gf.logCompleted(stats, started, slog.Int("workers", stats.workers), slog.Int64("manifest_duration_ms", manifestDuration.Milliseconds()))
+	} else {
+		gf.log("******************************************************")
+		gf.log("Status:                      %s", status)
+		if gf.DryRun {
+			gf.log("Dry run:                     no files were written")
+		}
+		gf.log("Started:                     %s", started.Format(time.RFC3339))
+		gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
+		gf.log("Requested workers: %6d", gf.WorkerCount)
+		gf.log("Actual workers:    %6d", stats.workers)
+		gf.log("Total files:       %6d", stats.files)
+		gf.logSkipped(stats)
+		gf.log("Total retries:     %6d", stats.retries)
+		if gf.TimeoutGCS {
+			gf.log("GCS timeouts:      %6d", stats.gcsTimeouts)
+			gf.log("Timed out reads:   %6d", stats.timeouts)
+		}
+		gf.log("MiB downloaded:    %9.2f MiB", mib)
+		gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
+
+		gf.log("Time for manifest: %9.2f ms", float64(manifestDuration)/float64(time.Millisecond))
+		gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
+		gf.log("******************************************************")
 	}
-	gf.log("MiB downloaded:    %9.2f MiB", mib)
-	gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
 
-	gf.log("Time for manifest: %9.2f ms", float64(manifestDuration)/float64(time.Millisecond))
-	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
-	gf.log("******************************************************")
+	if err != nil {
+		return stats.export(started), err
+	}
+	summary := stats.export(started)
+	if !gf.DryRun {
+		var files []writtenFile
+		for _, report := range stats.reports {
+			if report.success && !report.empty && !report.kept {
+				files = append(files, writtenFile{
+					name:       report.finalname,
+					size:       int64(report.size),
+					sha256:     report.sha256,
+					generation: report.job.generation,
+				})
+			}
+		}
+		if err := gf.complete(summary, files); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
 
-	if len(stats.errs) > 0 {
-		var es []string
-		es = append(es, fmt.Sprintf("Errors (%d):", len(stats.errs)))
-		for _, e := range stats.errs {
-			es = append(es, fmt.Sprintf(" - %s", e))
+// complete checks the number of files a successful fetch wrote against
+// ExpectedFileCount, sets TreeHash from them, then passes its summary and
+// the files to OnComplete, and lists them in LockfileWriter, if either is
+// set. A file written more than once, as when an archive holds several
+// entries of the same name, is counted and passed only once, as last
+// written.
+func (gf *Fetcher) complete(st Stats, files []writtenFile) error {
+	abs := make([]writtenFile, 0, len(files))
+	for _, f := range files {
+		if a, err := filepath.Abs(f.name); err == nil {
+			f.name = a
+		}
+		abs = append(abs, f)
+	}
+	sort.SliceStable(abs, func(i, j int) bool { return abs[i].name < abs[j].name })
+	uniq := abs[:0]
+	for _, f := range abs {
+		if n := len(uniq); n > 0 && uniq[n-1].name == f.name {
+			uniq[n-1] = f
+			continue
+		}
+		uniq = append(uniq, f)
+	}
+	if gf.ExpectedFileCount > 0 && len(uniq) != gf.ExpectedFileCount {
+		return &countMismatchError{want: gf.ExpectedFileCount, got: len(uniq)}
+	}
+	gf.setTreeHash(uniq)
+	if gf.OnComplete != nil {
+		names := make([]string, len(uniq))
+		for i, f := range uniq {
+			names[i] = f.name
+		}
+		gf.OnComplete(st, names)
+	}
+	if gf.LockfileWriter != nil {
+		if err := gf.writeLockfile(uniq); err != nil {
+			return fmt.Errorf("writing lockfile: %v", err)
 		}
-		return fmt.Errorf(strings.Join(es, "\n"))
 	}
 	return nil
 }
@@ -668,7 +2429,7 @@ func (gf *Fetcher) copyFile(name string, mode os.FileMode, rc io.ReadCloser) (er
 		return err
 	}
 
-	targetWriter, err := os.OpenFile(targetFile, os.O_WRONLY|os.O_CREATE, mode)
+	targetWriter, err := gf.OS.OpenFile(targetFile, os.O_WRONLY|os.O_CREATE, mode)
 	if err != nil {
 		return fmt.Errorf("failed to open target file %q: %v", targetFile, err)
 	}
@@ -684,119 +2445,184 @@ func (gf *Fetcher) copyFile(name string, mode os.FileMode, rc io.ReadCloser) (er
 	return nil
 }
 
-// fetchFromZip is used when downloading a single zip of source files. It is
-// responsible to fetch the zip file and unzip it into the destination folder.
-func (gf *Fetcher) fetchFromZip(ctx context.Context) (err error) {
-	started := time.Now()
-	gf.log("Fetching archive %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
+// archiveDownloadError returns the error to report when downloading the
+// archive failed. A digest mismatch is returned as the underlying
+// checksumError, after removing the staged copies of the archive. A missing
+// archive is returned as an ExitError with notFoundExitStatus.
+func (gf *Fetcher) archiveDownloadError(err error) error {
+	var cerr *checksumError
+	if errors.As(err, &cerr) {
+		if rerr := gf.OS.RemoveAll(gf.StagingDir); rerr != nil {
+			gf.log("Failed to remove staging dir %q, continuing: %v", gf.StagingDir, rerr)
+		}
+		return cerr
+	}
+	if exitStatus(err) == notFoundExitStatus {
+		gf.logErr(err.Error())
+		return &ExitError{Status: notFoundExitStatus, Err: err}
+	}
+	return fmt.Errorf("failed to download archive %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), err)
+}
 
-	// Download the archive from GCS.
-	zipDir := gf.StagingDir
-	j := job{
-		filename:        gf.Object,
-		bucket:          gf.Bucket,
-		object:          gf.Object,
-		generation:      gf.Generation,
-		destDirOverride: zipDir,
+// extractPath returns the path under dest where the archive entry name should
+// be written. Absolute names and names that would resolve outside of dest are
+// rejected, so a crafted archive cannot overwrite arbitrary files.
+func extractPath(dest, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("archive entry %q has an absolute path", name)
 	}
-	report := gf.fetchObject(ctx, j)
-	if !report.success {
-		return fmt.Errorf("failed to download archive %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
+	target := filepath.Join(dest, name)
+	rel, err := filepath.Rel(filepath.Clean(dest), target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %q resolves outside of %q", name, dest)
 	}
+	return target, nil
+}
 
-	// Unzip into the destination directory
-	zipfile := filepath.Join(zipDir, gf.Object)
-	unzipStart := time.Now()
-	numFiles, err := unzip(zipfile, gf.DestDir)
+// unzip extracts zipfile into dest, skipping entries excluded by the
+// Include/Exclude filters. If ctx is cancelled, it stops before the next
+// entry, and removes the one it was writing.
+func (gf *Fetcher) unzip(ctx context.Context, zipfile, dest string) (st stats, err error) {
+	f, err := gf.OS.Open(zipfile)
 	if err != nil {
-		return err
+		return st, fmt.Errorf("opening archive %s: %v", zipfile, err)
 	}
-	unzipDuration := time.Since(unzipStart)
-
-	if !gf.KeepSource {
-		// Remove the zip file (best effort only, no harm if this fails).
-		if err := os.RemoveAll(zipfile); err != nil {
-			gf.log("Failed to remove zipfile %s, continuing: %v", zipfile, err)
+	defer func() {
+		if cerr := f.Close(); cerr != nil {
+			err = fmt.Errorf("closing archive %s: %v", zipfile, cerr)
 		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return st, fmt.Errorf("opening archive %s: %v", zipfile, err)
+	}
+	zipReader, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return st, fmt.Errorf("opening archive %s: %v", zipfile, err)
+	}
 
-		// Final cleanup of staging directory, which is only a temporary staging
-		// location for downloading the zipfile in this case.
-		if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
-			gf.log("Failed to remove staging dir %q, continuing: %v", gf.StagingDir, err)
+	var bytesTotal int64
+	var filesTotal int
+	for _, file := range zipReader.File {
+		if !file.FileInfo().IsDir() && gf.included(file.Name) {
+			if err := gf.entryTooLarge(file.Name, int64(file.UncompressedSize64)); err != nil {
+				if !gf.SkipLargeFiles {
+					return st, err
+				}
+				continue
+			}
+			if err := gf.checkRatio(file.Name, int64(file.UncompressedSize64), int64(file.CompressedSize64)); err != nil {
+				return st, err
+			}
+			bytesTotal += int64(file.UncompressedSize64)
+			filesTotal++
 		}
 	}
-
-	mib := float64(report.size) / 1024 / 1024
-	var mibps float64
-	zipfileDuration := report.attempts[len(report.attempts)-1].duration
-	if zipfileDuration > 0 {
-		mibps = mib / zipfileDuration.Seconds()
-	}
-	gf.log("******************************************************")
-	gf.log("Status:                      SUCCESS")
-	gf.log("Started:                     %s", started.Format(time.RFC3339))
-	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
-	gf.log("Total files:       %6d", numFiles)
-	gf.log("MiB downloaded:    %9.2f MiB", mib)
-	gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
-	gf.log("Time for zipfile:  %9.2f s", zipfileDuration.Seconds())
-	gf.log("Time to unzip:     %9.2f s", unzipDuration.Seconds())
-	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
-	gf.log("******************************************************")
-	return nil
-}
-
-func unzip(zipfile, dest string) (numFiles int, err error) {
-	zipReader, err := zip.OpenReader(zipfile)
-	if err != nil {
-		return 0, fmt.Errorf("opening archive %s: %v", zipfile, err)
+	// archive/zip fails entries longer than they claim, so the claimed
+	// sizes can be trusted.
+	if err := gf.checkLimits(filesTotal, bytesTotal); err != nil {
+		return st, err
+	}
+	if err := gf.checkSpace(dest, bytesTotal); err != nil {
+		return st, err
 	}
+	progress := gf.newProgress(bytesTotal, filesTotal)
+	flat := gf.newFlattener(dest)
 	defer func() {
-		if cerr := zipReader.Close(); cerr != nil {
-			err = fmt.Errorf("closing archive %s: %v", zipfile, cerr)
+		if err != nil {
+			gf.removePartials(ctx)
 		}
 	}()
 
-	numFiles = 0
 	for _, file := range zipReader.File {
-		target := filepath.Join(dest, file.Name)
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		name, err := gf.entryName(file.Name)
+		if err != nil {
+			return st, err
+		}
+		target, err := extractPath(dest, name)
+		if err != nil {
+			return st, err
+		}
+		if !gf.included(file.Name) || (!file.FileInfo().IsDir() && gf.tooLarge(int64(file.UncompressedSize64))) {
+			if !file.FileInfo().IsDir() {
+				st.skipped++
+			}
+			continue
+		}
 
 		if file.FileInfo().IsDir() {
+			if gf.Flatten {
+				continue
+			}
 			// Create directory with appropriate permissions if it doesn't exist.
-			if _, err := os.Stat(target); os.IsNotExist(err) {
-				if err := os.MkdirAll(target, file.Mode()); err != nil {
-					return 0, fmt.Errorf("making directory %s: %v", target, err)
+			mode := gf.extractedMode(file.Mode(), true)
+			if _, err := gf.OS.Stat(target); os.IsNotExist(err) {
+				if err := gf.mkdirImplicit(filepath.Dir(target)); err != nil {
+					return st, fmt.Errorf("making parent directories for %s: %v", target, err)
+				}
+				if err := gf.OS.MkdirAll(target, mode); err != nil {
+					return st, fmt.Errorf("making directory %s: %v", target, err)
+				}
+				if !gf.setsModes() {
+					continue
 				}
-				continue
 			} else if err != nil {
-				return 0, fmt.Errorf("checking existence on %s: %v", target, err)
+				return st, fmt.Errorf("checking existence on %s: %v", target, err)
 			}
 			// If directory already exists, it may have been created below as a
 			// parent directory when processing a file. In this case, we must
 			// set the directory's permissions correctly.
-			if err := os.Chmod(target, file.Mode()); err != nil {
-				return 0, fmt.Errorf("setting permissions on %s: %v", target, err)
+			if err := gf.OS.Chmod(target, mode); err != nil {
+				return st, fmt.Errorf("setting permissions on %s: %v", target, err)
+			}
+			continue
+		}
+
+		if gf.Flatten {
+			if target, err = flat.path(name); err != nil {
+				return st, err
 			}
+		}
+		if gf.keepsExisting(target) {
+			progress.add(int64(file.UncompressedSize64), 1)
+			st.skipped++
 			continue
 		}
 
-		// Create parent directories with full access. This only matters if the
-		// file comes from zipReader before the directory. In this case, the
-		// file permissions will be set to the correct value when the directory
-		// itself is processed above.
-		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
-			return 0, fmt.Errorf("making parent directories for %s: %v", target, err)
+		// Create parent directories with DefaultDirMode, or full access. If
+		// the file comes from zipReader before the directory, the directory's
+		// permissions will be set to the correct value when it is processed
+		// above.
+		if err := gf.mkdirImplicit(filepath.Dir(target)); err != nil {
+			return st, fmt.Errorf("making parent directories for %s: %v", target, err)
+		}
+
+		st.files++
+		if gf.SkipUnchanged {
+			if sums, ok := gf.sumFile(target); ok && sums.size == int64(file.UncompressedSize64) && sums.crc32 == file.CRC32 {
+				if err := gf.checkEntry(file.Name, sums.sha256); err != nil {
+					return st, err
+				}
+				progress.add(sums.size, 1)
+				st.unchanged++
+				st.written = append(st.written, writtenFile{name: target, size: sums.size, sha256: sums.sha256, generation: gf.Generation})
+				continue
+			}
 		}
 
 		// Actually copy the bytes, using func to get early defer calls
 		// (important for large numbers of files).
-		numFiles++
 		reader, err := file.Open()
 		if err != nil {
-			return 0, fmt.Errorf("opening file in %s: %v", target, err)
+			return st, fmt.Errorf("opening file in %s: %v", target, err)
 		}
+		mode := gf.extractedMode(file.Mode(), false)
+		gf.trackPartial(target)
 		if err := func() (ferr error) {
-			writer, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, file.Mode())
+			writer, err := gf.OS.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 			if err != nil {
 				return fmt.Errorf("opening target file %s: %v", target, err)
 			}
@@ -805,139 +2631,831 @@ func unzip(zipfile, dest string) (numFiles int, err error) {
 					ferr = fmt.Errorf("closing target file %s: %v", target, cerr)
 				}
 			}()
-			if _, err := io.Copy(writer, reader); err != nil {
+			h := sha256.New()
+			body, err := gf.entryContent(file.Name, io.TeeReader(reader, h))
+			if err != nil {
+				return fmt.Errorf("transforming %s: %v", file.Name, err)
+			}
+			n, err := io.Copy(writer, body)
+			if err != nil {
 				return fmt.Errorf("copying %s to %s: %v", file.Name, target, err)
 			}
-			return nil
+			digest := fmt.Sprintf("%x", h.Sum(nil))
+			if err := gf.checkEntry(file.Name, digest); err != nil {
+				return err
+			}
+			// The total counts the sizes the archive claims, which a
+			// ContentTransform may change.
+			progress.add(int64(file.UncompressedSize64), 1)
+			st.written = append(st.written, writtenFile{name: target, size: n, sha256: digest, generation: gf.Generation})
+			return gf.syncFile(writer, target)
 		}(); err != nil {
-			return 0, err
+			return st, err
+		}
+		gf.untrackPartial(target)
+		if gf.setsModes() {
+			if err := gf.OS.Chmod(target, mode); err != nil {
+				return st, fmt.Errorf("setting permissions on %s: %v", target, err)
+			}
 		}
 	}
-	return numFiles, nil
+	progress.done()
+	return st, nil
+}
+
+// fetchFromZip is used when downloading a single zip of source files. It is
+// responsible to fetch the zip file and unzip it into the destination folder.
+func (gf *Fetcher) fetchFromZip(ctx context.Context) (Stats, error) {
+	return gf.fetchArchive(ctx, "zip")
 }
 
 // fetchFromTarGz is used when downloading a single .tar.gz of source files. It
 // is responsible to fetch the .tar.gz file and unzip it into the destination
 // folder.
-func (gf *Fetcher) fetchFromTarGz(ctx context.Context) (err error) {
+func (gf *Fetcher) fetchFromTarGz(ctx context.Context) (Stats, error) {
+	return gf.fetchArchive(ctx, "tgz")
+}
+
+// fetchFromTarXz is used when downloading a single .tar.xz of source files. It
+// is responsible to fetch the .tar.xz file and extract it into the destination
+// folder.
+func (gf *Fetcher) fetchFromTarXz(ctx context.Context) (Stats, error) {
+	return gf.fetchArchive(ctx, "txz")
+}
+
+// fetchFromTarZst is used when downloading a single .tar.zst of source files.
+// It is responsible to fetch the .tar.zst file and extract it into the
+// destination folder.
+func (gf *Fetcher) fetchFromTarZst(ctx context.Context) (Stats, error) {
+	return gf.fetchArchive(ctx, "tzst")
+}
+
+// fetchFromTarBz2 is used when downloading a single .tar.bz2 of source files.
+// It is responsible to fetch the .tar.bz2 file and extract it into the
+// destination folder.
+func (gf *Fetcher) fetchFromTarBz2(ctx context.Context) (Stats, error) {
+	return gf.fetchArchive(ctx, "tbz2")
+}
+
+// fetchArchive downloads an archive from GCS and extracts it into the
+// destination folder. kind is a short name for the archive format ("zip",
+// "tgz", "txz", "tzst", "tbz2") used in the summary report. If the object's extension
+// does not match kind, or the archive cannot be extracted as kind, its first
+// bytes are checked, and it is extracted as whatever format they identify.
+// A tarball found to be corrupt is downloaded again, up to Retries times.
+func (gf *Fetcher) fetchArchive(ctx context.Context, kind string) (_ Stats, err error) {
 	started := time.Now()
-	gf.log("Fetching archive %s.", formatGCSName(gf.Bucket, gf.Object, gf.Generation))
+	gf.logFetchStart("archive")
+
+	if gf.KeepArchive && gf.ArchivePath == "" {
+		return Stats{}, errors.New("misconfigured GCSFetcher, KeepArchive needs an ArchivePath")
+	}
+	extract := !gf.KeepArchive || gf.ExtractArchive
+	if !gf.DryRun && extract {
+		if err := gf.loadChecksumSidecar(ctx); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	if gf.streamable(kind) {
+		st, err := gf.streamArchive(ctx, kind, started)
+		if err != errNotStreamable {
+			return st, err
+		}
+	}
 
 	// Download the archive from GCS.
-	tgzDir := gf.StagingDir
+	archiveDir := gf.StagingDir
 	j := job{
 		filename:        gf.Object,
 		bucket:          gf.Bucket,
 		object:          gf.Object,
 		generation:      gf.Generation,
-		destDirOverride: tgzDir,
-	}
-	report := gf.fetchObject(ctx, j)
-	if !report.success {
-		return fmt.Errorf("failed to download archive %s: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), report.err)
+		sha256sum:       gf.ArchiveSha256,
+		destDirOverride: archiveDir,
 	}
+	archive := filepath.Join(archiveDir, gf.Object)
+	var report *jobReport
+	var st stats
+	var extractDuration time.Duration
+	var redownloads int
+	for {
+		report = gf.fetchObject(ctx, j)
+		if !report.success {
+			gf.removePartials(ctx)
+			return Stats{}, gf.archiveDownloadError(report.err)
+		}
+		if gf.DryRun {
+			if gf.KeepArchive {
+				gf.log("Would save %s to %q.", formatGCSName(gf.Bucket, gf.Object, gf.Generation), gf.ArchivePath)
+			}
+			if extract {
+				gf.log("Would extract %s into %q.", formatGCSName(gf.Bucket, gf.Object, gf.Generation), gf.DestDir)
+			}
+			return Stats{}, nil
+		}
+		if !extract {
+			break
+		}
 
-	// Untgz into the destination directory
-	untgzStart := time.Now()
-	tgzfile := filepath.Join(tgzDir, gf.Object)
-	f, err := os.Open(tgzfile)
-	if err != nil {
-		return err
+		// Extract into the destination directory.
+		extractStart := time.Now()
+		st, kind, err = gf.extractStaged(ctx, kind, archive)
+		extractDuration = time.Since(extractStart)
+		// A corrupt archive may have been damaged in transit, so it is
+		// downloaded again, rewriting the files already extracted.
+		var cerr *corruptArchiveError
+		if err == nil || !errors.As(err, &cerr) || redownloads >= gf.Retries || ctx.Err() != nil || !gf.retryAllowed() {
+			break
+		}
+		redownloads++
+		gf.metrics().IncRetry()
+		gf.log("Downloading %s again: %v", formatGCSName(gf.Bucket, gf.Object, gf.Generation), err)
 	}
-	gzr, err := gzip.NewReader(f)
 	if err != nil {
-		return err
+		return Stats{}, err
+	}
+	if extract {
+		nestedStart := time.Now()
+		if st, err = gf.extractNested(ctx, st); err != nil {
+			return Stats{}, err
+		}
+		extractDuration += time.Since(nestedStart)
+	}
+	if gf.KeepArchive {
+		if err := gf.saveArchive(archive); err != nil {
+			return Stats{}, err
+		}
+		if !extract {
+			st.files++
+			st.written = append(st.written, writtenFile{name: gf.ArchivePath, size: int64(report.size), sha256: report.sha256, generation: report.job.generation})
+		}
+	}
+
+	if !gf.KeepSource {
+		// Remove the archive (best effort only, no harm if this fails).
+		if err := gf.OS.RemoveAll(archive); err != nil {
+			gf.log("Failed to remove %sfile %s, continuing: %v", kind, archive, err)
+		}
+
+		// Final cleanup of staging directory, which is only a temporary staging
+		// location for downloading the archive in this case.
+		gf.removeStagingDirs()
+	}
+
+	st.size, st.retries = report.size, redownloads+len(report.attempts)-1
+	archiveDuration := report.attempts[len(report.attempts)-1].duration
+	return gf.archiveSummary(st, kind, started, archiveDuration, extractDuration)
+}
+
+// saveArchive saves the staged archive to ArchivePath, moving it unless
+// KeepSource keeps it in StagingDir as well.
+func (gf *Fetcher) saveArchive(archive string) error {
+	if err := gf.OS.MkdirAll(filepath.Dir(gf.ArchivePath), 0777); err != nil {
+		return fmt.Errorf("making parent directories for %s: %v", gf.ArchivePath, err)
+	}
+	save := gf.moveFile
+	if gf.KeepSource {
+		save = gf.copyLocalFile
+	}
+	if err := save(archive, gf.ArchivePath); err != nil {
+		return fmt.Errorf("saving archive to %s: %v", gf.ArchivePath, err)
+	}
+	return gf.syncDir(filepath.Dir(gf.ArchivePath))
+}
+
+// extractStaged extracts the staged archive, of the given kind, into the
+// destination folder, and returns the kind it was extracted as. If the
+// object's extension does not match kind, or the archive cannot be extracted
+// as kind, its first bytes decide.
+func (gf *Fetcher) extractStaged(ctx context.Context, kind, archive string) (stats, string, error) {
+	sniffed := extensionKind(gf.Object) != kind
+	if sniffed {
+		var err error
+		if kind, err = gf.sniffedKind(archive, kind); err != nil {
+			return stats{}, kind, err
+		}
+	}
+	st, err := gf.extractArchive(ctx, kind, archive, gf.DestDir)
+	if err != nil && !sniffed {
+		// The extension may be as wrong as the kind. An archive of another
+		// format fails before anything is extracted, so it is safe to retry.
+		if k, serr := gf.sniffedKind(archive, kind); serr == nil && k != kind {
+			kind = k
+			st, err = gf.extractArchive(ctx, kind, archive, gf.DestDir)
+		}
+	}
+	return st, kind, err
+}
+
+// archiveSummary reports a successful archive fetch that began at started,
+// took downloadDuration to download the archive and extractDuration to
+// extract it, and returns its public summary.
+func (gf *Fetcher) archiveSummary(st stats, kind string, started time.Time, downloadDuration, extractDuration time.Duration) (Stats, error) {
+	mib := float64(st.size) / 1024 / 1024
+	var mibps float64
+	if downloadDuration > 0 {
+		mibps = mib / downloadDuration.Seconds()
+	}
+	st.success = true
+	if gf.Logger != nil {
+		durationKey := "extract_duration_ms"
+		if kind == "zip" {
+			durationKey = "unzip_duration_ms"
+		}
+		gf.logCompleted(st, started, slog.Int64(durationKey, extractDuration.Milliseconds()))
+	} else {
+		gf.log("******************************************************")
+		gf.log("Status:                      SUCCESS")
+		gf.log("Started:                     %s", started.Format(time.RFC3339))
+		gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
+		gf.log("Total files:       %6d", st.files)
+		gf.logSkipped(st)
+		gf.log("MiB downloaded:    %9.2f MiB", mib)
+		gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
+		gf.log("Time for %-10s%9.2f s", kind+"file:", downloadDuration.Seconds())
+		gf.log("Time to %-11s%9.2f s", "un"+kind+":", extractDuration.Seconds())
+		gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
+		gf.log("******************************************************")
 	}
-	tr := tar.NewReader(gzr)
+	if err := gf.writeEntryProvenance(st.written); err != nil {
+		return Stats{}, err
+	}
+	summary := st.export(started)
+	return summary, gf.complete(summary, st.written)
+}
+
+// extractArchive extracts archive, of the given kind, into dest.
+func (gf *Fetcher) extractArchive(ctx context.Context, kind, archive, dest string) (stats, error) {
+	if kind == "zip" {
+		return gf.unzip(ctx, archive, dest)
+	}
+	return gf.extractTar(ctx, archive, dest, gf.decompressor(kind))
+}
+
+// decompressor returns the function that decompresses a tarball of the given
+// kind.
+func (gf *Fetcher) decompressor(kind string) func(io.Reader) (io.ReadCloser, error) {
+	switch kind {
+	case "tgz":
+		return func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}
+	case "txz":
+		return func(r io.Reader) (io.ReadCloser, error) {
+			xzr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xzr), nil
+		}
+	case "tbz2":
+		return func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		}
+	case "tzst":
+		return func(r io.Reader) (io.ReadCloser, error) {
+			var opts []zstd.DOption
+			if gf.ZstdMaxWindow > 0 {
+				opts = append(opts, zstd.WithDecoderMaxWindow(gf.ZstdMaxWindow))
+			}
+			if gf.ZstdConcurrency > 0 {
+				opts = append(opts, zstd.WithDecoderConcurrency(gf.ZstdConcurrency))
+			}
+			zr, err := zstd.NewReader(r, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		}
+	default: // An uncompressed tarball.
+		return func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		}
+	}
+}
 
+// extractTar decompresses the tarball in tarfile with decompress and extracts
+// it into dest.
+func (gf *Fetcher) extractTar(ctx context.Context, tarfile, dest string, decompress func(io.Reader) (io.ReadCloser, error)) (st stats, err error) {
+	f, err := gf.OS.Open(tarfile)
+	if err != nil {
+		return st, err
+	}
 	defer func() {
 		if cerr := f.Close(); cerr != nil {
-			err = fmt.Errorf("Failed to close file %q: %v", tgzfile, cerr)
+			err = fmt.Errorf("Failed to close file %q: %v", tarfile, cerr)
 		}
 	}()
+	compressed := &readTracker{r: f}
+	dr, err := decompress(compressed)
+	if err != nil {
+		if isCorruptStream(err) {
+			return st, gf.corruptArchive(st, err)
+		}
+		return st, fmt.Errorf("failed to decompress %q: %v", tarfile, err)
+	}
+	defer dr.Close()
 
-	numFiles := 0
+	st, err = gf.untar(ctx, decompressedReader{Reader: dr, compressed: compressed}, dest)
+	if err != nil {
+		if isCorruptStream(err) {
+			return st, gf.corruptArchive(st, err)
+		}
+		return st, fmt.Errorf("failed to extract %q: %v", tarfile, err)
+	}
+	return st, nil
+}
+
+// untar extracts the tar stream r into dest, skipping entries excluded by the
+// Include/Exclude filters. Symlinks are only created when AllowSymlinks is set; links
+// that would resolve outside of dest are rejected.
+func (gf *Fetcher) untar(ctx context.Context, r io.Reader, dest string) (st stats, err error) {
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header // Directories to set times on once their contents are written.
+	// The files written so far, by path, for hard links to them to copy.
+	written := map[string]writtenFile{}
+	// The symlinks written so far, which later entries must not be written
+	// through.
+	links := map[string]bool{}
+	progress := gf.newProgress(-1, -1)
+	pool := gf.newExtractPool(ctx, progress)
+	flat := gf.newFlattener(dest)
+	defer func() {
+		if cerr := pool.close(); err == nil {
+			err = cerr
+		}
+	}()
+	chown, err := gf.ownershipEnabled()
+	if err != nil {
+		return st, err
+	}
+	var compressed *readTracker
+	if d, ok := r.(decompressedReader); ok {
+		compressed = d.compressed
+	}
+	// Entries and bytes so far, counted against MaxFiles and MaxTotalBytes,
+	// and the paths written, to remove if either, or MaxCompressionRatio, is
+	// exceeded.
+	var entries int
+	var size int64
+	var created []string
+	defer func() {
+		var lerr *limitExceededError
+		var cerr *compressionRatioError
+		if errors.As(err, &lerr) || errors.As(err, &cerr) {
+			pool.close()
+			gf.removeExtracted(created)
+		}
+		if err != nil {
+			// The workers must be done before their files are removed.
+			pool.close()
+			gf.removePartials(ctx)
+		}
+	}()
 	for {
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
 		h, err := tr.Next()
 		if err == io.EOF {
-			break
+			if err := pool.close(); err != nil {
+				return st, err
+			}
+			progress.done()
+			if gf.setsModes() {
+				// Directories are only restricted once their contents are
+				// written.
+				for _, d := range dirs {
+					n, _ := gf.entryPath(dest, d.Name)
+					if err := gf.OS.Chmod(n, gf.extractedMode(d.FileInfo().Mode(), true)); err != nil {
+						return st, err
+					}
+				}
+			}
+			if gf.PreserveModTime {
+				// Walk backwards so children are done before their parents.
+				for i := len(dirs) - 1; i >= 0; i-- {
+					n, _ := gf.entryPath(dest, dirs[i].Name)
+					if err := gf.OS.Chtimes(n, accessTime(dirs[i]), dirs[i].ModTime); err != nil {
+						return st, err
+					}
+				}
+			}
+			return st, nil
 		}
 		if err != nil {
-			return err
+			return st, err
+		}
+		name, err := gf.entryName(h.Name)
+		if err != nil {
+			return st, err
+		}
+		n, err := extractPath(dest, name)
+		if err != nil {
+			return st, err
+		}
+		if !gf.included(h.Name) {
+			if h.Typeflag != tar.TypeDir {
+				st.skipped++
+			}
+			continue
+		}
+		if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeGNUSparse {
+			if err := gf.entryTooLarge(h.Name, h.Size); err != nil {
+				if !gf.SkipLargeFiles {
+					return st, err
+				}
+				st.skipped++
+				continue
+			}
+		}
+		if gf.Flatten && (h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeGNUSparse || h.Typeflag == tar.TypeLink) {
+			if n, err = flat.path(name); err != nil {
+				return st, err
+			}
+		}
+		if link, ok := underLink(links, dest, n); ok {
+			return st, fmt.Errorf("archive entry %q would be written through symlink %q", h.Name, link)
+		}
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse, tar.TypeLink, tar.TypeSymlink:
+			if gf.keepsExisting(n) {
+				st.skipped++
+				continue
+			}
 		}
-		n := filepath.Join(gf.DestDir, h.Name)
 		switch h.Typeflag {
 		case tar.TypeDir:
-			if err := gf.OS.MkdirAll(n, h.FileInfo().Mode()); err != nil {
-				return err
+			if gf.Flatten {
+				continue
+			}
+			if _, err := gf.OS.Stat(n); os.IsNotExist(err) {
+				created = append(created, n)
+			}
+			if err := gf.OS.MkdirAll(n, gf.extractedMode(h.FileInfo().Mode(), true)); err != nil {
+				return st, err
+			}
+			if chown {
+				if err := gf.setOwner(n, h.Uid, h.Gid); err != nil {
+					return st, err
+				}
+			}
+			dirs = append(dirs, h)
+		case tar.TypeReg, tar.TypeGNUSparse:
+			// tar.Reader resolves GNU and PAX long names, and expands sparse
+			// files, reading their holes as zeros.
+			entries, size = entries+1, size+h.Size
+			if err := gf.checkLimits(entries, size); err != nil {
+				return st, err
+			}
+			mode := gf.extractedMode(h.FileInfo().Mode(), false)
+			var setTimes, setOwner func() error
+			if gf.PreserveModTime {
+				setTimes = func() error { return gf.OS.Chtimes(n, accessTime(h), h.ModTime) }
+			}
+			if chown {
+				setOwner = func() error { return gf.setOwner(n, h.Uid, h.Gid) }
+			}
+			if h.Size <= maxBufferedEntry {
+				// Small files are written by the pool while reading goes on.
+				data := make([]byte, h.Size)
+				if _, err := io.ReadFull(tr, data); err != nil {
+					return st, err
+				}
+				digest := fmt.Sprintf("%x", sha256.Sum256(data))
+				if err := gf.checkEntry(h.Name, digest); err != nil {
+					return st, err
+				}
+				st.files++
+				written[n] = writtenFile{name: n, size: h.Size, sha256: digest, generation: gf.Generation}
+				st.written = append(st.written, written[n])
+				if gf.ContentTransform != nil || gf.NormalizeLineEndings {
+					if data, err = gf.entryBytes(h.Name, data); err != nil {
+						return st, fmt.Errorf("transforming %s: %v", h.Name, err)
+					}
+				}
+				if gf.SkipUnchanged {
+					// An earlier entry of the same name must be written
+					// before the file can be compared.
+					if err := pool.await(n); err != nil {
+						return st, err
+					}
+					if sums, ok := gf.sumFile(n); ok && sums.size == h.Size && sums.sha256 == digest {
+						progress.add(h.Size, 1)
+						st.unchanged++
+						continue
+					}
+				}
+				created = append(created, n)
+				if err := pool.submit(extractedFile{name: n, mode: mode, data: data, setOwner: setOwner, setTimes: setTimes}); err != nil {
+					return st, err
+				}
+				continue
+			}
+			if err := pool.await(n); err != nil {
+				return st, err
+			}
+			// Parent directories may have been filtered out, or may simply
+			// come later in the archive.
+			if err := gf.ensureFolders(n); err != nil {
+				return st, err
 			}
-		case tar.TypeReg:
-			if err := func() error {
-				f, err := os.OpenFile(n, os.O_WRONLY|os.O_CREATE, h.FileInfo().Mode())
+			digest := sha256.New()
+			entry, err := gf.entryContent(h.Name, io.TeeReader(gf.entryReader(h.Name, tr, compressed), digest))
+			if err != nil {
+				return st, fmt.Errorf("transforming %s: %v", h.Name, err)
+			}
+			changed := true
+			if gf.SkipUnchanged && gf.sameSize(n, h.Size) {
+				changed, _, err = gf.rewriteIfChanged(n, entry)
+				if changed {
+					created = append(created, n)
+				}
 				if err != nil {
-					return err
+					return st, err
 				}
-				defer f.Close()
-				_, err = io.Copy(f, tr)
-				return err
-			}(); err != nil {
-				return err
+				progress.add(h.Size, 1)
+			} else {
+				created = append(created, n)
+				gf.trackPartial(n)
+				if err := func() error {
+					f, err := gf.OS.OpenFile(n, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					size, err := io.Copy(f, entry)
+					progress.add(size, 1)
+					if err != nil {
+						return err
+					}
+					return gf.syncFile(f, n)
+				}(); err != nil {
+					return st, err
+				}
+				gf.untrackPartial(n)
+			}
+			sum := fmt.Sprintf("%x", digest.Sum(nil))
+			if err := gf.checkEntry(h.Name, sum); err != nil {
+				return st, err
 			}
+			if !changed {
+				st.unchanged++
+			} else {
+				// Changing the owner clears setuid and setgid bits, so the
+				// mode is set again afterwards.
+				if setOwner != nil {
+					if err := setOwner(); err != nil {
+						return st, err
+					}
+				}
+				if gf.setsModes() || setOwner != nil {
+					if err := gf.OS.Chmod(n, mode); err != nil {
+						return st, err
+					}
+				}
+				if setTimes != nil {
+					if err := setTimes(); err != nil {
+						return st, err
+					}
+				}
+			}
+			st.files++
+			written[n] = writtenFile{name: n, size: h.Size, sha256: sum, generation: gf.Generation}
+			st.written = append(st.written, written[n])
+		case tar.TypeSymlink:
+			if !gf.AllowSymlinks || gf.Flatten {
+				gf.logErr("WARNING: skipping symlink %q -> %q in archive", h.Name, h.Linkname)
+				continue
+			}
+			if err := symlinkTarget(dest, n, h.Linkname); err != nil {
+				return st, fmt.Errorf("archive entry %q: %v", h.Name, err)
+			}
+			entries++
+			if err := gf.checkLimits(entries, size); err != nil {
+				return st, err
+			}
+			if err := pool.await(n); err != nil {
+				return st, err
+			}
+			if err := gf.removeForLink(n); err != nil {
+				return st, err
+			}
+			if err := gf.OS.Symlink(h.Linkname, n); err != nil {
+				return st, err
+			}
+			links[n] = true
+			created = append(created, n)
+			if chown {
+				if err := gf.setOwner(n, h.Uid, h.Gid); err != nil {
+					return st, err
+				}
+			}
+		case tar.TypeLink:
+			target, err := gf.entryPath(dest, h.Linkname)
+			if gf.Flatten && err == nil {
+				linkname, _ := gf.entryName(h.Linkname)
+				target, err = flat.linkPath(linkname)
+			}
+			if err != nil {
+				return st, fmt.Errorf("archive entry %q: %v", h.Name, err)
+			}
+			if f, ok := written[target]; ok {
+				if err := gf.checkEntry(h.Name, f.sha256); err != nil {
+					return st, err
+				}
+			}
+			entries++
+			if err := gf.checkLimits(entries, size); err != nil {
+				return st, err
+			}
+			// The target must be written before it can be linked to.
+			if err := pool.flush(); err != nil {
+				return st, err
+			}
+			if target != n {
+				if err := gf.removeForLink(n); err != nil {
+					return st, err
+				}
+				if err := gf.OS.Link(target, n); err != nil {
+					return st, err
+				}
+			}
+			created = append(created, n)
+			progress.add(0, 1)
+			st.files++
+			f := written[target]
+			f.name = n
+			written[n] = f
+			st.written = append(st.written, f)
 		}
 	}
-	untgzDuration := time.Since(untgzStart)
+}
 
+// accessTime returns the access time recorded for h, falling back to its
+// modification time for formats that don't record one.
+func accessTime(h *tar.Header) time.Time {
+	if h.AccessTime.IsZero() {
+		return h.ModTime
+	}
+	return h.AccessTime
+}
 
-	if !gf.KeepSource {
-		// Remove the tgz file (best effort only, no harm if this fails).
-		if err := gf.OS.RemoveAll(tgzfile); err != nil {
-			gf.log("Failed to remove tgzfile %s, continuing: %v", tgzfile, err)
+// symlinkTarget checks that a symlink at path n pointing to linkname stays
+// within dest once resolved. Absolute link targets are rejected outright, as
+// are targets that climb back up with ".." after descending, since what they
+// resolve to would change if a later entry made the directory they descend
+// into a symlink.
+func symlinkTarget(dest, n, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return fmt.Errorf("symlink target %q is absolute", linkname)
+	}
+	descended := false
+	for _, part := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch {
+		case part == "..":
+			if descended {
+				return fmt.Errorf("symlink target %q climbs back up after descending", linkname)
+			}
+		case part != "" && part != ".":
+			descended = true
 		}
+	}
+	resolved := filepath.Join(filepath.Dir(n), linkname)
+	rel, err := filepath.Rel(filepath.Clean(dest), resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("symlink target %q resolves outside of %q", linkname, dest)
+	}
+	return nil
+}
 
-		// Final cleanup of staging directory, which is only a temporary staging
-		// location for downloading the tgzfile in this case.
-		if err := gf.OS.RemoveAll(gf.StagingDir); err != nil {
-			gf.log("Failed to remove staging dir %q, continuing: %v", gf.StagingDir, err)
+// removeForLink removes the file or symlink at n, if there is one, so that
+// a link can be made there, as tar does when an archive is extracted again
+// or names a path twice. A directory is left for making the link to fail.
+func (gf *Fetcher) removeForLink(n string) error {
+	info, err := gf.OS.Lstat(n)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return gf.OS.Remove(n)
+}
+
+// underLink returns the symlink in links, if any, that path n is below. The
+// paths extractPath checks are only compared as strings, so writing through
+// a symlink an earlier entry created could leave dest, as with the entries
+// "x/b -> ..", "x/b/c -> .." and "x/b/c/file".
+func underLink(links map[string]bool, dest, n string) (string, bool) {
+	root := filepath.Clean(dest)
+	for p := filepath.Dir(n); len(p) > len(root) && strings.HasPrefix(p, root); p = filepath.Dir(p) {
+		if links[p] {
+			return p, true
 		}
 	}
+	return "", false
+}
 
-	mib := float64(report.size) / 1024 / 1024
-	var mibps float64
-	tgzfileDuration := report.attempts[len(report.attempts)-1].duration
-	if tgzfileDuration > 0 {
-		mibps = mib / tgzfileDuration.Seconds()
-	}
-	gf.log("******************************************************")
-	gf.log("Status:                      SUCCESS")
-	gf.log("Started:                     %s", started.Format(time.RFC3339))
-	gf.log("Completed:                   %s", time.Now().Format(time.RFC3339))
-	gf.log("Total files:       %6d", numFiles)
-	gf.log("MiB downloaded:    %9.2f MiB", mib)
-	gf.log("MiB/s throughput:  %9.2f MiB/s", mibps)
-	gf.log("Time for tgzfile:  %9.2f s", tgzfileDuration.Seconds())
-	gf.log("Time to untgz:     %9.2f s", untgzDuration.Seconds())
-	gf.log("Total time:        %9.2f s", time.Since(started).Seconds())
-	gf.log("******************************************************")
-	return nil
+// included reports whether the manifest or archive entry name passes the
+// Include and Exclude filters.
+func (gf *Fetcher) included(name string) bool {
+	name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+	if len(gf.Include) > 0 && !matchAny(gf.Include, name) {
+		return false
+	}
+	return !matchAny(gf.Exclude, name)
+}
+
+// matchAny reports whether name, or any of its parent directories, matches
+// one of patterns.
+func matchAny(patterns []string, name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// logSkipped reports how many files the Include/Exclude filters, or
+// RewritePath, left out.
+func (gf *Fetcher) logSkipped(st stats) {
+	if len(gf.Include) > 0 || len(gf.Exclude) > 0 || gf.RewritePath != nil || gf.SkipIfNotNewer || gf.SkipLargeFiles {
+		gf.log("Skipped files:     %6d", st.skipped)
+	}
+	if gf.SkipUnchanged {
+		gf.log("Unchanged files:   %6d", st.unchanged)
+	}
+}
+
+// archiveSourceType picks the archive -type for an object from its suffix,
+// defaulting to zip.
+func archiveSourceType(object string) string {
+	name := strings.ToLower(object)
+	switch {
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return "TarXzArchive"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "TarGzArchive"
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return "TarZstArchive"
+	case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+		return "TarBz2Archive"
+	default:
+		return "ZipArchive"
+	}
 }
 
 // Fetch is the main entry point into Fetcher. Based on configuration,
 // it pulls source from GCS into the destination directory.
 func (gf *Fetcher) Fetch(ctx context.Context) error {
-	switch gf.SourceType {
+	_, err := gf.FetchWithStats(ctx)
+	return err
+}
+
+// FetchWithStats is like Fetch, but also returns a summary of the fetch. When
+// some of a manifest's files fail to fetch, the summary still covers the
+// files attempted.
+func (gf *Fetcher) FetchWithStats(ctx context.Context) (Stats, error) {
+	if err := gf.checkOpen(); err != nil {
+		return Stats{}, err
+	}
+	for _, pattern := range append(append([]string{}, gf.Include...), gf.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Stats{}, fmt.Errorf("invalid filter pattern %q: %v", pattern, err)
+		}
+	}
+	if !gf.DryRun {
+		gf.removeStaleTemps(time.Now())
+	}
+
+	sourceType := gf.SourceType
+	if sourceType == "Archive" {
+		sourceType = archiveSourceType(gf.Object)
+		fmt.Printf("WARNING: -type=Archive is deprecated; use -type=%s\n", sourceType)
+	}
+	switch sourceType {
 	case "Manifest":
 		return gf.fetchFromManifest(ctx)
-	case "Archive":
-		fmt.Println("WARNING: -type=Archive is deprecated; use -type=ZipArchive")
-		fallthrough
+	case "Prefix":
+		return gf.fetchFromPrefix(ctx)
 	case "ZipArchive":
 		return gf.fetchFromZip(ctx)
 	case "TarGzArchive":
 		return gf.fetchFromTarGz(ctx)
+	case "TarXzArchive":
+		return gf.fetchFromTarXz(ctx)
+	case "TarZstArchive":
+		return gf.fetchFromTarZst(ctx)
+	case "TarBz2Archive":
+		return gf.fetchFromTarBz2(ctx)
 	default:
-		return fmt.Errorf("misconfigured GCSFetcher, unsupported -type %q", gf.SourceType)
+		return Stats{}, fmt.Errorf("misconfigured GCSFetcher, unsupported -type %q", gf.SourceType)
 	}
-	return nil
 }
 
 func formatGCSName(bucket, object string, generation int64) string {
@@ -16,21 +16,38 @@ limitations under the License.
 package fetcher
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"google.golang.org/api/googleapi"
 )
 
@@ -49,6 +66,9 @@ const (
 	efile2        = "efile2"
 	efile3        = "efile3"
 	efile4        = "efile4"
+	efile5        = "efile5"
+	efile6        = "efile6"
+	efile7        = "efile7"
 	errorManifest = "error-manifest.json"
 	errorZipfile  = "error-source.zip"
 
@@ -80,7 +100,20 @@ var (
 	errCreate       = fmt.Errorf("instrumented os.Create error")
 	errMkdirAll     = fmt.Errorf("instrumented os.MkdirAll error")
 	errOpen         = fmt.Errorf("instrumented os.Open error")
+	errChtimes      = fmt.Errorf("instrumented os.Chtimes error")
+	errChown        = fmt.Errorf("instrumented os.Chown error")
 	errGCS403       = fmt.Errorf("instrumented GCS AccessDenied error")
+	errGCS404       = fmt.Errorf("instrumented GCS Not Found error")
+	errGCS503       = fmt.Errorf("instrumented GCS Service Unavailable error")
+
+	// errGCSRequesterPays marks an object in a Requester Pays bucket; reads
+	// fail with requesterPaysGCSError unless a user project is given.
+	errGCSRequesterPays   = fmt.Errorf("instrumented GCS Requester Pays bucket")
+	requesterPaysGCSError = &googleapi.Error{
+		Code:    400,
+		Message: "Bucket is a requester pays bucket but no user project provided.",
+		Errors:  []googleapi.ErrorItem{{Reason: "required", Message: "Bucket is a requester pays bucket but no user project provided."}},
+	}
 )
 
 type fakeGCSErrorReader struct {
@@ -96,17 +129,89 @@ func (f fakeGCSErrorReader) Read([]byte) (int, error) {
 type fakeGCSResponse struct {
 	content []byte
 	err     error
+	crc32c  *uint32 // Overrides the CRC32C computed from content.
+
+	generation int64  // Reported by Attrs.
+	failAfter  int    // If positive, the first read fails after this many bytes.
+	noRanges   bool   // If true, NewRangeReader returns ErrRangeNotSupported.
+	retryAfter string // If set, the first read fails with a 429 carrying this Retry-After.
+
+	// gzipped marks content as stored with Content-Encoding: gzip. NewReader
+	// then decompresses it, as GCS does, unless ReadCompressed is set.
+	gzipped bool
+
+	// stallFirst makes the first read stall until its context is cancelled.
+	stallFirst bool
+
+	// truncateFirst, if positive, makes the first read end, without error,
+	// after this many bytes, as if the object was damaged in transit.
+	truncateFirst int
+
+	contentType string // Reported by Attrs.
+
+	// md5 overrides the MD5 computed from content, and composite, as for
+	// composite objects, makes Attrs report none.
+	md5       []byte
+	composite bool
+
+	updated  time.Time         // Reported by Attrs.
+	metadata map[string]string // Reported by Attrs.
+	attrsErr error             // Returned by Attrs, while reads still succeed.
+
+	// liveGeneration, if set, fails requests with any other
+	// IfGenerationMatch with a 412, as if the object was overwritten.
+	liveGeneration int64
+}
+
+// checkGeneration returns the 412 that GCS fails a request made with opts
+// with, if its IfGenerationMatch precondition does not hold.
+func (r fakeGCSResponse) checkGeneration(opts ReadOptions) error {
+	if r.liveGeneration == 0 || opts.IfGenerationMatch == 0 || opts.IfGenerationMatch == r.liveGeneration {
+		return nil
+	}
+	return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "At least one of the pre-conditions you specified did not hold."}
 }
 
 // fakeGCS allows us to simulate errors when interacting with GCS.
 type fakeGCS struct {
 	t       *testing.T
 	objects map[string]fakeGCSResponse
+
+	mu          sync.Mutex
+	interrupted map[string]bool // Objects whose failAfter read has happened.
+	offsets     []int64         // Offsets passed to NewRangeReader.
+	requested   []string        // Names of the objects read or stat'ed.
+	reads       map[string]int  // NewReader calls per object.
+
+	pageSize   int      // Objects per List page; 0 lists them all at once.
+	listTokens []string // Page tokens passed to List.
+
+	released atomic.Int32 // Stalled reads ended by cancelling their context.
 }
 
-func (f *fakeGCS) NewReader(context context.Context, bucket, object string) (io.ReadCloser, error) {
+// name returns the key of the instrumented response for an object. Requests
+// that don't pin a generation get the default one, generation.
+func (f *fakeGCS) name(bucket, object string, opts ReadOptions) string {
+	g := opts.Generation
+	if g == 0 {
+		g = generation
+	}
+	name := formatGCSName(bucket, object, g)
+	f.mu.Lock()
+	f.requested = append(f.requested, name)
+	f.mu.Unlock()
+	return name
+}
+
+func (f *fakeGCS) NewReader(context context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
 	f.t.Helper()
-	name := formatGCSName(bucket, object, generation)
+	name := f.name(bucket, object, opts)
+	f.mu.Lock()
+	if f.reads == nil {
+		f.reads = map[string]int{}
+	}
+	f.reads[name]++
+	f.mu.Unlock()
 
 	response, ok := f.objects[name]
 	if !ok {
@@ -114,10 +219,18 @@ func (f *fakeGCS) NewReader(context context.Context, bucket, object string) (io.
 		return nil, nil
 	}
 
+	if response.err == errGCSRequesterPays && opts.UserProject == "" {
+		return nil, requesterPaysGCSError
+	}
+
 	if response.err == errGCSNewReader {
 		return ioutil.NopCloser(bytes.NewReader([]byte(""))), response.err
 	}
 
+	if err := response.checkGeneration(opts); err != nil {
+		return nil, err
+	}
+
 	if response.err == errGCS403 {
 		message := "<Xml><Code>AccessDenied</Code><Details>some@robot has no access.</Details></Xml>"
 		err := &googleapi.Error{
@@ -127,6 +240,14 @@ func (f *fakeGCS) NewReader(context context.Context, bucket, object string) (io.
 		return ioutil.NopCloser(bytes.NewReader([]byte(""))), err
 	}
 
+	if response.err == errGCS404 {
+		return nil, &googleapi.Error{Code: 404, Message: "No such object"}
+	}
+
+	if response.err == errGCS503 {
+		return nil, &googleapi.Error{Code: 503, Message: "Service Unavailable"}
+	}
+
 	if response.err == errGCSRead {
 		return ioutil.NopCloser(fakeGCSErrorReader{err: response.err}), nil
 	}
@@ -135,21 +256,247 @@ func (f *fakeGCS) NewReader(context context.Context, bucket, object string) (io.
 		return ioutil.NopCloser(fakeGCSErrorReader{sleep: 1 * time.Second}), nil
 	}
 
-	if response.err != nil {
+	if response.err != nil && response.err != errGCSRequesterPays {
 		f.t.Fatalf("unexpected error type %v", response.err)
 	}
 
+	if response.retryAfter != "" {
+		f.mu.Lock()
+		first := !f.interrupted[name]
+		if f.interrupted == nil {
+			f.interrupted = map[string]bool{}
+		}
+		f.interrupted[name] = true
+		f.mu.Unlock()
+		if first {
+			return nil, &googleapi.Error{Code: http.StatusTooManyRequests, Message: "Too Many Requests", Header: http.Header{"Retry-After": {response.retryAfter}}}
+		}
+	}
+
+	if response.failAfter > 0 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.interrupted[name] {
+			if f.interrupted == nil {
+				f.interrupted = map[string]bool{}
+			}
+			f.interrupted[name] = true
+			r := io.MultiReader(bytes.NewReader(response.content[:response.failAfter]), fakeGCSErrorReader{err: errGCSRead})
+			return ioutil.NopCloser(r), nil
+		}
+	}
+
+	if response.stallFirst {
+		f.mu.Lock()
+		first := !f.interrupted[name]
+		if f.interrupted == nil {
+			f.interrupted = map[string]bool{}
+		}
+		f.interrupted[name] = true
+		f.mu.Unlock()
+		if first {
+			return ioutil.NopCloser(&stalledReader{ctx: context, released: func() { f.released.Add(1) }}), nil
+		}
+	}
+
+	if response.truncateFirst > 0 {
+		f.mu.Lock()
+		first := !f.interrupted[name]
+		if f.interrupted == nil {
+			f.interrupted = map[string]bool{}
+		}
+		f.interrupted[name] = true
+		f.mu.Unlock()
+		if first {
+			return ioutil.NopCloser(bytes.NewReader(response.content[:response.truncateFirst])), nil
+		}
+	}
+
+	if response.gzipped && !opts.ReadCompressed {
+		zr, err := gzip.NewReader(bytes.NewReader(response.content))
+		if err != nil {
+			f.t.Fatalf("decompressing %q: %v", name, err)
+		}
+		return zr, nil
+	}
 	return ioutil.NopCloser(bytes.NewReader(response.content)), nil
 }
 
+func (f *fakeGCS) NewRangeReader(context context.Context, bucket, object string, offset, length int64, opts ReadOptions) (io.ReadCloser, error) {
+	f.t.Helper()
+	name := f.name(bucket, object, opts)
+
+	response, ok := f.objects[name]
+	if !ok {
+		f.t.Fatalf("no %q in instrumented responses", name)
+		return nil, nil
+	}
+	if response.noRanges {
+		return nil, ErrRangeNotSupported
+	}
+	if err := response.checkGeneration(opts); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.offsets = append(f.offsets, offset)
+	f.mu.Unlock()
+
+	content := response.content[offset:]
+	if length >= 0 && length < int64(len(content)) {
+		content = content[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (f *fakeGCS) Attrs(context context.Context, bucket, object string, opts ReadOptions) (*ObjectAttrs, error) {
+	f.t.Helper()
+	name := f.name(bucket, object, opts)
+
+	response, ok := f.objects[name]
+	if !ok {
+		f.t.Fatalf("no %q in instrumented responses", name)
+		return nil, nil
+	}
+
+	if response.err == errGCSRequesterPays && opts.UserProject == "" {
+		return nil, requesterPaysGCSError
+	}
+
+	if response.attrsErr != nil {
+		return nil, response.attrsErr
+	}
+
+	if response.err == errGCS403 {
+		return nil, &googleapi.Error{Code: 403, Body: "<Xml><Code>AccessDenied</Code><Details>some@robot has no access.</Details></Xml>"}
+	}
+
+	if response.err == errGCS404 {
+		return nil, &googleapi.Error{Code: 404, Message: "No such object"}
+	}
+
+	if err := response.checkGeneration(opts); err != nil {
+		return nil, err
+	}
+
+	attrs := &ObjectAttrs{
+		Size:       int64(len(response.content)),
+		CRC32C:     crc32.Checksum(response.content, crc32cTable),
+		Generation: response.generation,
+	}
+	if response.crc32c != nil {
+		attrs.CRC32C = *response.crc32c
+	}
+	if response.gzipped {
+		attrs.ContentEncoding = "gzip"
+	}
+	attrs.ContentType = response.contentType
+	attrs.Updated = response.updated
+	attrs.Metadata = response.metadata
+	switch {
+	case response.composite:
+	case response.md5 != nil:
+		attrs.MD5 = response.md5
+	default:
+		sum := md5.Sum(response.content)
+		attrs.MD5 = sum[:]
+	}
+	return attrs, nil
+}
+
+// List returns the instrumented objects in bucket under prefix, sorted by
+// name, pageSize at a time. Page tokens are offsets into that list.
+func (f *fakeGCS) List(context context.Context, bucket, prefix, pageToken string, opts ReadOptions) ([]ListedObject, string, error) {
+	f.t.Helper()
+	f.mu.Lock()
+	f.listTokens = append(f.listTokens, pageToken)
+	f.mu.Unlock()
+	if bucket == errorBucket {
+		return nil, "", &googleapi.Error{Code: 503, Message: "Service Unavailable"}
+	}
+
+	var all []ListedObject
+	for name, response := range f.objects {
+		b, object, generation, err := common.ParseBucketObject(name)
+		if err != nil {
+			f.t.Fatalf("parsing instrumented name %q: %v", name, err)
+		}
+		if b == bucket && strings.HasPrefix(object, prefix) {
+			all = append(all, ListedObject{Name: object, Size: int64(len(response.content)), Generation: generation})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	start := 0
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil {
+			f.t.Fatalf("unexpected page token %q", pageToken)
+		}
+	}
+	end := len(all)
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+	var next string
+	if end < len(all) {
+		next = strconv.Itoa(end)
+	}
+	return all[start:end], next, nil
+}
+
 // fakeOS raises errors if configures, otherwise simply passes
 // through to the normal os package.
 type fakeOS struct {
+	OSFileSystem
+
 	errorsRename   int
 	errorsChmod    int
 	errorsCreate   int
 	errorsMkdirAll int
 	errorsOpen     int
+	errorsChtimes  int
+	errorsChown    int
+	errorsEXDEV    int // Renames that fail as if across file systems.
+
+	exdevFrom     string // Renames out of this directory fail as if across file systems.
+	failRenameTo  string // The next rename to a path ending in this fails with errRename.
+	honorReadOnly bool   // Create fails on read-only files, as it does for users other than root.
+
+	freeBytes int64 // Reported by AvailableBytes; 0 means unlimited.
+
+	fileSyncs, dirSyncs atomic.Int32 // Sync calls on opened files and directories.
+
+	mu      sync.Mutex
+	created []string          // Files opened for writing.
+	owners  map[string][2]int // The uid and gid each file was given.
+}
+
+// syncCountingFile counts the Sync calls on a file opened through a fakeOS.
+type syncCountingFile struct {
+	File
+	fs *fakeOS
+}
+
+func (f syncCountingFile) Sync() error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		f.fs.dirSyncs.Add(1)
+	} else {
+		f.fs.fileSyncs.Add(1)
+	}
+	return f.File.Sync()
+}
+
+// wrap returns file, if opened without error, counting its Sync calls.
+func (f *fakeOS) wrap(file File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return syncCountingFile{File: file, fs: f}, nil
 }
 
 func (f *fakeOS) Rename(oldpath, newpath string) error {
@@ -157,7 +504,17 @@ func (f *fakeOS) Rename(oldpath, newpath string) error {
 		f.errorsRename--
 		return errRename
 	}
-	return os.Rename(oldpath, newpath)
+	if f.failRenameTo != "" && strings.HasSuffix(newpath, f.failRenameTo) {
+		f.failRenameTo = ""
+		return errRename
+	}
+	if f.errorsEXDEV > 0 || (f.exdevFrom != "" && strings.HasPrefix(oldpath, f.exdevFrom+string(filepath.Separator))) {
+		if f.errorsEXDEV > 0 {
+			f.errorsEXDEV--
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return f.OSFileSystem.Rename(oldpath, newpath)
 }
 
 func (f *fakeOS) Chmod(name string, mode os.FileMode) error {
@@ -165,16 +522,20 @@ func (f *fakeOS) Chmod(name string, mode os.FileMode) error {
 		f.errorsChmod--
 		return errChmod
 	}
-	return os.Chmod(name, mode)
+	return f.OSFileSystem.Chmod(name, mode)
 }
 
-func (f *fakeOS) Create(name string) (*os.File, error) {
+func (f *fakeOS) Create(name string) (File, error) {
 	if f.errorsCreate > 0 {
 		f.errorsCreate--
 		return nil, errCreate
 	}
+	if info, err := os.Stat(name); f.honorReadOnly && err == nil && info.Mode().Perm()&0200 == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
 
-	return os.Create(name)
+	f.recordCreate(name)
+	return f.wrap(f.OSFileSystem.Create(name))
 }
 
 func (f *fakeOS) MkdirAll(path string, perm os.FileMode) error {
@@ -182,21 +543,69 @@ func (f *fakeOS) MkdirAll(path string, perm os.FileMode) error {
 		f.errorsMkdirAll--
 		return errMkdirAll
 	}
-	return os.MkdirAll(path, perm)
+	return f.OSFileSystem.MkdirAll(path, perm)
 }
 
-func (f *fakeOS) Open(name string) (*os.File, error) {
+func (f *fakeOS) Open(name string) (File, error) {
 	if f.errorsOpen > 0 {
 		f.errorsOpen--
 		return nil, errOpen
 	}
-	return os.Open(name)
+	return f.wrap(f.OSFileSystem.Open(name))
+}
+
+func (f *fakeOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 {
+		f.recordCreate(name)
+	}
+	return f.wrap(f.OSFileSystem.OpenFile(name, flag, perm))
+}
+
+func (f *fakeOS) recordCreate(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, name)
+}
+
+func (f *fakeOS) Chtimes(name string, atime, mtime time.Time) error {
+	if f.errorsChtimes > 0 {
+		f.errorsChtimes--
+		return errChtimes
+	}
+	return f.OSFileSystem.Chtimes(name, atime, mtime)
+}
+
+// Chown records the owner given to name, which must exist, without
+// changing it on disk.
+func (f *fakeOS) Chown(name string, uid, gid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errorsChown > 0 {
+		f.errorsChown--
+		return errChown
+	}
+	if _, err := os.Lstat(name); err != nil {
+		return err
+	}
+	if f.owners == nil {
+		f.owners = map[string][2]int{}
+	}
+	f.owners[name] = [2]int{uid, gid}
+	return nil
 }
 
-func (*fakeOS) RemoveAll(path string) error {
-	return os.RemoveAll(path)
+func (f *fakeOS) AvailableBytes(path string) (int64, error) {
+	if f.freeBytes == 0 {
+		return math.MaxInt64, nil
+	}
+	return f.freeBytes, nil
 }
 
+// noBackoff retries immediately.
+type noBackoff struct{}
+
+func (noBackoff) NextDelay(int) time.Duration { return 0 }
+
 type testContext struct {
 	gf      *Fetcher
 	gcs     *fakeGCS
@@ -225,6 +634,9 @@ func buildManifestTestContext(t *testing.T) (tc *testContext, teardown func()) {
 			formatGCSName(errorBucket, efile2, generation):              {err: errGCSRead},
 			formatGCSName(errorBucket, efile3, generation):              {err: errGCSSlowRead},
 			formatGCSName(errorBucket, efile4, generation):              {err: errGCS403},
+			formatGCSName(errorBucket, efile5, generation):              {content: sfile1Contents, err: errGCSRequesterPays},
+			formatGCSName(errorBucket, efile6, generation):              {err: errGCS404},
+			formatGCSName(errorBucket, efile7, generation):              {err: errGCS503},
 			formatGCSName(successBucket, goodManifest, generation):      {content: goodManifestContents},
 			formatGCSName(successBucket, malformedManifest, generation): {content: malformedManifestContents},
 			formatGCSName(errorBucket, errorManifest, generation):       {err: errGCSRead},
@@ -242,6 +654,7 @@ func buildManifestTestContext(t *testing.T) (tc *testContext, teardown func()) {
 		TimeoutGCS:  true,
 		WorkerCount: 2,
 		Retries:     maxretries,
+		Backoff:     noBackoff{},
 		Stdout:      os.Stdout,
 		Stderr:      os.Stderr,
 	}
@@ -302,6 +715,127 @@ func TestGCSAccessDenied(t *testing.T) {
 	}
 }
 
+func TestGCSRequesterPays(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	j := job{bucket: errorBucket, object: efile5}
+
+	result := tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "efile5.tmp"), make(chan struct{}, 1))
+	if _, ok := result.err.(*requesterPaysError); !ok {
+		t.Fatalf("fetchObjectOnce() without billing project got err=%v, want requesterPaysError", result.err)
+	}
+	if !strings.Contains(result.err.Error(), "no billing project was specified") {
+		t.Errorf("incorrect error message, got %q", result.err)
+	}
+
+	tc.gf.BillingProject = "my-project"
+	result = tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "efile5.tmp"), make(chan struct{}, 1))
+	if result.err != nil {
+		t.Fatalf("fetchObjectOnce() with billing project got err=%v, want nil", result.err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "efile5.tmp"))
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("ReadFile() = %q, %v, want %q", got, err, sfile1Contents)
+	}
+}
+
+func TestGCSNotFound(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	j := job{bucket: errorBucket, object: efile6}
+	result := tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "efile6.tmp"), make(chan struct{}, 1))
+	var nerr *notFoundError
+	if !errors.As(result.err, &nerr) {
+		t.Fatalf("fetchObjectOnce() result.err got %v, want notFoundError", result.err)
+	}
+	if want := "Object gs://error-bucket/efile6 not found"; !strings.HasPrefix(result.err.Error(), want) {
+		t.Errorf("fetchObjectOnce() result.err got %q, want prefix %q", result.err, want)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	cases := map[string]struct {
+		setup func(tc *testContext)
+		want  int
+	}{
+		"missing manifest entry": {
+			setup: func(tc *testContext) {
+				manifest := []byte(`{"efile6": {"SourceURL": "gs://error-bucket/efile6"}}`)
+				tc.gcs.objects[formatGCSName(successBucket, "missing.json", generation)] = fakeGCSResponse{content: manifest}
+				tc.gf.Object = "missing.json"
+				tc.gf.SourceType = "Manifest"
+			},
+			want: notFoundExitStatus,
+		},
+		"missing archive": {
+			setup: func(tc *testContext) {
+				tc.gf.Bucket, tc.gf.Object = errorBucket, efile6
+				tc.gf.SourceType = "ZipArchive"
+			},
+			want: notFoundExitStatus,
+		},
+		"permission denied": {
+			setup: func(tc *testContext) {
+				manifest := []byte(`{"efile4": {"SourceURL": "gs://error-bucket/efile4"}}`)
+				tc.gcs.objects[formatGCSName(successBucket, "denied.json", generation)] = fakeGCSResponse{content: manifest}
+				tc.gf.Object = "denied.json"
+				tc.gf.SourceType = "Manifest"
+			},
+			want: failureExitStatus,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			c.setup(tc)
+			err := tc.gf.Fetch(context.Background())
+			if err == nil {
+				t.Fatalf("Fetch() = nil, want error")
+			}
+			if got := ExitStatus(err); got != c.want {
+				t.Errorf("ExitStatus(%v) = %d, want %d", err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestFetchFromZipMissingArchive(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Bucket, tc.gf.Object = errorBucket, efile6
+
+	_, err := tc.gf.fetchFromZip(context.Background())
+	var eerr *ExitError
+	if !errors.As(err, &eerr) || eerr.Status != notFoundExitStatus {
+		t.Fatalf("fetchFromZip() = %v, want ExitError with status %d", err, notFoundExitStatus)
+	}
+	var nerr *notFoundError
+	if !errors.As(err, &nerr) {
+		t.Errorf("fetchFromZip() = %v, want it to wrap a notFoundError", err)
+	}
+}
+
+func TestIsRequesterPaysError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{requesterPaysGCSError, true},
+		{&googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "userProjectMissing"}}}, true},
+		{&googleapi.Error{Code: 400, Body: "<Error><Code>UserProjectMissing</Code></Error>"}, true},
+		{&googleapi.Error{Code: 400, Message: "Invalid argument."}, false},
+		{&googleapi.Error{Code: 403, Message: "requester pays"}, false},
+		{errNonNil, false},
+	} {
+		if got := isRequesterPaysError(tc.err); got != tc.want {
+			t.Errorf("isRequesterPaysError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
 func TestFetchObjectOnceFailureModes(t *testing.T) {
 
 	// GCS NewReader failure
@@ -343,102 +877,268 @@ func TestFetchObjectOnceFailureModes(t *testing.T) {
 	}
 	teardown()
 
-	// SHA checksum failure
-	// TODO(jasonco): Add a SHA checksum failure test
+	// SHA-1 checksum failure
+	tc, teardown = buildManifestTestContext(t)
+	j = job{bucket: successBucket, object: sfile1, filename: sfile1, sha1sum: "0000000000000000000000000000000000000000"}
+	result = tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "sfile1.tmp"), make(chan struct{}, 1))
+	if result.err == nil || !strings.Contains(result.err.Error(), "SHA-1 mismatch") {
+		t.Errorf("fetchObjectOnce did not fail correctly, got err=%v, want SHA-1 mismatch", result.err)
+	}
+	teardown()
+
+	// SHA-256 checksum failure
+	tc, teardown = buildManifestTestContext(t)
+	j = job{bucket: successBucket, object: sfile1, filename: sfile1, sha256sum: strings.Repeat("0", 64)}
+	result = tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "sfile1.tmp"), make(chan struct{}, 1))
+	if result.err == nil || !strings.Contains(result.err.Error(), "SHA-256 mismatch") {
+		t.Errorf("fetchObjectOnce did not fail correctly, got err=%v, want SHA-256 mismatch", result.err)
+	}
+	teardown()
 }
 
-func TestFetchObjectOnceWithTimeoutSucceeds(t *testing.T) {
+func TestFetchObjectOnceVerifiesDigests(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
 
-	j := job{bucket: successBucket, object: sfile1}
-	timeout := 10 * time.Second
-	dest := filepath.Join(tc.workDir, "sfile1.tmp")
-
-	n, err := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest)
-	if err != nil || int(n) != len(sfile1Contents) {
-		t.Errorf("fetchObjectOnceWithTimeout() got (%v, %v), want (%v, %v)", n, err, nil, len(sfile1Contents))
+	j := job{
+		bucket:    successBucket,
+		object:    sfile1,
+		filename:  sfile1,
+		sha1sum:   fmt.Sprintf("%x", sha1.Sum(sfile1Contents)),
+		sha256sum: fmt.Sprintf("%X", sha256.Sum256(sfile1Contents)), // Case is ignored.
+	}
+	result := tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "sfile1.tmp"), make(chan struct{}, 1))
+	if result.err != nil {
+		t.Errorf("fetchObjectOnce() result.err got %v, want nil", result.err)
 	}
 }
 
-func TestFetchObjectOnceWithTimeoutFailsOnTimeout(t *testing.T) {
+func TestFetchObjectOnceVerifiesCRC32C(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
+	tc.gf.VerifyCRC32C = true
 
-	j := job{bucket: errorBucket, object: efile3} // efile3 is a slow GCS read
-	timeout := 100 * time.Millisecond
-	dest := filepath.Join(tc.workDir, "efile3.tmp")
+	j := job{bucket: successBucket, object: sfile1, filename: sfile1}
+	result := tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "sfile1.tmp"), make(chan struct{}, 1))
+	if result.err != nil {
+		t.Errorf("fetchObjectOnce() result.err got %v, want nil", result.err)
+	}
 
-	if _, err := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest); err == nil {
-		t.Errorf("fetchObjectOnceWithTimeout() got err=nil, want err=%v", errGCSTimeout)
+	// Corrupt the expected checksum.
+	bad := uint32(1234)
+	tc.gcs.objects[formatGCSName(successBucket, sfile1, generation)] = fakeGCSResponse{content: sfile1Contents, crc32c: &bad}
+	result = tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "sfile1.tmp"), make(chan struct{}, 1))
+	var cerr *checksumError
+	if !errors.As(result.err, &cerr) || cerr.algorithm != "CRC32C" {
+		t.Errorf("fetchObjectOnce() result.err got %v, want CRC32C checksumError", result.err)
 	}
 }
 
-func TestFetchObjectSucceeds(t *testing.T) {
+func TestFetchObjectRetriesOnDigestMismatch(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
 
-	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt", sha256sum: strings.Repeat("0", 64)}
 	report := tc.gf.fetchObject(context.Background(), j)
 
-	if report.job != j {
-		t.Errorf("report.job got %v, want %v", report.job, j)
-	}
-	if !report.success {
-		t.Errorf("report.success got false, want true")
-	}
-	if report.err != nil {
-		t.Errorf("report.err got %v, want nil", report.err)
-	}
-	if report.started == zeroTime {
-		t.Errorf("report.started got %v, want report.started > %v", report.started, zeroTime)
-	}
-	if report.completed == zeroTime {
-		t.Errorf("report.completed got %v, want report.completed > %v", report.completed, zeroTime)
-	}
-	if int(report.size) != len(sfile1Contents) {
-		t.Errorf("report.size got %v, want %v", report.size, len(sfile1Contents))
+	if report.success {
+		t.Errorf("report.success got true, want false")
 	}
-	if report.finalname == "" {
-		t.Errorf("report.finalname got empty string, want non-empty string")
+	if len(report.attempts) != maxretries+1 {
+		t.Errorf("len(report.attempts) got %d, want %d", len(report.attempts), maxretries+1)
 	}
-	if len(report.attempts) != 1 {
-		t.Fatalf("len(report.attempts) got %d, want 1", len(report.attempts))
+	if report.err == nil || !strings.Contains(report.err.Error(), "SHA-256 mismatch") {
+		t.Errorf("report.err got %v, want SHA-256 mismatch", report.err)
 	}
+}
 
-	attempt := report.attempts[0]
-	if attempt.started == zeroTime {
-		t.Errorf("attempt.started got %v, want attempt.started > %v", attempt.started, zeroTime)
+func TestFetchObjectResumesInterruptedDownload(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.ResumeDownloads = true
+	tc.gcs.objects[formatGCSName(successBucket, sfile1, generation)] = fakeGCSResponse{content: sfile1Contents, generation: 7, failAfter: 5}
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt", sha1sum: fmt.Sprintf("%x", sha1.Sum(sfile1Contents))}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if !report.success {
+		t.Fatalf("report.success got false, want true; err=%v", report.err)
 	}
-	if attempt.duration == 0 {
-		t.Errorf("attempt.duration got %v, want attempt.duration>0", attempt.duration)
+	if len(report.attempts) != 2 {
+		t.Errorf("len(report.attempts) got %d, want 2", len(report.attempts))
 	}
-	if attempt.err != nil {
-		t.Errorf("attempt.err got %v, want nil", attempt.err)
+	if want := []int64{5}; !reflect.DeepEqual(tc.gcs.offsets, want) {
+		t.Errorf("NewRangeReader offsets got %v, want %v", tc.gcs.offsets, want)
 	}
-
 	got, err := ioutil.ReadFile(report.finalname)
 	if err != nil {
 		t.Fatalf("ReadFile(%v) got %v, want nil", report.finalname, err)
 	}
 	if !bytes.Equal(got, sfile1Contents) {
-		t.Fatalf("ReadFile(%v) got %v, want %v", report.finalname, got, sfile1Contents)
+		t.Errorf("ReadFile(%v) got %q, want %q", report.finalname, got, sfile1Contents)
+	}
+	if len(tc.gf.partials) != 0 {
+		t.Errorf("partials got %v, want empty", tc.gf.partials)
 	}
 }
 
-func TestFetchObjectRetriesUntilSuccess(t *testing.T) {
+func TestFetchObjectResumeFallsBackWithoutRanges(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
-	tc.os.errorsCreate = 1 // first create fails, second succeeds
+	tc.gf.ResumeDownloads = true
+	tc.gcs.objects[formatGCSName(successBucket, sfile1, generation)] = fakeGCSResponse{content: sfile1Contents, failAfter: 5, noRanges: true}
 
-	j := job{bucket: successBucket, object: sfile1, filename: "localhost.txt"}
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt", sha1sum: fmt.Sprintf("%x", sha1.Sum(sfile1Contents))}
 	report := tc.gf.fetchObject(context.Background(), j)
 
 	if !report.success {
-		t.Errorf("report.success got false, want true")
-	}
-	if report.err != nil {
-		t.Errorf("report.err got %v, want nil", report.err)
+		t.Fatalf("report.success got false, want true; err=%v", report.err)
+	}
+	got, err := ioutil.ReadFile(report.finalname)
+	if err != nil {
+		t.Fatalf("ReadFile(%v) got %v, want nil", report.finalname, err)
+	}
+	if !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("ReadFile(%v) got %q, want %q", report.finalname, got, sfile1Contents)
+	}
+}
+
+func TestFetchObjectWithoutResumeRestarts(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, sfile1, generation)] = fakeGCSResponse{content: sfile1Contents, failAfter: 5}
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if !report.success {
+		t.Fatalf("report.success got false, want true; err=%v", report.err)
+	}
+	if len(tc.gcs.offsets) != 0 {
+		t.Errorf("NewRangeReader offsets got %v, want none", tc.gcs.offsets)
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	dest := filepath.Join(tc.workDir, "partial.tmp")
+	if err := ioutil.WriteFile(dest, []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		desc  string
+		attrs ObjectAttrs
+		want  int64
+	}{
+		{"first attempt", ObjectAttrs{Size: 10, Generation: 1}, 0},
+		{"same object", ObjectAttrs{Size: 10, Generation: 1}, 5},
+		{"new generation", ObjectAttrs{Size: 10, Generation: 2}, 0},
+		{"same generation again", ObjectAttrs{Size: 10, Generation: 2}, 5},
+		{"new size", ObjectAttrs{Size: 11, Generation: 2}, 0},
+		{"shorter than staged", ObjectAttrs{Size: 4, Generation: 2}, 0},
+		{"still shorter than staged", ObjectAttrs{Size: 4, Generation: 2}, 0},
+	} {
+		if got := tc.gf.resumeOffset(dest, c.attrs); got != c.want {
+			t.Errorf("%s: resumeOffset(%v) got %d, want %d", c.desc, c.attrs, got, c.want)
+		}
+	}
+}
+
+func TestFetchObjectOnceWithTimeoutSucceeds(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	j := job{bucket: successBucket, object: sfile1}
+	timeout := 10 * time.Second
+	dest := filepath.Join(tc.workDir, "sfile1.tmp")
+
+	result := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest)
+	if result.err != nil || int(result.size) != len(sfile1Contents) {
+		t.Errorf("fetchObjectOnceWithTimeout() got (%v, %v), want (%v, %v)", result.size, result.err, nil, len(sfile1Contents))
+	}
+}
+
+func TestFetchObjectOnceWithTimeoutFailsOnTimeout(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	j := job{bucket: errorBucket, object: efile3} // efile3 is a slow GCS read
+	timeout := 100 * time.Millisecond
+	dest := filepath.Join(tc.workDir, "efile3.tmp")
+
+	if err := tc.gf.fetchObjectOnceWithTimeout(context.Background(), j, timeout, dest).err; err == nil {
+		t.Errorf("fetchObjectOnceWithTimeout() got err=nil, want err=%v", errGCSTimeout)
+	}
+}
+
+func TestFetchObjectSucceeds(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if report.job != j {
+		t.Errorf("report.job got %v, want %v", report.job, j)
+	}
+	if !report.success {
+		t.Errorf("report.success got false, want true")
+	}
+	if report.err != nil {
+		t.Errorf("report.err got %v, want nil", report.err)
+	}
+	if report.started == zeroTime {
+		t.Errorf("report.started got %v, want report.started > %v", report.started, zeroTime)
+	}
+	if report.completed == zeroTime {
+		t.Errorf("report.completed got %v, want report.completed > %v", report.completed, zeroTime)
+	}
+	if int(report.size) != len(sfile1Contents) {
+		t.Errorf("report.size got %v, want %v", report.size, len(sfile1Contents))
+	}
+	if report.finalname == "" {
+		t.Errorf("report.finalname got empty string, want non-empty string")
+	}
+	if len(report.attempts) != 1 {
+		t.Fatalf("len(report.attempts) got %d, want 1", len(report.attempts))
+	}
+
+	attempt := report.attempts[0]
+	if attempt.started == zeroTime {
+		t.Errorf("attempt.started got %v, want attempt.started > %v", attempt.started, zeroTime)
+	}
+	if attempt.duration == 0 {
+		t.Errorf("attempt.duration got %v, want attempt.duration>0", attempt.duration)
+	}
+	if attempt.err != nil {
+		t.Errorf("attempt.err got %v, want nil", attempt.err)
+	}
+
+	got, err := ioutil.ReadFile(report.finalname)
+	if err != nil {
+		t.Fatalf("ReadFile(%v) got %v, want nil", report.finalname, err)
+	}
+	if !bytes.Equal(got, sfile1Contents) {
+		t.Fatalf("ReadFile(%v) got %v, want %v", report.finalname, got, sfile1Contents)
+	}
+}
+
+func TestFetchObjectRetriesUntilSuccess(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsCreate = 1 // first create fails, second succeeds
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localhost.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if !report.success {
+		t.Errorf("report.success got false, want true")
+	}
+	if report.err != nil {
+		t.Errorf("report.err got %v, want nil", report.err)
 	}
 
 	if len(report.attempts) != 2 {
@@ -498,6 +1198,79 @@ func TestFetchObjectRetriesMaxTimes(t *testing.T) {
 	}
 }
 
+func TestFetchObjectDoesNotRetryPermanentErrors(t *testing.T) {
+	for _, object := range []string{efile4, efile6} {
+		t.Run(object, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+
+			j := job{bucket: errorBucket, object: object, filename: "localfile.txt"}
+			report := tc.gf.fetchObject(context.Background(), j)
+
+			if report.success {
+				t.Errorf("report.success got true, want false")
+			}
+			if len(report.attempts) != 1 {
+				t.Errorf("len(report.attempts) got %d, want 1", len(report.attempts))
+			}
+			if !report.attempts[0].permanent {
+				t.Errorf("attempt.permanent got false, want true")
+			}
+		})
+	}
+}
+
+func TestFetchObjectRetriesTransientErrors(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	j := job{bucket: errorBucket, object: efile7, filename: "localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+
+	if report.success {
+		t.Errorf("report.success got true, want false")
+	}
+	if len(report.attempts) != maxretries+1 {
+		t.Errorf("len(report.attempts) got %d, want %d", len(report.attempts), maxretries+1)
+	}
+	for i, a := range report.attempts {
+		if a.permanent {
+			t.Errorf("attempt[%d].permanent got true, want false", i)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 401}, false},
+		{&googleapi.Error{Code: 403}, false},
+		{fmt.Errorf("creating GCS reader: %w", &googleapi.Error{Code: 404}), false},
+		{storage.ErrObjectNotExist, false},
+		{&permissionError{bucket: "b"}, false},
+		{&requesterPaysError{bucket: "b"}, false},
+		{&notFoundError{object: "gs://b/o"}, false},
+		{context.Canceled, false},
+		{&googleapi.Error{Code: 408}, true},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 502}, true},
+		{fmt.Errorf("creating GCS reader: %w", &googleapi.Error{Code: 503}), true},
+		{&googleapi.Error{Code: 504}, true},
+		{errGCSTimeout, true},
+		{&checksumError{algorithm: "SHA-1"}, true},
+		{errCreate, true},
+	} {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("isRetryable(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
 func TestFetchObjectRetriesOnFolderCreationError(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
@@ -594,6 +1367,103 @@ func TestFetchObjectRetriesOnRenameFailure(t *testing.T) {
 	}
 }
 
+func TestFetchObjectInPlaceWrite(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.InPlaceWrite = true
+	tc.os.errorsRename = 1 // Fails the fetch if it renames anything.
+
+	j := job{bucket: successBucket, object: sfile1, filename: "dir/localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success || len(report.attempts) != 1 {
+		t.Fatalf("fetchObject() success = %v after %d attempts, err = %v; want success after 1", report.success, len(report.attempts), report.err)
+	}
+
+	finalname := filepath.Join(tc.workDir, "dir/localfile.txt")
+	if want := []string{finalname}; !reflect.DeepEqual(tc.os.created, want) {
+		t.Errorf("files created = %q, want %q", tc.os.created, want)
+	}
+	if _, err := os.Stat(tc.gf.StagingDir); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want no staging dir", tc.gf.StagingDir, err)
+	}
+	got, err := ioutil.ReadFile(finalname)
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("ReadFile(%q) = %q, %v; want %q", finalname, got, err, sfile1Contents)
+	}
+}
+
+func TestFetchObjectInPlaceWriteStagesAfterTimeout(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.InPlaceWrite = true
+	tc.gf.Retries = 1
+	tc.gf.TimeoutRules = map[string][]time.Duration{"": {10 * time.Millisecond, 10 * time.Millisecond}}
+
+	j := job{bucket: errorBucket, object: efile3, filename: "localfile.txt"}
+	if report := tc.gf.fetchObject(context.Background(), j); report.success {
+		t.Fatalf("fetchObject() succeeded, want timeouts")
+	}
+
+	tc.os.mu.Lock()
+	defer tc.os.mu.Unlock()
+	if len(tc.os.created) != 2 {
+		t.Fatalf("files created = %q, want 2", tc.os.created)
+	}
+	if want := filepath.Join(tc.workDir, "localfile.txt"); tc.os.created[0] != want {
+		t.Errorf("first attempt wrote %q, want %q", tc.os.created[0], want)
+	}
+	if got := tc.os.created[1]; filepath.Dir(got) != filepath.Clean(tc.gf.StagingDir) {
+		t.Errorf("retry after a timeout wrote %q, want a file in %q", got, tc.gf.StagingDir)
+	}
+}
+
+func TestFetchObjectRetriesSlowReadWithNewReader(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.TimeoutRules = map[string][]time.Duration{"": {50 * time.Millisecond}}
+	name := formatGCSName(successBucket, sfile3, generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: sfile3Contents, stallFirst: true}
+
+	j := job{bucket: successBucket, object: sfile3, filename: sfile3}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success {
+		t.Fatalf("fetchObject() = %v, want success on the second attempt", report.err)
+	}
+	if len(report.attempts) != 2 {
+		t.Fatalf("fetchObject() made %d attempts, want 2", len(report.attempts))
+	}
+	if first := report.attempts[0]; !first.timedOut || !errors.Is(first.err, errGCSTimeout) {
+		t.Errorf("first attempt timedOut = %v, err = %v; want a timeout", first.timedOut, first.err)
+	}
+	if report.attempts[1].timedOut {
+		t.Errorf("second attempt timedOut = true, want false")
+	}
+	if got := tc.gcs.reads[name]; got != 2 {
+		t.Errorf("NewReader called %d times, want 2", got)
+	}
+	// The stalled read is torn down rather than left hanging.
+	for deadline := time.Now().Add(time.Second); tc.gcs.released.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled read still open after the retry succeeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var st stats
+	tc.gf.consumeReports(singleReport(*report), tc.gf.newProgress(-1, -1), &st)
+	if st.timeouts != 1 {
+		t.Errorf("stats.timeouts = %d, want 1", st.timeouts)
+	}
+}
+
+// singleReport returns a closed channel holding report.
+func singleReport(report jobReport) <-chan jobReport {
+	reports := make(chan jobReport, 1)
+	reports <- report
+	close(reports)
+	return reports
+}
+
 func TestFetchObjectRetriesOnChmodFailure(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
@@ -641,7 +1511,7 @@ func TestDoWork(t *testing.T) {
 	}
 
 	// Process the jobs
-	go tc.gf.doWork(context.Background(), todo, results)
+	go tc.gf.doWork(context.Background(), todo, results, nil)
 
 	// Get n reports
 	var gotFiles []string
@@ -685,7 +1555,10 @@ func TestProcessJobs(t *testing.T) {
 		{bucket: successBucket, object: sfile3, filename: "sfile3"},
 	}
 
-	stats := tc.gf.processJobs(context.Background(), jobs)
+	stats, err := tc.gf.processJobs(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("processJobs() got %v, want nil", err)
+	}
 
 	if !stats.success {
 		t.Errorf("processJobs() stats.success got false, want true")
@@ -706,6 +1579,37 @@ func TestProcessJobs(t *testing.T) {
 	}
 }
 
+func TestProcessJobsOverallTimeout(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.TimeoutGCS = false // Only the overall deadline can stop the slow read.
+	tc.gf.OverallTimeout = 500 * time.Millisecond
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: errorBucket, object: efile3, filename: "efile3"},
+	}
+
+	started := time.Now()
+	stats, err := tc.gf.processJobs(context.Background(), jobs)
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("processJobs() took %v, want about %v", elapsed, tc.gf.OverallTimeout)
+	}
+	derr, ok := err.(*deadlineExceededError)
+	if !ok {
+		t.Fatalf("processJobs() got %v, want deadlineExceededError", err)
+	}
+	if derr.fetched != 1 || derr.want != 2 {
+		t.Errorf("deadlineExceededError got %d of %d files fetched, want 1 of 2", derr.fetched, derr.want)
+	}
+	if stats.success || len(stats.reports) != 2 {
+		t.Errorf("processJobs() stats got success %v with %d reports, want failure with 2", stats.success, len(stats.reports))
+	}
+	if _, err := os.Stat(filepath.Join(tc.workDir, "sfile1")); err != nil {
+		t.Errorf("completed file sfile1 was not kept: %v", err)
+	}
+}
+
 func TestFetchFromManifestSuccess(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
@@ -713,7 +1617,7 @@ func TestFetchFromManifestSuccess(t *testing.T) {
 	tc.gf.Bucket = successBucket
 	tc.gf.Object = goodManifest
 
-	err := tc.gf.fetchFromManifest(context.Background())
+	_, err := tc.gf.fetchFromManifest(context.Background())
 	if err != nil {
 		t.Errorf("fetchFromManifest() got %v, want nil", err)
 	}
@@ -728,47 +1632,479 @@ func TestFetchFromManifestSuccess(t *testing.T) {
 	}
 }
 
-func TestFetchFromManifestManifestFetchFailed(t *testing.T) {
+func TestFetchWithStats(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
+	manifest := []byte(`{
+		"sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+		"efile2":     {"sourceUrl": "gs://error-bucket/efile2"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "stats.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "stats.json"
+	tc.gf.SourceType = "Manifest"
 
-	tc.gf.Bucket = errorBucket
-	tc.gf.Object = errorManifest
-
-	err := tc.gf.fetchFromManifest(context.Background())
-	if err == nil || !strings.Contains(err.Error(), errGCSRead.Error()) {
-		t.Errorf("fetchFromManifest() err=%v, want contains %v", err, errGCSRead)
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err == nil {
+		t.Fatalf("FetchWithStats() = nil, want error")
+	}
+	if got := ExitStatus(err); got != failureExitStatus {
+		t.Errorf("ExitStatus(%v) = %d, want %d", err, got, failureExitStatus)
+	}
+	if st.Files != 3 {
+		t.Errorf("Stats.Files = %d, want 3", st.Files)
+	}
+	if want := int64(len(sfile1Contents) + len(sfile2Contents)); st.Bytes != want {
+		t.Errorf("Stats.Bytes = %d, want %d", st.Bytes, want)
+	}
+	if st.Retries != maxretries {
+		t.Errorf("Stats.Retries = %d, want %d", st.Retries, maxretries)
+	}
+	if len(st.Errors) != 1 {
+		t.Errorf("Stats.Errors = %v, want 1 error", st.Errors)
+	}
+	if st.Elapsed <= 0 {
+		t.Errorf("Stats.Elapsed = %v, want > 0", st.Elapsed)
 	}
 }
 
-func TestFetchFromManifestManifestJSONDeserializtionFailed(t *testing.T) {
+func TestFetchFromManifestInvalidSourceURLs(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
+	manifest := []byte(`{
+		"good.js":    {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"http.js":    {"sourceUrl": "http://example.com/sfile1.js"},
+		"empty.js":   {"sourceUrl": ""},
+		"missing.js": {},
+		"nobucket":   {"sourceUrl": "gs:///sfile1.js"},
+		"noobject":   {"sourceUrl": "gs://success-bucket/"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "invalid.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "invalid.json"
 
-	tc.gf.Bucket = successBucket
-	tc.gf.Object = malformedManifest
+	_, err := tc.gf.fetchFromManifest(context.Background())
+	var verr *manifestValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("fetchFromManifest() = %v, want a manifestValidationError", err)
+	}
+	bad := []string{"http.js", "empty.js", "missing.js", "nobucket", "noobject"}
+	if len(verr.invalid) != len(bad) {
+		t.Errorf("invalid entries = %v, want %q", verr.invalid, bad)
+	}
+	for _, key := range bad {
+		if !strings.Contains(err.Error(), strconv.Quote(key)) {
+			t.Errorf("error %q does not mention %q", err, key)
+		}
+	}
+	if strings.Contains(err.Error(), "good.js") {
+		t.Errorf("error %q mentions the valid entry good.js", err)
+	}
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)]; got != 0 {
+		t.Errorf("%s read %d times, want 0: nothing should be fetched from a bad manifest", sfile1, got)
+	}
+}
 
-	wantErrStr := "decoding JSON from manifest file"
-	err := tc.gf.fetchFromManifest(context.Background())
-	if err == nil || !strings.Contains(err.Error(), wantErrStr) {
-		t.Errorf("fetchFromManifest() err=%v, want contains %q", err, wantErrStr)
+func TestOnComplete(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		sourceType string
+		object     string
+		content    []byte
+		atomic     bool
+		want       []string // Relative to DestDir; nil if OnComplete should not be called.
+	}{{
+		name:       "manifest",
+		sourceType: "Manifest",
+		object:     "manifest.json",
+		content:    []byte(`{"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"}, "d/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}}`),
+		want:       []string{"d/sfile2.jpg", "sfile1.js"},
+	}, {
+		name:       "atomic manifest",
+		sourceType: "Manifest",
+		object:     "manifest.json",
+		content:    []byte(`{"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"}, "d/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}}`),
+		atomic:     true,
+		want:       []string{"d/sfile2.jpg", "sfile1.js"},
+	}, {
+		name:       "failed manifest",
+		sourceType: "Manifest",
+		object:     "manifest.json",
+		content:    []byte(`{"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"}, "efile6": {"sourceUrl": "gs://error-bucket/efile6"}}`),
+	}, {
+		name:       "zip",
+		sourceType: "ZipArchive",
+		object:     "source.zip",
+		content:    flattenTestArchive(t, "zip"),
+		want:       []string{"a/x.txt", "b/c/x.txt", "b/y.txt"},
+	}, {
+		name:       "tgz",
+		sourceType: "TarGzArchive",
+		object:     "source.tgz",
+		content:    flattenTestArchive(t, "tgz"),
+		want:       []string{"a/x.txt", "b/c/x.txt", "b/y.txt"},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, test.object, generation)] = fakeGCSResponse{content: test.content}
+			tc.gf.Object = test.object
+			tc.gf.SourceType = test.sourceType
+			tc.gf.Atomic = test.atomic
+
+			var calls int
+			var got []string
+			var gotStats Stats
+			tc.gf.OnComplete = func(stats Stats, files []string) {
+				calls++
+				gotStats, got = stats, files
+			}
+			st, err := tc.gf.FetchWithStats(context.Background())
+
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("FetchWithStats() = nil, want error")
+				}
+				if calls != 0 {
+					t.Errorf("OnComplete called %d times after a failed fetch, want 0", calls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchWithStats() = %v", err)
+			}
+			if calls != 1 {
+				t.Fatalf("OnComplete called %d times, want 1", calls)
+			}
+			destDir, err := filepath.Abs(tc.workDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, name := range test.want {
+				want = append(want, filepath.Join(destDir, name))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("OnComplete files = %q, want %q", got, want)
+			}
+			if gotStats.Files != st.Files {
+				t.Errorf("OnComplete stats.Files = %d, want %d", gotStats.Files, st.Files)
+			}
+		})
 	}
 }
 
-func TestFetchFromManifestManifestFileReadFailed(t *testing.T) {
+func TestFetchFromManifestGenerations(t *testing.T) {
 	tc, teardown := buildManifestTestContext(t)
 	defer teardown()
-	tc.os.errorsOpen = 1 // Error returned when trying to open the downloaded manifest file
 
-	err := tc.gf.fetchFromManifest(context.Background())
-	if err == nil || !strings.Contains(err.Error(), errOpen.Error()) {
-		t.Errorf("fetchFromManifest() err=%v, want contains %v", err, errOpen)
+	manifest := []byte(`{
+		"unpinned":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"in-url":    {"sourceUrl": "gs://success-bucket/sfile2.jpg#111"},
+		"in-entry":  {"sourceUrl": "gs://success-bucket/sfile3", "generation": 222},
+		"overrides": {"sourceUrl": "gs://success-bucket/sfile3#111", "generation": 333}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "generations.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gcs.objects[formatGCSName(successBucket, sfile2, 111)] = fakeGCSResponse{content: sfile2Contents}
+	tc.gcs.objects[formatGCSName(successBucket, sfile3, 222)] = fakeGCSResponse{content: sfile3Contents}
+	tc.gcs.objects[formatGCSName(successBucket, sfile3, 333)] = fakeGCSResponse{content: sfile1Contents}
+	tc.gf.Object = "generations.json"
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() got %v, want nil", err)
 	}
-}
 
-func TestTimeout(t *testing.T) {
-	tests := []struct {
-		filename string
+	got := append([]string{}, tc.gcs.requested...)
+	sort.Strings(got)
+	want := []string{
+		formatGCSName(successBucket, "generations.json", generation),
+		formatGCSName(successBucket, sfile1, generation),
+		formatGCSName(successBucket, sfile2, 111),
+		formatGCSName(successBucket, sfile3, 222),
+		formatGCSName(successBucket, sfile3, 333),
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requested objects got %v, want %v", got, want)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(tc.workDir, "overrides"))
+	if err != nil || !bytes.Equal(content, sfile1Contents) {
+		t.Errorf("ReadFile(overrides) got (%q, %v), want (%q, nil)", content, err, sfile1Contents)
+	}
+}
+
+func TestFetchFromManifestDedupeIdentical(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	manifest := []byte(`{
+		"first":      {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"dir/second": {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"pinned":     {"sourceUrl": "gs://success-bucket/sfile1.js#111"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "dupes.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gcs.objects[formatGCSName(successBucket, sfile1, 111)] = fakeGCSResponse{content: sfile2Contents}
+	tc.gf.Object = "dupes.json"
+	tc.gf.DedupeIdentical = true
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() got %v, want nil", err)
+	}
+
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)]; got != 1 {
+		t.Errorf("NewReader calls for %s = %d, want 1", sfile1, got)
+	}
+	// A different generation is different content, and is fetched too.
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, 111)]; got != 1 {
+		t.Errorf("NewReader calls for %s#111 = %d, want 1", sfile1, got)
+	}
+	for name, want := range map[string][]byte{"first": sfile1Contents, "dir/second": sfile1Contents, "pinned": sfile2Contents} {
+		content, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+		if err != nil || !bytes.Equal(content, want) {
+			t.Errorf("ReadFile(%s) got (%q, %v), want (%q, nil)", name, content, err, want)
+		}
+	}
+}
+
+func TestLinkDuplicatesFallsBackToCopy(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	m := NewMemFileSystem()
+	tc.gf.OS = linklessFS{m}
+	tc.gf.DestDir = "/src"
+
+	f, err := m.Create("/fetched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(sfile1Contents)
+	f.Close()
+
+	report := jobReport{success: true, finalname: "/fetched", size: sizeBytes(len(sfile1Contents))}
+	reports := tc.gf.linkDuplicates(report, []job{{filename: "copy"}})
+	if len(reports) != 1 || !reports[0].success {
+		t.Fatalf("linkDuplicates() got %+v, want one successful report", reports)
+	}
+	if got := m.MapFS()["src/copy"]; got == nil || !bytes.Equal(got.Data, sfile1Contents) {
+		t.Errorf("src/copy got %+v, want %q", got, sfile1Contents)
+	}
+
+	failed := jobReport{err: errNonNil}
+	reports = tc.gf.linkDuplicates(failed, []job{{filename: "other"}})
+	if len(reports) != 1 || reports[0].success || reports[0].err != errNonNil {
+		t.Errorf("linkDuplicates() of a failed fetch got %+v, want a report failing with %v", reports, errNonNil)
+	}
+}
+
+// linklessFS is a FileSystem without hard links.
+type linklessFS struct {
+	FileSystem
+}
+
+func (linklessFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+}
+
+func TestFetchFromManifestFilters(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{name: "no filters", want: []string{sfile1, sfile2, sfile3}},
+		{name: "include", include: []string{"*.js", "*.jpg"}, want: []string{sfile1, sfile2}},
+		{name: "exclude", exclude: []string{"*.jpg"}, want: []string{sfile1, sfile3}},
+		{name: "include and exclude", include: []string{"sfile*"}, exclude: []string{"sfile3"}, want: []string{sfile1, sfile2}},
+		{name: "exclude everything", exclude: []string{"*"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, teardown := buildManifestTestContext(t)
+			defer teardown()
+			ctx.gf.SourceType = "Manifest"
+			ctx.gf.Include = tc.include
+			ctx.gf.Exclude = tc.exclude
+
+			if err := ctx.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() = %v, want nil", err)
+			}
+			infos, err := ioutil.ReadDir(ctx.gf.DestDir)
+			if err != nil {
+				t.Fatalf("ReadDir(%v) err = %v, want nil", ctx.gf.DestDir, err)
+			}
+			var got []string
+			for _, info := range infos {
+				got = append(got, info.Name())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("fetched files = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFetchInvalidFilter(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.SourceType = "Manifest"
+	tc.gf.Exclude = []string{"["}
+
+	if err := tc.gf.Fetch(context.Background()); err == nil {
+		t.Error("Fetch() with malformed pattern succeeded, want error")
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	for _, tc := range []struct {
+		include, exclude []string
+		name             string
+		want             bool
+	}{
+		{name: "any/file.go", want: true},
+		{include: []string{"src"}, name: "src/pkg/file.go", want: true},
+		{include: []string{"src/*"}, name: "src/pkg/file.go", want: true},
+		{include: []string{"src/*.go"}, name: "src/pkg/file.go", want: false},
+		{include: []string{"src"}, name: "docs/index.md", want: false},
+		{include: []string{"src"}, name: "./src/", want: true},
+		{exclude: []string{"vendor"}, name: "vendor/lib/lib.go", want: false},
+		{exclude: []string{"*.md"}, name: "docs/index.md", want: true},
+		{exclude: []string{"*/*.md"}, name: "docs/index.md", want: false},
+		{include: []string{"src"}, exclude: []string{"src/testdata"}, name: "src/testdata/x", want: false},
+		{include: []string{"src"}, exclude: []string{"src/testdata"}, name: "src/main.go", want: true},
+	} {
+		gf := &Fetcher{Include: tc.include, Exclude: tc.exclude}
+		if got := gf.included(tc.name); got != tc.want {
+			t.Errorf("included(%q) with include=%q exclude=%q = %t, want %t", tc.name, tc.include, tc.exclude, got, tc.want)
+		}
+	}
+}
+
+func TestFetchFromManifestRewritePath(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	manifest := []byte(`{
+		"src/a/sfile1.js":        {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"src/sfile2.jpg":         {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+		"src/vendor/lib/sfile3":  {"sourceUrl": "gs://success-bucket/sfile3"},
+		"README":                 {"sourceUrl": "gs://success-bucket/sfile3"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "rewrite.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "rewrite.json"
+	tc.gf.RewritePath = func(key string) (string, bool) {
+		rel := strings.TrimPrefix(key, "src/")
+		if rel == "vendor" || strings.HasPrefix(rel, "vendor/") {
+			return "", false
+		}
+		return rel, true
+	}
+
+	st, err := tc.gf.fetchFromManifest(context.Background())
+	if err != nil {
+		t.Fatalf("fetchFromManifest() = %v", err)
+	}
+	want := []string{"README", "a/sfile1.js", "sfile2.jpg"}
+	if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("files in DestDir got %v, want %v", got, want)
+	}
+	if st.Skipped != 1 {
+		t.Errorf("Stats.Skipped = %d, want 1", st.Skipped)
+	}
+}
+
+func TestFetchFromManifestDryRun(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.DryRun = true
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Errorf("fetchFromManifest() got %v, want nil", err)
+	}
+
+	// Nothing, not even the staging directory, should have been written.
+	infos, err := ioutil.ReadDir(tc.gf.DestDir)
+	if err != nil {
+		t.Fatalf("ReadDir(%v) err = %v, want nil", tc.gf.DestDir, err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("ReadDir(%v) len(fileinfos)=%v, want 0", tc.gf.DestDir, len(infos))
+	}
+}
+
+func TestProcessJobsDryRun(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.DryRun = true
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+		{bucket: successBucket, object: sfile3, filename: "sfile3"},
+	}
+	stats, err := tc.gf.processJobs(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("processJobs() got %v, want nil", err)
+	}
+
+	if !stats.success {
+		t.Errorf("processJobs() stats.success got false, want true")
+	}
+	if stats.files != len(jobs) {
+		t.Errorf("processJobs stats.files got %d, want %d", stats.files, len(jobs))
+	}
+	wantSize := len(sfile1Contents) + len(sfile2Contents) + len(sfile3Contents)
+	if int(stats.size) != wantSize {
+		t.Errorf("processJobs() stats.size got %d, want %d", stats.size, wantSize)
+	}
+	for _, j := range jobs {
+		if _, err := os.Stat(filepath.Join(tc.gf.DestDir, j.filename)); !os.IsNotExist(err) {
+			t.Errorf("file %q exists, want not exists", j.filename)
+		}
+	}
+	if _, err := os.Stat(tc.gf.StagingDir); !os.IsNotExist(err) {
+		t.Errorf("staging dir %q exists, want not exists", tc.gf.StagingDir)
+	}
+}
+
+func TestFetchFromManifestManifestFetchFailed(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	tc.gf.Bucket = errorBucket
+	tc.gf.Object = errorManifest
+
+	_, err := tc.gf.fetchFromManifest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), errGCSRead.Error()) {
+		t.Errorf("fetchFromManifest() err=%v, want contains %v", err, errGCSRead)
+	}
+}
+
+func TestFetchFromManifestManifestJSONDeserializtionFailed(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	tc.gf.Bucket = successBucket
+	tc.gf.Object = malformedManifest
+
+	wantErrStr := "decoding JSON from manifest file"
+	_, err := tc.gf.fetchFromManifest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), wantErrStr) {
+		t.Errorf("fetchFromManifest() err=%v, want contains %q", err, wantErrStr)
+	}
+}
+
+func TestFetchFromManifestManifestFileReadFailed(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsOpen = 1 // Error returned when trying to open the downloaded manifest file
+
+	_, err := tc.gf.fetchFromManifest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), errOpen.Error()) {
+		t.Errorf("fetchFromManifest() err=%v, want contains %v", err, errOpen)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		filename string
 		retrynum int
 		want     time.Duration
 	}{
@@ -792,6 +2128,38 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestTimeoutRules(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.TimeoutRules = map[string][]time.Duration{
+		".bin": {time.Minute, 2 * time.Minute},
+		"":     {5 * time.Second},
+	}
+
+	tests := []struct {
+		filename string
+		retrynum int
+		want     time.Duration
+	}{
+		{"assets/x.bin", 0, time.Minute},
+		{"assets/x.bin", 1, 2 * time.Minute},
+		{"assets/x.bin", 2, defaultTimeout},
+		{"source.js", 0, 5 * time.Second},
+		{"no-extension", 1, defaultTimeout},
+	}
+	for _, test := range tests {
+		if got := tc.gf.timeout(test.filename, test.retrynum); got != test.want {
+			t.Errorf("timeout(%v, %v) got %v, want %v", test.filename, test.retrynum, got, test.want)
+		}
+	}
+
+	// Without a default rule, other files keep the built-in timeouts.
+	delete(tc.gf.TimeoutRules, "")
+	if got := tc.gf.timeout("source.js", 0); got != sourceTimeout[0] {
+		t.Errorf("timeout(source.js, 0) got %v, want %v", got, sourceTimeout[0])
+	}
+}
+
 func TestUnzip(t *testing.T) {
 	type zipEntry struct {
 		name    string
@@ -901,7 +2269,7 @@ func TestUnzip(t *testing.T) {
 			}
 
 			// Unzip the archive (this is the function under test).
-			_, err = unzip(zipfile, dest)
+			_, err = (&Fetcher{OS: &fakeOS{}}).unzip(context.Background(), zipfile, dest)
 
 			// Walk the unzip folder and store the unzipped results for comparison.
 			got := make(map[string]zipEntry)
@@ -941,3 +2309,786 @@ func TestUnzip(t *testing.T) {
 		})
 	}
 }
+
+func TestArchiveSourceType(t *testing.T) {
+	for _, tc := range []struct {
+		object string
+		want   string
+	}{
+		{"source.zip", "ZipArchive"},
+		{"source", "ZipArchive"},
+		{"source.tar.gz", "TarGzArchive"},
+		{"source.tgz", "TarGzArchive"},
+		{"source.tar.xz", "TarXzArchive"},
+		{"SOURCE.TXZ", "TarXzArchive"},
+		{"source.tar.zst", "TarZstArchive"},
+		{"source.tzst", "TarZstArchive"},
+		{"source.tar.bz2", "TarBz2Archive"},
+		{"source.tbz2", "TarBz2Archive"},
+	} {
+		if got := archiveSourceType(tc.object); got != tc.want {
+			t.Errorf("archiveSourceType(%q) = %q, want %q", tc.object, got, tc.want)
+		}
+	}
+}
+
+func TestFetchTarArchives(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "contents of a",
+		"dir/b.txt": "contents of b",
+	}
+
+	for _, archive := range []struct {
+		object   string
+		compress func(io.Writer) (io.WriteCloser, error)
+	}{{
+		object:   "source.tar.gz",
+		compress: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	}, {
+		object: "source.tar.xz",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	}, {
+		object: "source.tzst",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}} {
+		t.Run(archive.object, func(t *testing.T) {
+			// Build the compressed tarball.
+			var buf bytes.Buffer
+			cw, err := archive.compress(&buf)
+			if err != nil {
+				t.Fatalf("Creating compressor: %v", err)
+			}
+			tw := tar.NewWriter(cw)
+			if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+				t.Fatalf("Writing dir header: %v", err)
+			}
+			for _, name := range []string{"a.txt", "dir/b.txt"} {
+				if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+					t.Fatalf("Writing header for %s: %v", name, err)
+				}
+				if _, err := tw.Write([]byte(files[name])); err != nil {
+					t.Fatalf("Writing content for %s: %v", name, err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Closing tar writer: %v", err)
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatalf("Closing compressor: %v", err)
+			}
+
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: buf.Bytes()}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = "Archive"
+			tc.gf.ZstdMaxWindow = 1 << 20
+			tc.gf.ZstdConcurrency = 1
+
+			st, err := tc.gf.FetchWithStats(context.Background())
+			if err != nil {
+				t.Fatalf("FetchWithStats() = %v", err)
+			}
+			if st.Files != len(files) || st.Bytes != int64(buf.Len()) {
+				t.Errorf("FetchWithStats() = %+v, want %d files and %d bytes", st, len(files), buf.Len())
+			}
+			for name, want := range files {
+				got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+				if err != nil {
+					t.Errorf("ReadFile(%s): %v", name, err)
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if _, err := os.Stat(tc.gf.StagingDir); !os.IsNotExist(err) {
+				t.Errorf("staging dir %q not removed: %v", tc.gf.StagingDir, err)
+			}
+		})
+	}
+}
+
+// tarBz2Archive is a .tar.bz2 of the files of TestFetchTarArchives, made
+// with the bzip2 command, as Go has no bzip2 compressor.
+const tarBz2Archive = `QlpoOTFBWSZTWTO+kOIAAItbkMqAQAH/hACMfyGeQAQARAggAJKGpkmmQAAeoBppoIpSGIaZMhpk
+ZNBtSh0KeWw3Mi+A70gJXXZo0tpxmGyYhqd4JAhDkeyqvgTtxCJQwImGGO1xYVtJ+cF5GoWEMUXt
+EhE4NIzNQDIIo0WIxYIDwEHhweNFfSg1ZGTINSTOXKfxdyRThQkDO+kOIA==`
+
+func TestFetchTarBz2(t *testing.T) {
+	archive, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(tarBz2Archive, "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":     "contents of a",
+		"dir/b.txt": "contents of b",
+	}
+	for _, test := range []struct {
+		object, sourceType string
+		stream             bool
+	}{
+		{object: "source.tar.bz2", sourceType: "TarBz2Archive"},
+		{object: "source.tbz2", sourceType: "TarBz2Archive", stream: true},
+		{object: "source.tbz2", sourceType: "Archive"},
+		// Sniffed from the first bytes.
+		{object: "source.tar.gz", sourceType: "TarGzArchive"},
+	} {
+		t.Run(fmt.Sprintf("%s as %s, StreamArchives=%v", test.object, test.sourceType, test.stream), func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, test.object, generation)] = fakeGCSResponse{content: archive}
+			tc.gf.Object = test.object
+			tc.gf.SourceType = test.sourceType
+			tc.gf.StreamArchives = test.stream
+
+			st, err := tc.gf.FetchWithStats(context.Background())
+			if err != nil {
+				t.Fatalf("FetchWithStats() = %v", err)
+			}
+			if st.Files != len(files) || st.Bytes != int64(len(archive)) {
+				t.Errorf("FetchWithStats() = %+v, want %d files and %d bytes", st, len(files), len(archive))
+			}
+			for name, want := range files {
+				got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+				if err != nil || string(got) != want {
+					t.Errorf("ReadFile(%s) = %q, %v, want %q", name, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchArchiveVerifiesSha256(t *testing.T) {
+	content := "contents of a"
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	w, err := zw.Create("a.txt")
+	if err != nil {
+		t.Fatalf("Creating zip entry: %v", err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Writing zip entry: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Closing zip writer: %v", err)
+	}
+
+	var tgzBuf bytes.Buffer
+	gw := gzip.NewWriter(&tgzBuf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatalf("Writing tar header: %v", err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatalf("Writing tar entry: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+
+	for _, archive := range []struct {
+		object     string
+		sourceType string
+		content    []byte
+	}{
+		{"source.zip", "ZipArchive", zipBuf.Bytes()},
+		{"source.tar.gz", "TarGzArchive", tgzBuf.Bytes()},
+	} {
+		for _, match := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/match=%t", archive.object, match), func(t *testing.T) {
+				tc, teardown := buildManifestTestContext(t)
+				defer teardown()
+				tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: archive.content}
+				tc.gf.Object = archive.object
+				tc.gf.SourceType = archive.sourceType
+				tc.gf.ArchiveSha256 = fmt.Sprintf("%x", sha256.Sum256(archive.content))
+				if !match {
+					tc.gf.ArchiveSha256 = strings.Repeat("0", 64)
+				}
+
+				err := tc.gf.Fetch(context.Background())
+				if match {
+					if err != nil {
+						t.Fatalf("Fetch() = %v", err)
+					}
+					got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "a.txt"))
+					if err != nil || string(got) != content {
+						t.Errorf("ReadFile(a.txt) = (%q, %v), want (%q, nil)", got, err, content)
+					}
+					return
+				}
+
+				var cerr *checksumError
+				if !errors.As(err, &cerr) || cerr.algorithm != "SHA-256" {
+					t.Fatalf("Fetch() = %v, want SHA-256 checksumError", err)
+				}
+				entries, err := ioutil.ReadDir(tc.workDir)
+				if err != nil {
+					t.Fatalf("ReadDir(%q): %v", tc.workDir, err)
+				}
+				if len(entries) != 0 {
+					t.Errorf("%q has %d entries after a digest mismatch, want 0", tc.workDir, len(entries))
+				}
+			})
+		}
+	}
+}
+
+func TestExtractPath(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "file.txt", want: "/dest/file.txt"},
+		{name: "dir/file.txt", want: "/dest/dir/file.txt"},
+		{name: "dir/../file.txt", want: "/dest/file.txt"},
+		{name: "./dir/", want: "/dest/dir"},
+		{name: "..dotted", want: "/dest/..dotted"},
+		{name: "../file.txt", wantErr: true},
+		{name: "dir/../../file.txt", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+	} {
+		got, err := extractPath("/dest", tc.name)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("extractPath(%q) = %q, want error", tc.name, got)
+			} else if !strings.Contains(err.Error(), tc.name) {
+				t.Errorf("extractPath(%q) error %q does not name the entry", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("extractPath(%q) = %q, %v, want %q, nil", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestExtractRejectsUnsafePaths(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcs-fetcher-unsafe-")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, name := range []string{
+		"../evil.txt",
+		"dir/../../evil.txt",
+		filepath.Join(tmp, "evil.txt"),
+	} {
+		extractors := map[string]func(t *testing.T, dest string) error{
+			"zip": func(t *testing.T, dest string) error {
+				zipfile := filepath.Join(tmp, "source.zip")
+				f, err := os.Create(zipfile)
+				if err != nil {
+					t.Fatalf("Creating zipfile: %v", err)
+				}
+				zw := zip.NewWriter(f)
+				w, err := zw.Create(name)
+				if err != nil {
+					t.Fatalf("Creating entry %s in zipfile: %v", name, err)
+				}
+				if _, err := w.Write([]byte("evil")); err != nil {
+					t.Fatalf("Writing entry %s in zipfile: %v", name, err)
+				}
+				if err := zw.Close(); err != nil {
+					t.Fatalf("Closing zip writer: %v", err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatalf("Closing zipfile: %v", err)
+				}
+				_, err = (&Fetcher{OS: &fakeOS{}}).unzip(context.Background(), zipfile, dest)
+				return err
+			},
+			"tar": func(t *testing.T, dest string) error {
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4}); err != nil {
+					t.Fatalf("Writing header for %s: %v", name, err)
+				}
+				if _, err := tw.Write([]byte("evil")); err != nil {
+					t.Fatalf("Writing content for %s: %v", name, err)
+				}
+				if err := tw.Close(); err != nil {
+					t.Fatalf("Closing tar writer: %v", err)
+				}
+				gf := &Fetcher{OS: &fakeOS{}}
+				_, err := gf.untar(context.Background(), &buf, dest)
+				return err
+			},
+		}
+		for format, extract := range extractors {
+			t.Run(format+" "+name, func(t *testing.T) {
+				dest := filepath.Join(tmp, "dest", "root")
+				if err := os.MkdirAll(dest, 0755); err != nil {
+					t.Fatalf("Creating dest dir: %v", err)
+				}
+				defer os.RemoveAll(filepath.Join(tmp, "dest"))
+
+				if err := extract(t, dest); err == nil {
+					t.Errorf("extracting %q succeeded, want error", name)
+				}
+				for _, p := range []string{filepath.Join(tmp, "evil.txt"), filepath.Join(tmp, "dest", "evil.txt")} {
+					if _, err := os.Stat(p); !os.IsNotExist(err) {
+						t.Errorf("%s was written outside of dest", p)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUntarLinks(t *testing.T) {
+	type tarEntry struct {
+		name     string
+		typeflag byte
+		linkname string
+		content  string
+	}
+	file := tarEntry{name: "dir/file.txt", typeflag: tar.TypeReg, content: "file.txt content"}
+
+	tests := []struct {
+		name          string
+		allowSymlinks bool
+		entries       []tarEntry
+		wantErr       bool
+		wantLinks     map[string]string // Symlink path to target.
+		wantFiles     map[string]string // File path to content.
+		wantMissing   []string
+	}{{
+		name:          "symlink inside tree",
+		allowSymlinks: true,
+		entries:       []tarEntry{file, {name: "dir/link", typeflag: tar.TypeSymlink, linkname: "file.txt"}},
+		wantLinks:     map[string]string{"dir/link": "file.txt"},
+		wantFiles:     map[string]string{"dir/link": "file.txt content"},
+	}, {
+		name:          "symlink to parent inside tree",
+		allowSymlinks: true,
+		entries:       []tarEntry{file, {name: "dir/up", typeflag: tar.TypeSymlink, linkname: "../dir/file.txt"}},
+		wantLinks:     map[string]string{"dir/up": "../dir/file.txt"},
+	}, {
+		name:        "symlinks skipped",
+		entries:     []tarEntry{file, {name: "dir/link", typeflag: tar.TypeSymlink, linkname: "file.txt"}},
+		wantFiles:   map[string]string{"dir/file.txt": "file.txt content"},
+		wantMissing: []string{"dir/link"},
+	}, {
+		name:          "symlink outside tree",
+		allowSymlinks: true,
+		entries:       []tarEntry{file, {name: "dir/link", typeflag: tar.TypeSymlink, linkname: "../../outside"}},
+		wantErr:       true,
+		wantMissing:   []string{"dir/link"},
+	}, {
+		name:          "absolute symlink",
+		allowSymlinks: true,
+		entries:       []tarEntry{file, {name: "dir/link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+		wantErr:       true,
+		wantMissing:   []string{"dir/link"},
+	}, {
+		name:          "file through symlink chain",
+		allowSymlinks: true,
+		entries: []tarEntry{
+			{name: "x/", typeflag: tar.TypeDir},
+			{name: "x/b", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "x/b/c", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "x/b/c/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+		},
+		wantErr:     true,
+		wantMissing: []string{"c", "x/b/c", "../evil.txt"},
+	}, {
+		name:          "file through symlink",
+		allowSymlinks: true,
+		entries: []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "dir"},
+			{name: "link/file.txt", typeflag: tar.TypeReg, content: "through link"},
+		},
+		wantErr:     true,
+		wantMissing: []string{"dir/file.txt"},
+	}, {
+		name:          "symlink target climbing back up",
+		allowSymlinks: true,
+		entries: []tarEntry{
+			{name: "dir/sub/", typeflag: tar.TypeDir},
+			{name: "dir/sub/link", typeflag: tar.TypeSymlink, linkname: "../b/../.."},
+		},
+		wantErr:     true,
+		wantMissing: []string{"dir/sub/link"},
+	}, {
+		name:      "hardlink",
+		entries:   []tarEntry{file, {name: "hard.txt", typeflag: tar.TypeLink, linkname: "dir/file.txt"}},
+		wantFiles: map[string]string{"hard.txt": "file.txt content"},
+	}, {
+		name:        "hardlink outside tree",
+		entries:     []tarEntry{file, {name: "hard.txt", typeflag: tar.TypeLink, linkname: "../outside"}},
+		wantErr:     true,
+		wantMissing: []string{"hard.txt"},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "gcs-fetcher-untar-")
+			if err != nil {
+				t.Fatalf("Creating temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmp)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+				t.Fatalf("Writing dir header: %v", err)
+			}
+			for _, e := range tc.entries {
+				h := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content))}
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("Writing header for %s: %v", e.name, err)
+				}
+				if _, err := tw.Write([]byte(e.content)); err != nil {
+					t.Fatalf("Writing content for %s: %v", e.name, err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Closing tar writer: %v", err)
+			}
+
+			gf := &Fetcher{OS: &fakeOS{}, AllowSymlinks: tc.allowSymlinks, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+			_, err = gf.untar(context.Background(), &buf, tmp)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("untar() = %v, want error %t", err, tc.wantErr)
+			}
+
+			for name, want := range tc.wantLinks {
+				got, err := os.Readlink(filepath.Join(tmp, name))
+				if err != nil || got != want {
+					t.Errorf("Readlink(%s) = %q, %v, want %q", name, got, err, want)
+				}
+			}
+			for name, want := range tc.wantFiles {
+				got, err := ioutil.ReadFile(filepath.Join(tmp, name))
+				if err != nil || string(got) != want {
+					t.Errorf("ReadFile(%s) = %q, %v, want %q", name, got, err, want)
+				}
+			}
+			for _, name := range tc.wantMissing {
+				if _, err := os.Lstat(filepath.Join(tmp, name)); !os.IsNotExist(err) {
+					t.Errorf("%s exists, want it skipped", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUntarLinksAgain(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gcs-fetcher-untar-")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The archive names dir/link twice, and is extracted twice into tmp.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(sfile1Contents))},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "missing.txt"},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file.txt"},
+		{Name: "dir/hard.txt", Typeflag: tar.TypeLink, Linkname: "dir/file.txt"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("Writing header for %s: %v", h.Name, err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(sfile1Contents); err != nil {
+				t.Fatalf("Writing content for %s: %v", h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+
+	gf := &Fetcher{OS: &fakeOS{}, AllowSymlinks: true, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+	for i := 0; i < 2; i++ {
+		if _, err := gf.untar(context.Background(), bytes.NewReader(buf.Bytes()), tmp); err != nil {
+			t.Fatalf("untar() #%d = %v", i+1, err)
+		}
+	}
+	if got, err := os.Readlink(filepath.Join(tmp, "dir/link")); err != nil || got != "file.txt" {
+		t.Errorf("Readlink(dir/link) = %q, %v; want %q", got, err, "file.txt")
+	}
+	for _, name := range []string{"dir/link", "dir/hard.txt"} {
+		if got, err := ioutil.ReadFile(filepath.Join(tmp, name)); err != nil || string(got) != string(sfile1Contents) {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q", name, got, err, sfile1Contents)
+		}
+	}
+}
+
+func TestExtractFilters(t *testing.T) {
+	files := map[string]string{
+		"src/main.go":         "package main",
+		"src/testdata/in.txt": "input",
+		"docs/index.md":       "# Docs",
+	}
+	names := []string{"src/main.go", "src/testdata/in.txt", "docs/index.md"}
+	gf := &Fetcher{OS: &fakeOS{}, Include: []string{"src"}, Exclude: []string{"src/testdata"}}
+	want := []string{"src/main.go"}
+
+	tmp, err := ioutil.TempDir("", "gcs-fetcher-filters-")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	extractors := map[string]func(t *testing.T, dest string) (stats, error){
+		"zip": func(t *testing.T, dest string) (stats, error) {
+			zipfile := filepath.Join(tmp, "source.zip")
+			f, err := os.Create(zipfile)
+			if err != nil {
+				t.Fatalf("Creating zipfile: %v", err)
+			}
+			zw := zip.NewWriter(f)
+			for _, name := range names {
+				w, err := zw.Create(name)
+				if err != nil {
+					t.Fatalf("Creating entry %s in zipfile: %v", name, err)
+				}
+				if _, err := w.Write([]byte(files[name])); err != nil {
+					t.Fatalf("Writing entry %s in zipfile: %v", name, err)
+				}
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatalf("Closing zip writer: %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Closing zipfile: %v", err)
+			}
+			return gf.unzip(context.Background(), zipfile, dest)
+		},
+		"tar": func(t *testing.T, dest string) (stats, error) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, name := range names {
+				if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+					t.Fatalf("Writing header for %s: %v", name, err)
+				}
+				if _, err := tw.Write([]byte(files[name])); err != nil {
+					t.Fatalf("Writing content for %s: %v", name, err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Closing tar writer: %v", err)
+			}
+			return gf.untar(context.Background(), &buf, dest)
+		},
+	}
+	for format, extract := range extractors {
+		t.Run(format, func(t *testing.T) {
+			dest := filepath.Join(tmp, format)
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatalf("Creating dest dir: %v", err)
+			}
+			st, err := extract(t, dest)
+			if err != nil {
+				t.Fatalf("extract() = %v, want nil", err)
+			}
+			if st.files != len(want) || st.skipped != len(names)-len(want) {
+				t.Errorf("extract() files=%d skipped=%d, want files=%d skipped=%d", st.files, st.skipped, len(want), len(names)-len(want))
+			}
+			var got []string
+			if err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() {
+					got = append(got, filepath.ToSlash(strings.TrimPrefix(path, dest+"/")))
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("Walking %s: %v", dest, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("extracted files = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUntarPreservesModTime(t *testing.T) {
+	dirTime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileTime := time.Date(2020, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: dirTime}); err != nil {
+		t.Fatalf("Writing dir header: %v", err)
+	}
+	content := []byte("file content")
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: fileTime}); err != nil {
+		t.Fatalf("Writing file header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("Writing file content: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	archive := buf.Bytes()
+
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("PreserveModTime=%t", preserve), func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "gcs-fetcher-mtime-")
+			if err != nil {
+				t.Fatalf("Creating temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmp)
+
+			gf := &Fetcher{OS: &fakeOS{}, PreserveModTime: preserve}
+			if _, err := gf.untar(context.Background(), bytes.NewReader(archive), tmp); err != nil {
+				t.Fatalf("untar() = %v", err)
+			}
+
+			for name, want := range map[string]time.Time{"dir": dirTime, "dir/file.txt": fileTime} {
+				info, err := os.Stat(filepath.Join(tmp, name))
+				if err != nil {
+					t.Fatalf("Stat(%s) = %v", name, err)
+				}
+				if got := info.ModTime(); got.Equal(want) != preserve {
+					t.Errorf("%s mtime = %v, want preserved=%t (archive mtime %v)", name, got, preserve, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUntarLongNames(t *testing.T) {
+	// A 200-character path, too long for the 100-byte name field of a
+	// plain ustar header.
+	name := strings.Repeat("d", 49) + "/" + strings.Repeat("e", 49) + "/" + strings.Repeat("f", 49) + "/" + strings.Repeat("g", 46) + ".txt"
+	if len(name) != 200 {
+		t.Fatalf("len(name) = %d, want 200", len(name))
+	}
+	content := []byte("long name content")
+
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), Format: format}); err != nil {
+				t.Fatalf("Writing file header: %v", err)
+			}
+			if _, err := tw.Write(content); err != nil {
+				t.Fatalf("Writing file content: %v", err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Closing tar writer: %v", err)
+			}
+
+			tmp, err := ioutil.TempDir("", "gcs-fetcher-longname-")
+			if err != nil {
+				t.Fatalf("Creating temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmp)
+
+			gf := &Fetcher{OS: &fakeOS{}}
+			if _, err := gf.untar(context.Background(), &buf, tmp); err != nil {
+				t.Fatalf("untar() = %v", err)
+			}
+			if got := listFiles(t, tmp); !reflect.DeepEqual(got, []string{name}) {
+				t.Errorf("extracted files = %v, want [%s]", got, name)
+			}
+			if got, err := ioutil.ReadFile(filepath.Join(tmp, name)); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("ReadFile(%s) = (%q, %v), want (%q, nil)", name, got, err, content)
+			}
+		})
+	}
+}
+
+// gnuSparseTar returns a tarball holding a single old-style GNU sparse file
+// called name, realSize bytes long, whose only data is data at offset.
+func gnuSparseTar(t *testing.T, name string, realSize, offset int64, data []byte) []byte {
+	t.Helper()
+	var hdr [512]byte
+	octal := func(b []byte, v int64) {
+		copy(b, fmt.Sprintf("%0*o", len(b)-1, v))
+	}
+	copy(hdr[0:100], name)
+	octal(hdr[100:108], 0644)              // Mode.
+	octal(hdr[108:116], 0)                 // Uid.
+	octal(hdr[116:124], 0)                 // Gid.
+	octal(hdr[124:136], int64(len(data)))  // Size of the data stored.
+	octal(hdr[136:148], time.Now().Unix()) // Modification time.
+	hdr[156] = tar.TypeGNUSparse           // Type.
+	copy(hdr[257:265], "ustar  \x00")      // GNU magic and version.
+	octal(hdr[386:398], offset)            // First sparse entry: offset.
+	octal(hdr[398:410], int64(len(data)))  // First sparse entry: length.
+	octal(hdr[483:495], realSize)          // Size of the expanded file.
+	copy(hdr[148:156], "        ")         // Checksum is computed with its own field blank.
+	var sum int64
+	for _, b := range hdr {
+		sum += int64(b)
+	}
+	copy(hdr[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	var buf bytes.Buffer
+	buf.Write(hdr[:])
+	buf.Write(data)
+	buf.Write(make([]byte, (512-len(data)%512)%512+1024)) // Padding, then the end-of-archive blocks.
+	return buf.Bytes()
+}
+
+func TestUntarSparseFile(t *testing.T) {
+	const realSize, offset = 2048, 1000
+	data := []byte("not a hole")
+	archive := gnuSparseTar(t, "sparse.bin", realSize, offset, data)
+
+	tmp, err := ioutil.TempDir("", "gcs-fetcher-sparse-")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	gf := &Fetcher{OS: &fakeOS{}}
+	st, err := gf.untar(context.Background(), bytes.NewReader(archive), tmp)
+	if err != nil {
+		t.Fatalf("untar() = %v", err)
+	}
+	if st.files != 1 {
+		t.Errorf("untar() extracted %d files, want 1", st.files)
+	}
+	want := make([]byte, realSize)
+	copy(want[offset:], data)
+	if got, err := ioutil.ReadFile(filepath.Join(tmp, "sparse.bin")); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("ReadFile(sparse.bin) = (%d bytes, %v), want %d bytes with %q at %d", len(got), err, realSize, data, offset)
+	}
+}
+
+func TestUntarChtimesFailure(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatalf("Writing file header: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "gcs-fetcher-mtime-")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	gf := &Fetcher{OS: &fakeOS{errorsChtimes: 1}, PreserveModTime: true}
+	if _, err := gf.untar(context.Background(), &buf, tmp); err != errChtimes {
+		t.Errorf("untar() = %v, want %v", err, errChtimes)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// File is an open file in a FileSystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (os.FileInfo, error)
+	// Sync commits the file's contents, or a directory's entries, to
+	// stable storage.
+	Sync() error
+}
+
+// FileSystem is where Fetcher stages downloads and writes the files it
+// fetches. OSFileSystem writes to disk, and MemFileSystem keeps everything
+// in memory. The methods behave like their namesakes in the os package.
+type FileSystem interface {
+	Create(name string) (File, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	// Chown changes the owner of name itself, not following a symbolic
+	// link, like os.Lchown.
+	Chown(name string, uid, gid int) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+	// AvailableBytes returns the disk space, in bytes, available to
+	// unprivileged users on the file system holding path.
+	AvailableBytes(path string) (int64, error)
+}
+
+// OS is the FileSystem that a Fetcher writes to.
+//
+// Deprecated: Use FileSystem.
+type OS = FileSystem
+
+// OSFileSystem is a FileSystem backed by the os package.
+type OSFileSystem struct{}
+
+func (OSFileSystem) Create(name string) (File, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFileSystem) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (OSFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (OSFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (OSFileSystem) Chown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func (OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFileSystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (OSFileSystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OSFileSystem) AvailableBytes(path string) (int64, error) {
+	return availableBytes(path)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// CollisionPolicy decides what happens when Flatten maps two files extracted
+// from an archive to the same name.
+type CollisionPolicy string
+
+const (
+	// CollisionError fails the extraction. It is the default.
+	CollisionError CollisionPolicy = "error"
+	// CollisionOverwrite keeps whichever file comes last in the archive.
+	CollisionOverwrite CollisionPolicy = "overwrite"
+	// CollisionRename writes later files under their name with a numeric
+	// suffix before the extension, e.g. a-1.txt.
+	CollisionRename CollisionPolicy = "rename-with-suffix"
+)
+
+// flattener assigns the paths that the files of an archive are written to
+// when Flatten is set.
+type flattener struct {
+	dest   string
+	policy CollisionPolicy
+	owners map[string]string // The entry written to each name in dest.
+	paths  map[string]string // The path each entry was written to, for hard links.
+}
+
+func (gf *Fetcher) newFlattener(dest string) *flattener {
+	return &flattener{
+		dest:   dest,
+		policy: gf.FlattenCollisions,
+		owners: map[string]string{},
+		paths:  map[string]string{},
+	}
+}
+
+// path returns the path in dest that the archive entry name is written to.
+func (f *flattener) path(name string) (string, error) {
+	base := path.Base(path.Clean("/" + filepath.ToSlash(name)))
+	if base == "/" {
+		return "", fmt.Errorf("archive entry %q has no file name", name)
+	}
+	target := base
+	if owner, ok := f.owners[base]; ok {
+		switch f.policy {
+		case CollisionOverwrite:
+		case CollisionRename:
+			ext := path.Ext(base)
+			stem := strings.TrimSuffix(base, ext)
+			for i := 1; f.owners[target] != ""; i++ {
+				target = fmt.Sprintf("%s-%d%s", stem, i, ext)
+			}
+		case CollisionError, "":
+			return "", fmt.Errorf("archive entries %q and %q would both be flattened to %q", owner, name, base)
+		default:
+			return "", fmt.Errorf("unknown flatten collision policy %q", f.policy)
+		}
+	}
+	f.owners[target] = name
+	p := filepath.Join(f.dest, target)
+	f.paths[name] = p
+	return p, nil
+}
+
+// linkPath returns the path that the earlier archive entry name, which a
+// hard link refers to, was written to.
+func (f *flattener) linkPath(name string) (string, error) {
+	p, ok := f.paths[name]
+	if !ok {
+		return "", fmt.Errorf("link target %q was not extracted", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// flattenTestFiles are the entries of the archives built by
+// flattenTestArchive; two of them share a base name.
+var flattenTestFiles = []struct{ name, contents string }{
+	{"a/x.txt", "first x"},
+	{"b/c/x.txt", "second x"},
+	{"b/y.txt", "y"},
+}
+
+// flattenTestArchive returns a zip or gzipped tarball of flattenTestFiles,
+// with an entry for each of their directories.
+func flattenTestArchive(t *testing.T, kind string) []byte {
+	t.Helper()
+	dirs := []string{"a/", "b/", "b/c/"}
+	var buf bytes.Buffer
+	if kind == "zip" {
+		zw := zip.NewWriter(&buf)
+		for _, d := range dirs {
+			if _, err := zw.Create(d); err != nil {
+				t.Fatalf("Creating zip entry %s: %v", d, err)
+			}
+		}
+		for _, f := range flattenTestFiles {
+			w, err := zw.Create(f.name)
+			if err != nil {
+				t.Fatalf("Creating zip entry %s: %v", f.name, err)
+			}
+			if _, err := w.Write([]byte(f.contents)); err != nil {
+				t.Fatalf("Writing zip entry %s: %v", f.name, err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Closing zip writer: %v", err)
+		}
+		return buf.Bytes()
+	}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, d := range dirs {
+		if err := tw.WriteHeader(&tar.Header{Name: d, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatalf("Writing tar header %s: %v", d, err)
+		}
+	}
+	for _, f := range flattenTestFiles {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.contents))}); err != nil {
+			t.Fatalf("Writing tar header %s: %v", f.name, err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatalf("Writing tar entry %s: %v", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFlatten(t *testing.T) {
+	for _, tc := range []struct {
+		policy  CollisionPolicy
+		want    map[string]string // Contents of each file in DestDir; nil if the fetch fails.
+		wantErr string
+	}{
+		{policy: "", wantErr: "would both be flattened"},
+		{policy: CollisionError, wantErr: "would both be flattened"},
+		{policy: CollisionOverwrite, want: map[string]string{"x.txt": "second x", "y.txt": "y"}},
+		{policy: CollisionRename, want: map[string]string{"x.txt": "first x", "x-1.txt": "second x", "y.txt": "y"}},
+	} {
+		for _, archive := range []struct{ kind, object, sourceType string }{
+			{"zip", "source.zip", "ZipArchive"},
+			{"tgz", "source.tgz", "TarGzArchive"},
+		} {
+			t.Run(string(tc.policy)+"/"+archive.kind, func(t *testing.T) {
+				ctx, teardown := buildManifestTestContext(t)
+				defer teardown()
+				ctx.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: flattenTestArchive(t, archive.kind)}
+				ctx.gf.Object = archive.object
+				ctx.gf.SourceType = archive.sourceType
+				ctx.gf.Flatten = true
+				ctx.gf.FlattenCollisions = tc.policy
+
+				err := ctx.gf.Fetch(context.Background())
+				if tc.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+						t.Errorf("Fetch() = %v, want error containing %q", err, tc.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Fetch() = %v", err)
+				}
+				got := map[string]string{}
+				for _, name := range listFiles(t, ctx.workDir) {
+					b, err := ioutil.ReadFile(filepath.Join(ctx.workDir, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					got[name] = string(b)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("files in DestDir = %v, want %v", got, tc.want)
+				}
+				for _, dir := range []string{"a", "b"} {
+					if _, err := os.Stat(filepath.Join(ctx.workDir, dir)); !os.IsNotExist(err) {
+						t.Errorf("Stat(%s) = %v, want not exist", dir, err)
+					}
+				}
+			})
+		}
+	}
+}
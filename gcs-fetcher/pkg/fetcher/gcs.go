@@ -0,0 +1,144 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// ClientOptions configure the GCS client created by NewStorageGCS.
+type ClientOptions struct {
+	// UserAgent is sent with every request.
+	UserAgent string
+
+	// Endpoint overrides the GCS JSON API endpoint, for example to target an
+	// emulator such as fake-gcs-server ("http://localhost:4443/storage/v1/").
+	// If empty, the production endpoint is used.
+	Endpoint string
+
+	// Insecure disables authentication and TLS certificate verification. It
+	// is meant for emulators and test servers only.
+	Insecure bool
+
+	// Transport, if set, makes the client's requests, e.g. through a proxy
+	// or with a TLS client certificate. Authentication is added on top of
+	// it, unless Insecure is set, in which case it is used as it is and
+	// must do its own certificate verification, if any.
+	Transport http.RoundTripper
+}
+
+// storageGCS implements GCS with the Cloud Storage client library.
+type storageGCS struct {
+	client *storage.Client
+}
+
+// NewStorageGCS returns a GCS backed by a Cloud Storage client configured
+// with opts.
+func NewStorageGCS(ctx context.Context, opts ClientOptions) (GCS, error) {
+	var copts []option.ClientOption
+	if opts.UserAgent != "" {
+		copts = append(copts, option.WithUserAgent(opts.UserAgent))
+	}
+	if opts.Endpoint != "" {
+		copts = append(copts, option.WithEndpoint(opts.Endpoint))
+	}
+	switch {
+	case opts.Insecure:
+		transport := opts.Transport
+		if transport == nil {
+			transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+		}
+		copts = append(copts, option.WithHTTPClient(&http.Client{Transport: transport}))
+	case opts.Transport != nil:
+		transport, err := htransport.NewTransport(ctx, opts.Transport, append(copts, option.WithScopes(storage.ScopeFullControl))...)
+		if err != nil {
+			return nil, err
+		}
+		copts = append(copts, option.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	client, err := storage.NewClient(ctx, copts...)
+	if err != nil {
+		return nil, err
+	}
+	return storageGCS{client}, nil
+}
+
+// Close closes the Cloud Storage client.
+func (g storageGCS) Close() error {
+	return g.client.Close()
+}
+
+func (g storageGCS) object(bucket, object string, opts ReadOptions) *storage.ObjectHandle {
+	b := g.client.Bucket(bucket)
+	if opts.UserProject != "" {
+		b = b.UserProject(opts.UserProject)
+	}
+	o := b.Object(object)
+	if opts.Generation > 0 {
+		o = o.Generation(opts.Generation)
+	}
+	if opts.IfGenerationMatch > 0 {
+		o = o.If(storage.Conditions{GenerationMatch: opts.IfGenerationMatch})
+	}
+	return o.ReadCompressed(opts.ReadCompressed)
+}
+
+func (g storageGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	return g.object(bucket, object, opts).NewReader(ctx)
+}
+
+func (g storageGCS) NewRangeReader(ctx context.Context, bucket, object string, offset, length int64, opts ReadOptions) (io.ReadCloser, error) {
+	return g.object(bucket, object, opts).NewRangeReader(ctx, offset, length)
+}
+
+func (g storageGCS) Attrs(ctx context.Context, bucket, object string, opts ReadOptions) (*ObjectAttrs, error) {
+	attrs, err := g.object(bucket, object, opts).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{Size: attrs.Size, CRC32C: attrs.CRC32C, Generation: attrs.Generation, ContentEncoding: attrs.ContentEncoding, ContentType: attrs.ContentType, MD5: attrs.MD5, Updated: attrs.Updated, Metadata: attrs.Metadata}, nil
+}
+
+// listPageSize is the number of objects storageGCS.List asks for at once.
+const listPageSize = 1000
+
+func (g storageGCS) List(ctx context.Context, bucket, prefix, pageToken string, opts ReadOptions) ([]ListedObject, string, error) {
+	b := g.client.Bucket(bucket)
+	if opts.UserProject != "" {
+		b = b.UserProject(opts.UserProject)
+	}
+	var page []*storage.ObjectAttrs
+	next, err := iterator.NewPager(b.Objects(ctx, &storage.Query{Prefix: prefix}), listPageSize, pageToken).NextPage(&page)
+	if err != nil {
+		return nil, "", err
+	}
+	objects := make([]ListedObject, len(page))
+	for i, attrs := range page {
+		objects[i] = ListedObject{Name: attrs.Name, Size: attrs.Size, Generation: attrs.Generation}
+	}
+	return objects, next, nil
+}
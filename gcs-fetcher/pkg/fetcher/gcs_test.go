@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newFakeGCSServer serves objects over the subset of the GCS XML and JSON
+// APIs used by the storage client for reads and metadata.
+func newFakeGCSServer(t *testing.T, bucket string, objects map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"+bucket+"/o/"); name != r.URL.Path {
+			content, ok := objects[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			crc := make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, crc32.Checksum(content, crc32cTable))
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"bucket": %q, "name": %q, "size": "%d", "crc32c": %q}`, bucket, name, len(content), base64.StdEncoding.EncodeToString(crc))
+			return
+		}
+		if name := strings.TrimPrefix(r.URL.Path, "/"+bucket+"/"); name != r.URL.Path {
+			content, ok := objects[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(content)
+			return
+		}
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}))
+}
+
+func TestStorageGCSCustomEndpoint(t *testing.T) {
+	const bucket = "emulated-bucket"
+	manifest := []byte(`{"main.go": {"sourceUrl": "gs://emulated-bucket/abcdef", "sha1sum": ""}}`)
+	objects := map[string][]byte{
+		"manifest.json": manifest,
+		"abcdef":        []byte("package main"),
+	}
+	server := newFakeGCSServer(t, bucket, objects)
+	defer server.Close()
+
+	gcs, err := NewStorageGCS(context.Background(), ClientOptions{
+		UserAgent: "gcs-fetcher-test",
+		Endpoint:  server.URL + "/storage/v1/",
+		Insecure:  true,
+	})
+	if err != nil {
+		t.Fatalf("NewStorageGCS() = %v", err)
+	}
+
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.GCS = gcs
+	tc.gf.SourceType = "Manifest"
+	tc.gf.Bucket = bucket
+	tc.gf.Object = "manifest.json"
+	tc.gf.VerifyCRC32C = true
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "main.go"))
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	if want := objects["abcdef"]; string(got) != string(want) {
+		t.Errorf("main.go = %q, want %q", got, want)
+	}
+}
+
+// recordingTransport records the paths of the requests it passes on.
+type recordingTransport struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.paths = append(rt.paths, r.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestStorageGCSCustomTransport(t *testing.T) {
+	const bucket = "emulated-bucket"
+	server := newFakeGCSServer(t, bucket, map[string][]byte{"abcdef": []byte("package main")})
+	defer server.Close()
+
+	rt := &recordingTransport{}
+	gcs, err := NewStorageGCS(context.Background(), ClientOptions{
+		Endpoint:  server.URL + "/storage/v1/",
+		Insecure:  true,
+		Transport: rt,
+	})
+	if err != nil {
+		t.Fatalf("NewStorageGCS() = %v", err)
+	}
+
+	if _, err := gcs.Attrs(context.Background(), bucket, "abcdef", ReadOptions{}); err != nil {
+		t.Fatalf("Attrs() = %v", err)
+	}
+	r, err := gcs.NewReader(context.Background(), bucket, "abcdef", ReadOptions{})
+	if err != nil {
+		t.Fatalf("NewReader() = %v", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	want := []string{"/storage/v1/b/" + bucket + "/o/abcdef", "/" + bucket + "/abcdef"}
+	if !reflect.DeepEqual(rt.paths, want) {
+		t.Errorf("requests through the transport = %q, want %q", rt.paths, want)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchObjectGenerationMismatch(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		j    job
+	}{
+		{"pinned", job{bucket: successBucket, object: sfile1, generation: generation, filename: sfile1}},
+		{"discovered", job{bucket: successBucket, object: sfile1, filename: sfile1}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gf.RequireGenerationMatch = true
+			name := formatGCSName(successBucket, sfile1, generation)
+			// Overwritten after the manifest was written, or after Attrs.
+			tc.gcs.objects[name] = fakeGCSResponse{content: sfile1Contents, generation: generation, liveGeneration: generation + 1}
+
+			report := tc.gf.fetchObject(context.Background(), test.j)
+			var gerr *generationMismatchError
+			if report.success || !errors.As(report.err, &gerr) {
+				t.Fatalf("fetchObject() err = %v, want a generationMismatchError", report.err)
+			}
+			if !strings.Contains(gerr.Error(), "changed while it was being fetched") {
+				t.Errorf("generationMismatchError = %q, want it to say the source changed", gerr)
+			}
+			if got := tc.gcs.reads[name]; got != 1 {
+				t.Errorf("%s read %d times, want 1: a changed object is not retried", name, got)
+			}
+
+			// The same object, unchanged, is fetched.
+			tc.gcs.objects[name] = fakeGCSResponse{content: sfile1Contents, generation: generation, liveGeneration: generation}
+			if report := tc.gf.fetchObject(context.Background(), test.j); !report.success {
+				t.Errorf("fetchObject() of an unchanged object err = %v, want success", report.err)
+			}
+		})
+	}
+}
+
+func TestStorageGCSGenerationMismatch(t *testing.T) {
+	const bucket, live = "emulated-bucket", 7
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("x-goog-if-generation-match"); got != fmt.Sprint(live) {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		w.Write([]byte("package main"))
+	}))
+	defer server.Close()
+	gcs, err := NewStorageGCS(context.Background(), ClientOptions{Endpoint: server.URL + "/storage/v1/", Insecure: true})
+	if err != nil {
+		t.Fatalf("NewStorageGCS() = %v", err)
+	}
+	gf := &Fetcher{GCS: gcs}
+	j := job{bucket: bucket, object: "main.go"}
+
+	if r, err := gcs.NewReader(context.Background(), bucket, "main.go", ReadOptions{IfGenerationMatch: live}); err != nil {
+		t.Errorf("NewReader(IfGenerationMatch: %d) = %v, want success", live, err)
+	} else {
+		r.Close()
+	}
+	_, err = gcs.NewReader(context.Background(), bucket, "main.go", ReadOptions{IfGenerationMatch: live - 1})
+	var gerr *generationMismatchError
+	if !errors.As(gf.gcsError(err, j, "creating GCS reader for"), &gerr) {
+		t.Errorf("NewReader(IfGenerationMatch: %d) = %v, want a 412 reported as a generationMismatchError", live-1, err)
+	}
+}
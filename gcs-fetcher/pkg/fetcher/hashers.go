@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DefaultHashers are the checksum algorithms that manifest entries may name
+// when Fetcher.Hashers is nil. A CRC32C digest is written as 8 hex digits,
+// most significant first.
+var DefaultHashers = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32cTable) },
+}
+
+func (gf *Fetcher) hashers() map[string]func() hash.Hash {
+	if gf.Hashers == nil {
+		return DefaultHashers
+	}
+	return gf.Hashers
+}
+
+// checksumProblem describes why a manifest entry's algorithm and digest
+// cannot be verified, or returns "" if they can, or are both unset.
+func (gf *Fetcher) checksumProblem(algorithm, digest string) string {
+	switch {
+	case algorithm == "" && digest == "":
+		return ""
+	case algorithm == "":
+		return "digest without an algorithm"
+	case digest == "":
+		return fmt.Sprintf("algorithm %q without a digest", algorithm)
+	}
+	if _, ok := gf.hashers()[algorithm]; !ok {
+		known := make([]string, 0, len(gf.hashers()))
+		for name := range gf.hashers() {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return fmt.Sprintf("unknown checksum algorithm %q; known ones are %s", algorithm, strings.Join(known, ", "))
+	}
+	return ""
+}
+
+// newHash returns a hash computing the digest that j expects, or nil if it
+// expects none.
+func (gf *Fetcher) newHash(j job) hash.Hash {
+	newHash, ok := gf.hashers()[j.algorithm]
+	if j.digest == "" || !ok {
+		return nil
+	}
+	return newHash()
+}
+
+// hashWriters returns w followed by h, unless h is nil.
+func hashWriters(h hash.Hash, w ...io.Writer) []io.Writer {
+	if h == nil {
+		return w
+	}
+	return append(w, h)
+}
+
+// verifyJobDigest checks h, as returned by newHash for j, against the
+// digest that j expects.
+func verifyJobDigest(j job, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	return verifyDigest(j.filename, j.algorithm, h, j.digest)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchObjectOnceVerifiesAlgorithmDigest(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		digest    string
+		hashers   map[string]func() hash.Hash
+	}{
+		{algorithm: "md5", digest: fmt.Sprintf("%x", md5.Sum(sfile1Contents))},
+		{algorithm: "sha256", digest: fmt.Sprintf("%X", sha256.Sum256(sfile1Contents))},
+		{
+			algorithm: "adler32",
+			digest:    fmt.Sprintf("%08x", adler32.Checksum(sfile1Contents)),
+			hashers:   map[string]func() hash.Hash{"adler32": func() hash.Hash { return adler32.New() }},
+		},
+	} {
+		t.Run(test.algorithm, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gf.Hashers = test.hashers
+			dest := filepath.Join(tc.workDir, "sfile1.tmp")
+
+			j := job{bucket: successBucket, object: sfile1, filename: sfile1, algorithm: test.algorithm, digest: test.digest}
+			if result := tc.gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1)); result.err != nil {
+				t.Errorf("fetchObjectOnce() = %v, want nil", result.err)
+			}
+
+			j.digest = strings.Repeat("0", len(test.digest))
+			result := tc.gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1))
+			var cerr *checksumError
+			if !errors.As(result.err, &cerr) || cerr.algorithm != test.algorithm {
+				t.Errorf("fetchObjectOnce() with a wrong digest = %v, want a %s checksumError", result.err, test.algorithm)
+			}
+		})
+	}
+}
+
+func TestFetchFromManifestRejectsUnknownAlgorithm(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	manifest := []byte(`{
+		"good.js":     {"sourceUrl": "gs://success-bucket/sfile1.js", "algorithm": "md5", "digest": "` + fmt.Sprintf("%x", md5.Sum(sfile1Contents)) + `"},
+		"unknown.js":  {"sourceUrl": "gs://success-bucket/sfile1.js", "algorithm": "whirlpool", "digest": "00"},
+		"nodigest.js": {"sourceUrl": "gs://success-bucket/sfile1.js", "algorithm": "md5"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "algorithms.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "algorithms.json"
+
+	_, err := tc.gf.fetchFromManifest(context.Background())
+	var verr *manifestValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("fetchFromManifest() = %v, want a manifestValidationError", err)
+	}
+	if len(verr.invalid) != 2 || !strings.Contains(verr.invalid["unknown.js"], `unknown checksum algorithm "whirlpool"`) || verr.invalid["nodigest.js"] == "" {
+		t.Errorf("invalid entries = %q, want unknown.js and nodigest.js", verr.invalid)
+	}
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)]; got != 0 {
+		t.Errorf("%s read %d times, want 0: nothing should be fetched from a bad manifest", sfile1, got)
+	}
+}
+
+func TestProcessJobsStreamingRejectsUnknownAlgorithm(t *testing.T) {
+	gf := &Fetcher{Hashers: map[string]func() hash.Hash{"md5": md5.New}}
+	_, err := gf.ProcessJobsStreaming(context.Background(), []Job{{Filename: "f", Bucket: "b", Object: "o", Algorithm: "sha256", Digest: "00"}})
+	if err == nil || !strings.Contains(err.Error(), `unknown checksum algorithm "sha256"`) {
+		t.Errorf("ProcessJobsStreaming() = %v, want an unknown algorithm error", err)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepArchive(t *testing.T) {
+	for _, extract := range []bool{true, false} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		content := flattenTestArchive(t, "tgz")
+		tc.gcs.objects[formatGCSName(successBucket, "source.tgz", generation)] = fakeGCSResponse{content: content}
+		tc.gf.Object = "source.tgz"
+		tc.gf.SourceType = "TarGzArchive"
+		tc.gf.StreamArchives = true
+		tc.gf.KeepArchive = true
+		tc.gf.ArchivePath = filepath.Join(tc.workDir, "cache", "source.tgz")
+		tc.gf.ExtractArchive = extract
+
+		st, err := tc.gf.FetchWithStats(context.Background())
+		if err != nil {
+			t.Fatalf("ExtractArchive=%v: FetchWithStats() = %v", extract, err)
+		}
+		got, err := ioutil.ReadFile(tc.gf.ArchivePath)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("ExtractArchive=%v: ReadFile(%s) = %d bytes, %v, want the %d bytes of the archive", extract, tc.gf.ArchivePath, len(got), err, len(content))
+		}
+		for _, f := range flattenTestFiles {
+			got, err := ioutil.ReadFile(filepath.Join(tc.workDir, f.name))
+			if extract && (err != nil || string(got) != f.contents) {
+				t.Errorf("ExtractArchive=true: ReadFile(%s) = %q, %v, want %q", f.name, got, err, f.contents)
+			}
+			if !extract && !os.IsNotExist(err) {
+				t.Errorf("ExtractArchive=false: ReadFile(%s) = %q, %v, want it not to exist", f.name, got, err)
+			}
+		}
+		want := len(flattenTestFiles)
+		if !extract {
+			want = 1 // The archive itself.
+		}
+		if st.Files != want {
+			t.Errorf("ExtractArchive=%v: FetchWithStats() = %d files, want %d", extract, st.Files, want)
+		}
+	}
+}
+
+func TestKeepArchiveNeedsPath(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "source.tgz", generation)] = fakeGCSResponse{content: flattenTestArchive(t, "tgz")}
+	tc.gf.Object = "source.tgz"
+	tc.gf.SourceType = "TarGzArchive"
+	tc.gf.KeepArchive = true
+
+	if err := tc.gf.Fetch(context.Background()); err == nil {
+		t.Errorf("Fetch() = nil, want an error for the missing ArchivePath")
+	}
+}
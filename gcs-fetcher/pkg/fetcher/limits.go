@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// minRatioChecked is the size an archive entry must exceed before its
+// compression ratio is checked. Smaller entries cannot fill the disk, and
+// their ratio is skewed by headers and read-ahead.
+const minRatioChecked = maxBufferedEntry
+
+// limitExceededError indicates that an archive holds more files, or more
+// bytes once extracted, than MaxFiles or MaxTotalBytes allow.
+type limitExceededError struct {
+	what  string // "files" or "bytes".
+	limit int64
+}
+
+func (e *limitExceededError) Error() string {
+	return fmt.Sprintf("archive exceeds the limit of %d %s once extracted", e.limit, e.what)
+}
+
+// checkLimits returns a limitExceededError if extracting files entries
+// holding size bytes in all would exceed MaxFiles or MaxTotalBytes, along
+// with what the archives a nested archive came from extracted.
+func (gf *Fetcher) checkLimits(files int, size int64) error {
+	files, size = files+gf.nestedUsage.files, size+gf.nestedUsage.size
+	if gf.MaxFiles > 0 && files > gf.MaxFiles {
+		return &limitExceededError{what: "files", limit: int64(gf.MaxFiles)}
+	}
+	if gf.MaxTotalBytes > 0 && size > gf.MaxTotalBytes {
+		return &limitExceededError{what: "bytes", limit: gf.MaxTotalBytes}
+	}
+	return nil
+}
+
+// compressionRatioError indicates that an archive entry expanded to more
+// than MaxCompressionRatio times the compressed bytes it was read from.
+type compressionRatioError struct {
+	name  string
+	limit float64
+}
+
+func (e *compressionRatioError) Error() string {
+	return fmt.Sprintf("archive entry %q expands to more than %g times its compressed size", e.name, e.limit)
+}
+
+// checkRatio returns a compressionRatioError if the archive entry name,
+// having expanded to size bytes from compressed bytes, exceeds
+// MaxCompressionRatio.
+func (gf *Fetcher) checkRatio(name string, size, compressed int64) error {
+	if gf.MaxCompressionRatio <= 0 || size <= minRatioChecked {
+		return nil
+	}
+	if compressed < 1 {
+		compressed = 1
+	}
+	if float64(size) > gf.MaxCompressionRatio*float64(compressed) {
+		return &compressionRatioError{name: name, limit: gf.MaxCompressionRatio}
+	}
+	return nil
+}
+
+// decompressedReader is a tarball being decompressed, with the count of
+// compressed bytes read so far, for untar to check each entry's
+// compression ratio against.
+type decompressedReader struct {
+	io.Reader
+	compressed *readTracker
+}
+
+// ratioReader reads an archive entry, failing once it has expanded to more
+// than MaxCompressionRatio times the compressed bytes read since it began.
+type ratioReader struct {
+	gf         *Fetcher
+	name       string
+	r          io.Reader
+	compressed *readTracker
+	start      int64 // compressed.n when the entry began.
+	n          int64
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if rerr := r.gf.checkRatio(r.name, r.n, r.compressed.n-r.start); rerr != nil {
+		return n, rerr
+	}
+	return n, err
+}
+
+// entryReader returns the reader for the archive entry name, read from tr,
+// checking its compression ratio if compressed counts the bytes tr is
+// decompressed from.
+func (gf *Fetcher) entryReader(name string, tr io.Reader, compressed *readTracker) io.Reader {
+	if compressed == nil || gf.MaxCompressionRatio <= 0 {
+		return tr
+	}
+	return &ratioReader{gf: gf, name: name, r: tr, compressed: compressed, start: compressed.n}
+}
+
+// removeExtracted removes the paths an extraction created, latest first,
+// so that directories are emptied before they are removed. Failures are
+// logged and otherwise ignored.
+func (gf *Fetcher) removeExtracted(paths []string) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := gf.OS.Remove(paths[i]); err != nil && !os.IsNotExist(err) {
+			gf.log("Failed to remove partially extracted %q, continuing: %v", paths[i], err)
+		}
+	}
+}
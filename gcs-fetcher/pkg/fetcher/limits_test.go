@@ -0,0 +1,236 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bombArchive returns an archive of the given kind holding a single file of
+// size zero bytes, which compresses to a tiny fraction of that.
+func bombArchive(t *testing.T, kind string, size int) []byte {
+	t.Helper()
+	return singleFileArchive(t, kind, make([]byte, size))
+}
+
+// textArchive returns an archive of the given kind holding a single file of
+// size bytes of made up, but realistically compressible, text.
+func textArchive(t *testing.T, kind string, size int) []byte {
+	t.Helper()
+	words := []string{"fetch", "the", "object", "from", "bucket", "and", "write", "it", "to", "disk", "retry", "on", "error"}
+	rnd := rand.New(rand.NewSource(1))
+	var text bytes.Buffer
+	for line := 1; text.Len() < size; line++ {
+		fmt.Fprintf(&text, "%06d %s", line, words[rnd.Intn(len(words))])
+		for i := rnd.Intn(12); i >= 0; i-- {
+			fmt.Fprintf(&text, " %s", words[rnd.Intn(len(words))])
+		}
+		fmt.Fprintf(&text, " %d\n", rnd.Int63())
+	}
+	return singleFileArchive(t, kind, text.Bytes()[:size])
+}
+
+// singleFileArchive returns an archive of the given kind holding content
+// as bomb.bin.
+func singleFileArchive(t *testing.T, kind string, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if kind == "zip" {
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("bomb.bin")
+		if err != nil {
+			t.Fatalf("Creating zip entry: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("Writing zip entry: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Closing zip writer: %v", err)
+		}
+		return buf.Bytes()
+	}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "bomb.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatalf("Writing tar header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("Writing tar entry: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// extractedPaths returns the paths under tc's DestDir, outside StagingDir.
+func extractedPaths(t *testing.T, tc *testContext) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(tc.workDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == filepath.Clean(tc.gf.StagingDir) {
+			return filepath.SkipDir
+		}
+		if p != tc.workDir {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk(%s): %v", tc.workDir, err)
+	}
+	return paths
+}
+
+func TestExtractLimits(t *testing.T) {
+	const bombSize = 16 << 20
+	tests := []struct {
+		name     string
+		archive  func(t *testing.T, kind string) []byte
+		maxFiles int
+		maxBytes int64
+		wantErr  string // Empty if the fetch succeeds.
+	}{
+		{name: "within limits", archive: flattenTestArchive, maxFiles: 3, maxBytes: 16},
+		{name: "too many files", archive: flattenTestArchive, maxFiles: 2, wantErr: "limit of 2 files"},
+		{name: "too many bytes", archive: flattenTestArchive, maxBytes: 10, wantErr: "limit of 10 bytes"},
+		{
+			name:     "decompression bomb",
+			archive:  func(t *testing.T, kind string) []byte { return bombArchive(t, kind, bombSize) },
+			maxBytes: 1 << 20,
+			wantErr:  "limit of 1048576 bytes",
+		},
+	}
+	for _, test := range tests {
+		for _, archive := range []struct{ kind, object, sourceType string }{
+			{"zip", "source.zip", "ZipArchive"},
+			{"tgz", "source.tgz", "TarGzArchive"},
+		} {
+			t.Run(test.name+"/"+archive.kind, func(t *testing.T) {
+				tc, teardown := buildManifestTestContext(t)
+				defer teardown()
+				content := test.archive(t, archive.kind)
+				if len(content) >= bombSize/100 {
+					t.Fatalf("archive is %d bytes, want a much smaller one", len(content))
+				}
+				tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: content}
+				tc.gf.Object = archive.object
+				tc.gf.SourceType = archive.sourceType
+				tc.gf.MaxFiles = test.maxFiles
+				tc.gf.MaxTotalBytes = test.maxBytes
+
+				err := tc.gf.Fetch(context.Background())
+				if test.wantErr == "" {
+					if err != nil {
+						t.Fatalf("Fetch() = %v, want nil", err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Fetch() = %v, want error containing %q", err, test.wantErr)
+				}
+				if got := extractedPaths(t, tc); len(got) != 0 {
+					t.Errorf("Fetch() left %v, want partial output removed", got)
+				}
+			})
+		}
+	}
+}
+
+func TestMaxCompressionRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		archive  func(t *testing.T, kind string) []byte
+		maxRatio float64
+		wantErr  bool
+	}{
+		{
+			name:     "high ratio entry",
+			archive:  func(t *testing.T, kind string) []byte { return bombArchive(t, kind, 16<<20) },
+			maxRatio: 200,
+			wantErr:  true,
+		},
+		{
+			name:    "high ratio entry, unchecked",
+			archive: func(t *testing.T, kind string) []byte { return bombArchive(t, kind, 16<<20) },
+		},
+		{
+			name:     "small high ratio entry",
+			archive:  func(t *testing.T, kind string) []byte { return bombArchive(t, kind, minRatioChecked) },
+			maxRatio: 200,
+		},
+		{
+			name:     "text",
+			archive:  func(t *testing.T, kind string) []byte { return textArchive(t, kind, 4<<20) },
+			maxRatio: 200,
+		},
+	}
+	for _, test := range tests {
+		for _, archive := range []struct {
+			kind, object, sourceType string
+			stream                   bool
+		}{
+			{"zip", "source.zip", "ZipArchive", false},
+			{"tgz", "source.tgz", "TarGzArchive", false},
+			{"tgz", "source.tgz", "TarGzArchive", true},
+		} {
+			name := test.name + "/" + archive.kind
+			if archive.stream {
+				name += "/streamed"
+			}
+			t.Run(name, func(t *testing.T) {
+				tc, teardown := buildManifestTestContext(t)
+				defer teardown()
+				tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: test.archive(t, archive.kind)}
+				tc.gf.Object = archive.object
+				tc.gf.SourceType = archive.sourceType
+				tc.gf.StreamArchives = archive.stream
+				tc.gf.MaxCompressionRatio = test.maxRatio
+
+				err := tc.gf.Fetch(context.Background())
+				if !test.wantErr {
+					if err != nil {
+						t.Fatalf("Fetch() = %v, want nil", err)
+					}
+					return
+				}
+				want := `archive entry "bomb.bin" expands to more than 200 times its compressed size`
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Fatalf("Fetch() = %v, want error containing %q", err, want)
+				}
+				if got := extractedPaths(t, tc); len(got) != 0 {
+					t.Errorf("Fetch() left %v, want partial output removed", got)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"strings"
+)
+
+// DefaultTextExtensions are the extensions of the files NormalizeLineEndings
+// converts when TextExtensions is empty.
+var DefaultTextExtensions = []string{
+	".bat", ".c", ".cc", ".cfg", ".cmd", ".conf", ".cpp", ".cs", ".css",
+	".csv", ".go", ".gradle", ".h", ".hpp", ".html", ".ini", ".java", ".js",
+	".json", ".md", ".mk", ".properties", ".ps1", ".py", ".rb", ".sh",
+	".sql", ".toml", ".ts", ".txt", ".xml", ".yaml", ".yml",
+}
+
+// sniffLen is how much of a file is looked at for a NUL byte, the mark of
+// binary content, as git does.
+const sniffLen = 8000
+
+// entryContent returns the content to write for the archive entry name,
+// read from r: with its line endings normalized, for NormalizeLineEndings,
+// then as ContentTransform makes it.
+func (gf *Fetcher) entryContent(name string, r io.Reader) (io.Reader, error) {
+	return gf.transformContent(name, gf.normalizeLineEndings(name, r))
+}
+
+// isTextFile reports whether the archive entry name has one of the
+// TextExtensions, or DefaultTextExtensions.
+func (gf *Fetcher) isTextFile(name string) bool {
+	exts := gf.TextExtensions
+	if len(exts) == 0 {
+		exts = DefaultTextExtensions
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range exts {
+		if ext != "" && strings.ToLower(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeLineEndings returns r with CRLF converted to LF, as it is read,
+// if NormalizeLineEndings applies to the archive entry name and its first
+// bytes hold no NUL. Otherwise, it returns r's content as it is.
+func (gf *Fetcher) normalizeLineEndings(name string, r io.Reader) io.Reader {
+	if !gf.NormalizeLineEndings || !gf.isTextFile(name) {
+		return r
+	}
+	br := bufio.NewReaderSize(r, sniffLen)
+	if head, _ := br.Peek(sniffLen); bytes.IndexByte(head, 0) >= 0 {
+		return br
+	}
+	return &crlfReader{r: br}
+}
+
+// crlfReader reads r with each CR that comes right before an LF dropped.
+type crlfReader struct {
+	r *bufio.Reader
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	out := 0
+	for i := 0; i < n; i++ {
+		if p[i] == '\r' {
+			if i+1 < n && p[i+1] == '\n' {
+				continue
+			}
+			if i+1 == n {
+				// The LF, if any, is still to be read.
+				if next, perr := c.r.Peek(1); perr == nil && next[0] == '\n' {
+					continue
+				}
+			}
+		}
+		p[out] = p[i]
+		out++
+	}
+	return out, err
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCRLFReader(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"lone\rcr\r", "lone\rcr\r"},
+		{"\r\r\n\r\n", "\r\n\n"},
+		{"", ""},
+	} {
+		// Reading a byte at a time splits every CRLF across reads.
+		got, err := io.ReadAll(&crlfReader{r: bufio.NewReader(iotest.OneByteReader(strings.NewReader(tc.in)))})
+		if err != nil || string(got) != tc.want {
+			t.Errorf("crlfReader(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	large := strings.Repeat("line\r\n", maxBufferedEntry/5) // Written without buffering.
+	entries := []archiveEntry{
+		{"build.sh", []byte("echo a\r\necho b\r\n")},
+		{"large.txt", []byte(large)},
+		{"image.png", []byte("PNG\r\n\x1a\n")},
+		{"nul.txt", []byte("has\x00nul\r\n")},
+	}
+	for _, archive := range []struct {
+		object, sourceType string
+		build              func(*testing.T, ...archiveEntry) []byte
+	}{
+		{"source.zip", "ZipArchive", nestedZip},
+		{"source.tgz", "TarGzArchive", nestedTgz},
+	} {
+		for _, normalize := range []bool{true, false} {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: archive.build(t, entries...)}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = archive.sourceType
+			tc.gf.NormalizeLineEndings = normalize
+
+			if err := tc.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("%s, NormalizeLineEndings=%v: Fetch() = %v", archive.sourceType, normalize, err)
+			}
+			for _, e := range entries {
+				want := e.content
+				if normalize && (e.name == "build.sh" || e.name == "large.txt") {
+					want = bytes.ReplaceAll(e.content, []byte("\r\n"), []byte("\n"))
+				}
+				got, err := os.ReadFile(filepath.Join(tc.workDir, e.name))
+				if err != nil || !bytes.Equal(got, want) {
+					t.Errorf("%s, NormalizeLineEndings=%v: ReadFile(%s) = %.40q, %v, want %.40q", archive.sourceType, normalize, e.name, got, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestNormalizeLineEndingsTextExtensions(t *testing.T) {
+	gf := &Fetcher{NormalizeLineEndings: true, TextExtensions: []string{".BAT"}}
+	for name, want := range map[string]bool{"run.bat": true, "RUN.Bat": true, "notes.txt": false, "Makefile": false} {
+		if got := gf.isTextFile(name); got != want {
+			t.Errorf("isTextFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// ManifestEntry describes a file listed in a manifest.
+type ManifestEntry struct {
+	Key        string // The file's path relative to DestDir.
+	SourceURL  string
+	Generation int64 // If zero, the live generation is fetched.
+	Size       int64 // Zero if the manifest does not record it.
+
+	// Digests the file is verified against; empty if not recorded.
+	Sha1Sum, Sha256Sum string
+	Algorithm, Digest  string
+}
+
+// ListManifest reads the manifest of a Manifest source, as Fetch would, and
+// returns its entries sorted by key, without downloading any of the objects
+// they list. Like Fetch, it fails with the same error if any entry is
+// invalid. The Include and Exclude filters are not applied.
+func (gf *Fetcher) ListManifest(ctx context.Context) ([]ManifestEntry, error) {
+	if err := gf.checkOpen(); err != nil {
+		return nil, err
+	}
+	files, _, err := gf.loadManifests(ctx, func(ctx context.Context, ref ObjectRef, each func(string, common.ManifestItem)) (time.Duration, error) {
+		return 0, gf.readManifest(ctx, ref, each)
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := gf.manifestJobs(files)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ManifestEntry, 0, len(jobs))
+	for _, j := range jobs {
+		entries = append(entries, ManifestEntry{
+			Key:        j.filename,
+			SourceURL:  files[j.filename].SourceURL,
+			Generation: j.generation,
+			Size:       j.size,
+			Sha1Sum:    j.sha1sum,
+			Sha256Sum:  j.sha256sum,
+			Algorithm:  j.algorithm,
+			Digest:     j.digest,
+		})
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Key < entries[k].Key })
+	return entries, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListManifest(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "list.json", generation)] = fakeGCSResponse{content: []byte(`{
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg#7", "size": 12, "sha256sum": "abcd"},
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js", "sha1sum": "1234", "algorithm": "md5", "digest": "5678"}
+	}`)}
+	tc.gf.Object = "list.json"
+
+	got, err := tc.gf.ListManifest(context.Background())
+	if err != nil {
+		t.Fatalf("ListManifest() = %v", err)
+	}
+	want := []ManifestEntry{
+		{Key: "a/sfile1.js", SourceURL: "gs://success-bucket/sfile1.js", Sha1Sum: "1234", Algorithm: "md5", Digest: "5678"},
+		{Key: "b/sfile2.jpg", SourceURL: "gs://success-bucket/sfile2.jpg#7", Generation: 7, Size: 12, Sha256Sum: "abcd"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListManifest() = %+v, want %+v", got, want)
+	}
+	for _, object := range []string{sfile1, sfile2} {
+		if n := tc.gcs.reads[formatGCSName(successBucket, object, generation)]; n != 0 {
+			t.Errorf("%s read %d times, want 0", object, n)
+		}
+	}
+}
+
+func TestListManifestInvalid(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "malformed.json", generation)] = fakeGCSResponse{content: []byte(`{"a.js": `)}
+	tc.gcs.objects[formatGCSName(successBucket, "invalid.json", generation)] = fakeGCSResponse{content: []byte(`{"a.js": {"sourceUrl": "not-a-url"}}`)}
+
+	tc.gf.Object = "malformed.json"
+	if _, err := tc.gf.ListManifest(context.Background()); err == nil || !strings.Contains(err.Error(), "decoding JSON from manifest") {
+		t.Errorf("ListManifest() of a malformed manifest = %v, want a decoding error", err)
+	}
+
+	tc.gf.Object = "invalid.json"
+	_, err := tc.gf.ListManifest(context.Background())
+	var verr *manifestValidationError
+	if !errors.As(err, &verr) || verr.invalid["a.js"] == "" {
+		t.Errorf("ListManifest() of an invalid manifest = %v, want a manifestValidationError for a.js", err)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The download rate reported by Progress is smoothed over rateWindow, kept
+// as rateBuckets slots.
+const (
+	rateWindow  = time.Second
+	rateBuckets = 10
+)
+
+// ProgressSnapshot is the state of a Fetcher at one moment, as returned by
+// Progress. Totals cover every fetch the Fetcher has made.
+type ProgressSnapshot struct {
+	BytesDownloaded int64   // Bytes read from GCS.
+	FilesDone       int     // Objects fetched successfully.
+	ActiveWorkers   int     // Workers fetching an object right now.
+	BytesPerSec     float64 // Download rate over the last second.
+}
+
+// liveCounters are updated as objects are downloaded, for Progress to read.
+type liveCounters struct {
+	bytes  atomic.Int64
+	files  atomic.Int64
+	active atomic.Int64
+
+	mu      sync.Mutex
+	buckets [rateBuckets]int64 // Bytes read during each slot.
+	slots   [rateBuckets]int64 // The slot each bucket is counting.
+}
+
+// slot returns the index of the slot of rateWindow/rateBuckets that t falls
+// in.
+func slot(t time.Time) int64 {
+	return t.UnixNano() / int64(rateWindow/rateBuckets)
+}
+
+func (c *liveCounters) addBytes(n int64, now time.Time) {
+	c.bytes.Add(n)
+	s := slot(now)
+	i := s % rateBuckets
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.slots[i] != s {
+		c.slots[i], c.buckets[i] = s, 0
+	}
+	c.buckets[i] += n
+}
+
+// rate returns the bytes per second read during the rateWindow up to now.
+func (c *liveCounters) rate(now time.Time) float64 {
+	s := slot(now)
+	var sum int64
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, bs := range c.slots {
+		if s-bs >= 0 && s-bs < rateBuckets {
+			sum += c.buckets[i]
+		}
+	}
+	return float64(sum) / rateWindow.Seconds()
+}
+
+// Progress returns a snapshot of the Fetcher's downloads. It is safe to call
+// from any goroutine, including while Fetch runs, for example to decide
+// whether to add workers.
+func (gf *Fetcher) Progress() ProgressSnapshot {
+	return ProgressSnapshot{
+		BytesDownloaded: gf.live.bytes.Load(),
+		FilesDone:       int(gf.live.files.Load()),
+		ActiveWorkers:   int(gf.live.active.Load()),
+		BytesPerSec:     gf.live.rate(time.Now()),
+	}
+}
+
+// counted wraps r so that the bytes read from it are added to the counters
+// read by Progress.
+func (gf *Fetcher) counted(r io.Reader) io.Reader {
+	return &countedReader{r: r, live: &gf.live}
+}
+
+type countedReader struct {
+	r    io.Reader
+	live *liveCounters
+}
+
+func (c *countedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.live.addBytes(int64(n), time.Now())
+	}
+	return n, err
+}
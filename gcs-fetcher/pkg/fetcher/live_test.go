@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	manifest := []byte(`{
+		"sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+		"sfile3":     {"sourceUrl": "gs://success-bucket/sfile3"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "manifest.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "manifest.json"
+	tc.gf.SourceType = "Manifest"
+
+	if got := tc.gf.Progress(); got != (ProgressSnapshot{}) {
+		t.Errorf("Progress() before fetching = %+v, want zero", got)
+	}
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+
+	got := tc.gf.Progress()
+	wantBytes := int64(len(manifest) + len(sfile1Contents) + len(sfile2Contents) + len(sfile3Contents))
+	if got.BytesDownloaded != wantBytes {
+		t.Errorf("BytesDownloaded = %d, want %d", got.BytesDownloaded, wantBytes)
+	}
+	if got.FilesDone != 4 {
+		t.Errorf("FilesDone = %d, want 4 (the manifest and its files)", got.FilesDone)
+	}
+	if got.ActiveWorkers != 0 {
+		t.Errorf("ActiveWorkers = %d, want 0", got.ActiveWorkers)
+	}
+	if got.BytesPerSec <= 0 || got.BytesPerSec > float64(wantBytes) {
+		t.Errorf("BytesPerSec = %v, want in (0, %d]", got.BytesPerSec, wantBytes)
+	}
+}
+
+func TestLiveCountersRate(t *testing.T) {
+	var c liveCounters
+	start := time.Unix(1000, 0)
+	c.addBytes(1000, start)
+	c.addBytes(500, start.Add(300*time.Millisecond))
+
+	for _, test := range []struct {
+		after time.Duration
+		want  float64
+	}{
+		{0, 1000},
+		{500 * time.Millisecond, 1500},
+		{1100 * time.Millisecond, 500},
+		{2 * time.Second, 0},
+	} {
+		if got := c.rate(start.Add(test.after)); got != test.want {
+			t.Errorf("rate() %v after the first read = %v, want %v", test.after, got, test.want)
+		}
+	}
+	if got := c.bytes.Load(); got != 1500 {
+		t.Errorf("bytes = %d, want 1500", got)
+	}
+}
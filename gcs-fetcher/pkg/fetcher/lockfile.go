@@ -0,0 +1,54 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+)
+
+// writtenFile describes a file that a fetch wrote.
+type writtenFile struct {
+	name       string
+	size       int64
+	sha256     string // Hex-encoded, computed as the file was written.
+	generation int64  // Of the object it came from; 0 if unknown.
+}
+
+// writeLockfile writes a line of the form
+//
+//	path sha256 size generation
+//
+// to LockfileWriter for each of files, which must be sorted by name. Paths
+// are relative to DestDir and use forward slashes.
+func (gf *Fetcher) writeLockfile(files []writtenFile) error {
+	dest, err := filepath.Abs(gf.DestDir)
+	if err != nil {
+		return fmt.Errorf("resolving %q: %v", gf.DestDir, err)
+	}
+	w := bufio.NewWriter(gf.LockfileWriter)
+	for _, f := range files {
+		rel, err := filepath.Rel(dest, f.name)
+		if err != nil {
+			return fmt.Errorf("locating %q in %q: %v", f.name, dest, err)
+		}
+		if _, err := fmt.Fprintf(w, "%s %s %d %d\n", filepath.ToSlash(rel), f.sha256, f.size, f.generation); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func lockfileLine(name string, contents []byte, generation int64) string {
+	return fmt.Sprintf("%s %x %d %d\n", name, sha256.Sum256(contents), len(contents), generation)
+}
+
+func TestLockfile(t *testing.T) {
+	var archiveWant string
+	for _, f := range flattenTestFiles {
+		archiveWant += lockfileLine(f.name, []byte(f.contents), 0)
+	}
+	for _, test := range []struct {
+		name       string
+		sourceType string
+		object     string
+		content    []byte
+		want       string
+	}{{
+		name:       "manifest",
+		sourceType: "Manifest",
+		object:     "manifest.json",
+		content: []byte(`{
+			"sfile1.js":      {"sourceUrl": "gs://success-bucket/sfile1.js"},
+			"d/sfile2.jpg":   {"sourceUrl": "gs://success-bucket/sfile2.jpg#111"},
+			"d/e/sfile3":     {"sourceUrl": "gs://success-bucket/sfile3", "generation": 222}
+		}`),
+		want: lockfileLine("d/e/sfile3", sfile3Contents, 222) +
+			lockfileLine("d/sfile2.jpg", sfile2Contents, 111) +
+			lockfileLine("sfile1.js", sfile1Contents, 0),
+	}, {
+		name:       "zip",
+		sourceType: "ZipArchive",
+		object:     "source.zip",
+		content:    flattenTestArchive(t, "zip"),
+		want:       archiveWant,
+	}, {
+		name:       "tgz",
+		sourceType: "TarGzArchive",
+		object:     "source.tgz",
+		content:    flattenTestArchive(t, "tgz"),
+		want:       archiveWant,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, test.object, generation)] = fakeGCSResponse{content: test.content}
+			tc.gcs.objects[formatGCSName(successBucket, sfile2, 111)] = fakeGCSResponse{content: sfile2Contents}
+			tc.gcs.objects[formatGCSName(successBucket, sfile3, 222)] = fakeGCSResponse{content: sfile3Contents}
+			tc.gf.Object = test.object
+			tc.gf.SourceType = test.sourceType
+			var lockfile bytes.Buffer
+			tc.gf.LockfileWriter = &lockfile
+
+			if err := tc.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			if got := lockfile.String(); got != test.want {
+				t.Errorf("lockfile got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLockfileNotWrittenOnFailure(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	manifest := []byte(`{"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"}, "efile6": {"sourceUrl": "gs://error-bucket/efile6"}}`)
+	tc.gcs.objects[formatGCSName(successBucket, "manifest.json", generation)] = fakeGCSResponse{content: manifest}
+	tc.gf.Object = "manifest.json"
+	tc.gf.SourceType = "Manifest"
+	var lockfile bytes.Buffer
+	tc.gf.LockfileWriter = &lockfile
+
+	if err := tc.gf.Fetch(context.Background()); err == nil {
+		t.Fatalf("Fetch() = nil, want error")
+	}
+	if lockfile.Len() != 0 {
+		t.Errorf("lockfile got %q after a failed fetch, want nothing", lockfile.String())
+	}
+}
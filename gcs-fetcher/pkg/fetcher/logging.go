@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// errorKind classifies err for structured logs.
+func errorKind(err error) string {
+	var (
+		perr *permissionError
+		rerr *requesterPaysError
+		nerr *notFoundError
+		cerr *checksumError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &perr):
+		return "permission"
+	case errors.As(err, &rerr):
+		return "requester_pays"
+	case errors.As(err, &nerr):
+		return "not_found"
+	case errors.As(err, &cerr):
+		return "checksum"
+	case errors.Is(err, errGCSTimeout):
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// objectAttrs returns the structured log attributes identifying j's object.
+func objectAttrs(j job) []any {
+	attrs := []any{slog.String("bucket", j.bucket), slog.String("object", j.object)}
+	if j.generation > 0 {
+		attrs = append(attrs, slog.Int64("generation", j.generation))
+	}
+	return attrs
+}
+
+// logFetchStart records the start of a fetch of the manifest or archive in
+// gf.Object, or of the manifest at gf.ManifestURL or from gf.ManifestReader;
+// what describes it in the text log.
+func (gf *Fetcher) logFetchStart(what string) {
+	if what == "manifest" && gf.ManifestReader != nil {
+		if gf.Logger == nil {
+			gf.log("Fetching %s from reader.", what)
+		} else {
+			gf.Logger.Info("fetch started", slog.String("manifest", "reader"), slog.String("source_type", gf.SourceType))
+		}
+		return
+	}
+	if what == "manifest" && gf.ManifestURL != "" {
+		if gf.Logger == nil {
+			gf.log("Fetching %s %s.", what, gf.ManifestURL)
+		} else {
+			gf.Logger.Info("fetch started", slog.String("url", gf.ManifestURL), slog.String("source_type", gf.SourceType))
+		}
+		return
+	}
+	if gf.Logger == nil {
+		gf.log("Fetching %s %s.", what, formatGCSName(gf.Bucket, gf.Object, gf.Generation))
+		return
+	}
+	j := job{bucket: gf.Bucket, object: gf.Object, generation: gf.Generation}
+	gf.Logger.Info("fetch started", append(objectAttrs(j), slog.String("source_type", gf.SourceType))...)
+}
+
+// logAttempt records the outcome of a single attempt to fetch j. Failed
+// attempts are warnings until no retries are left.
+func (gf *Fetcher) logAttempt(j job, report *jobReport, willRetry bool) {
+	attempt := report.attempts[len(report.attempts)-1]
+	attrs := append(objectAttrs(j),
+		slog.Int("attempt", len(report.attempts)),
+		slog.Int64("duration_ms", attempt.duration.Milliseconds()),
+	)
+	switch {
+	case attempt.err == nil:
+		gf.Logger.Debug("fetched object", append(attrs, slog.Int64("bytes", int64(report.size)))...)
+	case willRetry:
+		gf.Logger.Warn("fetch attempt failed", append(attrs, errorAttrs(attempt.err)...)...)
+	default:
+		gf.Logger.Error("fetch failed", append(attrs, errorAttrs(attempt.err)...)...)
+	}
+}
+
+// logCompleted records the outcome of a whole fetch.
+func (gf *Fetcher) logCompleted(st stats, started time.Time, attrs ...any) {
+	status := "SUCCESS"
+	if !st.success {
+		status = "FAILURE"
+	}
+	gf.Logger.Info("fetch completed", append([]any{
+		slog.String("status", status),
+		slog.Bool("dry_run", gf.DryRun),
+		slog.Int("files", st.files),
+		slog.Int("skipped", st.skipped),
+		slog.Int("unchanged", st.unchanged),
+		slog.Int("retries", st.retries),
+		slog.Int("gcs_timeouts", st.gcsTimeouts),
+		slog.Int("timeouts", st.timeouts),
+		slog.Int64("bytes", int64(st.size)),
+		slog.Int64("duration_ms", time.Since(started).Milliseconds()),
+	}, attrs...)...)
+}
+
+// errorAttrs returns the structured log attributes describing err.
+func errorAttrs(err error) []any {
+	return []any{slog.String("error", err.Error()), slog.String("error_type", errorKind(err))}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{&permissionError{bucket: "b"}, "permission"},
+		{&requesterPaysError{bucket: "b"}, "requester_pays"},
+		{fmt.Errorf("fetching: %w", &checksumError{algorithm: "SHA-1"}), "checksum"},
+		{fmt.Errorf("fetching: %w", errGCSTimeout), "timeout"},
+		{errors.New("boom"), "other"},
+	} {
+		if got := errorKind(tc.err); got != tc.want {
+			t.Errorf("errorKind(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestFetchFromManifestStructuredLogging(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsCreate = 1 // Provoke one retry of the manifest download.
+
+	var logs, stdout bytes.Buffer
+	tc.gf.Logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tc.gf.Stdout = &stdout
+	tc.gf.SourceType = "Manifest"
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Stdout got %q, want nothing when Logger is set", stdout.String())
+	}
+
+	var records []map[string]any
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var r map[string]any
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("decoding log record: %v", err)
+		}
+		records = append(records, r)
+	}
+	count := map[string]int{}
+	for _, r := range records {
+		msg := r["msg"].(string)
+		count[msg]++
+		switch msg {
+		case "fetch started":
+			if r["bucket"] != successBucket || r["object"] != goodManifest {
+				t.Errorf("fetch started record %v, want bucket %q and object %q", r, successBucket, goodManifest)
+			}
+		case "fetch attempt failed":
+			if r["level"] != "WARN" || r["attempt"] != 1.0 || r["error_type"] != "other" {
+				t.Errorf("fetch attempt failed record %v, want WARN at attempt 1 with error_type other", r)
+			}
+		case "fetched object":
+			if _, ok := r["bytes"]; !ok {
+				t.Errorf("fetched object record %v has no bytes", r)
+			}
+		case "fetch completed":
+			if r["status"] != "SUCCESS" || r["files"] != 3.0 || r["retries"] != 0.0 {
+				t.Errorf("fetch completed record %v, want SUCCESS with 3 files and no retries", r)
+			}
+		}
+	}
+	// The manifest and its three files are each fetched once.
+	want := map[string]int{"fetch started": 1, "fetch attempt failed": 1, "fetched object": 4, "fetch completed": 1}
+	for msg, n := range want {
+		if count[msg] != n {
+			t.Errorf("got %d %q records, want %d", count[msg], msg, n)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+func TestFetchFromManifestReader(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.ManifestReader = bytes.NewReader([]byte(`{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`))
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() = %v", err)
+	}
+	want := []string{"a/sfile1.js", "b/sfile2.jpg"}
+	if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("files in DestDir got %v, want %v", got, want)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "a/sfile1.js"))
+	if err != nil || string(got) != string(sfile1Contents) {
+		t.Errorf("ReadFile(a/sfile1.js) = (%q, %v), want (%q, nil)", got, err, sfile1Contents)
+	}
+}
+
+func TestFetchFromManifestReaderInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		manifest string
+	}{
+		{name: "malformed", manifest: `{"a.js": {"sourceUrl": `},
+		{name: "not an object", manifest: `["a.js"]`},
+		{name: "invalid entry", manifest: `{"a.js": {"sourceUrl": "gs://success-bucket/sfile1.js"}, "b.js": {"sourceUrl": "not-a-url"}}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The same manifest in GCS should fail the same way.
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "bad.json", generation)] = fakeGCSResponse{content: []byte(test.manifest)}
+			tc.gf.Object = "bad.json"
+			_, gcsErr := tc.gf.fetchFromManifest(context.Background())
+
+			tc.gf.Bucket, tc.gf.Object = "", ""
+			tc.gf.ManifestReader = strings.NewReader(test.manifest)
+			_, err := tc.gf.fetchFromManifest(context.Background())
+			if err == nil || gcsErr == nil {
+				t.Fatalf("fetchFromManifest() = %v from a reader and %v from GCS, want errors", err, gcsErr)
+			}
+
+			var verr *manifestValidationError
+			if errors.As(gcsErr, &verr) {
+				if err.Error() != gcsErr.Error() {
+					t.Errorf("fetchFromManifest() = %q, want %q as from GCS", err, gcsErr)
+				}
+				return
+			}
+			decodeErr := decodeManifest(strings.NewReader(test.manifest), func(string, common.ManifestItem) {})
+			if decodeErr == nil {
+				t.Fatal("decodeManifest() = nil, want error")
+			}
+			if want := "decoding JSON from manifest file: " + decodeErr.Error(); err.Error() != want {
+				t.Errorf("fetchFromManifest() = %q, want %q", err, want)
+			}
+			if !strings.HasPrefix(gcsErr.Error(), "decoding JSON from manifest file") || !strings.HasSuffix(gcsErr.Error(), decodeErr.Error()) {
+				t.Errorf("fetchFromManifest() = %q from GCS, want a decoding error ending in %q", gcsErr, decodeErr)
+			}
+		})
+	}
+}
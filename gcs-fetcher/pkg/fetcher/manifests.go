@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// ObjectRef names a GCS object.
+type ObjectRef struct {
+	Bucket, Object string
+	Generation     int64 // If zero, the live generation is read.
+}
+
+// manifests returns the manifests of a Manifest source: Manifests, or the
+// one at Bucket and Object if that is empty. There is only one if
+// ManifestURL or ManifestReader is set.
+func (gf *Fetcher) manifests() []ObjectRef {
+	if len(gf.Manifests) > 0 && gf.ManifestURL == "" && gf.ManifestReader == nil {
+		return gf.Manifests
+	}
+	return []ObjectRef{{Bucket: gf.Bucket, Object: gf.Object, Generation: gf.Generation}}
+}
+
+// loadManifests reads every manifest with read, and merges their entries by
+// destination path, later manifests overriding earlier ones. It also returns
+// how long the manifests took to fetch in total. When there are several, it
+// logs how many entries each contributed and overrode.
+func (gf *Fetcher) loadManifests(ctx context.Context, read func(context.Context, ObjectRef, func(string, common.ManifestItem)) (time.Duration, error)) (files map[string]common.ManifestItem, duration time.Duration, err error) {
+	refs := gf.manifests()
+	files = map[string]common.ManifestItem{}
+	source := map[string]int{} // The manifest each file's entry comes from.
+	var overridden int
+	for i, ref := range refs {
+		var entries, overrides int
+		d, err := read(ctx, ref, func(filename string, item common.ManifestItem) {
+			entries++
+			if from, ok := source[filename]; ok && from < i {
+				overrides++
+			}
+			files[filename] = item
+			source[filename] = i
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		duration += d
+		overridden += overrides
+		if len(refs) > 1 {
+			gf.log("Manifest %s: %d entries, %d overriding earlier manifests.", formatGCSName(ref.Bucket, ref.Object, ref.Generation), entries, overrides)
+		}
+	}
+	if len(refs) > 1 {
+		gf.log("Merged %d manifests into %d files; %d entries overridden.", len(refs), len(files), overridden)
+	}
+	return files, duration, nil
+}
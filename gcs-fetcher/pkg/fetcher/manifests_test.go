@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetchFromManifests(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	base := []byte(`{
+		"a.js":     {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"dir/b.js": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`)
+	overlay := []byte(`{
+		"dir/b.js": {"sourceUrl": "gs://success-bucket/sfile3"},
+		"c.js":     {"sourceUrl": "gs://success-bucket/sfile1.js"}
+	}`)
+	tc.gcs.objects[formatGCSName(successBucket, "base.json", generation)] = fakeGCSResponse{content: base}
+	tc.gcs.objects[formatGCSName(successBucket, "overlay.json", generation)] = fakeGCSResponse{content: overlay}
+	tc.gf.Manifests = []ObjectRef{
+		{Bucket: successBucket, Object: "base.json"},
+		{Bucket: successBucket, Object: "overlay.json"},
+	}
+	var stdout bytes.Buffer
+	tc.gf.Stdout = &stdout
+
+	st, err := tc.gf.fetchFromManifest(context.Background())
+	if err != nil {
+		t.Fatalf("fetchFromManifest() = %v", err)
+	}
+	if st.Files != 3 {
+		t.Errorf("Stats.Files = %d, want 3", st.Files)
+	}
+	want := map[string]string{
+		"a.js":     string(sfile1Contents),
+		"dir/b.js": string(sfile3Contents),
+		"c.js":     string(sfile1Contents),
+	}
+	got := map[string]string{}
+	for _, name := range listFiles(t, tc.workDir) {
+		b, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[filepath.ToSlash(name)] = string(b)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fetched files = %v, want %v", got, want)
+	}
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile2, generation)]; got != 0 {
+		t.Errorf("%s read %d times, want 0: it is overridden by the overlay", sfile2, got)
+	}
+	for _, line := range []string{
+		"base.json: 2 entries, 0 overriding earlier manifests.",
+		"overlay.json: 2 entries, 1 overriding earlier manifests.",
+		"Merged 2 manifests into 3 files; 1 entries overridden.",
+	} {
+		if !strings.Contains(stdout.String(), line) {
+			t.Errorf("output does not contain %q:\n%s", line, stdout.String())
+		}
+	}
+}
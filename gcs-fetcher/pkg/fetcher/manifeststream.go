@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// processManifestStream reads the manifest and fetches its files as their
+// entries are decoded, with WorkerCount workers, instead of once the whole
+// manifest has been. Once an invalid entry is found, no more files are
+// queued, but the rest of the manifest is still checked so that every
+// invalid entry is reported in the manifestValidationError returned. It also
+// returns how long the manifest took to fetch. If the manifest could not be
+// read, or was invalid, before any file was queued, the stats are zero.
+func (gf *Fetcher) processManifestStream(ctx context.Context) (_ stats, manifestDuration time.Duration, err error) {
+	parent := ctx
+	if gf.OverallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gf.OverallTimeout)
+		defer cancel()
+	}
+
+	workerCount := gf.WorkerCount
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	gf.state = gf.loadState()
+	todo := make(chan job, workerCount)
+	var (
+		files, skipped int
+		invalid        = map[string]string{}
+		readErr        error
+	)
+	go func() {
+		defer close(todo)
+		manifestDuration, readErr = gf.loadManifest(ctx, gf.manifests()[0], func(filename string, item common.ManifestItem) {
+			j, problem := gf.manifestJob(filename, item)
+			if problem != "" {
+				invalid[filename] = problem
+			}
+			if len(invalid) > 0 {
+				return
+			}
+			included, skip := gf.filterJobs([]job{j})
+			skipped += skip
+			for _, j := range included {
+				files++
+				todo <- j
+			}
+		})
+	}()
+
+	st := stats{workers: workerCount, success: true, started: time.Now()}
+	failed := gf.consumeReports(gf.runJobs(ctx, []jobQueue{{todo: todo, workers: workerCount}}, nil), gf.newProgress(-1, -1), &st)
+	// todo was closed before the last report was sent, so the reader is done.
+	st.files, st.skipped = files, skipped
+
+	manifestErr := readErr
+	if manifestErr == nil && len(invalid) > 0 {
+		manifestErr = &manifestValidationError{invalid: invalid}
+	}
+	if manifestErr != nil {
+		if files == 0 && skipped == 0 {
+			return stats{}, manifestDuration, manifestErr
+		}
+		failed = true
+		st.errs = append(st.errs, manifestErr)
+	}
+	st, err = gf.finishJobs(ctx, parent, st, failed)
+	if manifestErr != nil {
+		return st, manifestDuration, manifestErr
+	}
+	return st, manifestDuration, err
+}
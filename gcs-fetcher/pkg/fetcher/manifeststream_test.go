@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// notifyingGCS closes fetched when the first object is read.
+type notifyingGCS struct {
+	GCS
+	once    sync.Once
+	fetched chan struct{}
+}
+
+func (g *notifyingGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	g.once.Do(func() { close(g.fetched) })
+	return g.GCS.NewReader(ctx, bucket, object, opts)
+}
+
+func TestStreamManifestStartsBeforeFullParse(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	const entries = 5000
+	var manifest bytes.Buffer
+	manifest.WriteString("{")
+	for i := 0; i < entries; i++ {
+		if i > 0 {
+			manifest.WriteString(",")
+		}
+		fmt.Fprintf(&manifest, "\n%q: {\"sourceUrl\": \"gs://success-bucket/sfile1.js\"}", fmt.Sprintf("f/%05d", i))
+	}
+	manifest.WriteString("\n}")
+
+	// Serve the first half of the manifest, then hold back the rest until a
+	// file has been fetched.
+	gcs := &notifyingGCS{GCS: tc.gcs, fetched: make(chan struct{})}
+	var startedEarly atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		half := manifest.Len() / 2
+		w.Write(manifest.Bytes()[:half])
+		w.(http.Flusher).Flush()
+		select {
+		case <-gcs.fetched:
+			startedEarly.Store(true)
+		case <-time.After(10 * time.Second):
+		}
+		w.Write(manifest.Bytes()[half:])
+	}))
+	defer srv.Close()
+	tc.gf.GCS = gcs
+	tc.gf.ManifestURL = srv.URL
+	tc.gf.SourceType = "Manifest"
+	tc.gf.StreamManifest = true
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if !startedEarly.Load() {
+		t.Errorf("no file was fetched before the whole manifest was read")
+	}
+	if st.Files != entries {
+		t.Errorf("Stats.Files = %d, want %d", st.Files, entries)
+	}
+	if got := len(listFiles(t, tc.workDir)); got != entries {
+		t.Errorf("%d files fetched, want %d", got, entries)
+	}
+}
+
+func TestStreamManifestErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{{
+		name:     "malformed",
+		manifest: string(malformedManifestContents),
+		wantErr:  "decoding JSON from manifest file",
+	}, {
+		name:     "not an object",
+		manifest: `["gs://success-bucket/sfile1.js"]`,
+		wantErr:  "decoding JSON from manifest file",
+	}, {
+		name: "invalid entries",
+		manifest: `{
+			"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"},
+			"bad1":      {"sourceUrl": "http://example.com/bad1"},
+			"sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"},
+			"bad2":      {}
+		}`,
+		wantErr: "Invalid manifest entries (2)",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "stream.json", generation)] = fakeGCSResponse{content: []byte(test.manifest)}
+			tc.gf.Object = "stream.json"
+			tc.gf.StreamManifest = true
+
+			_, err := tc.gf.fetchFromManifest(context.Background())
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("fetchFromManifest() = %v, want error containing %q", err, test.wantErr)
+			}
+			var verr *manifestValidationError
+			if errors.As(err, &verr) {
+				if _, ok := verr.invalid["bad1"]; !ok {
+					t.Errorf("error %v does not report bad1", err)
+				}
+				if got := tc.gcs.reads[formatGCSName(successBucket, sfile2, generation)]; got != 0 {
+					t.Errorf("%s fetched after an invalid entry", sfile2)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// readManifestURL decodes the manifest served at ManifestURL, calling each
+// for every entry. The request is made with HTTPClient, or http.DefaultClient
+// if that is nil, and is bounded by OverallTimeout when set.
+func (gf *Fetcher) readManifestURL(ctx context.Context, each func(string, common.ManifestItem)) (err error) {
+	if gf.OverallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gf.OverallTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gf.ManifestURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating request for manifest %s: %v", gf.ManifestURL, err)
+	}
+	client := gf.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching manifest %s: %v", gf.ManifestURL, err)
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Failed to close response body: %v", cerr)
+		}
+	}()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return &notFoundError{object: gf.ManifestURL}
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("fetching manifest %s: %s", gf.ManifestURL, resp.Status)
+	}
+	if err := decodeManifest(resp.Body, each); err != nil {
+		return fmt.Errorf("decoding JSON from manifest %s: %v", gf.ManifestURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bearerTransport adds an Authorization header to every request.
+type bearerTransport struct {
+	token string
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFetchFromManifestURL(t *testing.T) {
+	manifest := []byte(`{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/manifest.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(manifest)
+	}))
+	defer srv.Close()
+
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.ManifestURL = srv.URL + "/manifest.json"
+	tc.gf.HTTPClient = &http.Client{Transport: bearerTransport{token: "secret"}}
+
+	if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+		t.Fatalf("fetchFromManifest() = %v", err)
+	}
+	want := []string{"a/sfile1.js", "b/sfile2.jpg"}
+	if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("files in DestDir got %v, want %v", got, want)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "a/sfile1.js"))
+	if err != nil || string(got) != string(sfile1Contents) {
+		t.Errorf("ReadFile(a/sfile1.js) = (%q, %v), want (%q, nil)", got, err, sfile1Contents)
+	}
+
+	for _, c := range []struct {
+		url    string
+		client *http.Client
+		want   int
+	}{
+		{srv.URL + "/manifest.json", nil, failureExitStatus},
+		{srv.URL + "/missing.json", tc.gf.HTTPClient, notFoundExitStatus},
+	} {
+		tc.gf.ManifestURL, tc.gf.HTTPClient = c.url, c.client
+		_, err := tc.gf.fetchFromManifest(context.Background())
+		if err == nil {
+			t.Errorf("fetchFromManifest(%s) = nil, want error", c.url)
+			continue
+		}
+		if got := ExitStatus(err); got != c.want {
+			t.Errorf("ExitStatus(%v) = %d, want %d", err, got, c.want)
+		}
+	}
+}
+
+func TestFetchFromManifestURLTimeout(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.ManifestURL = srv.URL
+	tc.gf.OverallTimeout = 50 * time.Millisecond
+
+	_, err := tc.gf.fetchFromManifest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("fetchFromManifest() = %v, want contains %q", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"io"
+)
+
+// fileTooLargeError indicates that a file is larger than MaxFileBytes.
+type fileTooLargeError struct {
+	name    string // The object, or the archive entry.
+	size    int64
+	limit   int64
+	atLeast bool // The download was stopped at size bytes.
+}
+
+func (e *fileTooLargeError) Error() string {
+	size := fmt.Sprintf("%d bytes", e.size)
+	if e.atLeast {
+		size = "at least " + size
+	}
+	return fmt.Sprintf("%s is %s, over the limit of %d bytes per file", e.name, size, e.limit)
+}
+
+// tooLarge reports whether a file of size bytes exceeds MaxFileBytes.
+func (gf *Fetcher) tooLarge(size int64) bool {
+	return gf.MaxFileBytes > 0 && size > gf.MaxFileBytes
+}
+
+// limitsSize reports whether the file of j is held to MaxFileBytes: the
+// staged manifests and archives are not.
+func (gf *Fetcher) limitsSize(j job) bool {
+	return gf.MaxFileBytes > 0 && j.destDirOverride == ""
+}
+
+// skipsLarge reports whether the file of j is left out by SkipLargeFiles,
+// its size being known to exceed MaxFileBytes.
+func (gf *Fetcher) skipsLarge(j job) bool {
+	if !gf.SkipLargeFiles || !gf.limitsSize(j) || !gf.tooLarge(j.size) {
+		return false
+	}
+	if gf.Verbose {
+		gf.log("Skipping %s: %d bytes is over the limit of %d", formatGCSName(j.bucket, j.object, j.generation), j.size, gf.MaxFileBytes)
+	}
+	return true
+}
+
+// entryTooLarge returns a fileTooLargeError if the archive entry name, of
+// size bytes, exceeds MaxFileBytes.
+func (gf *Fetcher) entryTooLarge(name string, size int64) error {
+	if !gf.tooLarge(size) {
+		return nil
+	}
+	return &fileTooLargeError{name: fmt.Sprintf("archive entry %q", name), size: size, limit: gf.MaxFileBytes}
+}
+
+// maxFileReader fails with a fileTooLargeError as soon as more than limit
+// bytes, counting the offset already written, are read from r, so that an
+// object larger than it claims is not downloaded whole.
+type maxFileReader struct {
+	r     io.Reader
+	name  string
+	n     int64
+	limit int64
+}
+
+func (m *maxFileReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.limit {
+		return n, &fileTooLargeError{name: m.name, size: m.n, limit: m.limit, atLeast: true}
+	}
+	return n, err
+}
+
+// tooLargeResult is the result of fetching an object found to be larger
+// than MaxFileBytes, with err describing it.
+func (gf *Fetcher) tooLargeResult(err *fileTooLargeError) fetchOnceResult {
+	if gf.SkipLargeFiles {
+		if gf.Verbose {
+			gf.log("Skipping %v", err)
+		}
+		return fetchOnceResult{tooLarge: true}
+	}
+	return fetchOnceResult{err: err}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingGCS counts the bytes read from the objects it serves.
+type countingGCS struct {
+	GCS
+	read *atomic.Int64
+}
+
+func (g countingGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	r, err := g.GCS.NewReader(ctx, bucket, object, opts)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&countingReader{r: r, n: g.read}, r}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestMaxFileBytes(t *testing.T) {
+	huge := bytes.Repeat([]byte("x"), 1<<20)
+	for _, test := range []struct {
+		name     string
+		size     int64 // In the manifest.
+		wantRead bool
+	}{
+		{name: "known size", size: int64(len(huge))},
+		{name: "streamed", wantRead: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "huge.bin", generation)] = fakeGCSResponse{content: huge}
+			var read atomic.Int64
+			tc.gf.GCS = countingGCS{GCS: tc.gcs, read: &read}
+			tc.gf.Bucket, tc.gf.Object = "", ""
+			tc.gf.SourceType = "Manifest"
+			tc.gf.ManifestReader = strings.NewReader(fmt.Sprintf(`{
+				"a.js":     {"sourceUrl": "gs://success-bucket/sfile1.js"},
+				"huge.bin": {"sourceUrl": "gs://success-bucket/huge.bin", "size": %d}
+			}`, test.size))
+			tc.gf.MaxFileBytes = 1024
+
+			_, err := tc.gf.FetchWithStats(context.Background())
+			var terr *fileTooLargeError
+			if !errors.As(err, &terr) {
+				t.Fatalf("FetchWithStats() = %v, want a fileTooLargeError", err)
+			}
+			if !strings.Contains(err.Error(), "gs://success-bucket/huge.bin") {
+				t.Errorf("FetchWithStats() = %q, want it to name the object", err)
+			}
+			if got := tc.gcs.reads[formatGCSName(successBucket, "huge.bin", generation)]; (got > 0) != test.wantRead || got > 1 {
+				t.Errorf("huge.bin read %d times, want it read %v and not retried", got, test.wantRead)
+			}
+			// The download stops soon after the limit, well short of the
+			// whole object.
+			if got := read.Load(); got >= int64(len(huge))/2 {
+				t.Errorf("%d bytes read, want the download stopped early", got)
+			}
+		})
+	}
+}
+
+func TestSkipLargeFiles(t *testing.T) {
+	for _, size := range []int64{0, 1 << 20} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		tc.gcs.objects[formatGCSName(successBucket, "huge.bin", generation)] = fakeGCSResponse{content: bytes.Repeat([]byte("x"), 1<<20)}
+		tc.gf.Bucket, tc.gf.Object = "", ""
+		tc.gf.SourceType = "Manifest"
+		tc.gf.ManifestReader = strings.NewReader(fmt.Sprintf(`{
+			"a.js":     {"sourceUrl": "gs://success-bucket/sfile1.js"},
+			"huge.bin": {"sourceUrl": "gs://success-bucket/huge.bin", "size": %d}
+		}`, size))
+		tc.gf.MaxFileBytes = 1024
+		tc.gf.SkipLargeFiles = true
+
+		st, err := tc.gf.FetchWithStats(context.Background())
+		if err != nil {
+			t.Fatalf("size %d: FetchWithStats() = %v", size, err)
+		}
+		if st.Skipped != 1 {
+			t.Errorf("size %d: FetchWithStats() = %+v, want 1 skipped", size, st)
+		}
+		if got, want := listFiles(t, tc.workDir), []string{"a.js"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("size %d: files in DestDir got %v, want %v", size, got, want)
+		}
+	}
+}
+
+func TestMaxFileBytesArchive(t *testing.T) {
+	for _, kind := range []string{"tgz", "zip"} {
+		for _, skip := range []bool{false, true} {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			object := "source." + kind
+			tc.gcs.objects[formatGCSName(successBucket, object, generation)] = fakeGCSResponse{content: flattenTestArchive(t, kind)}
+			tc.gf.Object = object
+			tc.gf.SourceType = "Archive"
+			tc.gf.MaxFileBytes = int64(len("first x")) // "second x" is one byte over.
+			tc.gf.SkipLargeFiles = skip
+
+			st, err := tc.gf.FetchWithStats(context.Background())
+			if !skip {
+				if err == nil || !strings.Contains(err.Error(), `archive entry "b/c/x.txt" is 8 bytes, over the limit of 7 bytes`) {
+					t.Errorf("%s: FetchWithStats() = %v, want b/c/x.txt over the limit", kind, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: FetchWithStats() = %v", kind, err)
+			}
+			if st.Files != 2 || st.Skipped != 1 {
+				t.Errorf("%s: FetchWithStats() = %+v, want 2 files and 1 skipped", kind, st)
+			}
+			if _, err := os.Stat(filepath.Join(tc.workDir, "b/c/x.txt")); !os.IsNotExist(err) {
+				t.Errorf("%s: Stat(b/c/x.txt) = %v, want it not extracted", kind, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchObjectOnceVerifiesMD5(t *testing.T) {
+	other := md5.Sum([]byte("something else"))
+	for _, test := range []struct {
+		name     string
+		response fakeGCSResponse
+		wantErr  bool
+		wantNote bool
+	}{
+		{name: "matching", response: fakeGCSResponse{content: sfile1Contents}},
+		{name: "mismatching", response: fakeGCSResponse{content: sfile1Contents, md5: other[:]}, wantErr: true},
+		{name: "composite", response: fakeGCSResponse{content: sfile1Contents, composite: true}, wantNote: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			var out bytes.Buffer
+			tc.gf.Stdout = &out
+			tc.gf.VerifyMD5 = true
+			tc.gcs.objects[formatGCSName(successBucket, "object", generation)] = test.response
+
+			j := job{bucket: successBucket, object: "object", filename: "object"}
+			result := tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "object"), make(chan struct{}, 1))
+			var cerr *checksumError
+			if gotErr := errors.As(result.err, &cerr) && cerr.algorithm == "MD5"; gotErr != test.wantErr {
+				t.Errorf("fetchObjectOnce() = %v, want an MD5 checksumError: %v", result.err, test.wantErr)
+			}
+			if !test.wantErr && result.err != nil {
+				t.Errorf("fetchObjectOnce() = %v, want nil", result.err)
+			}
+			if gotNote := strings.Contains(out.String(), "composite object"); gotNote != test.wantNote {
+				t.Errorf("log %q mentions a composite object: %v, want %v", out.String(), gotNote, test.wantNote)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing/fstest"
+	"time"
+)
+
+// maxSymlinks bounds how many symlinks are followed when resolving a path.
+const maxSymlinks = 40
+
+// MemFileSystem is a FileSystem that keeps everything in memory, for
+// fetching sources without touching disk. MapFS returns what it holds as an
+// fs.FS. The zero value is not usable; create one with NewMemFileSystem.
+type MemFileSystem struct {
+	// FreeBytes is reported by AvailableBytes. Zero means unlimited.
+	FreeBytes int64
+
+	mu    sync.Mutex
+	nodes map[string]*memNode // Keyed by cleaned path.
+}
+
+// memNode is a file, directory or symlink. Hard links share a memNode.
+type memNode struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	target  string // Symlink target.
+}
+
+// NewMemFileSystem returns an empty MemFileSystem.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{nodes: map[string]*memNode{}}
+}
+
+// isRoot reports whether the cleaned path p names a root, which always
+// exists as a directory.
+func isRoot(p string) bool {
+	return p == "." || p == string(filepath.Separator) || p == filepath.VolumeName(p)+string(filepath.Separator)
+}
+
+// lookup returns the node at the cleaned path p, following symlinks if
+// follow is set. The second result is the path of the returned node.
+func (m *MemFileSystem) lookup(p string, follow bool) (*memNode, string, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		if isRoot(p) {
+			return &memNode{mode: fs.ModeDir | 0777}, p, nil
+		}
+		n, ok := m.nodes[p]
+		if !ok {
+			return nil, p, fs.ErrNotExist
+		}
+		if !follow || n.mode&fs.ModeSymlink == 0 {
+			return n, p, nil
+		}
+		if filepath.IsAbs(n.target) {
+			p = filepath.Clean(n.target)
+		} else {
+			p = filepath.Join(filepath.Dir(p), n.target)
+		}
+	}
+	return nil, p, syscall.ELOOP
+}
+
+// checkParent returns an error unless the parent of the cleaned path p is a
+// directory.
+func (m *MemFileSystem) checkParent(p string) error {
+	n, _, err := m.lookup(filepath.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	if !n.mode.IsDir() {
+		return syscall.ENOTDIR
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *MemFileSystem) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := filepath.Clean(name)
+	n, p, err := m.lookup(p, true)
+	switch {
+	case err == fs.ErrNotExist && flag&os.O_CREATE != 0:
+		if err := m.checkParent(p); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		n = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[p] = n
+	case err != nil:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case n.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case flag&os.O_TRUNC != 0:
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{fs: m, node: n, name: name, flag: flag}, nil
+}
+
+func (m *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, p, err := m.lookup(filepath.Clean(name), true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return n.info(filepath.Base(p)), nil
+}
+
+func (m *MemFileSystem) Lstat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, p, err := m.lookup(filepath.Clean(name), false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return n.info(filepath.Base(p)), nil
+}
+
+func (m *MemFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, p, err := m.lookup(filepath.Clean(name), true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	prefix := p + string(filepath.Separator)
+	switch {
+	case p == ".":
+		prefix = ""
+	case strings.HasSuffix(p, string(filepath.Separator)):
+		prefix = p
+	}
+	var entries []fs.DirEntry
+	for q, child := range m.nodes {
+		if q == p || !strings.HasPrefix(q, prefix) {
+			continue
+		}
+		rest := q[len(prefix):]
+		if strings.ContainsRune(rest, filepath.Separator) {
+			continue // Not a direct child.
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(child.info(rest)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := filepath.Clean(path)
+	var missing []string
+	for ; !isRoot(p); p = filepath.Dir(p) {
+		n, _, err := m.lookup(p, true)
+		if err == nil {
+			if !n.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+	for _, d := range missing {
+		m.nodes[d] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _, err := m.lookup(filepath.Clean(name), true)
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	n.mode = n.mode.Type() | mode.Perm()
+	return nil
+}
+
+func (m *MemFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _, err := m.lookup(filepath.Clean(name), true)
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	n.modTime = mtime
+	return nil
+}
+
+// Chown only checks that name exists, as a MemFileSystem has no owners.
+func (m *MemFileSystem) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, _, err := m.lookup(filepath.Clean(name), false); err != nil {
+		return &fs.PathError{Op: "chown", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldp, newp := filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, _, err := m.lookup(oldp, false)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if err := m.checkParent(newp); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if existing, ok := m.nodes[newp]; ok && existing.mode.IsDir() && (!n.mode.IsDir() || m.hasChildren(newp)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EEXIST}
+	}
+	delete(m.nodes, oldp)
+	m.nodes[newp] = n
+	if n.mode.IsDir() {
+		prefix := oldp + string(filepath.Separator)
+		for p, child := range m.nodes {
+			if strings.HasPrefix(p, prefix) {
+				delete(m.nodes, p)
+				m.nodes[filepath.Join(newp, strings.TrimPrefix(p, prefix))] = child
+			}
+		}
+	}
+	return nil
+}
+
+// hasChildren reports whether the directory at the cleaned path p has any
+// entries.
+func (m *MemFileSystem) hasChildren(p string) bool {
+	prefix := p + string(filepath.Separator)
+	for q := range m.nodes {
+		if strings.HasPrefix(q, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := filepath.Clean(name)
+	if _, ok := m.nodes[p]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if m.hasChildren(p) {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.nodes, p)
+	return nil
+}
+
+func (m *MemFileSystem) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := filepath.Clean(path)
+	prefix := p + string(filepath.Separator)
+	for q := range m.nodes {
+		if q == p || strings.HasPrefix(q, prefix) {
+			delete(m.nodes, q)
+		}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := filepath.Clean(newname)
+	if err := m.checkParent(p); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if _, ok := m.nodes[p]; ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	m.nodes[p] = &memNode{mode: fs.ModeSymlink | 0777, modTime: time.Now(), target: oldname}
+	return nil
+}
+
+func (m *MemFileSystem) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := filepath.Clean(newname)
+	n, _, err := m.lookup(filepath.Clean(oldname), false)
+	if err == nil && n.mode.IsDir() {
+		err = syscall.EPERM
+	}
+	if err == nil {
+		err = m.checkParent(p)
+	}
+	if _, ok := m.nodes[p]; err == nil && ok {
+		err = fs.ErrExist
+	}
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	m.nodes[p] = n
+	return nil
+}
+
+func (m *MemFileSystem) AvailableBytes(path string) (int64, error) {
+	if m.FreeBytes == 0 {
+		return math.MaxInt64, nil
+	}
+	return m.FreeBytes, nil
+}
+
+// MapFS returns a snapshot of the files, directories and symlinks in m,
+// keyed by slash-separated paths without a leading slash. Symlinks are
+// recorded with their target as data.
+func (m *MemFileSystem) MapFS() fstest.MapFS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mfs := fstest.MapFS{}
+	paths := make([]string, 0, len(m.nodes))
+	for p := range m.nodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		n := m.nodes[p]
+		name := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, filepath.VolumeName(p))), "/")
+		data := append([]byte(nil), n.data...)
+		if n.mode&fs.ModeSymlink != 0 {
+			data = []byte(n.target)
+		}
+		mfs[name] = &fstest.MapFile{Data: data, Mode: n.mode, ModTime: n.modTime}
+	}
+	return mfs
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFileInfo is the os.FileInfo of a memNode.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is an open memNode. Reads and writes share one offset, as for an
+// *os.File.
+type memFile struct {
+	fs     *MemFileSystem
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(b)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], b)
+	f.offset += int64(len(b))
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// Sync does nothing, as a MemFileSystem has no stable storage.
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.node.info(filepath.Base(f.name)), nil
+}
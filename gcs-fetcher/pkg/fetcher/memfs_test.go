@@ -0,0 +1,238 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemFileSystem(t *testing.T) {
+	m := NewMemFileSystem()
+	if err := m.MkdirAll("/src/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll() = %v", err)
+	}
+	f, err := m.Create("/src/dir/a.txt")
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if _, err := io.WriteString(f, "hello"); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	// Appending through OpenFile continues after the existing content.
+	f, err = m.OpenFile("/src/dir/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() = %v", err)
+	}
+	if _, err := io.Copy(io.Discard, f); err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if _, err := io.WriteString(f, " world"); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	f.Close()
+
+	if err := m.Symlink("dir/a.txt", "/src/link"); err != nil {
+		t.Fatalf("Symlink() = %v", err)
+	}
+	if err := m.Link("/src/dir/a.txt", "/src/hard"); err != nil {
+		t.Fatalf("Link() = %v", err)
+	}
+	for _, name := range []string{"/src/dir/a.txt", "/src/link", "/src/hard"} {
+		info, err := m.Stat(name)
+		if err != nil {
+			t.Errorf("Stat(%s) = %v", name, err)
+			continue
+		}
+		if info.Size() != int64(len("hello world")) || !info.Mode().IsRegular() {
+			t.Errorf("Stat(%s) = size %d mode %v, want regular file of %d bytes", name, info.Size(), info.Mode(), len("hello world"))
+		}
+	}
+	if info, err := m.Lstat("/src/link"); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat(/src/link) = %v, %v; want a symlink", info, err)
+	}
+
+	entries, err := m.ReadDir("/src")
+	if err != nil {
+		t.Fatalf("ReadDir() = %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"dir", "hard", "link"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir(/src) got %v, want %v", names, want)
+	}
+
+	if err := m.Rename("/src/dir", "/src/moved"); err != nil {
+		t.Fatalf("Rename() = %v", err)
+	}
+	if _, err := m.Open("/src/dir/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Open(old name) = %v, want not exist", err)
+	}
+	if err := m.Remove("/src"); err == nil {
+		t.Errorf("Remove(non-empty dir) = nil, want error")
+	}
+	if _, err := m.Create("/missing/a.txt"); err == nil {
+		t.Errorf("Create() without parent = nil, want error")
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := m.Chtimes("/src/moved/a.txt", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes() = %v", err)
+	}
+	if err := m.Chmod("/src/moved/a.txt", 0600); err != nil {
+		t.Fatalf("Chmod() = %v", err)
+	}
+
+	mfs := m.MapFS()
+	got, err := fs.ReadFile(mfs, "src/moved/a.txt")
+	if err != nil || string(got) != "hello world" {
+		t.Errorf("ReadFile(src/moved/a.txt) = %q, %v, want %q", got, err, "hello world")
+	}
+	if f := mfs["src/moved/a.txt"]; f.Mode != 0600 || !f.ModTime.Equal(mtime) {
+		t.Errorf("src/moved/a.txt mode %v mtime %v, want %v %v", f.Mode, f.ModTime, os.FileMode(0600), mtime)
+	}
+	if got := string(mfs["src/link"].Data); got != "dir/a.txt" {
+		t.Errorf("src/link target = %q, want %q", got, "dir/a.txt")
+	}
+
+	if err := m.RemoveAll("/src"); err != nil {
+		t.Fatalf("RemoveAll() = %v", err)
+	}
+	if n := len(m.MapFS()); n != 0 {
+		t.Errorf("after RemoveAll got %d entries, want 0", n)
+	}
+}
+
+func TestMemFileSystemAvailableBytes(t *testing.T) {
+	m := NewMemFileSystem()
+	if got, err := m.AvailableBytes("/"); err != nil || got != math.MaxInt64 {
+		t.Errorf("AvailableBytes() = %d, %v, want unlimited", got, err)
+	}
+
+	m.FreeBytes = 10
+	gf := &Fetcher{OS: m, Stdout: io.Discard, Stderr: io.Discard}
+	if err := gf.checkSpace("/src", 10); err != nil {
+		t.Errorf("checkSpace(10) = %v, want nil", err)
+	}
+	if err := gf.checkSpace("/src", 11); err == nil {
+		t.Errorf("checkSpace(11) = nil, want insufficientSpaceError")
+	}
+}
+
+func TestFetchIntoMemFileSystem(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "contents of a",
+		"dir/b.txt": "contents of b",
+	}
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gw)
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatalf("Writing header for %s: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatalf("Writing content for %s: %v", name, err)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Creating %s in zip: %v", name, err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			t.Fatalf("Writing %s to zip: %v", name, err)
+		}
+	}
+	for _, c := range []io.Closer{tw, gw, zw} {
+		if err := c.Close(); err != nil {
+			t.Fatalf("Closing archive: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		object     string
+		sourceType string
+		want       map[string]string
+	}{{
+		object:     goodManifest,
+		sourceType: "Manifest",
+		want: map[string]string{
+			sfile1: string(sfile1Contents),
+			sfile2: string(sfile2Contents),
+			sfile3: string(sfile3Contents),
+		},
+	}, {
+		object:     "source.tgz",
+		sourceType: "Archive",
+		want:       files,
+	}, {
+		object:     "source.zip",
+		sourceType: "ZipArchive",
+		want:       files,
+	}} {
+		t.Run(tc.object, func(t *testing.T) {
+			ctx, teardown := buildManifestTestContext(t)
+			defer teardown()
+			ctx.gcs.objects[formatGCSName(successBucket, "source.tgz", generation)] = fakeGCSResponse{content: tgz.Bytes()}
+			ctx.gcs.objects[formatGCSName(successBucket, "source.zip", generation)] = fakeGCSResponse{content: zipped.Bytes()}
+			m := NewMemFileSystem()
+			ctx.gf.OS = m
+			ctx.gf.DestDir = "/src"
+			ctx.gf.StagingDir = "/src/.staging"
+			ctx.gf.Object = tc.object
+			ctx.gf.SourceType = tc.sourceType
+
+			if err := ctx.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			mfs := m.MapFS()
+			for name, want := range tc.want {
+				got, err := fs.ReadFile(mfs, "src/"+name)
+				if err != nil {
+					t.Errorf("ReadFile(%s): %v", name, err)
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if _, ok := mfs["src/.staging"]; ok {
+				t.Errorf("staging dir not removed")
+			}
+			// Nothing was written to the real work directory.
+			if entries, err := os.ReadDir(ctx.workDir); err != nil || len(entries) != 0 {
+				t.Errorf("ReadDir(%s) = %d entries, %v, want empty", ctx.workDir, len(entries), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "time"
+
+// Metrics receives measurements of a fetch, for export to a monitoring
+// system. Its methods are called from the download workers, concurrently,
+// and never while the Fetcher holds a lock or waits on GCS; they should
+// return quickly.
+//
+// For example, to export Prometheus metrics:
+//
+//	type promMetrics struct {
+//		fetches  *prometheus.CounterVec // Labelled by "result".
+//		bytes    prometheus.Counter
+//		duration prometheus.Histogram
+//		retries  prometheus.Counter
+//	}
+//
+//	func (m *promMetrics) ObserveFetch(object string, bytes int64, dur time.Duration, err error) {
+//		result := "success"
+//		if err != nil {
+//			result = "failure"
+//		}
+//		m.fetches.WithLabelValues(result).Inc()
+//		m.bytes.Add(float64(bytes))
+//		m.duration.Observe(dur.Seconds())
+//	}
+//
+//	func (m *promMetrics) IncRetry() { m.retries.Inc() }
+//
+// Labelling by object is best avoided, as a manifest may list many
+// thousands of them.
+//
+// If a Metrics also has a Flush() error method, Fetcher.Close calls it.
+type Metrics interface {
+	// ObserveFetch records the outcome of fetching an object, once all of
+	// its attempts are over. dur covers every attempt and the backoff
+	// between them, and err is nil if the object was fetched.
+	ObserveFetch(object string, bytes int64, dur time.Duration, err error)
+	// IncRetry counts an attempt made after a failed one.
+	IncRetry()
+}
+
+// noMetrics is the Metrics used when Fetcher.Metrics is nil.
+type noMetrics struct{}
+
+func (noMetrics) ObserveFetch(string, int64, time.Duration, error) {}
+func (noMetrics) IncRetry()                                        {}
+
+func (gf *Fetcher) metrics() Metrics {
+	if gf.Metrics == nil {
+		return noMetrics{}
+	}
+	return gf.Metrics
+}
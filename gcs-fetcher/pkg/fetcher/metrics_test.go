@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics keeps everything it is given.
+type recordingMetrics struct {
+	mu      sync.Mutex
+	fetches map[string]int64 // Object to bytes.
+	errs    int
+	retries int
+}
+
+func (m *recordingMetrics) ObserveFetch(object string, bytes int64, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fetches == nil {
+		m.fetches = map[string]int64{}
+	}
+	m.fetches[object] = bytes
+	if err != nil {
+		m.errs++
+	}
+}
+
+func (m *recordingMetrics) IncRetry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+func TestMetrics(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsCreate = 1 // Provoke one retry
+	m := &recordingMetrics{}
+	tc.gf.Metrics = m
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+		{bucket: successBucket, object: sfile3, filename: "sfile3"},
+	}
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("processJobs() got %v, want nil", err)
+	}
+
+	want := map[string]int64{
+		formatGCSName(successBucket, sfile1, 0): int64(len(sfile1Contents)),
+		formatGCSName(successBucket, sfile2, 0): int64(len(sfile2Contents)),
+		formatGCSName(successBucket, sfile3, 0): int64(len(sfile3Contents)),
+	}
+	if len(m.fetches) != len(want) {
+		t.Errorf("ObserveFetch() got %d objects, want %d", len(m.fetches), len(want))
+	}
+	for object, bytes := range want {
+		if got, ok := m.fetches[object]; !ok || got != bytes {
+			t.Errorf("ObserveFetch(%s) got %d bytes (observed: %v), want %d", object, got, ok, bytes)
+		}
+	}
+	if m.errs != 0 {
+		t.Errorf("ObserveFetch() got %d errors, want 0", m.errs)
+	}
+	if m.retries != 1 {
+		t.Errorf("IncRetry() got %d calls, want 1", m.retries)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMaxArchiveDepth is how deep RecurseArchives extracts nested
+// archives when MaxArchiveDepth is zero.
+const defaultMaxArchiveDepth = 3
+
+// archiveSuffixes are the extensions, as extensionKind recognizes them,
+// stripped from a nested archive's name to name the directory it is
+// extracted into. Longer suffixes come first.
+var archiveSuffixes = []string{".tar.gz", ".tar.xz", ".tar.zst", ".tar.bz2", ".tgz", ".txz", ".tzst", ".tbz2", ".tar", ".zip"}
+
+// nestedUsage is what the archives that a nested archive came from
+// extracted, counted against MaxFiles and MaxTotalBytes.
+type nestedUsage struct {
+	files int
+	size  int64
+}
+
+// nestedDest returns the directory the nested archive name is extracted
+// into: its name without its extension.
+func nestedDest(name string) string {
+	lower := strings.ToLower(name)
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return name
+}
+
+// extractNested extracts the archives among the files in st, extracted
+// from an archive, if RecurseArchives is set, and adds what they held to
+// st.
+func (gf *Fetcher) extractNested(ctx context.Context, st stats) (stats, error) {
+	if !gf.RecurseArchives {
+		return st, nil
+	}
+	defer func() { gf.nestedUsage = nestedUsage{} }()
+	return gf.extractNestedAt(ctx, st, st.written, 1)
+}
+
+// extractNestedAt extracts the archives among written, nested depth deep,
+// and those they hold in turn, adding what they held to st.
+func (gf *Fetcher) extractNestedAt(ctx context.Context, st stats, written []writtenFile, depth int) (stats, error) {
+	maxDepth := gf.MaxArchiveDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxArchiveDepth
+	}
+	for _, w := range written {
+		kind := extensionKind(w.name)
+		if kind == "" {
+			continue
+		}
+		if depth > maxDepth {
+			gf.logErr("WARNING: not extracting %q, nested more than %d archives deep", w.name, maxDepth)
+			continue
+		}
+		var size int64
+		for _, f := range st.written {
+			size += f.size
+		}
+		gf.nestedUsage = nestedUsage{files: st.files, size: size}
+		inner, err := gf.extractArchive(ctx, kind, w.name, nestedDest(w.name))
+		if err != nil {
+			return st, fmt.Errorf("extracting nested archive %q: %w", w.name, err)
+		}
+		if gf.Verbose {
+			gf.log("Extracted %d files from nested archive %q.", inner.files, filepath.Base(w.name))
+		}
+		st.files += inner.files
+		st.skipped += inner.skipped
+		st.unchanged += inner.unchanged
+		st.written = append(st.written, inner.written...)
+		if st, err = gf.extractNestedAt(ctx, st, inner.written, depth+1); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
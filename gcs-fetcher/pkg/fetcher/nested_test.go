@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file in an archive built by nestedZip or nestedTgz.
+type archiveEntry struct {
+	name    string
+	content []byte
+}
+
+func nestedZip(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatalf("Creating zip entry %s: %v", e.name, err)
+		}
+		if _, err := w.Write(e.content); err != nil {
+			t.Fatalf("Writing zip entry %s: %v", e.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Closing zip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func nestedTgz(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.content))}); err != nil {
+			t.Fatalf("Writing tar header %s: %v", e.name, err)
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			t.Fatalf("Writing tar entry %s: %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// fetchNested fetches a zip holding lib/inner.tar.gz, which holds a.txt
+// and deeper.zip, which holds b.txt.
+func fetchNested(t *testing.T, configure func(*Fetcher)) (string, error) {
+	tc, teardown := buildManifestTestContext(t)
+	t.Cleanup(teardown)
+	deeper := nestedZip(t, archiveEntry{"b.txt", []byte("b")})
+	inner := nestedTgz(t, archiveEntry{"a.txt", []byte("a")}, archiveEntry{"deeper.zip", deeper})
+	outer := nestedZip(t, archiveEntry{"top.txt", []byte("top")}, archiveEntry{"lib/inner.tar.gz", inner})
+	tc.gcs.objects[formatGCSName(successBucket, "source.zip", generation)] = fakeGCSResponse{content: outer}
+	tc.gf.Object = "source.zip"
+	tc.gf.SourceType = "ZipArchive"
+	tc.gf.RecurseArchives = true
+	if configure != nil {
+		configure(tc.gf)
+	}
+	_, err := tc.gf.FetchWithStats(context.Background())
+	return tc.workDir, err
+}
+
+func TestRecurseArchives(t *testing.T) {
+	dest, err := fetchNested(t, nil)
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	for name, want := range map[string]string{
+		"top.txt":                "top",
+		"lib/inner/a.txt":        "a",
+		"lib/inner/deeper/b.txt": "b",
+	} {
+		if got, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(got) != want {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "lib/inner.tar.gz")); err != nil {
+		t.Errorf("Stat(lib/inner.tar.gz) = %v, want the nested archive kept", err)
+	}
+}
+
+func TestRecurseArchivesMaxDepth(t *testing.T) {
+	dest, err := fetchNested(t, func(gf *Fetcher) { gf.MaxArchiveDepth = 1 })
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "lib/inner/a.txt")); err != nil {
+		t.Errorf("Stat(lib/inner/a.txt) = %v, want the first level extracted", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "lib/inner/deeper.zip")); err != nil {
+		t.Errorf("Stat(lib/inner/deeper.zip) = %v, want it left as it is", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "lib/inner/deeper")); !os.IsNotExist(err) {
+		t.Errorf("Stat(lib/inner/deeper) = %v, want nothing extracted past the depth limit", err)
+	}
+}
+
+func TestRecurseArchivesLimitsAllLevels(t *testing.T) {
+	// No archive holds more than 2 files, but they hold 5 in all.
+	_, err := fetchNested(t, func(gf *Fetcher) { gf.MaxFiles = 4 })
+	var lerr *limitExceededError
+	if !errors.As(err, &lerr) || lerr.what != "files" {
+		t.Errorf("FetchWithStats() = %v, want a limitExceededError for files", err)
+	}
+}
+
+func TestRecurseArchivesRejectsZipSlip(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	inner := nestedTgz(t, archiveEntry{"../../escaped.txt", []byte("x")})
+	outer := nestedZip(t, archiveEntry{"lib/inner.tgz", inner})
+	tc.gcs.objects[formatGCSName(successBucket, "source.zip", generation)] = fakeGCSResponse{content: outer}
+	tc.gf.Object = "source.zip"
+	tc.gf.SourceType = "ZipArchive"
+	tc.gf.RecurseArchives = true
+
+	_, err := tc.gf.FetchWithStats(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "nested archive") {
+		t.Errorf("FetchWithStats() = %v, want the nested archive rejected", err)
+	}
+	if _, err := os.Stat(filepath.Join(tc.workDir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("Stat(escaped.txt) = %v, want nothing written outside lib/inner", err)
+	}
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "context"
+
+// notNewer reports whether SkipIfNotNewer leaves alone the file already at
+// the final name of j: it is modified no earlier than the object was last
+// updated. Staged files are always fetched.
+func (gf *Fetcher) notNewer(ctx context.Context, j job) bool {
+	if !gf.SkipIfNotNewer || j.destDirOverride != "" || gf.Atomic {
+		return false
+	}
+	info, err := gf.OS.Stat(gf.finalName(j))
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	attrs, err := gf.GCS.Attrs(ctx, j.bucket, j.object, gf.readOptions(j))
+	if err != nil || attrs.Updated.IsZero() {
+		return false
+	}
+	return !info.ModTime().Before(attrs.Updated)
+}
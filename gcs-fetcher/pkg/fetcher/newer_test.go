@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSkipIfNotNewer(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	updated := time.Now().Add(-time.Hour)
+	for _, object := range []string{sfile1, sfile2} {
+		name := formatGCSName(successBucket, object, generation)
+		response := tc.gcs.objects[name]
+		response.updated = updated
+		tc.gcs.objects[name] = response
+	}
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.SkipIfNotNewer = true
+	tc.gf.ManifestReader = bytes.NewReader([]byte(`{
+		"newer.js": {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"older.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`))
+
+	// newer.js was modified since the object was updated, older.jpg before.
+	for name, mtime := range map[string]time.Time{"newer.js": time.Now(), "older.jpg": updated.Add(-time.Hour)} {
+		path := filepath.Join(tc.workDir, name)
+		if err := ioutil.WriteFile(path, []byte("LOCAL"), 0644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", path, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("Chtimes(%s): %v", path, err)
+		}
+	}
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if st.Skipped != 1 {
+		t.Errorf("FetchWithStats() = %+v, want 1 skipped", st)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "newer.js")); err != nil || string(got) != "LOCAL" {
+		t.Errorf("ReadFile(newer.js) = %q, %v, want the local copy left alone", got, err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "older.jpg")); err != nil || !bytes.Equal(got, sfile2Contents) {
+		t.Errorf("ReadFile(older.jpg) = %q, %v, want %q", got, err, sfile2Contents)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// objectPath returns the local path, relative to DestDir, of an object
+// whose name relative to the fetched prefix is name. GCS object names may
+// start with a slash or contain several in a row, which would otherwise
+// make empty path components; these are dropped, so that "//weird//name"
+// is written to weird/name and "dir//file" to dir/file.
+func objectPath(name string) string {
+	var parts []string
+	for _, p := range strings.Split(name, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// uniquePaths makes the filenames of jobs unique where objectPath mapped
+// several objects to the same one. Jobs whose filename is their object's
+// name as it is keep it; the others, in order, are given the first free
+// name with a numeric suffix before the extension, as with
+// CollisionRename: if both "dir/file.txt" and "dir//file.txt" are listed,
+// the latter is written to dir/file-1.txt. normalized reports which jobs'
+// filenames objectPath changed.
+func uniquePaths(jobs []job, normalized []bool) {
+	taken := map[string]bool{}
+	for i, j := range jobs {
+		if !normalized[i] {
+			taken[j.filename] = true
+		}
+	}
+	for i := range jobs {
+		if !normalized[i] {
+			continue
+		}
+		name := jobs[i].filename
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for n := 1; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d%s", stem, n, ext)
+		}
+		taken[name] = true
+		jobs[i].filename = name
+	}
+}
@@ -0,0 +1,40 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "path/filepath"
+
+// keepsExisting reports whether OverwritePolicy keeps the file already at
+// name, which is then not written.
+func (gf *Fetcher) keepsExisting(name string) bool {
+	if gf.OverwritePolicy == nil {
+		return false
+	}
+	if _, err := gf.OS.Stat(name); err != nil {
+		return false
+	}
+	return !gf.OverwritePolicy(name)
+}
+
+// keepsExistingObject is keepsExisting for the file in DestDir that the
+// object of j is written to, which an Atomic fetch only moves there at the
+// end. Staged objects are always written.
+func (gf *Fetcher) keepsExistingObject(j job) bool {
+	if j.destDirOverride != "" {
+		return false
+	}
+	return gf.keepsExisting(filepath.Join(gf.DestDir, j.filename))
+}
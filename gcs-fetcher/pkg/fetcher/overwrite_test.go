@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// protect is an OverwritePolicy that keeps files named seeded.
+func protect(finalname string) bool {
+	return filepath.Base(finalname) != "seeded"
+}
+
+func TestOverwritePolicyManifest(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		tc.gf.Atomic = atomic
+		tc.gf.OverwritePolicy = protect
+		for _, name := range []string{"seeded", "other"} {
+			if err := os.WriteFile(filepath.Join(tc.workDir, name), []byte("pre-seeded"), 0644); err != nil {
+				t.Fatalf("WriteFile(%s): %v", name, err)
+			}
+		}
+
+		tc.gf.Bucket, tc.gf.Object = "", ""
+		tc.gf.SourceType = "Manifest"
+		tc.gf.ManifestReader = strings.NewReader(`{
+			"seeded": {"sourceUrl": "gs://success-bucket/sfile1.js"},
+			"other":  {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+		}`)
+
+		st, err := tc.gf.FetchWithStats(context.Background())
+		if err != nil {
+			t.Fatalf("Atomic=%v: FetchWithStats() = %v", atomic, err)
+		}
+		if st.Skipped != 1 {
+			t.Errorf("Atomic=%v: FetchWithStats() = %+v, want 1 skipped", atomic, st)
+		}
+		for name, want := range map[string]string{"seeded": "pre-seeded", "other": string(sfile2Contents)} {
+			if got, err := os.ReadFile(filepath.Join(tc.workDir, name)); err != nil || string(got) != want {
+				t.Errorf("Atomic=%v: ReadFile(%s) = %q, %v, want %q", atomic, name, got, err, want)
+			}
+		}
+		if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)]; got != 0 {
+			t.Errorf("Atomic=%v: %s read %d times, want 0", atomic, sfile1, got)
+		}
+	}
+}
+
+func TestOverwritePolicyArchive(t *testing.T) {
+	for _, archive := range []struct {
+		object, sourceType string
+		build              func(*testing.T, ...archiveEntry) []byte
+	}{
+		{"source.zip", "ZipArchive", nestedZip},
+		{"source.tgz", "TarGzArchive", nestedTgz},
+	} {
+		t.Run(archive.sourceType, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			content := archive.build(t,
+				archiveEntry{"dir/seeded", []byte("from archive")},
+				archiveEntry{"dir/other", []byte("from archive")},
+			)
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: content}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = archive.sourceType
+			tc.gf.OverwritePolicy = protect
+			if err := os.MkdirAll(filepath.Join(tc.workDir, "dir"), 0755); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			for _, name := range []string{"dir/seeded", "dir/other"} {
+				if err := os.WriteFile(filepath.Join(tc.workDir, name), []byte("pre-seeded"), 0644); err != nil {
+					t.Fatalf("WriteFile(%s): %v", name, err)
+				}
+			}
+
+			st, err := tc.gf.FetchWithStats(context.Background())
+			if err != nil {
+				t.Fatalf("FetchWithStats() = %v", err)
+			}
+			if st.Skipped != 1 {
+				t.Errorf("FetchWithStats() = %+v, want 1 skipped", st)
+			}
+			for name, want := range map[string]string{"dir/seeded": "pre-seeded", "dir/other": "from archive"} {
+				if got, err := os.ReadFile(filepath.Join(tc.workDir, name)); err != nil || string(got) != want {
+					t.Errorf("ReadFile(%s) = %q, %v, want %q", name, got, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// privileged reports whether the process may give files away to other
+// users. It is a variable so that tests can pretend either way.
+var privileged = func() bool { return os.Geteuid() == 0 }
+
+// errOwnershipPrivilege is returned when StrictOwnership is set but the
+// process cannot change the owner of the files it extracts.
+var errOwnershipPrivilege = errors.New("preserving ownership requires running as root")
+
+// ownershipEnabled reports whether extracted files are to be given the
+// owner recorded in the archive. Without privilege, it returns
+// errOwnershipPrivilege if StrictOwnership is set, and otherwise warns that
+// ownership is not preserved.
+func (gf *Fetcher) ownershipEnabled() (bool, error) {
+	if !gf.PreserveOwnership {
+		return false, nil
+	}
+	if privileged() {
+		return true, nil
+	}
+	if gf.StrictOwnership {
+		return false, errOwnershipPrivilege
+	}
+	gf.logErr("WARNING: not running as root, so extracted files are not given their archived owners")
+	return false, nil
+}
+
+// setOwner gives name the uid and gid recorded in the archive. A failure
+// is returned if StrictOwnership is set, and otherwise logged.
+func (gf *Fetcher) setOwner(name string, uid, gid int) error {
+	if err := gf.OS.Chown(name, uid, gid); err != nil {
+		if gf.StrictOwnership {
+			return fmt.Errorf("setting owner of %s to %d:%d: %w", name, uid, gid, err)
+		}
+		gf.logErr("WARNING: failed to set owner of %s to %d:%d, continuing: %v", name, uid, gid, err)
+	}
+	return nil
+}
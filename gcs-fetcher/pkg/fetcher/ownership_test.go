@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ownedTar returns a tarball holding a directory, a small and a large
+// file, and a symlink, each with its own uid and gid.
+func ownedTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	large := make([]byte, maxBufferedEntry+1)
+	entries := []struct {
+		h    tar.Header
+		data []byte
+	}{
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1, Gid: 2}, nil},
+		{tar.Header{Name: "dir/small.txt", Typeflag: tar.TypeReg, Mode: 0644, Uid: 3, Gid: 4, Size: 5}, []byte("small")},
+		{tar.Header{Name: "dir/large.bin", Typeflag: tar.TypeReg, Mode: 0644, Uid: 5, Gid: 6, Size: int64(len(large))}, large},
+		{tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "small.txt", Uid: 7, Gid: 8}, nil},
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&e.h); err != nil {
+			t.Fatalf("Writing header for %s: %v", e.h.Name, err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatalf("Writing content for %s: %v", e.h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// pretendPrivileged makes privileged return is until the test ends.
+func pretendPrivileged(t *testing.T, is bool) {
+	old := privileged
+	privileged = func() bool { return is }
+	t.Cleanup(func() { privileged = old })
+}
+
+func TestUntarPreservesOwnership(t *testing.T) {
+	pretendPrivileged(t, true)
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.PreserveOwnership = true
+	tc.gf.AllowSymlinks = true
+
+	if _, err := tc.gf.untar(context.Background(), bytes.NewReader(ownedTar(t)), tc.workDir); err != nil {
+		t.Fatalf("untar() = %v", err)
+	}
+	want := map[string][2]int{
+		filepath.Join(tc.workDir, "dir"):           {1, 2},
+		filepath.Join(tc.workDir, "dir/small.txt"): {3, 4},
+		filepath.Join(tc.workDir, "dir/large.bin"): {5, 6},
+		filepath.Join(tc.workDir, "dir/link"):      {7, 8},
+	}
+	if !reflect.DeepEqual(tc.os.owners, want) {
+		t.Errorf("owners = %v, want %v", tc.os.owners, want)
+	}
+}
+
+func TestUntarOwnershipFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		privileged  bool
+		strict      bool
+		errorsChown int
+		wantErr     error
+	}{
+		{name: "unprivileged", privileged: false},
+		{name: "unprivileged, strict", privileged: false, strict: true, wantErr: errOwnershipPrivilege},
+		{name: "chown fails", privileged: true, errorsChown: 1},
+		{name: "chown fails, strict", privileged: true, strict: true, errorsChown: 1, wantErr: errChown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pretendPrivileged(t, test.privileged)
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gf.PreserveOwnership = true
+			tc.gf.StrictOwnership = test.strict
+			tc.os.errorsChown = test.errorsChown
+
+			_, err := tc.gf.untar(context.Background(), bytes.NewReader(ownedTar(t)), tc.workDir)
+			if test.wantErr == nil {
+				if err != nil {
+					t.Fatalf("untar() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("untar() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
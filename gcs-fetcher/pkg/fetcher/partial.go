@@ -0,0 +1,59 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"os"
+)
+
+// trackPartial records that name is about to be written, so that it is
+// removed if the fetch is cancelled before untrackPartial is called.
+func (gf *Fetcher) trackPartial(name string) {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	if gf.partialFiles == nil {
+		gf.partialFiles = map[string]bool{}
+	}
+	gf.partialFiles[name] = true
+}
+
+// untrackPartial records that name has been written completely.
+func (gf *Fetcher) untrackPartial(name string) {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	delete(gf.partialFiles, name)
+}
+
+// removePartials forgets the files being written and, if ctx was cancelled
+// or ran past its deadline, removes them, so that the next run does not
+// find staged downloads or truncated files left by this one. Files written
+// completely are left alone; those of an Atomic fetch are removed with
+// StagingDir instead.
+func (gf *Fetcher) removePartials(ctx context.Context) {
+	gf.mu.Lock()
+	names := gf.partialFiles
+	gf.partialFiles = nil
+	gf.mu.Unlock()
+	if ctx.Err() == nil {
+		return
+	}
+	for name := range names {
+		if err := gf.OS.Remove(name); err != nil && !os.IsNotExist(err) {
+			gf.log("Failed to remove partly written file %q, continuing: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stalledReader signals on stalled when it is first read from, then blocks
+// until ctx is done, like a connection that stops delivering bytes. If set,
+// released is called once ctx is done.
+type stalledReader struct {
+	ctx      context.Context
+	stalled  chan<- struct{}
+	released func()
+}
+
+func (r *stalledReader) Read([]byte) (int, error) {
+	select {
+	case r.stalled <- struct{}{}:
+	default:
+	}
+	<-r.ctx.Done()
+	if r.released != nil {
+		r.released()
+	}
+	return 0, r.ctx.Err()
+}
+
+// stallingGCS serves the first bytes of every object, then stalls.
+type stallingGCS struct {
+	GCS
+	stalled chan struct{}
+}
+
+func (g *stallingGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), &stalledReader{ctx: ctx, stalled: g.stalled})), nil
+}
+
+// regularFiles returns the regular files under dir.
+func regularFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk(%q) = %v", dir, err)
+	}
+	return files
+}
+
+func TestProcessJobsCancelledRemovesPartialFiles(t *testing.T) {
+	for _, inPlace := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		gcs := &stallingGCS{stalled: make(chan struct{}, 3)}
+		tc.gf.GCS = gcs
+		tc.gf.InPlaceWrite = inPlace
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-gcs.stalled
+			cancel()
+		}()
+		jobs := []job{
+			{bucket: successBucket, object: sfile1, filename: sfile1},
+			{bucket: successBucket, object: sfile2, filename: sfile2},
+			{bucket: successBucket, object: sfile3, filename: "dir/" + sfile3},
+		}
+		if _, err := tc.gf.processJobs(ctx, jobs); err == nil {
+			t.Errorf("processJobs(InPlaceWrite=%v) succeeded, want the cancellation", inPlace)
+		}
+		if files := regularFiles(t, tc.workDir); len(files) > 0 {
+			t.Errorf("processJobs(InPlaceWrite=%v) left %q, want no files", inPlace, files)
+		}
+	}
+}
+
+func TestProcessJobsCancelledKeepsCompletedFiles(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := tc.gf.processJobs(ctx, []job{{bucket: successBucket, object: sfile1, filename: sfile1}}); err != nil {
+		t.Fatalf("processJobs() = %v", err)
+	}
+	cancel()
+	tc.gf.removePartials(ctx)
+	if _, err := os.Stat(filepath.Join(tc.workDir, sfile1)); err != nil {
+		t.Errorf("Stat(%s) = %v, want the fetched file kept", sfile1, err)
+	}
+}
+
+func TestUntarCancelledRemovesPartialFile(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := make([]byte, maxBufferedEntry+1) // Written as it is read.
+	if err := tw.WriteHeader(&tar.Header{Name: "big.bin", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	ctx, cancel := context.WithCancel(context.Background())
+	stalled := make(chan struct{}, 1)
+	go func() {
+		<-stalled
+		cancel()
+	}()
+	// Stall halfway through the entry.
+	r := io.MultiReader(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), &stalledReader{ctx: ctx, stalled: stalled})
+	gf := &Fetcher{OS: OSFileSystem{}, WorkerCount: 2}
+	if _, err := gf.untar(ctx, r, dest); err != context.Canceled {
+		t.Errorf("untar() = %v, want %v", err, context.Canceled)
+	}
+	if files := regularFiles(t, dest); len(files) > 0 {
+		t.Errorf("untar() left %q, want no files", files)
+	}
+}
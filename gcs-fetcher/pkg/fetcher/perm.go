@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// specialBits are the mode bits that PermMask strips unless AllowSpecialBits
+// is set.
+const specialBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// extractedMode returns the mode to give a file, or a directory if dir is
+// set, that an archive records with the given mode.
+func (gf *Fetcher) extractedMode(mode os.FileMode, dir bool) os.FileMode {
+	typ := mode & os.ModeType
+	if dir && gf.ForceDirMode != 0 {
+		return typ | gf.ForceDirMode&(os.ModePerm|specialBits)
+	}
+	if !dir && gf.ForceFileMode != 0 {
+		return typ | gf.ForceFileMode&(os.ModePerm|specialBits)
+	}
+	if gf.PermMask == 0 {
+		return mode
+	}
+	mode &^= gf.PermMask & os.ModePerm
+	if !gf.AllowSpecialBits {
+		mode &^= specialBits
+	}
+	return mode
+}
+
+// setsModes reports whether extracted files and directories must be chmod-ed
+// to their mode once written: creating them is subject to the process umask,
+// and leaves the mode of existing ones alone.
+func (gf *Fetcher) setsModes() bool {
+	return gf.PermMask != 0 || gf.ForceFileMode != 0 || gf.ForceDirMode != 0
+}
+
+// mkdirImplicit creates dir and any missing parents, which an archive has
+// no entry for, or none yet. Those created get DefaultDirMode if set, and
+// otherwise 0777 less the umask.
+func (gf *Fetcher) mkdirImplicit(dir string) error {
+	if gf.DefaultDirMode == 0 {
+		return gf.OS.MkdirAll(dir, 0777)
+	}
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := gf.OS.Stat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := gf.OS.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// MkdirAll is subject to the umask; Chmod is not.
+	for _, d := range missing {
+		if err := gf.OS.Chmod(d, gf.DefaultDirMode&(os.ModePerm|specialBits)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// permTestEntries are the entries of the archives built by permTestArchive,
+// with the modes they record.
+var permTestEntries = []struct {
+	name string
+	mode os.FileMode
+}{
+	{"d/", os.ModeDir | 0777},
+	{"d/open", 0777},
+	{"d/setuid", os.ModeSetuid | 0755},
+	{"d/readonly", 0444},
+}
+
+// permTestArchive returns a zip or gzipped tarball of permTestEntries.
+func permTestArchive(t *testing.T, kind string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if kind == "zip" {
+		zw := zip.NewWriter(&buf)
+		for _, e := range permTestEntries {
+			h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			h.SetMode(e.mode)
+			w, err := zw.CreateHeader(h)
+			if err != nil {
+				t.Fatalf("Creating zip entry %s: %v", e.name, err)
+			}
+			if !e.mode.IsDir() {
+				if _, err := w.Write([]byte(e.name)); err != nil {
+					t.Fatalf("Writing zip entry %s: %v", e.name, err)
+				}
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Closing zip writer: %v", err)
+		}
+		return buf.Bytes()
+	}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range permTestEntries {
+		h := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: int64(e.mode.Perm()), Size: int64(len(e.name))}
+		if e.mode&os.ModeSetuid != 0 {
+			h.Mode |= 04000
+		}
+		if e.mode.IsDir() {
+			h.Typeflag, h.Size = tar.TypeDir, 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("Writing tar header %s: %v", e.name, err)
+		}
+		if !e.mode.IsDir() {
+			if _, err := tw.Write([]byte(e.name)); err != nil {
+				t.Fatalf("Writing tar entry %s: %v", e.name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractedModes(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		setup func(gf *Fetcher)
+		want  map[string]os.FileMode
+	}{{
+		name:  "mask",
+		setup: func(gf *Fetcher) { gf.PermMask = 022 },
+		want:  map[string]os.FileMode{"d": 0755, "d/open": 0755, "d/setuid": 0755, "d/readonly": 0444},
+	}, {
+		name: "mask allowing special bits",
+		setup: func(gf *Fetcher) {
+			gf.PermMask = 022
+			gf.AllowSpecialBits = true
+		},
+		want: map[string]os.FileMode{"d": 0755, "d/open": 0755, "d/setuid": os.ModeSetuid | 0755, "d/readonly": 0444},
+	}, {
+		name: "forced",
+		setup: func(gf *Fetcher) {
+			gf.PermMask = 077
+			gf.ForceFileMode = 0640
+			gf.ForceDirMode = 0750
+		},
+		want: map[string]os.FileMode{"d": 0750, "d/open": 0640, "d/setuid": 0640, "d/readonly": 0640},
+	}} {
+		for _, archive := range []struct{ kind, object, sourceType string }{
+			{"zip", "source.zip", "ZipArchive"},
+			{"tgz", "source.tgz", "TarGzArchive"},
+		} {
+			t.Run(test.name+"/"+archive.kind, func(t *testing.T) {
+				tc, teardown := buildManifestTestContext(t)
+				defer teardown()
+				tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: permTestArchive(t, archive.kind)}
+				tc.gf.Object = archive.object
+				tc.gf.SourceType = archive.sourceType
+				test.setup(tc.gf)
+
+				if err := tc.gf.Fetch(context.Background()); err != nil {
+					t.Fatalf("Fetch() = %v", err)
+				}
+				for name, want := range test.want {
+					info, err := os.Stat(filepath.Join(tc.workDir, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := info.Mode() & (os.ModePerm | specialBits); got != want {
+						t.Errorf("mode of %s = %v, want %v", name, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUnzipDirectoryModes(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"d/f", 0644},   // Before the entry for d.
+		{"x/y/g", 0644}, // x and x/y have no entries.
+		{"d/", os.ModeDir | 0750},
+	} {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		h.SetMode(e.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatalf("Creating zip entry %s: %v", e.name, err)
+		}
+		if !e.mode.IsDir() {
+			if _, err := w.Write([]byte(e.name)); err != nil {
+				t.Fatalf("Writing zip entry %s: %v", e.name, err)
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Closing zip writer: %v", err)
+	}
+
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "source.zip", generation)] = fakeGCSResponse{content: buf.Bytes()}
+	tc.gf.Object = "source.zip"
+	tc.gf.SourceType = "ZipArchive"
+	tc.gf.DefaultDirMode = 0711
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	for name, want := range map[string]os.FileMode{"d": 0750, "x": 0711, "x/y": 0711} {
+		info, err := os.Stat(filepath.Join(tc.workDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("mode of %s = %v, want %v", name, got, want)
+		}
+	}
+}
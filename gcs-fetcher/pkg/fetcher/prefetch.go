@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "io"
+
+// prefetchChunk is the size of the chunks a prefetchReader reads ahead.
+const prefetchChunk = 256 * 1024
+
+// prefetched is a chunk read ahead by a prefetchReader, with the error, if
+// any, that followed it.
+type prefetched struct {
+	data []byte
+	err  error
+}
+
+// prefetchReader reads its source ahead in a goroutine, up to a bounded
+// number of chunks, so that downloading overlaps with the decompression and
+// writes of the data read before.
+type prefetchReader struct {
+	chunks <-chan prefetched
+	stop   chan struct{}
+	cur    []byte
+	err    error
+}
+
+// prefetch returns r read ahead by up to PrefetchBytes, or r itself if
+// PrefetchBytes is not positive, and a func to stop reading ahead, which
+// does not close r.
+func (gf *Fetcher) prefetch(r io.Reader) (io.Reader, func()) {
+	if gf.PrefetchBytes <= 0 {
+		return r, func() {}
+	}
+	n := gf.PrefetchBytes / prefetchChunk
+	if n < 1 {
+		n = 1
+	}
+	chunks := make(chan prefetched, n)
+	p := &prefetchReader{chunks: chunks, stop: make(chan struct{})}
+	go p.fill(r, chunks)
+	return p, p.close
+}
+
+func (p *prefetchReader) fill(r io.Reader, chunks chan<- prefetched) {
+	defer close(chunks)
+	for {
+		buf := make([]byte, prefetchChunk)
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if n == 0 && err == nil {
+			continue
+		}
+		select {
+		case chunks <- prefetched{data: buf[:n], err: err}:
+		case <-p.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *prefetchReader) Read(b []byte) (int, error) {
+	for len(p.cur) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		c, ok := <-p.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		p.cur, p.err = c.data, c.err
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// close stops reading ahead. A read already under way in the source is not
+// interrupted, but its result is dropped.
+func (p *prefetchReader) close() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+}
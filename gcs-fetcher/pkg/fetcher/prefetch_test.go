@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPrefetchReader(t *testing.T) {
+	content := make([]byte, 3*prefetchChunk+123)
+	rand.New(rand.NewSource(1)).Read(content)
+	for _, size := range []int{0, 1, prefetchChunk, 4 * prefetchChunk} {
+		gf := &Fetcher{PrefetchBytes: size}
+		r, stop := gf.prefetch(iotest.HalfReader(bytes.NewReader(content)))
+		got, err := io.ReadAll(r)
+		stop()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("PrefetchBytes=%d: read %d bytes, %v, want %d bytes, nil", size, len(got), err, len(content))
+		}
+	}
+}
+
+func TestPrefetchReaderError(t *testing.T) {
+	content := make([]byte, prefetchChunk+10)
+	errRead := errors.New("read failed")
+	gf := &Fetcher{PrefetchBytes: 4 * prefetchChunk}
+	r, stop := gf.prefetch(io.MultiReader(bytes.NewReader(content), fakeGCSErrorReader{err: errRead}))
+	defer stop()
+	got, err := io.ReadAll(r)
+	if err != errRead || len(got) != len(content) {
+		t.Errorf("read %d bytes, %v, want %d bytes, %v", len(got), err, len(content), errRead)
+	}
+}
+
+func TestPrefetchReaderStop(t *testing.T) {
+	gf := &Fetcher{PrefetchBytes: prefetchChunk}
+	r, stop := gf.prefetch(bytes.NewReader(make([]byte, 10*prefetchChunk)))
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatalf("ReadFull() = %v", err)
+	}
+	stop()
+	stop() // Stopping again is harmless.
+}
+
+func TestStreamArchivesPrefetch(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	name := formatGCSName(successBucket, "source.tgz", generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: flattenTestArchive(t, "tgz"), failAfter: 20}
+	tc.gf.Object = "source.tgz"
+	tc.gf.SourceType = "TarGzArchive"
+	tc.gf.StreamArchives = true
+	tc.gf.PrefetchBytes = 1 << 20
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if st.Files != len(flattenTestFiles) || st.Retries != 1 {
+		t.Errorf("FetchWithStats() = %+v, want %d files and 1 retry", st, len(flattenTestFiles))
+	}
+	for _, f := range flattenTestFiles {
+		got, err := ioutil.ReadFile(filepath.Join(tc.workDir, f.name))
+		if err != nil || string(got) != f.contents {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", f.name, got, err, f.contents)
+		}
+	}
+}
+
+// slowGCS serves content in packets of 64 KiB, each taking latency to
+// arrive, like a download over a high-latency link.
+type slowGCS struct {
+	GCS
+	content []byte
+	latency time.Duration
+}
+
+func (g slowGCS) NewReader(context.Context, string, string, ReadOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&slowReader{content: g.content, latency: g.latency}), nil
+}
+
+type slowReader struct {
+	content []byte // Not yet arrived.
+	packet  []byte // Arrived but not yet read.
+	latency time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.packet) == 0 {
+		if len(r.content) == 0 {
+			return 0, io.EOF
+		}
+		time.Sleep(r.latency)
+		n := 64 * 1024
+		if n > len(r.content) {
+			n = len(r.content)
+		}
+		r.packet, r.content = r.content[:n], r.content[n:]
+	}
+	n := copy(p, r.packet)
+	r.packet = r.packet[n:]
+	return n, nil
+}
+
+// largeTarGz returns a tar.gz archive of n files of size bytes each.
+func largeTarGz(b *testing.B, n, size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	content := make([]byte, size)
+	for i := 0; i < n; i++ {
+		rnd.Read(content[:size/2]) // Half random, half zeroes, to compress by half.
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("file%d.bin", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkStreamArchivePrefetch streams a large tar.gz, downloaded over a
+// high-latency link, with and without reading it ahead of its extraction.
+func BenchmarkStreamArchivePrefetch(b *testing.B) {
+	archive := largeTarGz(b, 64, 512*1024)
+	j := job{filename: "source.tgz", bucket: successBucket, object: "source.tgz"}
+	for _, prefetch := range []int{0, 4 << 20} {
+		b.Run(fmt.Sprintf("PrefetchBytes=%d", prefetch), func(b *testing.B) {
+			b.SetBytes(int64(len(archive)))
+			for i := 0; i < b.N; i++ {
+				dest, err := ioutil.TempDir("", "prefetch")
+				if err != nil {
+					b.Fatal(err)
+				}
+				gf := &Fetcher{
+					GCS:           slowGCS{content: archive, latency: time.Millisecond},
+					OS:            OSFileSystem{},
+					DestDir:       dest,
+					CreatedDirs:   map[string]bool{},
+					WorkerCount:   1,
+					PrefetchBytes: prefetch,
+				}
+				if _, _, err := gf.streamArchiveOnce(context.Background(), j, "tgz"); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				os.RemoveAll(dest)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchFromPrefix fetches every object in Bucket whose name starts with
+// Object, as if each were listed in a manifest, writing it to its name with
+// the prefix removed. See objectPath for names with unusual slashes.
+func (gf *Fetcher) fetchFromPrefix(ctx context.Context) (Stats, error) {
+	started := time.Now()
+	gf.logFetchStart("prefix")
+
+	jobs, err := gf.listJobs(ctx)
+	if err != nil {
+		return Stats{}, fmt.Errorf("listing %s: %v", formatGCSName(gf.Bucket, gf.Object, 0), err)
+	}
+	listDuration := time.Since(started)
+
+	included, _ := gf.filterJobs(jobs)
+	if err := gf.checkSpace(gf.StagingDir, knownSize(included)); err != nil {
+		return Stats{}, err
+	}
+
+	gf.log("Processing %v files.", len(jobs))
+	stats, err := gf.processJobs(ctx, jobs)
+	return gf.summarizeFetch(started, stats, listDuration, err)
+}
+
+// listJobs lists the objects under the prefix Object, a page at a time, and
+// returns a job for each. Each job is pinned to the listed generation, so
+// that objects replaced during the fetch are not mixed with the rest.
+func (gf *Fetcher) listJobs(ctx context.Context) ([]job, error) {
+	var jobs []job
+	var normalized []bool
+	// The slash after a prefix that does not end in one separates it from
+	// the names under it.
+	sep := ""
+	if gf.Object != "" && !strings.HasSuffix(gf.Object, "/") {
+		sep = "/"
+	}
+	opts := ReadOptions{UserProject: gf.BillingProject}
+	token := ""
+	for {
+		objects, next, err := gf.GCS.List(ctx, gf.Bucket, gf.Object, token, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			rel := strings.TrimPrefix(o.Name, gf.Object)
+			name, exact := objectPath(rel), strings.TrimPrefix(rel, sep)
+			if name == "" || strings.HasSuffix(rel, "/") {
+				// The prefix itself, or a placeholder for a folder.
+				continue
+			}
+			if !filepath.IsLocal(name) {
+				return nil, fmt.Errorf("object %q would be written outside of %q", o.Name, gf.DestDir)
+			}
+			jobs = append(jobs, job{
+				filename:   name,
+				bucket:     gf.Bucket,
+				object:     o.Name,
+				generation: o.Generation,
+				size:       o.Size,
+			})
+			normalized = append(normalized, name != exact)
+		}
+		if next == "" {
+			uniquePaths(jobs, normalized)
+			return jobs, nil
+		}
+		token = next
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetchFromPrefix(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	objects := map[string]string{
+		"src/a.txt":         "a",
+		"src/b.txt":         "b",
+		"src/dir/":          "", // A folder placeholder.
+		"src/dir/c.txt":     "c",
+		"src/dir/sub/d.bin": "d",
+		"srcother.txt":      "not under the prefix",
+	}
+	for name, content := range objects {
+		tc.gcs.objects[formatGCSName(successBucket, name, generation)] = fakeGCSResponse{content: []byte(content)}
+	}
+	tc.gcs.pageSize = 2
+	tc.gf.SourceType = "Prefix"
+	tc.gf.Object = "src/"
+	tc.gf.Exclude = []string{"dir/sub"}
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if st.Files != 3 || st.Skipped != 1 {
+		t.Errorf("FetchWithStats() = %+v, want 3 files and 1 skipped", st)
+	}
+	if want := []string{"", "2", "4"}; !reflect.DeepEqual(tc.gcs.listTokens, want) {
+		t.Errorf("List page tokens = %q, want %q", tc.gcs.listTokens, want)
+	}
+	for name, want := range map[string]string{"a.txt": "a", "b.txt": "b", "dir/c.txt": "c"} {
+		got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+		if err != nil {
+			t.Errorf("ReadFile(%s): %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s got %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"dir/sub/d.bin", "srcother.txt", "src"} {
+		if _, err := os.Stat(filepath.Join(tc.workDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Stat(%s) = %v, want it not fetched", name, err)
+		}
+	}
+}
+
+func TestFetchFromPrefixErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		object  string
+		wantErr string
+	}{
+		{"list failure", errorBucket, "src/", "Service Unavailable"},
+		{"escaping name", successBucket, "src", `object "src/../escape.txt" would be written outside of`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "src/../escape.txt", generation)] = fakeGCSResponse{content: []byte("x")}
+			tc.gf.SourceType = "Prefix"
+			tc.gf.Bucket = test.bucket
+			tc.gf.Object = test.object
+
+			_, err := tc.gf.FetchWithStats(context.Background())
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("FetchWithStats() = %v, want error containing %q", err, test.wantErr)
+			}
+			if len(tc.gcs.requested) != 0 {
+				t.Errorf("requested objects %v, want none", tc.gcs.requested)
+			}
+		})
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.txt":         "a.txt",
+		"dir/file":      "dir/file",
+		"/a.txt":        "a.txt",
+		"//weird//name": "weird/name",
+		"dir//file":     "dir/file",
+		"dir///sub//f":  "dir/sub/f",
+		"//":            "",
+	} {
+		if got := objectPath(name); got != want {
+			t.Errorf("objectPath(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestFetchFromPrefixUnusualSlashes(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	objects := map[string]string{
+		"odd///weird//name":  "weird",
+		"odd/dir//file.txt":  "double",
+		"odd/dir/file.txt":   "single",
+		"odd/dir///file.txt": "triple",
+	}
+	for name, content := range objects {
+		tc.gcs.objects[formatGCSName(successBucket, name, generation)] = fakeGCSResponse{content: []byte(content)}
+	}
+	tc.gf.SourceType = "Prefix"
+	tc.gf.Object = "odd/"
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if st.Files != len(objects) {
+		t.Errorf("FetchWithStats() = %+v, want %d files", st, len(objects))
+	}
+	// Objects are listed in name order, so "dir///" comes before "dir//".
+	want := map[string]string{
+		"weird/name":     "weird",
+		"dir/file.txt":   "single",
+		"dir/file-1.txt": "triple",
+		"dir/file-2.txt": "double",
+	}
+	for name, content := range want {
+		got, err := ioutil.ReadFile(filepath.Join(tc.workDir, name))
+		if err != nil || string(got) != content {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, got, err, content)
+		}
+	}
+	if got := listFiles(t, tc.workDir); len(got) != len(want) {
+		t.Errorf("files in DestDir got %v, want %d files", got, len(want))
+	}
+}
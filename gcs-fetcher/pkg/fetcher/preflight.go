@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// Preflight checks that the source of a fetch can be read, without
+// downloading it, so that a missing object or a lack of access fails in a
+// moment rather than once a fetch is under way. It looks up the attributes
+// of the manifest or archive, or lists the first page of a prefix, and
+// returns the permissionError, requesterPaysError or notFoundError that
+// Fetch would. If PreflightSample is positive, the entries of a manifest
+// are checked too; see PreflightSample.
+func (gf *Fetcher) Preflight(ctx context.Context) error {
+	if err := gf.checkOpen(); err != nil {
+		return err
+	}
+	switch {
+	case gf.SourceType == "Manifest" && (gf.ManifestURL != "" || gf.ManifestReader != nil):
+		// The manifest is not in GCS.
+	case gf.SourceType == "Prefix":
+		j := job{bucket: gf.Bucket, object: gf.Object}
+		if _, _, err := gf.GCS.List(ctx, j.bucket, j.object, "", ReadOptions{UserProject: gf.BillingProject}); err != nil {
+			return gf.gcsError(err, j, "listing")
+		}
+	default:
+		for _, ref := range gf.manifests() {
+			if err := gf.checkObject(ctx, job{bucket: ref.Bucket, object: ref.Object, generation: ref.Generation}); err != nil {
+				return err
+			}
+		}
+	}
+	if gf.PreflightSample <= 0 || gf.SourceType != "Manifest" || gf.ManifestReader != nil {
+		return nil
+	}
+	return gf.checkSample(ctx)
+}
+
+// checkSample checks the objects of the first PreflightSample entries of
+// the manifest, by destination path.
+func (gf *Fetcher) checkSample(ctx context.Context) error {
+	files, _, err := gf.loadManifests(ctx, func(ctx context.Context, ref ObjectRef, each func(string, common.ManifestItem)) (time.Duration, error) {
+		return 0, gf.readManifest(ctx, ref, each)
+	})
+	if err != nil {
+		return err
+	}
+	jobs, err := gf.manifestJobs(files)
+	if err != nil {
+		return err
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].filename < jobs[k].filename })
+	if len(jobs) > gf.PreflightSample {
+		jobs = jobs[:gf.PreflightSample]
+	}
+	for _, j := range jobs {
+		if err := gf.checkObject(ctx, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkObject looks up the attributes of the object of j.
+func (gf *Fetcher) checkObject(ctx context.Context, j job) error {
+	if _, err := gf.GCS.Attrs(ctx, j.bucket, j.object, gf.readOptions(j)); err != nil {
+		return gf.gcsError(err, j, "checking")
+	}
+	return nil
+}
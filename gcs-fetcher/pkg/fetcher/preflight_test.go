@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		sourceType string
+		bucket     string
+		object     string
+		sample     int
+		wantErr    interface{} // A pointer to the type of error wanted, or nil.
+	}{
+		{name: "manifest", sourceType: "Manifest", bucket: successBucket, object: goodManifest},
+		{name: "no permission", sourceType: "Manifest", bucket: errorBucket, object: efile4, wantErr: new(*permissionError)},
+		{name: "requester pays", sourceType: "Manifest", bucket: errorBucket, object: efile5, wantErr: new(*requesterPaysError)},
+		{name: "missing", sourceType: "Manifest", bucket: errorBucket, object: efile6, wantErr: new(*notFoundError)},
+		{name: "archive", sourceType: "TarGzArchive", bucket: errorBucket, object: efile4, wantErr: new(*permissionError)},
+		{name: "sampled entries", sourceType: "Manifest", bucket: successBucket, object: "sample.json", sample: 2, wantErr: new(*permissionError)},
+		{name: "entries not sampled", sourceType: "Manifest", bucket: successBucket, object: "sample.json"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "sample.json", generation)] = fakeGCSResponse{content: []byte(`{
+				"a.js": {"sourceUrl": "gs://success-bucket/sfile1.js"},
+				"b.js": {"sourceUrl": "gs://error-bucket/efile4"}
+			}`)}
+			tc.gf.SourceType = test.sourceType
+			tc.gf.Bucket, tc.gf.Object = test.bucket, test.object
+			tc.gf.PreflightSample = test.sample
+
+			err := tc.gf.Preflight(context.Background())
+			if test.wantErr == nil {
+				if err != nil {
+					t.Errorf("Preflight() = %v, want nil", err)
+				}
+			} else if err == nil || !errors.As(err, test.wantErr) {
+				t.Errorf("Preflight() = %v, want %T", err, test.wantErr)
+			}
+			if want := test.sample > 0; (len(tc.gcs.reads) != 0) != want {
+				t.Errorf("objects read: %v, want reads only to sample the manifest", tc.gcs.reads)
+			}
+		})
+	}
+}
+
+func TestPreflightManifestReader(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ManifestReader = bytes.NewReader([]byte(fmt.Sprintf(`{"a.js": {"sourceUrl": "gs://%s/%s"}}`, errorBucket, efile4)))
+	tc.gf.PreflightSample = 1
+
+	// The reader is left for Fetch to read.
+	if err := tc.gf.Preflight(context.Background()); err != nil {
+		t.Errorf("Preflight() = %v, want nil", err)
+	}
+	if len(tc.gcs.requested) != 0 {
+		t.Errorf("requested objects %v, want none", tc.gcs.requested)
+	}
+}
+
+func TestPreflightPrefix(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.SourceType = "Prefix"
+	tc.gf.Object = "src/"
+	if err := tc.gf.Preflight(context.Background()); err != nil {
+		t.Errorf("Preflight() = %v, want nil", err)
+	}
+	tc.gf.Bucket = errorBucket
+	if err := tc.gf.Preflight(context.Background()); err == nil {
+		t.Error("Preflight() = nil, want the listing error")
+	}
+	if len(tc.gcs.reads) != 0 {
+		t.Errorf("objects read: %v, want none", tc.gcs.reads)
+	}
+}
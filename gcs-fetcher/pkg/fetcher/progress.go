@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "sync"
+
+// Progress is reported at most once per progressFiles files or progressBytes
+// bytes, plus a final call when the work is done.
+const (
+	progressFiles = 10
+	progressBytes = 8 * 1024 * 1024
+)
+
+// progress tracks completed work and passes it to a Fetcher's ProgressFunc.
+// Calls to fn are serialized, so that ProgressFunc never needs locking, and
+// are made without holding mu, so that a slow fn does not hold up the
+// workers recording their progress: a report that comes due while fn is
+// still running is skipped, and made by the next call to add or done.
+type progress struct {
+	mu         sync.Mutex // Guards the counts.
+	call       sync.Mutex // Held while fn runs.
+	fn         func(bytesDone, bytesTotal int64, filesDone, filesTotal int)
+	bytesTotal int64 // -1 if unknown.
+	filesTotal int   // -1 if unknown.
+
+	bytesDone, lastBytes int64
+	filesDone, lastFiles int
+}
+
+// newProgress returns a tracker reporting to gf.ProgressFunc, or nil if no
+// callback is set. A nil *progress ignores all calls.
+func (gf *Fetcher) newProgress(bytesTotal int64, filesTotal int) *progress {
+	if gf.ProgressFunc == nil {
+		return nil
+	}
+	return &progress{fn: gf.ProgressFunc, bytesTotal: bytesTotal, filesTotal: filesTotal}
+}
+
+// add records bytes and files of completed work, and reports if enough has
+// accumulated since the last call to fn, unless fn is running already.
+func (p *progress) add(bytes int64, files int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.bytesDone += bytes
+	p.filesDone += files
+	due := p.filesDone-p.lastFiles >= progressFiles || p.bytesDone-p.lastBytes >= progressBytes
+	p.mu.Unlock()
+	if due && p.call.TryLock() {
+		defer p.call.Unlock()
+		p.report()
+	}
+}
+
+// done makes the final report, once any call to fn still running returns.
+// Unknown totals are taken to be the amount of work done, so the last call
+// always shows completion.
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.call.Lock()
+	defer p.call.Unlock()
+	p.mu.Lock()
+	if p.bytesTotal < 0 {
+		p.bytesTotal = p.bytesDone
+	}
+	if p.filesTotal < 0 {
+		p.filesTotal = p.filesDone
+	}
+	p.mu.Unlock()
+	p.report()
+}
+
+// report calls fn with the counts so far. p.call must be held.
+func (p *progress) report() {
+	p.mu.Lock()
+	p.lastBytes, p.lastFiles = p.bytesDone, p.filesDone
+	bytesDone, bytesTotal, filesDone, filesTotal := p.bytesDone, p.bytesTotal, p.filesDone, p.filesTotal
+	p.mu.Unlock()
+	p.fn(bytesDone, bytesTotal, filesDone, filesTotal)
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// progressCall records the arguments of one ProgressFunc call.
+type progressCall struct {
+	bytesDone, bytesTotal int64
+	filesDone, filesTotal int
+}
+
+// recordProgress sets gf.ProgressFunc to append each call to the returned
+// slice.
+func recordProgress(gf *Fetcher) *[]progressCall {
+	var calls []progressCall
+	gf.ProgressFunc = func(bytesDone, bytesTotal int64, filesDone, filesTotal int) {
+		calls = append(calls, progressCall{bytesDone, bytesTotal, filesDone, filesTotal})
+	}
+	return &calls
+}
+
+// checkProgress verifies that calls never go backwards and that the last one
+// reports all of want as done.
+func checkProgress(t *testing.T, calls []progressCall, want progressCall) {
+	t.Helper()
+	if len(calls) == 0 {
+		t.Fatalf("ProgressFunc never called")
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i].bytesDone < calls[i-1].bytesDone || calls[i].filesDone < calls[i-1].filesDone {
+			t.Errorf("progress went backwards: %+v after %+v", calls[i], calls[i-1])
+		}
+	}
+	if got := calls[len(calls)-1]; got != want {
+		t.Errorf("final progress got %+v, want %+v", got, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var nilProgress *progress
+	nilProgress.add(1, 1) // Must not panic.
+	nilProgress.done()
+
+	gf := &Fetcher{}
+	if p := gf.newProgress(-1, -1); p != nil {
+		t.Errorf("newProgress() without ProgressFunc got %v, want nil", p)
+	}
+
+	calls := recordProgress(gf)
+	p := gf.newProgress(-1, -1)
+	for i := 0; i < progressFiles-1; i++ {
+		p.add(1, 1)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("got %d calls before %d files, want 0", len(*calls), progressFiles)
+	}
+	p.add(1, 1)
+	if len(*calls) != 1 {
+		t.Errorf("got %d calls after %d files, want 1", len(*calls), progressFiles)
+	}
+	p.add(progressBytes, 0)
+	if len(*calls) != 2 {
+		t.Errorf("got %d calls after %d bytes, want 2", len(*calls), progressBytes)
+	}
+	p.done()
+	want := progressCall{progressFiles + progressBytes, progressFiles + progressBytes, progressFiles, progressFiles}
+	checkProgress(t, *calls, want)
+}
+
+func TestProgressSlowCallback(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls []progressCall
+	var p *progress
+	gf := &Fetcher{ProgressFunc: func(bytesDone, bytesTotal int64, filesDone, filesTotal int) {
+		calls = append(calls, progressCall{bytesDone, bytesTotal, filesDone, filesTotal})
+		if len(calls) == 1 {
+			p.add(0, 1) // Calling back in must not deadlock.
+			close(started)
+			<-release
+		}
+	}}
+	p = gf.newProgress(-1, -1)
+
+	go p.add(0, progressFiles) // Reports, and blocks in the callback.
+	<-started
+	added := make(chan struct{})
+	go func() {
+		// These come due while the callback runs, so they are skipped
+		// instead of waiting for it.
+		for i := 0; i < 3*progressFiles; i++ {
+			p.add(0, 1)
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(10 * time.Second):
+		t.Fatal("add() blocked while ProgressFunc was running")
+	}
+	close(release)
+	p.done()
+	checkProgress(t, calls, progressCall{0, 0, 4*progressFiles + 1, 4*progressFiles + 1})
+	if len(calls) != 2 {
+		t.Errorf("got %d calls, want the first and the final one", len(calls))
+	}
+}
+
+func TestProcessJobsProgress(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	calls := recordProgress(tc.gf)
+
+	var jobs []job
+	var size int64
+	for i := 0; i < 25; i++ {
+		jobs = append(jobs, job{bucket: successBucket, object: sfile1, filename: fmt.Sprintf("sfile1-%d", i), size: int64(len(sfile1Contents))})
+		size += int64(len(sfile1Contents))
+	}
+	tc.gf.processJobs(context.Background(), jobs)
+
+	checkProgress(t, *calls, progressCall{size, size, len(jobs), len(jobs)})
+	if len(*calls) < 2 {
+		t.Errorf("got %d progress calls, want periodic calls before the final one", len(*calls))
+	}
+}
+
+func TestProcessJobsProgressUnknownSize(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	calls := recordProgress(tc.gf)
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1", size: int64(len(sfile1Contents))},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+	}
+	tc.gf.processJobs(context.Background(), jobs)
+
+	size := int64(len(sfile1Contents) + len(sfile2Contents))
+	// Once everything is done, the total is known after all.
+	checkProgress(t, *calls, progressCall{size, size, 2, 2})
+}
+
+func TestUntarProgress(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	calls := recordProgress(tc.gf)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	const files = 25
+	content := []byte("contents")
+	for i := 0; i < files; i++ {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("f%d.txt", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("Writing header: %v", err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatalf("Writing content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+
+	if _, err := tc.gf.untar(context.Background(), &buf, tc.workDir); err != nil {
+		t.Fatalf("untar() = %v", err)
+	}
+
+	size := int64(files * len(content))
+	checkProgress(t, *calls, progressCall{size, size, files, files})
+	for _, c := range (*calls)[:len(*calls)-1] {
+		if c.bytesTotal != -1 || c.filesTotal != -1 {
+			t.Errorf("intermediate progress %+v, want unknown totals", c)
+		}
+	}
+}
+
+func TestProgressSkippedFiles(t *testing.T) {
+	keepExisting := func(string) bool { return false }
+
+	t.Run("manifest", func(t *testing.T) {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		calls := recordProgress(tc.gf)
+		tc.gf.SkipUnchanged = true
+		tc.gf.OverwritePolicy = keepExisting
+		tc.gf.MaxFileBytes, tc.gf.SkipLargeFiles = 100, true
+		for name, content := range map[string][]byte{"unchanged": sfile1Contents, "kept": []byte("local")} {
+			if err := os.WriteFile(filepath.Join(tc.workDir, name), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		jobs := []job{
+			{bucket: successBucket, object: sfile1, filename: "fetched", size: int64(len(sfile1Contents))},
+			{bucket: successBucket, object: sfile1, filename: "unchanged", size: int64(len(sfile1Contents))},
+			{bucket: successBucket, object: sfile2, filename: "kept", size: int64(len(sfile2Contents))},
+			{bucket: successBucket, object: sfile3, filename: "large", size: 1000},
+		}
+		if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+			t.Fatalf("processJobs() = %v", err)
+		}
+		size := manifestSize(jobs)
+		checkProgress(t, *calls, progressCall{size, size, len(jobs), len(jobs)})
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		calls := recordProgress(tc.gf)
+		tc.gf.OverwritePolicy = keepExisting
+		dest := filepath.Join(tc.workDir, "dest")
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "kept.txt"), []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		zipfile := filepath.Join(tc.workDir, "source.zip")
+		f, err := os.Create(zipfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for _, name := range []string{"fetched.txt", "kept.txt"} {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(sfile2Contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tc.gf.unzip(context.Background(), zipfile, dest); err != nil {
+			t.Fatalf("unzip() = %v", err)
+		}
+		size := int64(2 * len(sfile2Contents))
+		checkProgress(t, *calls, progressCall{size, size, 2, 2})
+	})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ProvenanceFormat is the format of the sidecars written by WriteProvenance.
+type ProvenanceFormat string
+
+const (
+	// ProvenanceText writes a "key: value" line for each field. It is the
+	// default.
+	ProvenanceText ProvenanceFormat = "text"
+	// ProvenanceJSON writes a JSON object.
+	ProvenanceJSON ProvenanceFormat = "json"
+)
+
+// provenance records where a fetched file came from.
+type provenance struct {
+	Source  string    `json:"source"`          // gs://bucket/object#generation
+	Entry   string    `json:"entry,omitempty"` // The file's path in DestDir, if extracted from the archive Source.
+	Fetched time.Time `json:"fetched"`
+	Sha256  string    `json:"sha256"`
+}
+
+func (p provenance) encode(format ProvenanceFormat) ([]byte, error) {
+	switch format {
+	case ProvenanceText, "":
+		s := fmt.Sprintf("source: %s\n", p.Source)
+		if p.Entry != "" {
+			s += fmt.Sprintf("entry: %s\n", p.Entry)
+		}
+		s += fmt.Sprintf("fetched: %s\nsha256: %s\n", p.Fetched.Format(time.RFC3339), p.Sha256)
+		return []byte(s), nil
+	case ProvenanceJSON:
+		data, err := json.Marshal(p)
+		return append(data, '\n'), err
+	default:
+		return nil, fmt.Errorf("unknown provenance format %q", format)
+	}
+}
+
+// provenancePath returns the path of the sidecar for the file finalname.
+func (gf *Fetcher) provenancePath(finalname string) string {
+	if gf.ProvenancePath != nil {
+		return gf.ProvenancePath(finalname)
+	}
+	return finalname + ".provenance"
+}
+
+// writeProvenance writes the sidecar of the file finalname, fetched from
+// the object of j, if WriteProvenance is set.
+func (gf *Fetcher) writeProvenance(j job, finalname, sha256 string) error {
+	if !gf.WriteProvenance || j.destDirOverride != "" {
+		return nil
+	}
+	return gf.writeSidecar(finalname, provenance{
+		Source:  formatGCSName(j.bucket, j.object, j.generation),
+		Fetched: time.Now().UTC(),
+		Sha256:  sha256,
+	})
+}
+
+// writeEntryProvenance writes the sidecars of the files extracted from the
+// archive Object, if WriteProvenance and ProvenanceEntries are set.
+func (gf *Fetcher) writeEntryProvenance(files []writtenFile) error {
+	if !gf.WriteProvenance || !gf.ProvenanceEntries || gf.DryRun {
+		return nil
+	}
+	fetched := time.Now().UTC()
+	for _, f := range files {
+		entry, err := filepath.Rel(gf.DestDir, f.name)
+		if err != nil {
+			entry = f.name
+		}
+		p := provenance{
+			Source:  formatGCSName(gf.Bucket, gf.Object, f.generation),
+			Entry:   filepath.ToSlash(entry),
+			Fetched: fetched,
+			Sha256:  f.sha256,
+		}
+		if err := gf.writeSidecar(f.name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gf *Fetcher) writeSidecar(finalname string, p provenance) error {
+	data, err := p.encode(gf.ProvenanceFormat)
+	if err != nil {
+		return err
+	}
+	name := gf.provenancePath(finalname)
+	if err := gf.OS.MkdirAll(filepath.Dir(name), os.FileMode(0777)|os.ModeDir); err != nil {
+		return fmt.Errorf("creating folders for provenance %q: %v", name, err)
+	}
+	f, err := gf.OS.Create(name)
+	if err != nil {
+		return fmt.Errorf("writing provenance %q: %v", name, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("writing provenance %q: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing provenance %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readProvenance parses the text sidecar at name into its fields.
+func readProvenance(t *testing.T, name string) map[string]string {
+	t.Helper()
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", name, err)
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		k, v, ok := strings.Cut(line, ": ")
+		if !ok {
+			t.Fatalf("%s: malformed line %q", name, line)
+		}
+		fields[k] = v
+	}
+	return fields
+}
+
+func TestWriteProvenance(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		tc.gf.Bucket, tc.gf.Object = "", ""
+		tc.gf.SourceType = "Manifest"
+		tc.gf.ManifestReader = bytes.NewReader([]byte(`{
+			"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+			"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+		}`))
+		tc.gf.WriteProvenance = true
+		tc.gf.Atomic = atomic
+
+		started := time.Now().Add(-time.Second)
+		if _, err := tc.gf.FetchWithStats(context.Background()); err != nil {
+			t.Fatalf("Atomic=%v: FetchWithStats() = %v", atomic, err)
+		}
+		want := []string{"a/sfile1.js", "a/sfile1.js.provenance", "b/sfile2.jpg", "b/sfile2.jpg.provenance"}
+		if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("Atomic=%v: files in DestDir got %v, want %v", atomic, got, want)
+		}
+		for _, f := range []struct {
+			name, object string
+			contents     []byte
+		}{
+			{"a/sfile1.js", sfile1, sfile1Contents},
+			{"b/sfile2.jpg", sfile2, sfile2Contents},
+		} {
+			p := readProvenance(t, filepath.Join(tc.workDir, f.name+".provenance"))
+			if want := formatGCSName(successBucket, f.object, 0); p["source"] != want {
+				t.Errorf("Atomic=%v: %s source = %q, want %q", atomic, f.name, p["source"], want)
+			}
+			if want := fmt.Sprintf("%x", sha256.Sum256(f.contents)); p["sha256"] != want {
+				t.Errorf("Atomic=%v: %s sha256 = %q, want %q", atomic, f.name, p["sha256"], want)
+			}
+			if fetched, err := time.Parse(time.RFC3339, p["fetched"]); err != nil || fetched.Before(started) || fetched.After(time.Now()) {
+				t.Errorf("Atomic=%v: %s fetched = %q, %v, want the time of the fetch", atomic, f.name, p["fetched"], err)
+			}
+		}
+	}
+}
+
+func TestWriteProvenanceJSONPath(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ManifestReader = bytes.NewReader([]byte(`{"a/sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js#7"}}`))
+	tc.gcs.objects[formatGCSName(successBucket, sfile1, 7)] = fakeGCSResponse{content: sfile1Contents}
+	audit := filepath.Join(tc.workDir, "audit")
+	tc.gf.WriteProvenance = true
+	tc.gf.ProvenanceFormat = ProvenanceJSON
+	tc.gf.ProvenancePath = func(finalname string) string {
+		return filepath.Join(audit, filepath.Base(finalname)+".json")
+	}
+
+	if _, err := tc.gf.FetchWithStats(context.Background()); err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(audit, "sfile1.js.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got provenance
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal(%s) = %v", data, err)
+	}
+	want := provenance{Source: "gs://success-bucket/sfile1.js#7", Sha256: fmt.Sprintf("%x", sha256.Sum256(sfile1Contents)), Fetched: got.Fetched}
+	if got != want || got.Fetched.IsZero() {
+		t.Errorf("provenance got %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteProvenanceArchiveEntries(t *testing.T) {
+	for _, entries := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		tc.gcs.objects[formatGCSName(successBucket, "source.tgz", generation)] = fakeGCSResponse{content: flattenTestArchive(t, "tgz")}
+		tc.gf.Object = "source.tgz"
+		tc.gf.SourceType = "TarGzArchive"
+		tc.gf.WriteProvenance = true
+		tc.gf.ProvenanceEntries = entries
+
+		if _, err := tc.gf.FetchWithStats(context.Background()); err != nil {
+			t.Fatalf("ProvenanceEntries=%v: FetchWithStats() = %v", entries, err)
+		}
+		var want []string
+		for _, f := range flattenTestFiles {
+			want = append(want, f.name)
+			if entries {
+				want = append(want, f.name+".provenance")
+			}
+		}
+		if got := listFiles(t, tc.workDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("ProvenanceEntries=%v: files in DestDir got %v, want %v", entries, got, want)
+		}
+		if !entries {
+			continue
+		}
+		for _, f := range flattenTestFiles {
+			p := readProvenance(t, filepath.Join(tc.workDir, f.name+".provenance"))
+			if p["source"] != formatGCSName(successBucket, "source.tgz", 0) || p["entry"] != f.name {
+				t.Errorf("%s provenance got %v, want source.tgz entry %s", f.name, p, f.name)
+			}
+			if want := fmt.Sprintf("%x", sha256.Sum256([]byte(f.contents))); p["sha256"] != want {
+				t.Errorf("%s sha256 = %q, want %q", f.name, p["sha256"], want)
+			}
+		}
+	}
+}
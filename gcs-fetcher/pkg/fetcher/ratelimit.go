@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// maxThrottleBurst bounds how many bytes a single read may take from the
+// rate limiter at once, keeping the aggregate rate smooth across workers.
+const maxThrottleBurst = 32 * 1024
+
+// throttle wraps r so that reads draw from the Fetcher's shared rate limiter.
+// It returns r unchanged when MaxBytesPerSec is not set.
+func (gf *Fetcher) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if gf.MaxBytesPerSec <= 0 {
+		return r
+	}
+	gf.limiterOnce.Do(func() {
+		burst := maxThrottleBurst
+		if gf.MaxBytesPerSec < int64(burst) {
+			burst = int(gf.MaxBytesPerSec)
+		}
+		gf.limiter = rate.NewLimiter(rate.Limit(gf.MaxBytesPerSec), burst)
+	})
+	return &throttledReader{ctx: ctx, r: r, limiter: gf.limiter}
+}
+
+// throttledReader waits for the limiter after each read, so the bytes
+// consumed never run ahead of the configured rate.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
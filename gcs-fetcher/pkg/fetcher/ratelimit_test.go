@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleLimitsAggregateRate(t *testing.T) {
+	const (
+		maxBytesPerSec = 256 * 1024
+		workers        = 4
+		perWorker      = 96 * 1024
+	)
+	gf := &Fetcher{MaxBytesPerSec: maxBytesPerSec}
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := gf.throttle(context.Background(), bytes.NewReader(make([]byte, perWorker)))
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				t.Errorf("Copy() = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	// The limiter starts with a full burst, so discount it from the total.
+	got := float64(workers*perWorker-maxThrottleBurst) / elapsed.Seconds()
+	if got < 0.8*maxBytesPerSec || got > 1.2*maxBytesPerSec {
+		t.Errorf("observed rate %.0f B/s, want within 20%% of %d B/s", got, maxBytesPerSec)
+	}
+}
+
+func TestThrottleRespectsCancellation(t *testing.T) {
+	gf := &Fetcher{MaxBytesPerSec: 1024}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	started := time.Now()
+	r := gf.throttle(ctx, bytes.NewReader(make([]byte, 1024*1024)))
+	_, err := io.Copy(ioutil.Discard, r)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Copy() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Copy() took %v after cancellation, want prompt return", elapsed)
+	}
+}
+
+func TestThrottleDisabled(t *testing.T) {
+	gf := &Fetcher{}
+	r := bytes.NewReader(nil)
+	if got := gf.throttle(context.Background(), r); got != r {
+		t.Errorf("throttle() wrapped reader with MaxBytesPerSec unset")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// jsonReport is the machine-readable summary written to Fetcher.ReportWriter.
+type jsonReport struct {
+	Status         string     `json:"status"`
+	DryRun         bool       `json:"dryRun,omitempty"`
+	Started        time.Time  `json:"started"`
+	Completed      time.Time  `json:"completed"`
+	ElapsedSeconds float64    `json:"elapsedSeconds"`
+	Workers        int        `json:"workers"`
+	TotalFiles     int        `json:"totalFiles"`
+	SkippedFiles   int        `json:"skippedFiles"`
+	TotalBytes     int64      `json:"totalBytes"`
+	Retries        int        `json:"retries"`
+	GCSTimeouts    int        `json:"gcsTimeouts"`
+	Timeouts       int        `json:"timeouts"`
+	TreeHash       string     `json:"treeHash,omitempty"` // See Fetcher.TreeHash.
+	Files          []jsonFile `json:"files"`
+	Errors         []string   `json:"errors,omitempty"`
+}
+
+// jsonFile describes the fetch of a single object.
+type jsonFile struct {
+	Name            string        `json:"name"`
+	Source          string        `json:"source"`
+	Bytes           int64         `json:"bytes"`
+	Success         bool          `json:"success"`
+	DurationSeconds float64       `json:"durationSeconds"`
+	Error           string        `json:"error,omitempty"`
+	Attempts        []jsonAttempt `json:"attempts"`
+
+	// Metadata is the object's custom metadata, if it has any.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// jsonAttempt describes one attempt at fetching an object.
+type jsonAttempt struct {
+	Started           time.Time `json:"started"`
+	DurationSeconds   float64   `json:"durationSeconds"`
+	BackoffSeconds    float64   `json:"backoffSeconds,omitempty"`
+	GCSTimeoutSeconds float64   `json:"gcsTimeoutSeconds,omitempty"`
+	Error             string    `json:"error,omitempty"`
+	Permanent         bool      `json:"permanent,omitempty"` // The error was not retried.
+	TimedOut          bool      `json:"timedOut,omitempty"`  // The read was abandoned after gcsTimeoutSeconds.
+}
+
+// writeReport marshals stats as JSON to ReportWriter, if one is set.
+func (gf *Fetcher) writeReport(stats stats) error {
+	if gf.ReportWriter == nil {
+		return nil
+	}
+
+	r := jsonReport{
+		Status:         "SUCCESS",
+		DryRun:         gf.DryRun,
+		Started:        stats.started,
+		Completed:      stats.started.Add(stats.duration),
+		ElapsedSeconds: stats.duration.Seconds(),
+		Workers:        stats.workers,
+		TotalFiles:     stats.files,
+		SkippedFiles:   stats.skipped,
+		TotalBytes:     int64(stats.size),
+		Retries:        stats.retries,
+		GCSTimeouts:    stats.gcsTimeouts,
+		Timeouts:       stats.timeouts,
+		Files:          []jsonFile{},
+	}
+	if !stats.success {
+		r.Status = "FAILURE"
+	}
+	for _, err := range stats.errs {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	for _, report := range stats.reports {
+		f := jsonFile{
+			Name:            report.job.filename,
+			Source:          formatGCSName(report.job.bucket, report.job.object, report.job.generation),
+			Bytes:           int64(report.size),
+			Success:         report.success,
+			DurationSeconds: report.completed.Sub(report.started).Seconds(),
+			Error:           errString(report.err),
+			Metadata:        report.metadata,
+		}
+		for _, a := range report.attempts {
+			f.Attempts = append(f.Attempts, jsonAttempt{
+				Started:           a.started,
+				DurationSeconds:   a.duration.Seconds(),
+				BackoffSeconds:    a.backoff.Seconds(),
+				GCSTimeoutSeconds: a.gcsTimeout.Seconds(),
+				Error:             errString(a.err),
+				Permanent:         a.permanent,
+				TimedOut:          a.timedOut,
+			})
+		}
+		r.Files = append(r.Files, f)
+	}
+	sort.Slice(r.Files, func(i, j int) bool { return r.Files[i].Name < r.Files[j].Name })
+	if stats.success && !gf.DryRun {
+		r.TreeHash = merkleRoot(reportLeaves(stats.reports))
+	}
+
+	enc := json.NewEncoder(gf.ReportWriter)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestProcessJobsWritesReport(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.os.errorsCreate = 1 // Provoke one retry
+	tc.gf.WorkerCount = 1  // Ensure the retry happens on sfile1.
+	tc.gf.Exclude = []string{"sfile3"}
+	var buf bytes.Buffer
+	tc.gf.ReportWriter = &buf
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+		{bucket: successBucket, object: sfile3, filename: "sfile3"},
+	}
+	tc.gf.processJobs(context.Background(), jobs)
+
+	var got jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) = %v", buf.String(), err)
+	}
+	if got.Status != "SUCCESS" {
+		t.Errorf("status = %q, want SUCCESS", got.Status)
+	}
+	if got.TotalFiles != 2 || got.SkippedFiles != 1 {
+		t.Errorf("totalFiles, skippedFiles = %d, %d, want 2, 1", got.TotalFiles, got.SkippedFiles)
+	}
+	if want := int64(len(sfile1Contents) + len(sfile2Contents)); got.TotalBytes != want {
+		t.Errorf("totalBytes = %d, want %d", got.TotalBytes, want)
+	}
+	if got.Retries != 1 {
+		t.Errorf("retries = %d, want 1", got.Retries)
+	}
+	if len(got.Files) != 2 {
+		t.Fatalf("len(files) = %d, want 2", len(got.Files))
+	}
+
+	f := got.Files[0]
+	if f.Name != "sfile1" || f.Source != formatGCSName(successBucket, sfile1, 0) || !f.Success {
+		t.Errorf("files[0] = %+v, want successful sfile1", f)
+	}
+	if f.Bytes != int64(len(sfile1Contents)) {
+		t.Errorf("files[0].bytes = %d, want %d", f.Bytes, len(sfile1Contents))
+	}
+	if len(f.Attempts) != 2 {
+		t.Fatalf("len(files[0].attempts) = %d, want 2", len(f.Attempts))
+	}
+	if f.Attempts[0].Error == "" || f.Attempts[1].Error != "" {
+		t.Errorf("files[0].attempts errors = %q, %q, want failure then success", f.Attempts[0].Error, f.Attempts[1].Error)
+	}
+	if got.Files[1].Name != "sfile2" || len(got.Files[1].Attempts) != 1 {
+		t.Errorf("files[1] = %+v, want sfile2 fetched in one attempt", got.Files[1])
+	}
+}
+
+func TestReportIncludesMetadata(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	meta := map[string]string{"commit": "0123abc", "builder": "ci"}
+	name := formatGCSName(successBucket, sfile1, generation)
+	response := tc.gcs.objects[name]
+	response.metadata = meta
+	tc.gcs.objects[name] = response
+	var buf bytes.Buffer
+	tc.gf.ReportWriter = &buf
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+	}
+	tc.gf.processJobs(context.Background(), jobs)
+
+	var got jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) = %v", buf.String(), err)
+	}
+	if len(got.Files) != 2 {
+		t.Fatalf("len(files) = %d, want 2", len(got.Files))
+	}
+	if !reflect.DeepEqual(got.Files[0].Metadata, meta) {
+		t.Errorf("files[0].metadata = %v, want %v", got.Files[0].Metadata, meta)
+	}
+	if got.Files[1].Metadata != nil {
+		t.Errorf("files[1].metadata = %v, want none", got.Files[1].Metadata)
+	}
+}
+
+func TestReportMetadataLookupFails(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	name := formatGCSName(successBucket, sfile1, generation)
+	response := tc.gcs.objects[name]
+	response.attrsErr = &googleapi.Error{Code: http.StatusServiceUnavailable}
+	tc.gcs.objects[name] = response
+	var buf bytes.Buffer
+	tc.gf.ReportWriter = &buf
+
+	jobs := []job{{bucket: successBucket, object: sfile1, filename: "sfile1"}}
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("processJobs() = %v, want the download to succeed without its metadata", err)
+	}
+
+	var got jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) = %v", buf.String(), err)
+	}
+	if len(got.Files) != 1 || !got.Files[0].Success || got.Files[0].Metadata != nil {
+		t.Errorf("files = %+v, want sfile1 fetched, without metadata", got.Files)
+	}
+}
+
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job is a file for ProcessJobsStreaming to fetch: the object
+// gs://Bucket/Object, written to Filename under DestDir.
+type Job struct {
+	Filename       string
+	Bucket, Object string
+	Generation     int64 // If zero, the live generation is fetched.
+
+	// Sha1Sum and Sha256Sum, if set, are the expected hex digests of the
+	// object's content.
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Algorithm and Digest, if set, are a checksum algorithm in the
+	// Fetcher's Hashers and the expected hex digest it computes.
+	Algorithm string
+	Digest    string
+}
+
+// JobResult is the outcome of fetching one Job.
+type JobResult struct {
+	Filename string
+	Object   string        // The object fetched, as a gs:// URL.
+	Bytes    int64         // Bytes downloaded from GCS.
+	Duration time.Duration // Time from the first attempt to the outcome.
+	Attempts int
+	Err      error // Why the object could not be fetched, or nil.
+}
+
+// ProcessJobsStreaming fetches jobs like a manifest fetch does, subject to
+// the same filters, retries and OverallTimeout, and sends a JobResult on the
+// returned channel as each one finishes. The channel is closed once every
+// job has finished; the caller must drain it. Unlike Fetch, it neither
+// removes StagingDir nor writes a summary when done, and it does not support
+// Atomic.
+func (gf *Fetcher) ProcessJobsStreaming(ctx context.Context, jobs []Job) (<-chan JobResult, error) {
+	if err := gf.checkOpen(); err != nil {
+		return nil, err
+	}
+	if gf.Atomic {
+		return nil, errors.New("ProcessJobsStreaming does not support Atomic")
+	}
+	todo := make([]job, 0, len(jobs))
+	for _, j := range jobs {
+		if j.Filename == "" || j.Bucket == "" || j.Object == "" {
+			return nil, errors.New("every job needs a Filename, Bucket and Object")
+		}
+		if problem := gf.checksumProblem(j.Algorithm, j.Digest); problem != "" {
+			return nil, fmt.Errorf("job %q: %s", j.Filename, problem)
+		}
+		todo = append(todo, job{
+			filename:   j.Filename,
+			bucket:     j.Bucket,
+			object:     j.Object,
+			generation: j.Generation,
+			sha1sum:    j.Sha1Sum,
+			sha256sum:  j.Sha256Sum,
+			algorithm:  j.Algorithm,
+			digest:     j.Digest,
+		})
+	}
+
+	cancel := func() {}
+	if gf.OverallTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, gf.OverallTimeout)
+	}
+	reports, _, _, _ := gf.startJobs(ctx, todo)
+	results := make(chan JobResult)
+	go func() {
+		defer cancel()
+		defer close(results)
+		for report := range reports {
+			results <- report.result()
+		}
+	}()
+	return results, nil
+}
+
+// result returns the public summary of the report.
+func (report jobReport) result() JobResult {
+	j := report.job
+	r := JobResult{
+		Filename: j.filename,
+		Object:   formatGCSName(j.bucket, j.object, j.generation),
+		Duration: report.completed.Sub(report.started),
+		Attempts: len(report.attempts),
+		Err:      report.err,
+	}
+	if !report.linked {
+		r.Bytes = int64(report.size)
+	}
+	return r
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProcessJobsStreaming(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	jobs := []Job{
+		{Filename: "a/sfile1.js", Bucket: successBucket, Object: sfile1},
+		{Filename: "sfile2.jpg", Bucket: successBucket, Object: sfile2},
+		{Filename: "sfile3", Bucket: successBucket, Object: sfile3},
+		{Filename: "missing", Bucket: errorBucket, Object: efile6},
+	}
+
+	results, err := tc.gf.ProcessJobsStreaming(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("ProcessJobsStreaming() = %v", err)
+	}
+	got := map[string]JobResult{}
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				done = true
+				break
+			}
+			if _, dup := got[r.Filename]; dup {
+				t.Errorf("more than one result for %s", r.Filename)
+			}
+			got[r.Filename] = r
+		case <-timeout:
+			t.Fatalf("results channel not closed; got %d results", len(got))
+		}
+	}
+
+	if len(got) != len(jobs) {
+		t.Errorf("got %d results, want %d", len(got), len(jobs))
+	}
+	for _, j := range jobs {
+		r, ok := got[j.Filename]
+		if !ok {
+			t.Errorf("no result for %s", j.Filename)
+			continue
+		}
+		if want := formatGCSName(j.Bucket, j.Object, 0); r.Object != want {
+			t.Errorf("%s: Object = %q, want %q", j.Filename, r.Object, want)
+		}
+		if r.Attempts < 1 {
+			t.Errorf("%s: Attempts = %d, want at least 1", j.Filename, r.Attempts)
+		}
+		if j.Bucket == errorBucket {
+			if r.Err == nil {
+				t.Errorf("%s: Err = nil, want an error", j.Filename)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("%s: Err = %v", j.Filename, r.Err)
+		}
+	}
+	if r := got["sfile2.jpg"]; r.Bytes != int64(len(sfile2Contents)) {
+		t.Errorf("sfile2.jpg: Bytes = %d, want %d", r.Bytes, len(sfile2Contents))
+	}
+}
+
+func TestProcessJobsStreamingInvalidJob(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	if _, err := tc.gf.ProcessJobsStreaming(context.Background(), []Job{{Bucket: successBucket, Object: sfile1}}); err == nil {
+		t.Errorf("ProcessJobsStreaming() with no Filename = nil, want error")
+	}
+}
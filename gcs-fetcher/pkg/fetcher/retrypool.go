@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"sync"
+)
+
+// retryPool retries the downloads that failed their first attempt with
+// RetryWorkers workers of its own, so that the workers fetching the jobs
+// queued go on to fresh ones instead of backing off.
+type retryPool struct {
+	todo     chan *objectFetch
+	handoffs sync.WaitGroup // Fetches on their way to todo.
+	workers  sync.WaitGroup
+}
+
+// newRetryPool starts the retry workers, which send the report of each
+// fetch to results once it is done.
+func (gf *Fetcher) newRetryPool(ctx context.Context, results chan<- jobReport) *retryPool {
+	p := &retryPool{todo: make(chan *objectFetch)}
+	for i := 0; i < gf.RetryWorkers; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for f := range p.todo {
+				release := gf.acquireBucket(f.report.job.bucket)
+				gf.fetchAttempts(ctx, f, gf.Retries)
+				release()
+				results <- *gf.finishFetch(f)
+			}
+		}()
+	}
+	return p
+}
+
+// add hands f over to the retry workers without waiting for one to be free.
+func (p *retryPool) add(f *objectFetch) {
+	p.handoffs.Add(1)
+	go func() {
+		defer p.handoffs.Done()
+		p.todo <- f
+	}()
+}
+
+// close waits until every fetch added is done, and stops the workers. No
+// more fetches may be added.
+func (p *retryPool) close() {
+	p.handoffs.Wait()
+	close(p.todo)
+	p.workers.Wait()
+}
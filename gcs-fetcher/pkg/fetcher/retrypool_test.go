@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// flakyGCS fails the first reads of the objects in failures with a 503.
+type flakyGCS struct {
+	GCS
+	mu       sync.Mutex
+	failures map[string]int // Object to reads left to fail.
+}
+
+func (g *flakyGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	g.mu.Lock()
+	fail := g.failures[object] > 0
+	if fail {
+		g.failures[object]--
+	}
+	g.mu.Unlock()
+	if fail {
+		return nil, &googleapi.Error{Code: 503, Message: "Service Unavailable"}
+	}
+	return g.GCS.NewReader(ctx, bucket, object, opts)
+}
+
+func TestProcessJobsRetryWorkers(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "flaky", generation)] = fakeGCSResponse{content: sfile1Contents}
+	tc.gcs.objects[formatGCSName(successBucket, "broken", generation)] = fakeGCSResponse{content: sfile1Contents}
+	tc.gf.GCS = &flakyGCS{GCS: tc.gcs, failures: map[string]int{"flaky": 1, "broken": 100}}
+	tc.gf.WorkerCount = 1
+	tc.gf.RetryWorkers = 1
+	tc.gf.Retries = 3
+	tc.gf.Backoff = ExponentialBackoff{Base: 50 * time.Millisecond}
+
+	jobs := []job{
+		{bucket: successBucket, object: "flaky", filename: "flaky"},
+		{bucket: successBucket, object: "broken", filename: "broken"},
+	}
+	for _, name := range []string{"fresh1", "fresh2", "fresh3"} {
+		jobs = append(jobs, job{bucket: successBucket, object: sfile1, filename: name})
+	}
+	st, err := tc.gf.processJobs(context.Background(), jobs)
+	if err == nil {
+		t.Fatal("processJobs() = nil, want the error of broken")
+	}
+
+	// The only worker fetching jobs moves on while flaky and broken back
+	// off, so the fresh files are done first.
+	var order []string
+	attempts := map[string]int{}
+	for _, r := range st.reports {
+		order = append(order, r.job.filename)
+		attempts[r.job.filename] = len(r.attempts)
+	}
+	for i, name := range order[:3] {
+		if name == "flaky" || name == "broken" {
+			t.Errorf("report %d is for %s, want the fresh files first; order %v", i, name, order)
+		}
+	}
+	if attempts["flaky"] != 2 || attempts["broken"] != tc.gf.Retries+1 {
+		t.Errorf("attempts = %v, want 2 for flaky and %d for broken", attempts, tc.gf.Retries+1)
+	}
+	if want := 1 + tc.gf.Retries; st.retries != want {
+		t.Errorf("retries = %d, want %d", st.retries, want)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"google.golang.org/api/googleapi"
+)
+
+// retryable reports whether another attempt might succeed where err failed:
+// isRetryable, unless RetryableStatuses sets a policy of its own. Network
+// errors follow NoRetryNetworkErrors either way.
+func (gf *Fetcher) retryable(err error) bool {
+	if neverRetried(err) {
+		return false
+	}
+	if isNetworkError(err) {
+		return !gf.NoRetryNetworkErrors
+	}
+	if len(gf.RetryableStatuses) == 0 {
+		return isRetryable(err)
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		for _, code := range gf.RetryableStatuses {
+			if gerr.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isNetworkError reports whether err is a failure to talk to GCS at all, or
+// a response cut short, rather than an error status from it.
+func isNetworkError(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	return errors.Is(err, errGCSTimeout) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
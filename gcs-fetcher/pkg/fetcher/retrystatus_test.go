@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// errorGCS fails every read with err.
+type errorGCS struct {
+	GCS
+	err error
+}
+
+func (g errorGCS) NewReader(context.Context, string, string, ReadOptions) (io.ReadCloser, error) {
+	return nil, g.err
+}
+
+func TestRetryableStatuses(t *testing.T) {
+	teapot := &googleapi.Error{Code: 418, Message: "I'm a teapot"}
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: io.EOF}
+	for _, test := range []struct {
+		name      string
+		err       error
+		statuses  []int
+		noNetwork bool
+		want      int // Attempts.
+	}{
+		{name: "418 by default", err: teapot, want: 1},
+		{name: "418 listed", err: teapot, statuses: []int{408, 418}, want: maxretries + 1},
+		{name: "418 removed", err: teapot, statuses: []int{408}, want: 1},
+		{name: "503 by default", err: &googleapi.Error{Code: 503}, want: maxretries + 1},
+		{name: "503 not listed", err: &googleapi.Error{Code: 503}, statuses: []int{418}, want: 1},
+		{name: "network error by default", err: unreachable, want: maxretries + 1},
+		{name: "network error with statuses", err: unreachable, statuses: []int{418}, want: maxretries + 1},
+		{name: "timeout with statuses", err: errGCSTimeout, statuses: []int{418}, want: maxretries + 1},
+		{name: "network error not retried", err: unreachable, statuses: []int{418}, noNetwork: true, want: 1},
+		{name: "network error not retried by default statuses", err: unreachable, noNetwork: true, want: 1},
+		{name: "timeout not retried by default statuses", err: errGCSTimeout, noNetwork: true, want: 1},
+		{name: "503 without network retries", err: &googleapi.Error{Code: 503}, noNetwork: true, want: maxretries + 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gf.GCS = errorGCS{GCS: tc.gcs, err: test.err}
+			tc.gf.RetryableStatuses = test.statuses
+			tc.gf.NoRetryNetworkErrors = test.noNetwork
+
+			report := tc.gf.fetchObject(context.Background(), job{bucket: successBucket, object: sfile1, filename: "localfile.txt"})
+			if report.success {
+				t.Fatal("report.success got true, want false")
+			}
+			if got := len(report.attempts); got != test.want {
+				t.Errorf("len(report.attempts) got %d, want %d: %v", got, test.want, report.err)
+			}
+		})
+	}
+}
+
+func TestRetryableStatusesKeepsPermanentErrors(t *testing.T) {
+	gf := &Fetcher{RetryableStatuses: []int{403, 404}}
+	for _, err := range []error{&permissionError{bucket: "b"}, &notFoundError{object: "gs://b/o"}, context.Canceled} {
+		if gf.retryable(err) {
+			t.Errorf("retryable(%v) = true, want false", err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// windowsReserved are the device names Windows reserves, with or without
+// an extension, in any case.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// WindowsNameSanitizer is a NameSanitizer for extracting archives made on
+// Unix onto Windows. Characters Windows does not allow in file names, such
+// as ':' and '\', are replaced with '_'. Names with a reserved device name,
+// such as CON or NUL.txt, or ending in a dot or space, which Windows would
+// silently drop, cannot be made safe without risking a clash with another
+// entry, so they are rejected.
+func WindowsNameSanitizer(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		part = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+				return '_'
+			}
+			return r
+		}, part)
+		if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+			return "", fmt.Errorf("%q ends in a dot or space, which Windows does not allow", parts[i])
+		}
+		stem, _, _ := strings.Cut(part, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			return "", fmt.Errorf("%q is a device name reserved by Windows", parts[i])
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// entryName returns the name the archive entry name is extracted under: the
+// name NameSanitizer gives it, or name itself.
+func (gf *Fetcher) entryName(name string) (string, error) {
+	if gf.NameSanitizer == nil {
+		return name, nil
+	}
+	sanitized, err := gf.NameSanitizer(name)
+	if err != nil {
+		return "", fmt.Errorf("archive entry %q cannot be extracted: %v", name, err)
+	}
+	return sanitized, nil
+}
+
+// entryPath is extractPath for the archive entry name, as entryName gives
+// it.
+func (gf *Fetcher) entryPath(dest, name string) (string, error) {
+	name, err := gf.entryName(name)
+	if err != nil {
+		return "", err
+	}
+	return extractPath(dest, name)
+}
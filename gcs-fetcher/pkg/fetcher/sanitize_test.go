@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWindowsNameSanitizer(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+		wantErr    bool
+	}{
+		{name: "src/main.go", want: "src/main.go"},
+		{name: "logs/12:30.txt", want: "logs/12_30.txt"},
+		{name: `a<b>c"d|e?f*g\h`, want: "a_b_c_d_e_f_g_h"},
+		{name: "tab\there", want: "tab_here"},
+		{name: "dir/", want: "dir/"},
+		{name: "../escape", want: "../escape"}, // Left for extractPath to reject.
+		{name: "CON", wantErr: true},
+		{name: "nul.txt", wantErr: true},
+		{name: "src/Com1.tar.gz", wantErr: true},
+		{name: "lpt9/readme", wantErr: true},
+		{name: "trailing.", wantErr: true},
+		{name: "trailing /file", wantErr: true},
+		{name: "CONSOLE.txt", want: "CONSOLE.txt"},
+		{name: "COM10", want: "COM10"},
+	} {
+		got, err := WindowsNameSanitizer(tc.name)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("WindowsNameSanitizer(%q) = %q, want error", tc.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("WindowsNameSanitizer(%q) = %q, %v, want %q, nil", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestNameSanitizerArchive(t *testing.T) {
+	for _, archive := range []struct {
+		object, sourceType string
+		build              func(*testing.T, ...archiveEntry) []byte
+	}{
+		{"source.zip", "ZipArchive", nestedZip},
+		{"source.tgz", "TarGzArchive", nestedTgz},
+	} {
+		t.Run(archive.sourceType, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{
+				content: archive.build(t, archiveEntry{"logs/12:30.txt", []byte("log")}),
+			}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = archive.sourceType
+			tc.gf.NameSanitizer = WindowsNameSanitizer
+
+			if err := tc.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			if got, err := os.ReadFile(filepath.Join(tc.workDir, "logs/12_30.txt")); err != nil || string(got) != "log" {
+				t.Errorf("ReadFile(logs/12_30.txt) = %q, %v, want %q", got, err, "log")
+			}
+		})
+	}
+}
+
+func TestNameSanitizerRejects(t *testing.T) {
+	for _, archive := range []struct {
+		object, sourceType string
+		build              func(*testing.T, ...archiveEntry) []byte
+	}{
+		{"source.zip", "ZipArchive", nestedZip},
+		{"source.tgz", "TarGzArchive", nestedTgz},
+	} {
+		t.Run(archive.sourceType, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{
+				content: archive.build(t, archiveEntry{"dev/NUL.txt", []byte("null")}),
+			}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = archive.sourceType
+			tc.gf.NameSanitizer = WindowsNameSanitizer
+
+			err := tc.gf.Fetch(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "dev/NUL.txt") || !strings.Contains(err.Error(), "reserved") {
+				t.Errorf("Fetch() = %v, want an error naming the reserved entry", err)
+			}
+			if _, err := os.Stat(filepath.Join(tc.workDir, "dev/NUL.txt")); !os.IsNotExist(err) {
+				t.Errorf("Stat(dev/NUL.txt) = %v, want it not extracted", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Schedule decides the order in which the files of a manifest are fetched.
+type Schedule string
+
+const (
+	// ManifestOrder fetches files in the order the manifest lists them. It
+	// is the default.
+	ManifestOrder Schedule = ""
+	// LargestFirst fetches the largest files first, so that no worker is
+	// left with a large file once the others are done, which tends to
+	// finish the fetch soonest.
+	LargestFirst Schedule = "largest-first"
+	// SmallestFirst fetches the smallest files first, so that most files
+	// are available soonest.
+	SmallestFirst Schedule = "smallest-first"
+)
+
+// scheduleJobs returns jobs in the order Schedule fetches them. Sizes the
+// manifest does not give are looked up in GCS; files whose size is still
+// unknown come last, in manifest order.
+func (gf *Fetcher) scheduleJobs(ctx context.Context, jobs []job) []job {
+	if gf.Schedule == ManifestOrder || len(jobs) < 2 {
+		return jobs
+	}
+	sizes := gf.jobSizes(ctx, jobs)
+	order := make([]int, len(jobs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		sa, sb := sizes[order[a]], sizes[order[b]]
+		if sa < 0 || sb < 0 {
+			return sb < 0 && sa >= 0
+		}
+		if gf.Schedule == SmallestFirst {
+			return sa < sb
+		}
+		return sa > sb
+	})
+	scheduled := make([]job, len(jobs))
+	for i, k := range order {
+		scheduled[i] = jobs[k]
+	}
+	return scheduled
+}
+
+// jobSizes returns the size in bytes of the object of each of jobs, or -1
+// where it is unknown. Sizes missing from the manifest are looked up with
+// up to WorkerCount requests at a time.
+func (gf *Fetcher) jobSizes(ctx context.Context, jobs []job) []int64 {
+	sizes := make([]int64, len(jobs))
+	sem := make(chan struct{}, max(gf.WorkerCount, 1))
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		if j.size > 0 {
+			sizes[i] = j.size
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, j job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			sizes[i] = -1
+			if attrs, err := gf.GCS.Attrs(ctx, j.bucket, j.object, gf.readOptions(j)); err == nil {
+				sizes[i] = attrs.Size
+			}
+		}(i, j)
+	}
+	wg.Wait()
+	return sizes
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// orderGCS records the objects read from its fakeGCS in order.
+type orderGCS struct {
+	*fakeGCS
+	mu    sync.Mutex
+	order []string
+}
+
+func (g *orderGCS) NewReader(ctx context.Context, bucket, object string, opts ReadOptions) (io.ReadCloser, error) {
+	g.mu.Lock()
+	g.order = append(g.order, object)
+	g.mu.Unlock()
+	return g.fakeGCS.NewReader(ctx, bucket, object, opts)
+}
+
+func TestProcessJobsSchedule(t *testing.T) {
+	// sfile2 and sfile3 have no size in the manifest, so theirs are looked
+	// up.
+	for _, test := range []struct {
+		schedule Schedule
+		want     []string
+	}{
+		{ManifestOrder, []string{"small", "large", sfile2, sfile3}},
+		{LargestFirst, []string{"large", sfile3, sfile2, "small"}},
+		{SmallestFirst, []string{"small", sfile2, sfile3, "large"}},
+	} {
+		t.Run(string(test.schedule), func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "small", generation)] = fakeGCSResponse{content: []byte("s")}
+			tc.gcs.objects[formatGCSName(successBucket, "large", generation)] = fakeGCSResponse{content: make([]byte, 1000)}
+			gcs := &orderGCS{fakeGCS: tc.gcs}
+			tc.gf.GCS = gcs
+			tc.gf.WorkerCount = 1
+			tc.gf.Schedule = test.schedule
+
+			jobs := []job{
+				{bucket: successBucket, object: "small", filename: "small", size: 1},
+				{bucket: successBucket, object: "large", filename: "large", size: 1000},
+				{bucket: successBucket, object: sfile2, filename: sfile2},
+				{bucket: successBucket, object: sfile3, filename: sfile3},
+			}
+			if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+				t.Fatalf("processJobs() = %v", err)
+			}
+			if !reflect.DeepEqual(gcs.order, test.want) {
+				t.Errorf("objects fetched in order %q, want %q", gcs.order, test.want)
+			}
+		})
+	}
+}
+
+func TestScheduleJobsUnknownSizesLast(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Schedule = SmallestFirst
+	unknown := job{bucket: errorBucket, object: efile4}
+	jobs := []job{unknown, {object: "b", size: 2}, {object: "a", size: 1}}
+
+	var got []string
+	for _, j := range tc.gf.scheduleJobs(context.Background(), jobs) {
+		got = append(got, j.object)
+	}
+	if want := []string{"a", "b", efile4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scheduleJobs() order = %q, want %q", got, want)
+	}
+}
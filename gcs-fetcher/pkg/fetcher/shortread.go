@@ -0,0 +1,40 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "fmt"
+
+// shortReadError indicates that the read of an object ended without error
+// before all of its bytes arrived, as when the stream is silently truncated.
+// The bytes that did arrive are sound, so the download may be resumed.
+type shortReadError struct {
+	name      string
+	got, want int64
+}
+
+func (e *shortReadError) Error() string {
+	return fmt.Sprintf("%s was cut short, got %d bytes, want %d", e.name, e.got, e.want)
+}
+
+// sizeError returns the error for got bytes read of the object, named name,
+// described by attrs, whose size they do not match: a shortReadError if too
+// few bytes arrived, or a sizeMismatchError.
+func sizeError(name string, got int64, attrs *ObjectAttrs) error {
+	if got < attrs.Size && attrs.ContentEncoding != "gzip" {
+		return &shortReadError{name: name, got: got, want: attrs.Size}
+	}
+	return &sizeMismatchError{name: name, got: got, want: attrs.Size, encoding: attrs.ContentEncoding}
+}
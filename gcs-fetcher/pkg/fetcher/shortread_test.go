@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// shortReadManifest lists sfile1.js with its size.
+func shortReadManifest() *bytes.Reader {
+	return bytes.NewReader([]byte(fmt.Sprintf(`{"a.js": {"sourceUrl": "gs://success-bucket/sfile1.js", "size": %d}}`, len(sfile1Contents))))
+}
+
+func TestShortReadRetried(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	name := formatGCSName(successBucket, sfile1, generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: sfile1Contents, truncateFirst: 5}
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ManifestReader = shortReadManifest()
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if st.Retries != 1 {
+		t.Errorf("FetchWithStats() = %+v, want 1 retry", st)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "a.js")); err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("ReadFile(a.js) = %q, %v, want %q", got, err, sfile1Contents)
+	}
+}
+
+func TestShortReadFails(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	name := formatGCSName(successBucket, sfile1, generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: sfile1Contents, truncateFirst: 5}
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ManifestReader = shortReadManifest()
+	tc.gf.Retries = 0
+
+	_, err := tc.gf.FetchWithStats(context.Background())
+	var serr *shortReadError
+	if !errors.As(err, &serr) {
+		t.Fatalf("FetchWithStats() = %v, want a shortReadError", err)
+	}
+	if serr.got != 5 || serr.want != int64(len(sfile1Contents)) {
+		t.Errorf("shortReadError = %+v, want got 5, want %d", serr, len(sfile1Contents))
+	}
+}
+
+func TestShortReadStaleSize(t *testing.T) {
+	// A size in the manifest that no longer matches the object is not a
+	// short read if the object arrives whole.
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ManifestReader = bytes.NewReader([]byte(`{"a.js": {"sourceUrl": "gs://success-bucket/sfile1.js", "size": 1000}}`))
+	tc.gf.Retries = 0
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// loadChecksumSidecar reads the SHA-256 digests of archive entries from
+// ChecksumSidecar, if it is set, for checkEntry to verify.
+func (gf *Fetcher) loadChecksumSidecar(ctx context.Context) (err error) {
+	gf.entrySums = nil
+	if gf.ChecksumSidecar == "" {
+		return nil
+	}
+	j := job{bucket: gf.Bucket, object: gf.ChecksumSidecar}
+	opts := gf.readOptions(j)
+	opts.ReadCompressed = false // Let GCS decompress it.
+	r, err := gf.GCS.NewReader(ctx, j.bucket, j.object, opts)
+	if err != nil {
+		return gf.gcsError(err, j, "creating GCS reader for")
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Failed to close GCS reader: %v", cerr)
+		}
+	}()
+	sums, err := parseSha256Sums(r)
+	if err != nil {
+		return fmt.Errorf("reading checksum sidecar %s: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+	gf.entrySums = sums
+	return nil
+}
+
+// parseSha256Sums parses the output of sha256sum: lines of a hex-encoded
+// digest, whitespace, and a file name, which is marked with a leading "*"
+// if it was read in binary mode. Blank lines and lines starting with "#"
+// are ignored. The digests are returned by entryKey of their name.
+func parseSha256Sums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: want a digest and a file name", n)
+		}
+		digest := strings.ToLower(line[:i])
+		if len(digest) != 64 || nonHexRegex.MatchString(digest) {
+			return nil, fmt.Errorf("line %d: %q is not a SHA-256 digest", n, line[:i])
+		}
+		name := strings.TrimPrefix(strings.TrimLeft(line[i:], " \t"), "*")
+		sums[entryKey(name)] = digest
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// entryKey returns the form of an archive entry name that digests are
+// looked up by, so that "./a/b" and "a/b" match.
+func entryKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// checkEntry verifies digest, the hex-encoded SHA-256 of the archive entry
+// name, against the checksum sidecar, if one was loaded. Entries the
+// sidecar does not list fail only with RequireSidecarEntries.
+func (gf *Fetcher) checkEntry(name, digest string) error {
+	if gf.entrySums == nil {
+		return nil
+	}
+	want, ok := gf.entrySums[entryKey(name)]
+	if !ok {
+		if gf.RequireSidecarEntries {
+			return fmt.Errorf("archive entry %q is not listed in checksum sidecar %s", name, gf.ChecksumSidecar)
+		}
+		return nil
+	}
+	if digest != want {
+		return &checksumError{name: fmt.Sprintf("archive entry %q", name), algorithm: "SHA-256", got: digest, want: want}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChecksumSidecar(t *testing.T) {
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	matching := "# Written by sha256sum.\n" +
+		sum("first x") + "  ./a/x.txt\n" +
+		sum("second x") + " *b/c/x.txt\n" +
+		"\n" +
+		strings.ToUpper(sum("y")) + "  b/y.txt\n"
+	partial := sum("first x") + "  a/x.txt\n" + sum("second x") + "  b/c/x.txt\n"
+
+	for _, test := range []struct {
+		name    string
+		sidecar string
+		require bool
+		wantErr string // Empty if the fetch succeeds.
+	}{
+		{name: "matching", sidecar: matching},
+		{name: "matching, all required", sidecar: matching, require: true},
+		{name: "mismatch", sidecar: partial + sum("z") + "  b/y.txt\n", wantErr: `archive entry "b/y.txt" SHA-256 mismatch`},
+		{name: "missing entry allowed", sidecar: partial},
+		{name: "missing entry required", sidecar: partial, require: true, wantErr: `archive entry "b/y.txt" is not listed`},
+		{name: "malformed", sidecar: "abc  a/x.txt\n", wantErr: "not a SHA-256 digest"},
+	} {
+		for _, archive := range []struct{ kind, object, sourceType string }{
+			{"zip", "source.zip", "ZipArchive"},
+			{"tgz", "source.tgz", "TarGzArchive"},
+		} {
+			t.Run(test.name+"/"+archive.kind, func(t *testing.T) {
+				tc, teardown := buildManifestTestContext(t)
+				defer teardown()
+				tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: flattenTestArchive(t, archive.kind)}
+				tc.gcs.objects[formatGCSName(successBucket, "source.sha256sums", generation)] = fakeGCSResponse{content: []byte(test.sidecar)}
+				tc.gf.Object = archive.object
+				tc.gf.SourceType = archive.sourceType
+				tc.gf.ChecksumSidecar = "source.sha256sums"
+				tc.gf.RequireSidecarEntries = test.require
+
+				err := tc.gf.Fetch(context.Background())
+				if test.wantErr == "" {
+					if err != nil {
+						t.Fatalf("Fetch() = %v, want nil", err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Fetch() = %v, want error containing %q", err, test.wantErr)
+				}
+			})
+		}
+	}
+}
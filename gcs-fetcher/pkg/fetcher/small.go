@@ -0,0 +1,33 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+// splitSmallJobs returns the jobs that are not small, and those that are,
+// as SmallObjectSize and SmallObjectWorkers define them, each in the order
+// of jobs. Jobs of unknown size are not small.
+func (gf *Fetcher) splitSmallJobs(jobs []job) (large, small []job) {
+	if gf.SmallObjectSize <= 0 || gf.SmallObjectWorkers <= 0 {
+		return jobs, nil
+	}
+	for _, j := range jobs {
+		if j.size > 0 && j.size <= gf.SmallObjectSize {
+			small = append(small, j)
+		} else {
+			large = append(large, j)
+		}
+	}
+	return large, small
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitSmallJobs(t *testing.T) {
+	jobs := []job{{object: "a", size: 10}, {object: "b", size: 1000}, {object: "c"}, {object: "d", size: 100}}
+	names := func(jobs []job) []string {
+		var names []string
+		for _, j := range jobs {
+			names = append(names, j.object)
+		}
+		return names
+	}
+	for _, test := range []struct {
+		size                 int64
+		workers              int
+		wantLarge, wantSmall []string
+	}{
+		{0, 0, []string{"a", "b", "c", "d"}, nil},
+		{100, 0, []string{"a", "b", "c", "d"}, nil},
+		{100, 8, []string{"b", "c"}, []string{"a", "d"}},
+	} {
+		gf := &Fetcher{SmallObjectSize: test.size, SmallObjectWorkers: test.workers}
+		large, small := gf.splitSmallJobs(jobs)
+		if !reflect.DeepEqual(names(large), test.wantLarge) || !reflect.DeepEqual(names(small), test.wantSmall) {
+			t.Errorf("splitSmallJobs() with size %d and %d workers = %q, %q; want %q, %q", test.size, test.workers, names(large), names(small), test.wantLarge, test.wantSmall)
+		}
+	}
+}
+
+func TestProcessJobsSmallObjectWorkers(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.WorkerCount = 1
+	tc.gf.SmallObjectSize = int64(len(sfile1Contents))
+	tc.gf.SmallObjectWorkers = 4
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "small1", size: int64(len(sfile1Contents))},
+		{bucket: successBucket, object: sfile1, filename: "small2", size: int64(len(sfile1Contents))},
+		{bucket: successBucket, object: sfile3, filename: "large", size: int64(len(sfile3Contents))},
+	}
+	st, err := tc.gf.processJobs(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("processJobs() = %v", err)
+	}
+	// One worker for the large file, and one for each small file.
+	if st.workers != 3 || st.files != 3 {
+		t.Errorf("processJobs() used %d workers for %d files, want 3 for 3", st.workers, st.files)
+	}
+	for _, name := range []string{"small1", "small2", "large"} {
+		if _, err := ioutil.ReadFile(filepath.Join(tc.workDir, name)); err != nil {
+			t.Errorf("ReadFile(%s) = %v", name, err)
+		}
+	}
+}
+
+// latencyGCS serves the same content for every object, after a delay like
+// that of a request's round trip.
+type latencyGCS struct {
+	GCS
+	content []byte
+	latency time.Duration
+}
+
+func (g latencyGCS) NewReader(context.Context, string, string, ReadOptions) (io.ReadCloser, error) {
+	time.Sleep(g.latency)
+	return ioutil.NopCloser(bytes.NewReader(g.content)), nil
+}
+
+// BenchmarkProcessJobsTinyFiles fetches a manifest of many tiny files,
+// whose fetches are bound by request latency, with the same total number of
+// workers either all in one pool or split into a pool of small object
+// workers. The split does not make each fetch cheaper, so the two should
+// take about as long.
+func BenchmarkProcessJobsTinyFiles(b *testing.B) {
+	content := []byte("tiny")
+	jobs := make([]job, 500)
+	for i := range jobs {
+		jobs[i] = job{bucket: successBucket, object: fmt.Sprintf("f%d", i), filename: fmt.Sprintf("f%d", i), size: int64(len(content))}
+	}
+	for _, bench := range []struct {
+		workers, smallWorkers int
+	}{{72, 0}, {8, 64}} {
+		b.Run(fmt.Sprintf("WorkerCount=%d,SmallObjectWorkers=%d", bench.workers, bench.smallWorkers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				gf := &Fetcher{
+					GCS:                latencyGCS{content: content, latency: 2 * time.Millisecond},
+					OS:                 NewMemFileSystem(),
+					DestDir:            "/dest",
+					StagingDir:         "/dest/.staging",
+					CreatedDirs:        map[string]bool{},
+					WorkerCount:        bench.workers,
+					SmallObjectSize:    1024,
+					SmallObjectWorkers: bench.smallWorkers,
+					Stdout:             ioutil.Discard,
+					Stderr:             ioutil.Discard,
+				}
+				if _, err := gf.processJobs(context.Background(), jobs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
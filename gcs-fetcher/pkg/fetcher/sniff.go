@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// tarMagicOffset is where the magic number of an uncompressed tarball is.
+const tarMagicOffset = 257
+
+// Magic numbers at the start of each archive format, or, for an uncompressed
+// tarball, at tarMagicOffset.
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06") // A zip with no entries starts with its end record.
+	gzipMagic     = []byte("\x1f\x8b")
+	xzMagic       = []byte("\xfd7zXZ\x00")
+	zstdMagic     = []byte("\x28\xb5\x2f\xfd")
+	bzip2Magic    = []byte("BZh") // Followed by the block size, '1' to '9'.
+	tarMagic      = []byte("ustar")
+)
+
+// extensionKind returns the archive format named by the extension of object,
+// as one of the short names fetchArchive uses, or "" if the extension is not
+// that of an archive.
+func extensionKind(object string) string {
+	name := strings.ToLower(object)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(name, ".tar.xz"), strings.HasSuffix(name, ".txz"):
+		return "txz"
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return "tzst"
+	case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+		return "tbz2"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	default:
+		return ""
+	}
+}
+
+// sniffedKind returns the archive format that the first bytes of archive
+// identify, or kind if they identify none.
+func (gf *Fetcher) sniffedKind(archive, kind string) (string, error) {
+	sniffed, err := gf.sniffArchive(archive)
+	if err != nil {
+		return "", err
+	}
+	if sniffed == "" || sniffed == kind {
+		return kind, nil
+	}
+	return gf.sniffedAs(sniffed), nil
+}
+
+// sniffedAs logs that the archive is extracted as the sniffed kind, rather
+// than the one its extension or source type names, and returns sniffed.
+func (gf *Fetcher) sniffedAs(sniffed string) string {
+	gf.log("%s looks like a %s archive; extracting it as one.", formatGCSName(gf.Bucket, gf.Object, gf.Generation), sniffed)
+	return sniffed
+}
+
+// sniffArchive returns the archive format that the first bytes of the file
+// name identify, or "" if they match none.
+func (gf *Fetcher) sniffArchive(name string) (kind string, err error) {
+	f, err := gf.OS.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("opening archive %s: %v", name, err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("closing archive %s: %v", name, cerr)
+		}
+	}()
+	head := make([]byte, tarMagicOffset+len(tarMagic))
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("reading archive %s: %v", name, err)
+	}
+	return sniffKind(head[:n]), nil
+}
+
+// sniffKind returns the archive format that head, the first bytes of an
+// archive, identifies, or "" if it matches none.
+func sniffKind(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, zipMagic), bytes.HasPrefix(head, emptyZipMagic):
+		return "zip"
+	case bytes.HasPrefix(head, gzipMagic):
+		return "tgz"
+	case bytes.HasPrefix(head, xzMagic):
+		return "txz"
+	case bytes.HasPrefix(head, zstdMagic):
+		return "tzst"
+	case bytes.HasPrefix(head, bzip2Magic) && len(head) > len(bzip2Magic) && head[len(bzip2Magic)] >= '1' && head[len(bzip2Magic)] <= '9':
+		return "tbz2"
+	case len(head) >= tarMagicOffset+len(tarMagic) && bytes.Equal(head[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return "tar"
+	default:
+		return ""
+	}
+}
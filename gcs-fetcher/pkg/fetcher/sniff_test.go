@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// sniffTestFile is the one file in the archives built by sniffTestArchive.
+const sniffTestFile, sniffTestContents = "dir/a.txt", "contents of a"
+
+// sniffTestArchive returns an archive of the given kind, one of "zip", "tar"
+// and "tgz", holding sniffTestFile.
+func sniffTestArchive(t *testing.T, kind string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if kind == "zip" {
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create(sniffTestFile)
+		if err != nil {
+			t.Fatalf("Creating zip entry: %v", err)
+		}
+		if _, err := w.Write([]byte(sniffTestContents)); err != nil {
+			t.Fatalf("Writing zip entry: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Closing zip writer: %v", err)
+		}
+		return buf.Bytes()
+	}
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: sniffTestFile, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(sniffTestContents))}); err != nil {
+		t.Fatalf("Writing tar header: %v", err)
+	}
+	if _, err := tw.Write([]byte(sniffTestContents)); err != nil {
+		t.Fatalf("Writing tar entry: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if kind == "tar" {
+		return buf.Bytes()
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	if _, err := gw.Write(buf.Bytes()); err != nil {
+		t.Fatalf("Compressing tarball: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+	return gz.Bytes()
+}
+
+func TestSniffKind(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"zip", sniffTestArchive(t, "zip"), "zip"},
+		{"empty zip", []byte("PK\x05\x06\x00\x00"), "zip"},
+		{"gzip", sniffTestArchive(t, "tgz"), "tgz"},
+		{"xz", []byte("\xfd7zXZ\x00\x00\x04"), "txz"},
+		{"zstd", []byte("\x28\xb5\x2f\xfd\x04\x00"), "tzst"},
+		{"bzip2", []byte("BZh91AY&SY"), "tbz2"},
+		{"text starting like bzip2", []byte("BZh, hm"), ""},
+		{"tar", sniffTestArchive(t, "tar"), "tar"},
+		{"text", []byte("just some text"), ""},
+		{"empty", nil, ""},
+	} {
+		if got := sniffKind(tc.head); got != tc.want {
+			t.Errorf("sniffKind(%s) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFetchMislabeledArchives(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		object     string
+		sourceType string
+		content    string // Kind of archive the object really is.
+	}{
+		{"gzipped tarball named zip", "source.zip", "ZipArchive", "tgz"},
+		{"zip named tgz", "source.tgz", "TarGzArchive", "zip"},
+		{"zip without extension", "source", "Archive", "zip"},
+		{"gzipped tarball without extension", "source", "Archive", "tgz"},
+		{"uncompressed tarball", "source.tar", "Archive", "tar"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, teardown := buildManifestTestContext(t)
+			defer teardown()
+			ctx.gcs.objects[formatGCSName(successBucket, tc.object, generation)] = fakeGCSResponse{content: sniffTestArchive(t, tc.content)}
+			ctx.gf.Object = tc.object
+			ctx.gf.SourceType = tc.sourceType
+
+			if err := ctx.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(ctx.workDir, sniffTestFile))
+			if err != nil || string(got) != sniffTestContents {
+				t.Errorf("ReadFile(%s) = (%q, %v), want (%q, nil)", sniffTestFile, got, err, sniffTestContents)
+			}
+		})
+	}
+}
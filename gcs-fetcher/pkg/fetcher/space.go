@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// insufficientSpaceError indicates that the files to be written need more
+// disk space than is available.
+type insufficientSpaceError struct {
+	path      string
+	need      int64
+	available int64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("Not enough disk space in %s: %d bytes are needed but only %d are available, %d bytes short. Free up space, or use --include or --exclude to fetch fewer files.", e.path, e.need, e.available, e.need-e.available)
+}
+
+// checkSpace returns an insufficientSpaceError if writing need bytes under
+// path would run out of disk space. The check is best effort: it is skipped
+// if the available space cannot be determined.
+func (gf *Fetcher) checkSpace(path string, need int64) error {
+	if gf.SkipSpaceCheck || gf.DryRun || need <= 0 {
+		return nil
+	}
+	dir := gf.existingDir(path)
+	available, err := gf.OS.AvailableBytes(dir)
+	if err != nil {
+		gf.logErr("WARNING: cannot determine free space in %q, continuing: %v", dir, err)
+		return nil
+	}
+	if available < need {
+		return &insufficientSpaceError{path: dir, need: need, available: available}
+	}
+	return nil
+}
+
+// existingDir returns path, or its closest ancestor that exists.
+func (gf *Fetcher) existingDir(path string) string {
+	if path == "" {
+		path = "."
+	}
+	for {
+		if _, err := gf.OS.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// knownSize returns the total size recorded in the manifest for jobs. Jobs
+// without a size don't count, so the result is a lower bound.
+func knownSize(jobs []job) int64 {
+	var total int64
+	for _, j := range jobs {
+		if j.size > 0 {
+			total += j.size
+		}
+	}
+	return total
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchFromManifestChecksSpace(t *testing.T) {
+	manifest := []byte(`{
+		"sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js", "size": 100},
+		"sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg", "size": 50},
+		"sfile3":     {"sourceUrl": "gs://success-bucket/sfile3"}
+	}`)
+
+	for _, tc := range []struct {
+		name      string
+		freeBytes int64
+		exclude   []string
+		skip      bool
+		wantErr   bool
+	}{
+		{name: "enough space", freeBytes: 150},
+		{name: "not enough space", freeBytes: 149, wantErr: true},
+		{name: "excluded files don't count", freeBytes: 50, exclude: []string{"sfile1.js"}},
+		{name: "check skipped", freeBytes: 1, skip: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, teardown := buildManifestTestContext(t)
+			defer teardown()
+			c.gcs.objects[formatGCSName(successBucket, "sized.json", generation)] = fakeGCSResponse{content: manifest}
+			c.gf.Object = "sized.json"
+			c.gf.Exclude = tc.exclude
+			c.gf.SkipSpaceCheck = tc.skip
+			c.os.freeBytes = tc.freeBytes
+
+			_, err := c.gf.fetchFromManifest(context.Background())
+			var serr *insufficientSpaceError
+			if got := errors.As(err, &serr); got != tc.wantErr {
+				t.Fatalf("fetchFromManifest() = %v, want insufficientSpaceError: %t", err, tc.wantErr)
+			}
+			if !tc.wantErr {
+				return
+			}
+			if serr.need != 150 || serr.available != 149 {
+				t.Errorf("insufficientSpaceError got need=%d available=%d, want need=150 available=149", serr.need, serr.available)
+			}
+			// Nothing but the staging directory has been written.
+			infos, err := ioutil.ReadDir(c.workDir)
+			if err != nil {
+				t.Fatalf("ReadDir(%q) = %v", c.workDir, err)
+			}
+			for _, info := range infos {
+				if filepath.Join(c.workDir, info.Name()) != filepath.Clean(c.gf.StagingDir) {
+					t.Errorf("found %q after failed space check", info.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestUnzipChecksSpace(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	zipfile := filepath.Join(tc.workDir, "source.zip")
+	f, err := os.Create(zipfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(tc.workDir, "dest")
+	tc.os.freeBytes = 999
+	_, err = tc.gf.unzip(context.Background(), zipfile, dest)
+	var serr *insufficientSpaceError
+	if !errors.As(err, &serr) || serr.need != 1000 {
+		t.Fatalf("unzip() = %v, want insufficientSpaceError needing 1000 bytes", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("%q exists after failed space check: %v", dest, err)
+	}
+
+	tc.os.freeBytes = 1000
+	if _, err := tc.gf.unzip(context.Background(), zipfile, dest); err != nil {
+		t.Errorf("unzip() = %v, want nil", err)
+	}
+}
+
+func TestExistingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gf := &Fetcher{OS: OSFileSystem{}}
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"", "."},
+		{dir, dir},
+		{filepath.Join(dir, "a", "b"), dir},
+	} {
+		if got := gf.existingDir(tc.path); got != tc.want {
+			t.Errorf("existingDir(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempDir returns the directory that objects are downloaded to before being
+// moved to their final names.
+func (gf *Fetcher) tempDir() string {
+	if gf.FastStagingDir != "" {
+		return gf.FastStagingDir
+	}
+	return gf.StagingDir
+}
+
+// tempName returns the name under tempDir that attempt retrynum of j
+// downloads to: [TempPrefix][Bucket]-[Object]-[fuzz]-[retry].
+func (gf *Fetcher) tempName(j job, fuzz, retrynum int) string {
+	return filepath.Join(gf.tempDir(), fmt.Sprintf("%s%s-%s-%d-%d", gf.TempPrefix, j.bucket, j.object, fuzz, retrynum))
+}
+
+// removeStagingDirs removes StagingDir and, if set, FastStagingDir, once a
+// fetch no longer needs them. Failures are logged and otherwise ignored.
+func (gf *Fetcher) removeStagingDirs() {
+	for _, dir := range []string{gf.StagingDir, gf.FastStagingDir} {
+		if dir == "" {
+			continue
+		}
+		if err := gf.OS.RemoveAll(dir); err != nil {
+			gf.log("Failed to remove staging dir %q, continuing: %v", dir, err)
+		}
+	}
+}
+
+// removeStaleTemps removes the files under StagingDir and FastStagingDir,
+// left by runs that crashed or timed out, which were last modified at least
+// StaleTempAge before now. Only entries of those directories named with
+// TempPrefix are considered, and symbolic links are removed rather than
+// followed, so nothing outside them is touched. Failures are logged and
+// otherwise ignored, as the fetch does not depend on them.
+func (gf *Fetcher) removeStaleTemps(now time.Time) {
+	if gf.StaleTempAge <= 0 {
+		return
+	}
+	for _, dir := range []string{gf.StagingDir, gf.FastStagingDir} {
+		if dir == "" {
+			continue
+		}
+		entries, err := gf.OS.ReadDir(dir)
+		if err != nil {
+			// Most likely no earlier run left a staging dir behind.
+			continue
+		}
+		var removed int
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), gf.TempPrefix) {
+				removed += gf.removeStale(dir, e, now.Add(-gf.StaleTempAge))
+			}
+		}
+		if removed > 0 {
+			gf.log("Removed %d stale temp files from %q.", removed, dir)
+		}
+	}
+}
+
+// removeStale removes the entry e of dir if it was last modified before
+// cutoff or, if it is a directory, the stale files within it and then the
+// directory if that leaves it empty. It returns the number of files
+// removed.
+func (gf *Fetcher) removeStale(dir string, e fs.DirEntry, cutoff time.Time) int {
+	name := filepath.Join(dir, e.Name())
+	if !e.IsDir() {
+		// Info describes a symbolic link itself, not its target.
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return 0
+		}
+		if err := gf.OS.Remove(name); err != nil {
+			gf.log("Failed to remove stale temp file %q, continuing: %v", name, err)
+			return 0
+		}
+		return 1
+	}
+	entries, err := gf.OS.ReadDir(name)
+	if err != nil {
+		gf.log("Failed to list %q for stale temp files, continuing: %v", name, err)
+		return 0
+	}
+	var removed int
+	for _, child := range entries {
+		removed += gf.removeStale(name, child, cutoff)
+	}
+	if removed == len(entries) {
+		// Best effort: a file may have been added since.
+		gf.OS.Remove(name)
+	}
+	return removed
+}
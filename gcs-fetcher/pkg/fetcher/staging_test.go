@@ -0,0 +1,218 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleTemps(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	now := time.Now()
+	old, recent := now.Add(-2*time.Hour), now.Add(-time.Minute)
+	outside := filepath.Join(tc.workDir, "outside.txt")
+
+	staged := func(name string) string { return filepath.Join(tc.gf.StagingDir, name) }
+	files := []struct {
+		name     string
+		modTime  time.Time
+		wantGone bool
+	}{
+		{staged("a-bucket-old.txt-1-0"), old, true},
+		{staged("a-bucket-recent.txt-2-0"), recent, false},
+		{staged("a-bucket-dir/old.txt-3-0"), old, true},
+		{staged("a-bucket-dir/recent.txt-4-0"), recent, false},
+		{staged("a-bucket-gone/old.txt-5-0"), old, true},
+		{staged("b-bucket-old.txt-6-0"), old, false}, // Another fetcher's.
+		{outside, old, false},
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.name), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(f.name, []byte("orphan"), 0644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", f.name, err)
+		}
+		if err := os.Chtimes(f.name, f.modTime, f.modTime); err != nil {
+			t.Fatalf("Chtimes(%s): %v", f.name, err)
+		}
+	}
+	// A link out of StagingDir is not followed to the old file outside.
+	link := staged("a-link")
+	if err := os.Symlink(tc.workDir, link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	tc.gf.TempPrefix = "a-"
+	tc.gf.StaleTempAge = time.Hour
+	tc.gf.removeStaleTemps(now)
+
+	for _, f := range files {
+		_, err := os.Stat(f.name)
+		if gone := os.IsNotExist(err); gone != f.wantGone {
+			t.Errorf("%s removed = %t, want %t", f.name, gone, f.wantGone)
+		}
+	}
+	if _, err := os.Stat(staged("a-bucket-gone")); !os.IsNotExist(err) {
+		t.Errorf("Stat(a-bucket-gone) = %v, want the emptied directory removed", err)
+	}
+	if _, err := os.Stat(staged("a-bucket-dir")); err != nil {
+		t.Errorf("Stat(a-bucket-dir) = %v, want the directory kept", err)
+	}
+	if _, err := os.Lstat(link); err != nil {
+		t.Errorf("Lstat(%s) = %v, want the recent link kept", link, err)
+	}
+}
+
+func TestRemoveStaleTempsDisabled(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	name := filepath.Join(tc.gf.StagingDir, "bucket-old.txt-1-0")
+	if err := os.MkdirAll(tc.gf.StagingDir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(name, nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	tc.gf.removeStaleTemps(time.Now())
+
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("Stat(%s) = %v, want the file kept with no StaleTempAge", name, err)
+	}
+}
+
+func TestTempPrefix(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.TempPrefix = "fetcher-1-"
+
+	j := job{bucket: successBucket, object: sfile1, filename: "localfile.txt"}
+	if report := tc.gf.fetchObject(context.Background(), j); !report.success {
+		t.Fatalf("fetchObject() failed: %v", report.err)
+	}
+
+	var staged []string
+	for _, name := range tc.os.created {
+		if strings.HasPrefix(name, tc.gf.StagingDir) {
+			staged = append(staged, name)
+		}
+	}
+	if len(staged) != 1 || !strings.HasPrefix(staged[0], filepath.Join(tc.gf.StagingDir, "fetcher-1-"+successBucket+"-")) {
+		t.Errorf("staged files = %v, want one named with the prefix", staged)
+	}
+}
+
+func TestFetchObjectFastStagingDirAcrossFileSystems(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.FastStagingDir = filepath.Join(tc.workDir, ".fast")
+	tc.os.errorsEXDEV = 1 // Renames out of FastStagingDir cross file systems.
+
+	j := job{bucket: successBucket, object: sfile1, filename: "dir/localfile.txt"}
+	report := tc.gf.fetchObject(context.Background(), j)
+	if !report.success || len(report.attempts) != 1 {
+		t.Fatalf("fetchObject() success = %v after %d attempts, err = %v; want success after 1", report.success, len(report.attempts), report.err)
+	}
+
+	tc.os.mu.Lock()
+	created := tc.os.created
+	tc.os.mu.Unlock()
+	if len(created) == 0 || filepath.Dir(created[0]) != tc.gf.FastStagingDir {
+		t.Errorf("files created = %q, want the download in %q", created, tc.gf.FastStagingDir)
+	}
+	if tc.os.errorsEXDEV != 0 {
+		t.Errorf("%d EXDEV renames left, want the move to have tried a rename", tc.os.errorsEXDEV)
+	}
+	finalname := filepath.Join(tc.workDir, "dir/localfile.txt")
+	if got, err := os.ReadFile(finalname); err != nil || string(got) != string(sfile1Contents) {
+		t.Errorf("ReadFile(%q) = %q, %v; want %q", finalname, got, err, sfile1Contents)
+	}
+	if files := regularFiles(t, tc.gf.FastStagingDir); len(files) > 0 {
+		t.Errorf("FastStagingDir holds %q, want the download removed after the copy", files)
+	}
+}
+
+func TestFetchFromManifestAtomicFastStagingDir(t *testing.T) {
+	manifest := []byte(`{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`)
+	tests := []struct {
+		name      string
+		failMove  string // Moving this file into DestDir fails.
+		wantErr   bool
+		wantFiles map[string]string
+	}{{
+		name:      "success",
+		wantFiles: map[string]string{"a/sfile1.js": string(sfile1Contents), "b/sfile2.jpg": string(sfile2Contents)},
+	}, {
+		name:      "commit fails",
+		failMove:  "b/sfile2.jpg",
+		wantErr:   true,
+		wantFiles: map[string]string{"b/sfile2.jpg": "read-only"},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, teardown := buildManifestTestContext(t)
+			defer teardown()
+			ctx.gf.Atomic = true
+			ctx.gf.FastStagingDir = filepath.Join(ctx.workDir, ".fast")
+			ctx.os.exdevFrom = ctx.gf.FastStagingDir // Every download is copied out of FastStagingDir.
+			ctx.os.honorReadOnly = true
+			if tc.failMove != "" {
+				ctx.os.failRenameTo = filepath.Join(ctx.workDir, tc.failMove)
+			}
+			existing := filepath.Join(ctx.workDir, "b", "sfile2.jpg")
+			if err := os.MkdirAll(filepath.Dir(existing), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(existing, []byte("read-only"), 0555); err != nil {
+				t.Fatal(err)
+			}
+			ctx.gcs.objects[formatGCSName(successBucket, "atomic.json", generation)] = fakeGCSResponse{content: manifest}
+			ctx.gf.Object = "atomic.json"
+
+			_, err := ctx.gf.fetchFromManifest(context.Background())
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("fetchFromManifest() = %v, want error %t", err, tc.wantErr)
+			}
+			var want []string
+			for name, content := range tc.wantFiles {
+				want = append(want, name)
+				if got, err := os.ReadFile(filepath.Join(ctx.workDir, name)); err != nil || string(got) != content {
+					t.Errorf("ReadFile(%s) = %q, %v; want %q", name, got, err, content)
+				}
+			}
+			sort.Strings(want)
+			if got := listFiles(t, ctx.workDir); !reflect.DeepEqual(got, want) {
+				t.Errorf("files in DestDir = %v, want %v", got, want)
+			}
+		})
+	}
+}
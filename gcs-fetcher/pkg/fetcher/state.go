@@ -0,0 +1,159 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// stateInterval is how often, at most, StateFile is rewritten while files
+// are being fetched. It is always written once they all have been.
+var stateInterval = 5 * time.Second
+
+// fetchState is the content of a StateFile.
+type fetchState struct {
+	// Files are the files fetched, by manifest key.
+	Files map[string]stateEntry `json:"files"`
+}
+
+// stateEntry records a file that a fetch completed.
+type stateEntry struct {
+	Source     string `json:"source"` // The object, without its generation.
+	Generation int64  `json:"generation,omitempty"`
+	Size       int64  `json:"size"`
+	Sha256     string `json:"sha256"`
+}
+
+// stateTracker holds the files an earlier fetch completed, as loaded from
+// StateFile, and those completed since.
+type stateTracker struct {
+	done  map[string]stateEntry // As loaded; not changed while fetching.
+	files map[string]stateEntry // done, and the files completed since.
+	saved time.Time
+}
+
+// loadState reads StateFile, if set. An absent or unreadable file is
+// treated as an empty one, so that every file is fetched. It returns nil
+// when there is no state to keep.
+func (gf *Fetcher) loadState() *stateTracker {
+	if gf.StateFile == "" || gf.DryRun || gf.Atomic {
+		return nil
+	}
+	st := &stateTracker{done: map[string]stateEntry{}, files: map[string]stateEntry{}, saved: time.Now()}
+	f, err := gf.OS.Open(gf.StateFile)
+	if err != nil {
+		return st
+	}
+	defer f.Close()
+	var fs fetchState
+	if err := json.NewDecoder(f).Decode(&fs); err != nil {
+		gf.log("Ignoring state file %q, fetching every file: %v", gf.StateFile, err)
+		return st
+	}
+	for name, e := range fs.Files {
+		st.done[name] = e
+		st.files[name] = e
+	}
+	return st
+}
+
+// completedBefore reports whether the file for j was completed by an
+// earlier fetch, according to StateFile, is still on disk as it was
+// written, and still holds the object: either the generation j names, or,
+// if it names none, the live object, whose size and CRC32C are looked up.
+// It returns the file's sums if so.
+func (gf *Fetcher) completedBefore(ctx context.Context, j job) (localSums, bool) {
+	if gf.state == nil || j.destDirOverride != "" {
+		return localSums{}, false
+	}
+	e, ok := gf.state.done[j.filename]
+	if !ok || e.Source != formatGCSName(j.bucket, j.object, 0) || (j.generation != 0 && j.generation != e.Generation) {
+		return localSums{}, false
+	}
+	sums, ok := gf.sumFile(gf.finalName(j))
+	if !ok || sums.size != e.Size || sums.sha256 != e.Sha256 {
+		return localSums{}, false
+	}
+	if !gf.matchesJob(gf.finalName(j), sums, j) {
+		return localSums{}, false
+	}
+	if j.generation == 0 {
+		// The object may have been replaced since the file was written.
+		attrs, err := gf.GCS.Attrs(ctx, j.bucket, j.object, gf.readOptions(j))
+		if err != nil || attrs.Size != sums.size || attrs.CRC32C != sums.crc32c {
+			return localSums{}, false
+		}
+	}
+	return sums, true
+}
+
+// recordState adds the file of report, if it was written, to the state,
+// and writes StateFile if it was last written over stateInterval ago.
+func (gf *Fetcher) recordState(report jobReport) {
+	if gf.state == nil {
+		return
+	}
+	j := report.job
+	if report.success && !report.empty && !report.kept && j.destDirOverride == "" && report.sha256 != "" {
+		gf.state.files[j.filename] = stateEntry{
+			Source:     formatGCSName(j.bucket, j.object, 0),
+			Generation: j.generation,
+			Size:       int64(report.size),
+			Sha256:     report.sha256,
+		}
+	}
+	if time.Since(gf.state.saved) >= stateInterval {
+		gf.saveState()
+	}
+}
+
+// saveState writes the state to StateFile, replacing it only once the new
+// content is complete. Failing to is logged, and does not fail the fetch.
+func (gf *Fetcher) saveState() {
+	if gf.state == nil {
+		return
+	}
+	gf.state.saved = time.Now()
+	if err := gf.writeState(); err != nil {
+		gf.log("Failed to write state file %q, continuing: %v", gf.StateFile, err)
+	}
+}
+
+func (gf *Fetcher) writeState() (err error) {
+	data, err := json.MarshalIndent(fetchState{Files: gf.state.files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := gf.StateFile + ".tmp"
+	f, err := gf.OS.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := gf.OS.Rename(tmp, gf.StateFile); err != nil {
+		return fmt.Errorf("renaming %q: %v", tmp, err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateFileResumes(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.StateFile = filepath.Join(tc.workDir, ".fetch-state.json")
+	tc.gf.Retries = 0
+
+	// The first fetch dies partway, with two of its files fetched.
+	first := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+		{bucket: errorBucket, object: efile1, filename: "sfile3"},
+	}
+	if _, err := tc.gf.processJobs(context.Background(), first); err == nil {
+		t.Fatalf("first processJobs() = nil, want error")
+	}
+	if _, err := os.Stat(tc.gf.StateFile); err != nil {
+		t.Fatalf("Stat(state file) = %v, want it written", err)
+	}
+
+	rerun(tc)
+	tc.gcs.reads = nil
+	second := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+		{bucket: successBucket, object: sfile3, filename: "sfile3"},
+	}
+	st, err := tc.gf.processJobs(context.Background(), second)
+	if err != nil {
+		t.Fatalf("second processJobs() = %v", err)
+	}
+	for object, want := range map[string]int{sfile1: 0, sfile2: 0, sfile3: 1} {
+		if got := tc.gcs.reads[formatGCSName(successBucket, object, generation)]; got != want {
+			t.Errorf("%s read %d times when resuming, want %d", object, got, want)
+		}
+	}
+	if st.files != 3 || st.unchanged != 2 {
+		t.Errorf("second processJobs() = %d files, %d unchanged, want 3, 2", st.files, st.unchanged)
+	}
+}
+
+func TestStateFileRefetchesChangedFiles(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.StateFile = filepath.Join(tc.workDir, ".fetch-state.json")
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+	}
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("first processJobs() = %v", err)
+	}
+	if err := os.Chmod(filepath.Join(tc.workDir, "sfile2"), 0644); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tc.workDir, "sfile2"), []byte("changed"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	rerun(tc)
+	tc.gcs.reads = nil
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("second processJobs() = %v", err)
+	}
+	for object, want := range map[string]int{sfile1: 0, sfile2: 1} {
+		if got := tc.gcs.reads[formatGCSName(successBucket, object, generation)]; got != want {
+			t.Errorf("%s read %d times, want %d", object, got, want)
+		}
+	}
+}
+
+func TestStateFileRefetchesReplacedObjects(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.StateFile = filepath.Join(tc.workDir, ".fetch-state.json")
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+	}
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("first processJobs() = %v", err)
+	}
+	// sfile2 is overwritten in GCS; the manifest names no generation.
+	tc.gcs.objects[formatGCSName(successBucket, sfile2, generation)] = fakeGCSResponse{content: []byte("replaced")}
+
+	rerun(tc)
+	tc.gcs.reads = nil
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("second processJobs() = %v", err)
+	}
+	for object, want := range map[string]int{sfile1: 0, sfile2: 1} {
+		if got := tc.gcs.reads[formatGCSName(successBucket, object, generation)]; got != want {
+			t.Errorf("%s read %d times, want %d", object, got, want)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(tc.workDir, "sfile2")); err != nil || string(got) != "replaced" {
+		t.Errorf("ReadFile(sfile2) = %q, %v; want %q", got, err, "replaced")
+	}
+}
+
+func TestStateFileChecksDigest(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.StateFile = filepath.Join(tc.workDir, ".fetch-state.json")
+	tc.gf.Retries = 0
+	// The entry is pinned only by its Algorithm and Digest.
+	j := job{bucket: successBucket, object: sfile1, filename: "sfile1", algorithm: "md5", digest: fmt.Sprintf("%x", md5.Sum(sfile1Contents))}
+	if _, err := tc.gf.processJobs(context.Background(), []job{j}); err != nil {
+		t.Fatalf("first processJobs() = %v", err)
+	}
+
+	// The manifest now pins other content, which the file no longer has.
+	j.digest = fmt.Sprintf("%x", md5.Sum(sfile2Contents))
+	rerun(tc)
+	tc.gcs.reads = nil
+	st, err := tc.gf.processJobs(context.Background(), []job{j})
+	if err == nil {
+		t.Errorf("second processJobs() = nil, want the object's digest to mismatch")
+	}
+	if got := tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)]; got != 1 || st.unchanged != 0 {
+		t.Errorf("sfile1 read %d times, %d unchanged; want it fetched again", got, st.unchanged)
+	}
+}
+
+func TestStateFileCorrupt(t *testing.T) {
+	for name, content := range map[string]string{
+		"corrupt": `{"files": {"sfile1": `,
+		"absent":  "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gf.StateFile = filepath.Join(tc.workDir, ".fetch-state.json")
+			if content != "" {
+				if err := os.WriteFile(tc.gf.StateFile, []byte(content), 0644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+			jobs := []job{
+				{bucket: successBucket, object: sfile1, filename: "sfile1"},
+				{bucket: successBucket, object: sfile2, filename: "sfile2"},
+			}
+			st, err := tc.gf.processJobs(context.Background(), jobs)
+			if err != nil {
+				t.Fatalf("processJobs() = %v", err)
+			}
+			if st.unchanged != 0 || tc.gcs.reads[formatGCSName(successBucket, sfile1, generation)] != 1 {
+				t.Errorf("processJobs() = %d unchanged, want every file fetched", st.unchanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+//go:build !linux && !darwin
+
+package fetcher
+
+import "errors"
+
+// availableBytes is not implemented on this platform, so the free space
+// check is skipped.
+func availableBytes(path string) (int64, error) {
+	return 0, errors.New("checking free space is not supported on this platform")
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// errNotStreamable is returned by streamArchive when the archive turns out
+// to be a zip, which cannot be extracted without random access.
+var errNotStreamable = errors.New("archive cannot be extracted as it is read")
+
+// extractError is a failure to extract a streamed archive that reading it
+// again would not fix, such as a malformed entry.
+type extractError struct {
+	err error
+}
+
+func (e *extractError) Error() string { return e.err.Error() }
+func (e *extractError) Unwrap() error { return e.err }
+
+// readTracker counts the bytes read from r and remembers the first error
+// other than io.EOF, so that a failed extraction can tell a broken download,
+// or a failed decryption, from a broken archive.
+type readTracker struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// failure returns err, the failure to extract an archive read through t, as
+// an extractError unless reading from GCS failed.
+func (t *readTracker) failure(err error) error {
+	if t.err != nil {
+		return err
+	}
+	return &extractError{err: err}
+}
+
+// streamable reports whether an archive of the given kind can be extracted
+// as it is downloaded. Anything that needs the whole archive first, such as
+// a digest to check before extracting, a copy to keep or a zip, is staged.
+func (gf *Fetcher) streamable(kind string) bool {
+	return gf.StreamArchives && kind != "zip" && extensionKind(gf.Object) == kind &&
+		gf.ArchiveSha256 == "" && !gf.VerifyCRC32C && gf.CacheDir == "" && !gf.KeepSource && !gf.KeepArchive && !gf.DryRun &&
+		gf.GzipObjects == GzipTranscoded
+}
+
+// streamArchive downloads a tarball of the given kind from GCS and extracts
+// it into the destination folder as it is read, so that the archive is
+// never written to StagingDir. A failed download is retried from the start,
+// rewriting the files already extracted. It returns errNotStreamable, before
+// anything is extracted, if the archive turns out to be a zip.
+func (gf *Fetcher) streamArchive(ctx context.Context, kind string, started time.Time) (Stats, error) {
+	j := job{filename: gf.Object, bucket: gf.Bucket, object: gf.Object, generation: gf.Generation}
+	report := &jobReport{job: j, started: started}
+	gf.live.active.Add(1)
+	defer gf.live.active.Add(-1)
+	var st stats
+	for retrynum := 0; retrynum <= gf.Retries; retrynum++ {
+		if n := len(report.attempts); n > 0 && report.attempts[n-1].permanent {
+			break // Retrying cannot help.
+		}
+		if retrynum > 0 && !gf.retryAllowed() {
+			gf.budgetExhausted(j, report)
+			break
+		}
+
+		var backoff time.Duration
+		if retrynum > 0 {
+			gf.metrics().IncRetry()
+			sleepStarted := time.Now()
+			err := sleep(ctx, gf.retryDelay(report, retrynum))
+			backoff = time.Since(sleepStarted)
+			if err != nil {
+				gf.recordFailure(j, time.Now(), backoff, noTimeout, err, report)
+				break
+			}
+		}
+
+		attemptStarted := time.Now()
+		var err error
+		st, kind, err = gf.streamArchiveOnce(ctx, j, kind)
+		if err == errNotStreamable {
+			return Stats{}, err
+		}
+		if err != nil {
+			gf.recordFailure(j, attemptStarted, backoff, noTimeout, err, report)
+			continue
+		}
+		gf.recordSuccess(j, attemptStarted, backoff, st.size, gf.DestDir, report)
+		break
+	}
+	report.completed = time.Now()
+	gf.metrics().ObserveFetch(formatGCSName(j.bucket, j.object, j.generation), int64(report.size), time.Since(report.started), report.err)
+
+	if !report.success {
+		var xerr *extractError
+		if errors.As(report.err, &xerr) {
+			return Stats{}, xerr.err
+		}
+		var cerr *corruptArchiveError
+		if errors.As(report.err, &cerr) {
+			return Stats{}, cerr
+		}
+		return Stats{}, gf.archiveDownloadError(report.err)
+	}
+	st, err := gf.extractNested(ctx, st)
+	if err != nil {
+		return Stats{}, err
+	}
+	gf.removeStagingDirs()
+	st.retries = len(report.attempts) - 1
+	duration := report.attempts[len(report.attempts)-1].duration
+	return gf.archiveSummary(st, kind, started, duration, duration)
+}
+
+// streamArchiveOnce makes one attempt at streamArchive, returning the kind
+// of archive that was extracted, which differs from kind if the archive's
+// first bytes identify another format.
+func (gf *Fetcher) streamArchiveOnce(ctx context.Context, j job, kind string) (st stats, _ string, err error) {
+	name := formatGCSName(j.bucket, j.object, j.generation)
+	r, err := gf.GCS.NewReader(ctx, j.bucket, j.object, gf.readOptions(j))
+	if err != nil {
+		return st, kind, gf.gcsError(err, j, "creating GCS reader for")
+	}
+	defer func() {
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Failed to close GCS reader: %v", cerr)
+		}
+	}()
+
+	ahead, stop := gf.prefetch(gf.counted(gf.throttle(ctx, r)))
+	defer stop()
+	downloaded := &readTracker{r: ahead}
+	plaintext, err := gf.decrypt(ctx, j, downloaded)
+	if err != nil {
+		return st, kind, err
+	}
+	t := &readTracker{r: plaintext}
+	br := bufio.NewReader(t)
+	head, err := br.Peek(tarMagicOffset + len(tarMagic))
+	if t.err != nil {
+		return st, kind, fmt.Errorf("reading %s: %v", name, t.err)
+	}
+	if err != nil && err != io.EOF {
+		return st, kind, fmt.Errorf("reading %s: %v", name, err)
+	}
+	switch sniffed := sniffKind(head); sniffed {
+	case "zip":
+		return st, kind, errNotStreamable
+	case "", kind:
+	default:
+		kind = gf.sniffedAs(sniffed)
+	}
+
+	dr, err := gf.decompressor(kind)(br)
+	if err != nil {
+		if t.err == nil && isCorruptStream(err) {
+			return st, kind, gf.corruptArchive(st, err)
+		}
+		return st, kind, t.failure(fmt.Errorf("failed to decompress %s: %v", name, err))
+	}
+	defer dr.Close()
+	if st, err = gf.untar(ctx, decompressedReader{Reader: dr, compressed: t}, gf.DestDir); err != nil {
+		if t.err == nil && isCorruptStream(err) {
+			return st, kind, gf.corruptArchive(st, err)
+		}
+		return st, kind, t.failure(fmt.Errorf("failed to extract %s: %v", name, err))
+	}
+	// Read to the end, so that the decompressor checks its trailer and the
+	// whole archive is counted.
+	if _, err := io.Copy(io.Discard, dr); err != nil {
+		if t.err == nil && isCorruptStream(err) {
+			return st, kind, gf.corruptArchive(st, err)
+		}
+		return st, kind, t.failure(fmt.Errorf("failed to decompress %s: %v", name, err))
+	}
+	st.size = sizeBytes(downloaded.n)
+	return st, kind, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamArchives(t *testing.T) {
+	for _, stream := range []bool{true, false} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		tc.gcs.objects[formatGCSName(successBucket, "source.tgz", generation)] = fakeGCSResponse{content: flattenTestArchive(t, "tgz")}
+		tc.gf.Object = "source.tgz"
+		tc.gf.SourceType = "TarGzArchive"
+		tc.gf.StreamArchives = stream
+
+		if err := tc.gf.Fetch(context.Background()); err != nil {
+			t.Fatalf("StreamArchives=%v: Fetch() = %v", stream, err)
+		}
+		for _, f := range flattenTestFiles {
+			got, err := ioutil.ReadFile(filepath.Join(tc.workDir, f.name))
+			if err != nil || string(got) != f.contents {
+				t.Errorf("StreamArchives=%v: ReadFile(%s) = %q, %v, want %q", stream, f.name, got, err, f.contents)
+			}
+		}
+		var staged []string
+		for _, name := range tc.os.created {
+			if strings.HasPrefix(name, tc.gf.StagingDir) {
+				staged = append(staged, name)
+			}
+		}
+		if stream && len(staged) > 0 {
+			t.Errorf("StreamArchives=true: files created in the staging dir: %q", staged)
+		}
+		if !stream && len(staged) == 0 {
+			t.Errorf("StreamArchives=false: the archive was not staged")
+		}
+	}
+}
+
+func TestStreamArchivesRetries(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	name := formatGCSName(successBucket, "source.tgz", generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: flattenTestArchive(t, "tgz"), failAfter: 20}
+	tc.gf.Object = "source.tgz"
+	tc.gf.SourceType = "TarGzArchive"
+	tc.gf.StreamArchives = true
+
+	st, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWithStats() = %v", err)
+	}
+	if st.Files != len(flattenTestFiles) || st.Retries != 1 {
+		t.Errorf("FetchWithStats() = %+v, want %d files and 1 retry", st, len(flattenTestFiles))
+	}
+	if got := tc.gcs.reads[name]; got != 2 {
+		t.Errorf("%s read %d times, want 2", name, got)
+	}
+}
+
+func TestStreamArchivesMalformed(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(bytes.Repeat([]byte("not a tarball "), 100))
+	gw.Close()
+	name := formatGCSName(successBucket, "source.tgz", generation)
+	tc.gcs.objects[name] = fakeGCSResponse{content: buf.Bytes()}
+	tc.gf.Object = "source.tgz"
+	tc.gf.SourceType = "TarGzArchive"
+	tc.gf.StreamArchives = true
+
+	if err := tc.gf.Fetch(context.Background()); err == nil {
+		t.Fatalf("Fetch() = nil, want error")
+	}
+	if got := tc.gcs.reads[name]; got != 1 {
+		t.Errorf("%s read %d times, want 1: a malformed archive is not worth retrying", name, got)
+	}
+}
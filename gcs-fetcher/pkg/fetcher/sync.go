@@ -0,0 +1,51 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import "fmt"
+
+// syncFile flushes the contents of f, written to name, to stable storage if
+// SyncWrites is set.
+func (gf *Fetcher) syncFile(f File, name string) error {
+	if !gf.SyncWrites {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %q: %v", name, err)
+	}
+	return nil
+}
+
+// syncDir flushes the entries of dir, such as a file just renamed into it,
+// to stable storage if SyncWrites is set.
+func (gf *Fetcher) syncDir(dir string) (err error) {
+	if !gf.SyncWrites {
+		return nil
+	}
+	d, err := gf.OS.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening directory %q: %v", dir, err)
+	}
+	defer func() {
+		if cerr := d.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Failed to close directory %q: %v", dir, cerr)
+		}
+	}()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing directory %q: %v", dir, err)
+	}
+	return nil
+}
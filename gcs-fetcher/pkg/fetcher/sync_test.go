@@ -0,0 +1,43 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSyncWrites(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		tc, teardown := buildManifestTestContext(t)
+		defer teardown()
+		tc.gf.SyncWrites = enabled
+
+		if _, err := tc.gf.fetchFromManifest(context.Background()); err != nil {
+			t.Fatalf("fetchFromManifest() = %v", err)
+		}
+		want := int32(0)
+		if enabled {
+			want = 3 // One per file in the manifest; the manifest itself is not synced.
+		}
+		if got := tc.os.fileSyncs.Load(); got != want {
+			t.Errorf("SyncWrites=%t: file syncs = %d, want %d", enabled, got, want)
+		}
+		if got := tc.os.dirSyncs.Load(); got != want {
+			t.Errorf("SyncWrites=%t: directory syncs = %d, want %d", enabled, got, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// GzipMode decides how objects stored with Content-Encoding: gzip are read.
+type GzipMode string
+
+const (
+	// GzipTranscoded lets GCS decompress such objects as it serves them,
+	// which is its default. Their size and CRC32C describe the compressed
+	// bytes, so they cannot be verified.
+	GzipTranscoded GzipMode = ""
+	// GzipCompressed reads the stored, compressed bytes and writes them as
+	// they are. Digests from a manifest are checked against them.
+	GzipCompressed GzipMode = "compressed"
+	// GzipDecompressed reads the stored, compressed bytes and decompresses
+	// them locally. The CRC32C is checked against the compressed bytes and
+	// digests from a manifest against the decompressed ones.
+	GzipDecompressed GzipMode = "decompressed"
+)
+
+// sizeMismatchError indicates that the bytes read for an object do not add
+// up to its size in GCS.
+type sizeMismatchError struct {
+	name      string
+	got, want int64
+	encoding  string // The object's Content-Encoding.
+}
+
+func (e *sizeMismatchError) Error() string {
+	msg := fmt.Sprintf("%s size mismatch, got %d bytes, want %d", e.name, e.got, e.want)
+	if e.encoding == "gzip" {
+		msg += ". The object is stored with Content-Encoding: gzip, and GCS decompresses such objects as it serves them, so they no longer match their size and CRC32C. Set --gzip_objects to compressed or decompressed to fetch the stored bytes instead."
+	}
+	return msg
+}
+
+// gunzips reports whether the object described by j is decompressed
+// locally if it is stored with Content-Encoding: gzip. Manifests and
+// archives are staged to be read, so they are decompressed even with
+// GzipCompressed.
+func (gf *Fetcher) gunzips(j job) bool {
+	return gf.GzipObjects == GzipDecompressed || (gf.GzipObjects == GzipCompressed && j.destDirOverride != "")
+}
+
+// decompress returns the content of the object described by j and attrs,
+// read from stored, which must be its stored bytes, and reports whether it
+// had to be decompressed.
+func (gf *Fetcher) decompress(j job, attrs *ObjectAttrs, stored io.Reader) (io.Reader, bool, error) {
+	if !gf.gunzips(j) || attrs == nil || attrs.ContentEncoding != "gzip" {
+		return stored, false, nil
+	}
+	zr, err := gzip.NewReader(stored)
+	if err != nil {
+		return nil, false, fmt.Errorf("decompressing %s: %v", formatGCSName(j.bucket, j.object, j.generation), err)
+	}
+	return zr, true, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipTranscodedObjects(t *testing.T) {
+	compressed := gzipBytes(t, sfile1Contents)
+	compressedSum := fmt.Sprintf("%x", sha256.Sum256(compressed))
+	decompressedSum := fmt.Sprintf("%x", sha256.Sum256(sfile1Contents))
+
+	for _, test := range []struct {
+		name      string
+		mode      GzipMode
+		sha256sum string
+		want      []byte // Contents written; nil if the fetch fails.
+		wantErr   string
+	}{
+		{name: "transcoded", mode: GzipTranscoded, wantErr: "Content-Encoding: gzip"},
+		{name: "compressed", mode: GzipCompressed, sha256sum: compressedSum, want: compressed},
+		{name: "compressed with digest of content", mode: GzipCompressed, sha256sum: decompressedSum, wantErr: "SHA-256 mismatch"},
+		{name: "decompressed", mode: GzipDecompressed, sha256sum: decompressedSum, want: sfile1Contents},
+		{name: "decompressed with digest of stored bytes", mode: GzipDecompressed, sha256sum: compressedSum, wantErr: "SHA-256 mismatch"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "zipped", generation)] = fakeGCSResponse{content: compressed, gzipped: true}
+			tc.gf.VerifyCRC32C = true
+			tc.gf.GzipObjects = test.mode
+
+			j := job{bucket: successBucket, object: "zipped", filename: "zipped", sha256sum: test.sha256sum}
+			dest := filepath.Join(tc.workDir, "zipped")
+			result := tc.gf.fetchObjectOnce(context.Background(), j, dest, make(chan struct{}, 1))
+
+			if test.want == nil {
+				if result.err == nil || !strings.Contains(result.err.Error(), test.wantErr) {
+					t.Fatalf("fetchObjectOnce() err = %v, want it to contain %q", result.err, test.wantErr)
+				}
+				return
+			}
+			if result.err != nil {
+				t.Fatalf("fetchObjectOnce() err = %v", result.err)
+			}
+			got, err := ioutil.ReadFile(dest)
+			if err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("ReadFile(%s) = (%q, %v), want (%q, nil)", dest, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestGzipTranscodedSizeMismatch(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, "zipped", generation)] = fakeGCSResponse{content: gzipBytes(t, sfile1Contents), gzipped: true}
+	tc.gf.VerifyCRC32C = true
+
+	j := job{bucket: successBucket, object: "zipped", filename: "zipped"}
+	result := tc.gf.fetchObjectOnce(context.Background(), j, filepath.Join(tc.workDir, "zipped"), make(chan struct{}, 1))
+	var serr *sizeMismatchError
+	if !errors.As(result.err, &serr) {
+		t.Fatalf("fetchObjectOnce() err = %v, want sizeMismatchError", result.err)
+	}
+	if serr.got != int64(len(sfile1Contents)) || serr.encoding != "gzip" {
+		t.Errorf("sizeMismatchError = %+v, want got=%d and encoding gzip", serr, len(sfile1Contents))
+	}
+}
+
+func TestGzipCompressedManifest(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	manifest := gzipBytes(t, []byte(`{"sfile1.js": {"sourceUrl": "gs://success-bucket/sfile1.js"}}`))
+	tc.gcs.objects[formatGCSName(successBucket, "manifest.json", generation)] = fakeGCSResponse{content: manifest, gzipped: true}
+	tc.gf.Object = "manifest.json"
+	tc.gf.SourceType = "Manifest"
+	tc.gf.GzipObjects = GzipCompressed
+
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(tc.workDir, "sfile1.js"))
+	if err != nil || !bytes.Equal(got, sfile1Contents) {
+		t.Errorf("ReadFile(sfile1.js) = (%q, %v), want (%q, nil)", got, err, sfile1Contents)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"io"
+)
+
+// transformContent returns the content to write for the file at relpath,
+// read from r: r itself, or what ContentTransform makes of it if set. The
+// rest of r is read once the transformed content has been, so that readers
+// teed off r, such as the hashes verifying it, see all of it.
+func (gf *Fetcher) transformContent(relpath string, r io.Reader) (io.Reader, error) {
+	if gf.ContentTransform == nil {
+		return r, nil
+	}
+	t, err := gf.ContentTransform(relpath, r)
+	if err != nil {
+		return nil, err
+	}
+	return &drainingReader{r: t, src: r}, nil
+}
+
+// entryBytes is entryContent for an archive entry held in memory.
+func (gf *Fetcher) entryBytes(name string, data []byte) ([]byte, error) {
+	r, err := gf.entryContent(name, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// drainingReader reads r, and discards what is left of src when r is done.
+type drainingReader struct {
+	r, src io.Reader
+}
+
+func (d *drainingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		if _, derr := io.Copy(io.Discard, d.src); derr != nil {
+			return n, derr
+		}
+	}
+	return n, err
+}
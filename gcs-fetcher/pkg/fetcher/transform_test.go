@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// upperTransform uppercases the content of the files named in paths.
+func upperTransform(paths ...string) func(string, io.Reader) (io.Reader, error) {
+	return func(relpath string, r io.Reader) (io.Reader, error) {
+		for _, p := range paths {
+			if relpath == p {
+				b, err := io.ReadAll(r)
+				return bytes.NewReader(bytes.ToUpper(b)), err
+			}
+		}
+		return r, nil
+	}
+}
+
+func TestProcessJobsContentTransform(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.ContentTransform = upperTransform("upper.js")
+
+	jobs := []job{
+		// The digest is that of the object, not of what is written.
+		{bucket: successBucket, object: sfile1, filename: "upper.js", sha256sum: fmt.Sprintf("%x", sha256.Sum256(sfile1Contents))},
+		{bucket: successBucket, object: sfile1, filename: "same.js"},
+	}
+	if _, err := tc.gf.processJobs(context.Background(), jobs); err != nil {
+		t.Fatalf("processJobs() = %v, want nil", err)
+	}
+	for name, want := range map[string][]byte{
+		"upper.js": bytes.ToUpper(sfile1Contents),
+		"same.js":  sfile1Contents,
+	} {
+		got, err := os.ReadFile(filepath.Join(tc.workDir, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("ReadFile(%s) = (%q, %v), want (%q, nil)", name, got, err, want)
+		}
+	}
+}
+
+func TestExtractContentTransform(t *testing.T) {
+	// An entry too large to buffer is written as it is read.
+	big := strings.Repeat("big ", maxBufferedEntry/2)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range []struct{ name, content string }{
+		{"d/upper", "small"},
+		{"d/same", "small"},
+		{"d/big", big},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.content))}); err != nil {
+			t.Fatalf("Writing tar header %s: %v", e.name, err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Writing tar entry %s: %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Closing tar writer: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Closing gzip writer: %v", err)
+	}
+
+	for _, archive := range []struct {
+		kind, object, sourceType string
+		content                  []byte
+		want                     map[string]string
+	}{
+		{"zip", "source.zip", "ZipArchive", permTestArchive(t, "zip"), map[string]string{"d/open": "D/OPEN", "d/readonly": "d/readonly"}},
+		{"tgz", "source.tgz", "TarGzArchive", buf.Bytes(), map[string]string{"d/upper": "SMALL", "d/same": "small", "d/big": strings.ToUpper(big)}},
+	} {
+		t.Run(archive.kind, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: archive.content}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = archive.sourceType
+			tc.gf.ContentTransform = upperTransform("d/open", "d/upper", "d/big")
+
+			if err := tc.gf.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			for name, want := range archive.want {
+				got, err := os.ReadFile(filepath.Join(tc.workDir, name))
+				if err != nil || string(got) != want {
+					t.Errorf("ReadFile(%s) = (%.20q, %v), want (%.20q, nil)", name, got, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// treeLeaf is a file covered by a tree hash.
+type treeLeaf struct {
+	path   string // Relative to DestDir, with forward slashes.
+	sha256 string // Hex-encoded digest of the file's content.
+}
+
+// merkleRoot returns the hex-encoded root of a binary Merkle tree over
+// leaves, sorted by path. Each leaf hashes its path and digest, and each
+// node its two children, with distinct prefixes so that neither can pass
+// for the other; a node without a sibling is carried up a level as it is.
+// No leaves at all hash to the SHA-256 of nothing.
+func merkleRoot(leaves []treeLeaf) string {
+	sorted := append([]treeLeaf(nil), leaves...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].path < sorted[j].path })
+	if len(sorted) == 0 {
+		return fmt.Sprintf("%x", sha256.Sum256(nil))
+	}
+	level := make([][]byte, len(sorted))
+	for i, l := range sorted {
+		sum := sha256.Sum256([]byte("\x00" + l.path + "\x00" + l.sha256))
+		level[i] = sum[:]
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := append(append([]byte{1}, level[i]...), level[i+1]...)
+			sum := sha256.Sum256(node)
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return fmt.Sprintf("%x", level[0])
+}
+
+// TreeHash returns a digest summarizing the files that the last successful
+// fetch wrote, for attestation: the root of a Merkle tree over their paths,
+// relative to DestDir, and SHA-256 digests, as computed while fetching. It
+// only changes if a file is added, removed, renamed or changed. It is empty
+// until a fetch succeeds, and after a dry run.
+func (gf *Fetcher) TreeHash() string {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	return gf.tree
+}
+
+// setTreeHash sets TreeHash for files, with absolute names.
+func (gf *Fetcher) setTreeHash(files []writtenFile) {
+	dest, err := filepath.Abs(gf.DestDir)
+	if err != nil {
+		dest = gf.DestDir
+	}
+	leaves := make([]treeLeaf, 0, len(files))
+	for _, f := range files {
+		rel, err := filepath.Rel(dest, f.name)
+		if err != nil {
+			rel = f.name
+		}
+		leaves = append(leaves, treeLeaf{path: filepath.ToSlash(rel), sha256: f.sha256})
+	}
+	root := merkleRoot(leaves)
+	gf.mu.Lock()
+	gf.tree = root
+	gf.mu.Unlock()
+}
+
+// reportLeaves returns the leaves of the tree hash for the files that
+// reports wrote, as complete counts them.
+func reportLeaves(reports []jobReport) []treeLeaf {
+	byPath := map[string]string{}
+	for _, report := range reports {
+		if report.success && !report.empty && !report.kept && report.job.destDirOverride == "" {
+			byPath[filepath.ToSlash(filepath.Clean(report.job.filename))] = report.sha256
+		}
+	}
+	leaves := make([]treeLeaf, 0, len(byPath))
+	for p, digest := range byPath {
+		leaves = append(leaves, treeLeaf{path: p, sha256: digest})
+	}
+	return leaves
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// fetchTreeHash fetches sfile1 and sfile2, with sfile2 holding content, and
+// returns TreeHash and the tree hash in the report.
+func fetchTreeHash(t *testing.T, content []byte) (string, string) {
+	t.Helper()
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gcs.objects[formatGCSName(successBucket, sfile2, generation)] = fakeGCSResponse{content: content}
+	tc.gf.Bucket, tc.gf.Object = "", ""
+	tc.gf.SourceType = "Manifest"
+	tc.gf.ManifestReader = bytes.NewReader([]byte(`{
+		"a/sfile1.js":  {"sourceUrl": "gs://success-bucket/sfile1.js"},
+		"b/sfile2.jpg": {"sourceUrl": "gs://success-bucket/sfile2.jpg"}
+	}`))
+	var buf bytes.Buffer
+	tc.gf.ReportWriter = &buf
+
+	if got := tc.gf.TreeHash(); got != "" {
+		t.Errorf("TreeHash() before fetching = %q, want empty", got)
+	}
+	if err := tc.gf.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	var report jsonReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Unmarshal(%s) = %v", buf.String(), err)
+	}
+	return tc.gf.TreeHash(), report.TreeHash
+}
+
+func TestTreeHash(t *testing.T) {
+	first, firstReport := fetchTreeHash(t, sfile2Contents)
+	if first == "" || firstReport != first {
+		t.Fatalf("TreeHash() = %q, report treeHash = %q, want the same non-empty hash", first, firstReport)
+	}
+	if again, _ := fetchTreeHash(t, sfile2Contents); again != first {
+		t.Errorf("TreeHash() of identical content = %q, want %q", again, first)
+	}
+	if changed, _ := fetchTreeHash(t, []byte("sfile2-contents-bb")); changed == first {
+		t.Errorf("TreeHash() = %q after sfile2 changed, want a different hash", changed)
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a := treeLeaf{path: "a", sha256: "01"}
+	b := treeLeaf{path: "b", sha256: "02"}
+	c := treeLeaf{path: "c", sha256: "03"}
+	if got, want := merkleRoot([]treeLeaf{c, a, b}), merkleRoot([]treeLeaf{a, b, c}); got != want {
+		t.Errorf("merkleRoot() depends on the order of its leaves: %q != %q", got, want)
+	}
+	// Moving content to another path changes the hash.
+	moved := treeLeaf{path: "d", sha256: "03"}
+	if merkleRoot([]treeLeaf{a, b, c}) == merkleRoot([]treeLeaf{a, b, moved}) {
+		t.Errorf("merkleRoot() unchanged when a file moved")
+	}
+	if merkleRoot(nil) == merkleRoot([]treeLeaf{a}) {
+		t.Errorf("merkleRoot() of no leaves matches that of one")
+	}
+}
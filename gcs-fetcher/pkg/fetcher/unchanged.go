@@ -0,0 +1,183 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// localSums are the size and digests of a file already in DestDir.
+type localSums struct {
+	size   int64
+	sha1   string // Hex-encoded.
+	sha256 string // Hex-encoded.
+	crc32  uint32 // IEEE, as recorded in zip archives.
+	crc32c uint32 // Castagnoli, as reported by GCS.
+}
+
+// sumFile returns the sums of the regular file at name, and whether it
+// could be read.
+func (gf *Fetcher) sumFile(name string) (localSums, bool) {
+	info, err := gf.OS.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return localSums{}, false
+	}
+	f, err := gf.OS.Open(name)
+	if err != nil {
+		return localSums{}, false
+	}
+	defer f.Close()
+	h1, h256, hcrc, hcrcc := sha1.New(), sha256.New(), crc32.NewIEEE(), crc32.New(crc32cTable)
+	n, err := io.Copy(io.MultiWriter(h1, h256, hcrc, hcrcc), f)
+	if err != nil {
+		return localSums{}, false
+	}
+	return localSums{
+		size:   n,
+		sha1:   fmt.Sprintf("%x", h1.Sum(nil)),
+		sha256: fmt.Sprintf("%x", h256.Sum(nil)),
+		crc32:  hcrc.Sum32(),
+		crc32c: hcrcc.Sum32(),
+	}, true
+}
+
+// unchangedObject reports whether SkipUnchanged can leave the file for j
+// alone: it already exists with the object's size and CRC32C, and matches
+// any digests from the manifest. It returns the file's sums if so.
+func (gf *Fetcher) unchangedObject(ctx context.Context, j job) (localSums, bool) {
+	// Staged, decrypted or decompressed files cannot be compared against
+	// the object, and Atomic fetches write to an empty directory.
+	if !gf.SkipUnchanged || j.destDirOverride != "" || gf.Atomic || gf.Decryptor != nil || gf.gunzips(j) {
+		return localSums{}, false
+	}
+	sums, ok := gf.sumFile(gf.finalName(j))
+	if !ok {
+		return localSums{}, false
+	}
+	attrs, err := gf.GCS.Attrs(ctx, j.bucket, j.object, gf.readOptions(j))
+	if err != nil || attrs.Size != sums.size || attrs.CRC32C != sums.crc32c {
+		return localSums{}, false
+	}
+	if !gf.matchesJob(gf.finalName(j), sums, j) {
+		return localSums{}, false
+	}
+	return sums, true
+}
+
+// matchesJob reports whether the file at name, with sums, has every digest
+// the manifest entry of j gives: its sha1sum, its sha256sum, and its Digest
+// in its Algorithm.
+func (gf *Fetcher) matchesJob(name string, sums localSums, j job) bool {
+	if !digestMatches(sums.sha1, j.sha1sum) || !digestMatches(sums.sha256, j.sha256sum) {
+		return false
+	}
+	return gf.hasJobDigest(name, j)
+}
+
+// hasJobDigest reports whether the file at name has the digest, computed
+// with its Algorithm, that j expects, if it expects one.
+func (gf *Fetcher) hasJobDigest(name string, j job) bool {
+	h := gf.newHash(j)
+	if h == nil {
+		return true
+	}
+	f, err := gf.OS.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return verifyJobDigest(j, h) == nil
+}
+
+// digestMatches reports whether got, hex-encoded, matches want, as given in
+// a manifest. An empty want always matches.
+func digestMatches(got, want string) bool {
+	return want == "" || got == nonHexRegex.ReplaceAllString(strings.ToLower(want), "")
+}
+
+// sameSize reports whether a regular file of the given size exists at name.
+func (gf *Fetcher) sameSize(name string, size int64) bool {
+	info, err := gf.OS.Stat(name)
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
+}
+
+// rewriteIfChanged compares the file at name, which must be as long as r,
+// with the content read from r. It leaves the file alone if they match, and
+// otherwise rewrites it in place. It reports whether the file changed, and
+// the SHA-256 of r, hex-encoded.
+func (gf *Fetcher) rewriteIfChanged(name string, r io.Reader) (changed bool, digest string, err error) {
+	f, err := gf.OS.Open(name)
+	if err != nil {
+		return false, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	buf, cur := make([]byte, 32*1024), make([]byte, 32*1024)
+	var off int64
+	for {
+		n, rerr := r.Read(buf)
+		h.Write(buf[:n])
+		if m, _ := f.ReadAt(cur[:n], off); m < n || !bytes.Equal(buf[:n], cur[:n]) {
+			// The first off bytes match, so writing them back as they are
+			// read from the same file keeps them intact.
+			rest := io.MultiReader(io.NewSectionReader(f, 0, off), bytes.NewReader(buf[:n]), io.TeeReader(r, h))
+			if err := gf.overwrite(name, rest); err != nil {
+				return true, "", err
+			}
+			return true, fmt.Sprintf("%x", h.Sum(nil)), nil
+		}
+		off += int64(n)
+		if rerr == io.EOF {
+			return false, fmt.Sprintf("%x", h.Sum(nil)), nil
+		}
+		if rerr != nil {
+			return false, "", rerr
+		}
+	}
+}
+
+// overwrite writes r over the start of the existing file at name.
+func (gf *Fetcher) overwrite(name string, r io.Reader) error {
+	gf.trackPartial(name)
+	w, err := gf.OS.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := gf.syncFile(w, name); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	gf.untrackPartial(name)
+	return nil
+}
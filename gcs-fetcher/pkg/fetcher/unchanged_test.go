@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// destCreates returns the files opened for writing, other than those
+// staged, such as the archive or manifest.
+func destCreates(tc *testContext) []string {
+	tc.os.mu.Lock()
+	defer tc.os.mu.Unlock()
+	var got []string
+	for _, name := range tc.os.created {
+		if !strings.HasPrefix(name, tc.gf.StagingDir) {
+			got = append(got, name)
+		}
+	}
+	return got
+}
+
+// rerun resets tc as if the Fetcher were started afresh on the same
+// DestDir.
+func rerun(tc *testContext) {
+	tc.gf.CreatedDirs = map[string]bool{}
+	tc.os.created = nil
+}
+
+func TestSkipUnchangedArchive(t *testing.T) {
+	for _, archive := range []struct{ kind, object, sourceType string }{
+		{"zip", "source.zip", "ZipArchive"},
+		{"tgz", "source.tgz", "TarGzArchive"},
+	} {
+		t.Run(archive.kind, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, archive.object, generation)] = fakeGCSResponse{content: flattenTestArchive(t, archive.kind)}
+			tc.gf.Object = archive.object
+			tc.gf.SourceType = archive.sourceType
+			tc.gf.SkipUnchanged = true
+
+			st, err := tc.gf.FetchWithStats(context.Background())
+			if err != nil {
+				t.Fatalf("first FetchWithStats() = %v", err)
+			}
+			if st.Files != len(flattenTestFiles) || st.Unchanged != 0 {
+				t.Fatalf("first FetchWithStats() = %+v, want %d files, none unchanged", st, len(flattenTestFiles))
+			}
+
+			// Change one file, and remove another along with its directory.
+			changed := filepath.Join(tc.workDir, "a/x.txt")
+			if err := ioutil.WriteFile(changed, []byte("FIRST X"), 0644); err != nil {
+				t.Fatalf("WriteFile(%s): %v", changed, err)
+			}
+			if err := os.RemoveAll(filepath.Join(tc.workDir, "b/c")); err != nil {
+				t.Fatalf("RemoveAll: %v", err)
+			}
+
+			rerun(tc)
+			st, err = tc.gf.FetchWithStats(context.Background())
+			if err != nil {
+				t.Fatalf("second FetchWithStats() = %v", err)
+			}
+			if st.Files != len(flattenTestFiles) || st.Unchanged != 1 {
+				t.Errorf("second FetchWithStats() = %+v, want %d files, 1 unchanged", st, len(flattenTestFiles))
+			}
+			for _, f := range flattenTestFiles {
+				got, err := ioutil.ReadFile(filepath.Join(tc.workDir, f.name))
+				if err != nil {
+					t.Errorf("ReadFile(%s): %v", f.name, err)
+					continue
+				}
+				if string(got) != f.contents {
+					t.Errorf("%s got %q, want %q", f.name, got, f.contents)
+				}
+			}
+
+			rerun(tc)
+			st, err = tc.gf.FetchWithStats(context.Background())
+			if err != nil {
+				t.Fatalf("third FetchWithStats() = %v", err)
+			}
+			if st.Unchanged != st.Files {
+				t.Errorf("third FetchWithStats() = %+v, want every file unchanged", st)
+			}
+			if got := destCreates(tc); len(got) != 0 {
+				t.Errorf("third FetchWithStats() wrote %v, want no files written", got)
+			}
+		})
+	}
+}
+
+func TestRewriteIfChanged(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	n := filepath.Join(tc.workDir, "big.bin")
+	content := strings.Repeat("0123456789abcdef", maxBufferedEntry/8)
+	tests := []struct {
+		existing    string
+		wantChanged bool
+	}{
+		{content, false},
+		{content[:len(content)-1] + "X", true},
+		{"X" + content[1:], true},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(n, []byte(test.existing), 0644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", n, err)
+		}
+		changed, digest, err := tc.gf.rewriteIfChanged(n, strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("rewriteIfChanged() = %v", err)
+		}
+		if changed != test.wantChanged {
+			t.Errorf("rewriteIfChanged() changed = %t, want %t", changed, test.wantChanged)
+		}
+		if want := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); digest != want {
+			t.Errorf("rewriteIfChanged() digest = %s, want %s", digest, want)
+		}
+		got, err := ioutil.ReadFile(n)
+		if err != nil {
+			t.Fatalf("ReadFile(%s): %v", n, err)
+		}
+		if string(got) != content {
+			t.Errorf("rewriteIfChanged() left %d bytes not matching the entry", len(got))
+		}
+	}
+}
+
+func TestSkipUnchangedManifest(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.SourceType = "Manifest"
+	tc.gf.Object = goodManifest
+	tc.gf.SkipUnchanged = true
+
+	first, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("first FetchWithStats() = %v", err)
+	}
+	if first.Unchanged != 0 {
+		t.Errorf("first FetchWithStats() = %+v, want none unchanged", first)
+	}
+
+	rerun(tc)
+	second, err := tc.gf.FetchWithStats(context.Background())
+	if err != nil {
+		t.Fatalf("second FetchWithStats() = %v", err)
+	}
+	if second.Unchanged != second.Files || second.Files != first.Files {
+		t.Errorf("second FetchWithStats() = %+v, want all %d files unchanged", second, first.Files)
+	}
+	if got := destCreates(tc); len(got) != 0 {
+		t.Errorf("second FetchWithStats() wrote %v, want no files written", got)
+	}
+}
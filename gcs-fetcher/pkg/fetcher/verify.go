@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-builders/gcs-fetcher/pkg/common"
+)
+
+// Verify checks the files under DestDir against the manifest at Bucket and
+// Object, without downloading them. It returns the names, relative to
+// DestDir, of the files that are missing, or whose size or digests differ
+// from those recorded in the manifest. Files the manifest has no size or
+// digest for are only checked for existence, and files left out by the
+// Include and Exclude filters are not checked.
+func (gf *Fetcher) Verify(ctx context.Context) (mismatches []string, err error) {
+	if err := gf.checkOpen(); err != nil {
+		return nil, err
+	}
+	files, _, err := gf.loadManifests(ctx, func(ctx context.Context, ref ObjectRef, each func(string, common.ManifestItem)) (time.Duration, error) {
+		return 0, gf.readManifest(ctx, ref, each)
+	})
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := gf.manifestJobs(files)
+	if err != nil {
+		return nil, err
+	}
+	jobs, _ = gf.filterJobs(jobs)
+	for _, j := range jobs {
+		problem, err := gf.verifyFile(j)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			gf.logErr(problem)
+			mismatches = append(mismatches, j.filename)
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
+
+// verifyFile checks the local copy of the file described by j, and describes
+// what is wrong with it, or returns "" if nothing is.
+func (gf *Fetcher) verifyFile(j job) (problem string, err error) {
+	name := filepath.Join(gf.DestDir, j.filename)
+	f, err := gf.OS.Open(name)
+	if os.IsNotExist(err) {
+		return fmt.Sprintf("%s is missing", j.filename), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("opening %q: %v", name, err)
+	}
+	defer f.Close()
+
+	h1, h256, hx := sha1.New(), sha256.New(), gf.newHash(j)
+	n, err := io.Copy(io.MultiWriter(hashWriters(hx, h1, h256)...), f)
+	if err != nil {
+		return "", fmt.Errorf("reading %q: %v", name, err)
+	}
+	if j.size > 0 && n != j.size {
+		return fmt.Sprintf("%s is %d bytes, want %d", j.filename, n, j.size), nil
+	}
+	if err := verifyDigest(j.filename, "SHA-1", h1, j.sha1sum); err != nil {
+		return err.Error(), nil
+	}
+	if err := verifyDigest(j.filename, "SHA-256", h256, j.sha256sum); err != nil {
+		return err.Error(), nil
+	}
+	if err := verifyJobDigest(j, hx); err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
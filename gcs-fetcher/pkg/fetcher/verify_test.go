@@ -0,0 +1,100 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	manifest := []byte(fmt.Sprintf(`{
+		"sfile1.js":   {"SourceURL": "gs://success-bucket/sfile1.js", "Sha256Sum": "%x"},
+		"dir/sfile2":  {"SourceURL": "gs://success-bucket/sfile2.jpg", "Size": %d},
+		"sfile3":      {"SourceURL": "gs://success-bucket/sfile3"}
+	}`, sha256.Sum256(sfile1Contents), len(sfile2Contents)))
+
+	// Fetched files are read-only, so they are replaced rather than
+	// rewritten.
+	replace := func(name string, content []byte) error {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(name, content, 0644)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tamper func(dir string) error
+		want   []string
+	}{{
+		name:   "matching tree",
+		tamper: func(string) error { return nil },
+	}, {
+		name: "tampered file",
+		tamper: func(dir string) error {
+			return replace(filepath.Join(dir, "sfile1.js"), sfile2Contents)
+		},
+		want: []string{"sfile1.js"},
+	}, {
+		name: "truncated file",
+		tamper: func(dir string) error {
+			return replace(filepath.Join(dir, "dir/sfile2"), nil)
+		},
+		want: []string{"dir/sfile2"},
+	}, {
+		name: "missing files",
+		tamper: func(dir string) error {
+			if err := os.Remove(filepath.Join(dir, "sfile3")); err != nil {
+				return err
+			}
+			return os.Remove(filepath.Join(dir, "sfile1.js"))
+		},
+		want: []string{"sfile1.js", "sfile3"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, teardown := buildManifestTestContext(t)
+			defer teardown()
+			ctx.gcs.objects[formatGCSName(successBucket, "verify.json", generation)] = fakeGCSResponse{content: manifest}
+			ctx.gf.Object = "verify.json"
+			if _, err := ctx.gf.fetchFromManifest(context.Background()); err != nil {
+				t.Fatalf("fetchFromManifest() = %v", err)
+			}
+			if err := tc.tamper(ctx.workDir); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx.gcs.reads = nil
+			got, err := ctx.gf.Verify(context.Background())
+			if err != nil {
+				t.Fatalf("Verify() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Verify() got %v, want %v", got, tc.want)
+			}
+			want := map[string]int{formatGCSName(successBucket, "verify.json", generation): 1}
+			if !reflect.DeepEqual(ctx.gcs.reads, want) {
+				t.Errorf("Verify() read %v from GCS, want only the manifest", ctx.gcs.reads)
+			}
+		})
+	}
+}
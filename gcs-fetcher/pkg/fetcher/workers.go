@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+const (
+	defaultMinWorkers = 1
+	defaultMaxWorkers = 200
+
+	// largeFileSize is the average file size above which downloads are
+	// considered bandwidth rather than latency bound.
+	largeFileSize = 1024 * 1024
+	// bytesPerWorker is how much data a single worker is expected to pull
+	// efficiently once downloads are bandwidth bound.
+	bytesPerWorker = 64 * 1024 * 1024
+)
+
+// autoScaleWorkers chooses a worker count for jobs.
+//
+// Small files are dominated by per-request latency, so by default every file
+// gets its own worker. When the manifest records every object's size and the
+// average exceeds largeFileSize, the total size instead bounds the count to
+// one worker per bytesPerWorker: a handful of streams already saturate the
+// network for large files, and more only add contention. The result is
+// clamped to [MinWorkers, MaxWorkers].
+func (gf *Fetcher) autoScaleWorkers(jobs []job) int {
+	minWorkers, maxWorkers := gf.MinWorkers, gf.MaxWorkers
+	if minWorkers <= 0 {
+		minWorkers = defaultMinWorkers
+	}
+	if maxWorkers <= 0 {
+		maxWorkers = defaultMaxWorkers
+	}
+
+	workers := len(jobs)
+	var total int64
+	for _, j := range jobs {
+		if j.size <= 0 {
+			// Without every size we can't tell how the bytes are spread.
+			total = 0
+			break
+		}
+		total += j.size
+	}
+	if total > 0 && total/int64(len(jobs)) > largeFileSize {
+		if bySize := int((total + bytesPerWorker - 1) / bytesPerWorker); bySize < workers {
+			workers = bySize
+		}
+	}
+
+	if workers > maxWorkers {
+		workers = maxWorkers
+	}
+	if workers < minWorkers {
+		workers = minWorkers
+	}
+	return workers
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAutoScaleWorkers(t *testing.T) {
+	const mib = 1024 * 1024
+	jobs := func(n int, size int64) []job {
+		js := make([]job, n)
+		for i := range js {
+			js[i].size = size
+		}
+		return js
+	}
+
+	for _, tc := range []struct {
+		name     string
+		jobs     []job
+		min, max int
+		want     int
+	}{
+		{name: "no jobs", want: 1},
+		{name: "few small files", jobs: jobs(10, 0), want: 10},
+		{name: "many small files", jobs: jobs(10000, 0), want: defaultMaxWorkers},
+		{name: "many small files, custom max", jobs: jobs(10000, 1024), max: 50, want: 50},
+		{name: "three huge files", jobs: jobs(3, 2048*mib), want: 3},
+		{name: "medium files", jobs: jobs(100, 10*mib), want: 16},
+		{name: "many tiny files with sizes", jobs: jobs(150, 1024), want: 150},
+		{name: "few files, custom min", jobs: jobs(2, 0), min: 8, want: 8},
+		{name: "unknown sizes", jobs: append(jobs(99, 10*mib), job{}), want: 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gf := &Fetcher{AutoScaleWorkers: true, MinWorkers: tc.min, MaxWorkers: tc.max}
+			if got := gf.autoScaleWorkers(tc.jobs); got != tc.want {
+				t.Errorf("autoScaleWorkers() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessJobsAutoScaleWorkers(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	tc.gf.WorkerCount = 1
+	tc.gf.AutoScaleWorkers = true
+
+	jobs := []job{
+		{bucket: successBucket, object: sfile1, filename: "sfile1"},
+		{bucket: successBucket, object: sfile2, filename: "sfile2"},
+		{bucket: successBucket, object: sfile3, filename: "sfile3"},
+	}
+	stats, err := tc.gf.processJobs(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("processJobs() got %v, want nil", err)
+	}
+	if stats.workers != len(jobs) {
+		t.Errorf("processJobs() stats.workers = %d, want %d", stats.workers, len(jobs))
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// errCannotResume is returned when a download to a writer fails part way,
+// and GCS cannot serve the rest of the object on its own.
+var errCannotResume = errors.New("cannot resume the download, and the bytes already written cannot be taken back")
+
+// objectWriter is the io.Writer passed to FetchToWriter, counting the
+// bytes written to it and their CRC32C across attempts.
+type objectWriter struct {
+	w     io.Writer
+	n     int64
+	crc   uint32
+	err   error        // The first error from w.
+	attrs *ObjectAttrs // The object being written, once known.
+}
+
+func (o *objectWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.n += int64(n)
+	o.crc = crc32.Update(o.crc, crc32cTable, p[:n])
+	if err != nil && o.err == nil {
+		o.err = err
+	}
+	return n, err
+}
+
+// FetchToWriter writes the object in bucket to w, without staging it on
+// disk, and returns the number of bytes written. The bytes are those stored
+// in GCS, so objects with Content-Encoding: gzip are written compressed and
+// Decryptor is not applied, and they are verified against the object's size
+// and CRC32C. Failed reads are retried as for any other download, each try
+// limited by the timeouts of TimeoutGCS, and resume after the bytes already
+// written. Errors that cannot be recovered from without rewinding w, such
+// as w's own errors or content that fails verification, are returned
+// straight away.
+func (gf *Fetcher) FetchToWriter(ctx context.Context, bucket, object string, w io.Writer) (int64, error) {
+	if err := gf.checkOpen(); err != nil {
+		return 0, err
+	}
+	j := job{filename: object, bucket: bucket, object: object}
+	report := &jobReport{job: j, started: time.Now()}
+	gf.live.active.Add(1)
+	defer gf.live.active.Add(-1)
+
+	out := &objectWriter{w: w}
+	for retrynum := 0; retrynum <= gf.Retries; retrynum++ {
+		if err := ctx.Err(); err != nil {
+			if len(report.attempts) == 0 {
+				gf.recordFailure(j, time.Now(), 0, noTimeout, err, report)
+			}
+			break
+		}
+		if n := len(report.attempts); n > 0 && report.attempts[n-1].permanent {
+			break // Retrying cannot help.
+		}
+		if retrynum > 0 && !gf.retryAllowed() {
+			gf.budgetExhausted(j, report)
+			break
+		}
+
+		var backoff time.Duration
+		if retrynum > 0 {
+			gf.metrics().IncRetry()
+			sleepStarted := time.Now()
+			err := sleep(ctx, gf.retryDelay(report, retrynum))
+			backoff = time.Since(sleepStarted)
+			if err != nil {
+				gf.recordFailure(j, time.Now(), backoff, noTimeout, err, report)
+				break
+			}
+		}
+
+		attemptStarted := time.Now()
+		timeout := gf.timeout(object, retrynum)
+		err := gf.writeObjectOnce(ctx, &j, out, timeout)
+		var cerr *checksumError
+		var serr *sizeMismatchError
+		if out.err != nil || errors.As(err, &cerr) || errors.As(err, &serr) || err == errCannotResume {
+			if out.err != nil {
+				err = fmt.Errorf("writing %s: %w", formatGCSName(j.bucket, j.object, j.generation), out.err)
+			}
+			gf.recordFailure(j, attemptStarted, backoff, noTimeout, err, report)
+			break
+		}
+		if err != nil {
+			if !isActionableError(err) {
+				err = fmt.Errorf("fetching %q with timeout %v: %w", formatGCSName(j.bucket, j.object, j.generation), timeout, err)
+			}
+			gf.recordFailure(j, attemptStarted, backoff, timeout, err, report)
+			continue
+		}
+		gf.recordSuccess(j, attemptStarted, backoff, sizeBytes(out.n), "", report)
+		break
+	}
+	report.completed = time.Now()
+	gf.metrics().ObserveFetch(formatGCSName(j.bucket, j.object, j.generation), int64(report.size), time.Since(report.started), report.err)
+	if !report.success {
+		return out.n, report.err
+	}
+	return out.n, nil
+}
+
+// writeObjectOnce makes one attempt at writing the object described by j
+// to out, starting after the bytes already written. The first attempt pins
+// j to the generation it finds, so that later ones read the same content.
+func (gf *Fetcher) writeObjectOnce(ctx context.Context, j *job, out *objectWriter, timeout time.Duration) error {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	timedOut := func(err error) error {
+		if ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return errGCSTimeout
+		}
+		return err
+	}
+
+	opts := gf.readOptions(*j)
+	opts.ReadCompressed = true
+	if out.attrs == nil {
+		attrs, err := gf.GCS.Attrs(ctx, j.bucket, j.object, opts)
+		if err != nil {
+			return timedOut(gf.gcsError(err, *j, "fetching attributes of"))
+		}
+		out.attrs = attrs
+		if j.generation == 0 {
+			j.generation = attrs.Generation
+			opts.Generation = attrs.Generation
+		}
+	}
+
+	var r io.ReadCloser
+	var err error
+	switch {
+	case out.n == out.attrs.Size:
+		r = io.NopCloser(strings.NewReader(""))
+	case out.n > 0:
+		r, err = gf.GCS.NewRangeReader(ctx, j.bucket, j.object, out.n, -1, opts)
+		if err == ErrRangeNotSupported {
+			return errCannotResume
+		}
+	default:
+		r, err = gf.GCS.NewReader(ctx, j.bucket, j.object, opts)
+	}
+	if err != nil {
+		return timedOut(gf.gcsError(err, *j, "creating GCS reader for"))
+	}
+	defer r.Close()
+
+	if _, err := gf.copyObject(out, gf.counted(gf.throttle(ctx, r))); err != nil {
+		if out.err != nil {
+			return out.err
+		}
+		return timedOut(err)
+	}
+	if out.n != out.attrs.Size {
+		return &sizeMismatchError{name: j.object, got: out.n, want: out.attrs.Size}
+	}
+	if out.crc != out.attrs.CRC32C {
+		return &checksumError{
+			name:      j.object,
+			algorithm: "CRC32C",
+			got:       fmt.Sprintf("%08x", out.crc),
+			want:      fmt.Sprintf("%08x", out.attrs.CRC32C),
+		}
+	}
+	return nil
+}
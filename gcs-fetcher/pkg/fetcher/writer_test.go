@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// failingWriter accepts limit bytes, then fails.
+type failingWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+var errWriter = errors.New("writer failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if room := w.limit - w.Len(); len(p) > room {
+		n, _ := w.Buffer.Write(p[:room])
+		return n, errWriter
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestFetchToWriter(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+
+	var buf bytes.Buffer
+	n, err := tc.gf.FetchToWriter(context.Background(), successBucket, sfile1, &buf)
+	if err != nil {
+		t.Fatalf("FetchToWriter() = %v", err)
+	}
+	if n != int64(len(sfile1Contents)) || !bytes.Equal(buf.Bytes(), sfile1Contents) {
+		t.Errorf("FetchToWriter() wrote %d bytes %q, want %q", n, buf.Bytes(), sfile1Contents)
+	}
+	if got := extractedPaths(t, tc); len(got) != 0 {
+		t.Errorf("FetchToWriter() wrote %v to disk, want nothing", got)
+	}
+}
+
+func TestFetchToWriterResumesAfterReadError(t *testing.T) {
+	tc, teardown := buildManifestTestContext(t)
+	defer teardown()
+	content := []byte(strings.Repeat("resumable content ", 100))
+	tc.gcs.objects[formatGCSName(successBucket, "interrupted", generation)] = fakeGCSResponse{content: content, failAfter: 500}
+
+	var buf bytes.Buffer
+	n, err := tc.gf.FetchToWriter(context.Background(), successBucket, "interrupted", &buf)
+	if err != nil {
+		t.Fatalf("FetchToWriter() = %v", err)
+	}
+	if n != int64(len(content)) || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("FetchToWriter() wrote %d bytes, want the %d bytes of the object", n, len(content))
+	}
+	if want := []int64{500}; !reflect.DeepEqual(tc.gcs.offsets, want) {
+		t.Errorf("range read offsets = %v, want %v", tc.gcs.offsets, want)
+	}
+}
+
+func TestFetchToWriterErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response fakeGCSResponse
+		writer   func() *failingWriter
+		wantErr  error  // Matched with errors.Is, if set.
+		wantMsg  string // Contained in the error, if set.
+	}{
+		{
+			name:     "writer error",
+			response: fakeGCSResponse{content: []byte("some content")},
+			writer:   func() *failingWriter { return &failingWriter{limit: 4} },
+			wantErr:  errWriter,
+		},
+		{
+			name:     "read error without ranges",
+			response: fakeGCSResponse{content: []byte("some content"), failAfter: 4, noRanges: true},
+			wantErr:  errCannotResume,
+		},
+		{
+			name:     "checksum mismatch",
+			response: fakeGCSResponse{content: []byte("some content"), crc32c: new(uint32)},
+			wantMsg:  "CRC32C mismatch",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tc, teardown := buildManifestTestContext(t)
+			defer teardown()
+			tc.gcs.objects[formatGCSName(successBucket, "object", generation)] = test.response
+			w := &failingWriter{limit: 1 << 20}
+			if test.writer != nil {
+				w = test.writer()
+			}
+
+			_, err := tc.gf.FetchToWriter(context.Background(), successBucket, "object", w)
+			if err == nil {
+				t.Fatalf("FetchToWriter() = nil, want error")
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("FetchToWriter() = %v, want %v", err, test.wantErr)
+			}
+			if test.wantMsg != "" && !strings.Contains(err.Error(), test.wantMsg) {
+				t.Errorf("FetchToWriter() = %v, want error containing %q", err, test.wantMsg)
+			}
+			// None of these can be retried without rewinding the writer.
+			if got := tc.gcs.reads[formatGCSName(successBucket, "object", generation)]; got != 1 {
+				t.Errorf("object read %d times, want once", got)
+			}
+		})
+	}
+}
@@ -129,6 +129,7 @@ func (u *Uploader) Do(ctx context.Context, path string, info os.FileInfo) error
 		SourceURL: fmt.Sprintf("gs://%s/%s", u.bucket, digest),
 		Sha1Sum:   digest,
 		FileMode:  info.Mode(),
+		Size:      cw.b,
 	})
 
 	if err := wc.Close(); isAlreadyExists(err) {